@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"time"
 
@@ -31,6 +32,7 @@ const (
 	CMD_PING         = 'P'
 	CMD_VERSION      = 'V'
 	CMD_SET_DATA_DIR = 'S'
+	CMD_WAIT_STATUS  = 'H' // Firmware 3.6
 )
 
 // Response bytes
@@ -261,24 +263,42 @@ func (ap *ArduinoPort) SendCommand(cmd byte) error {
 	return nil
 }
 
-// WaitForInput waits for specific status value (handshaking)
-func (ap *ArduinoPort) WaitForInput(expected byte, timeout time.Duration) error {
-	deadline := time.Now().Add(timeout)
+// WaitStatus has the Arduino poll the status register until
+// (status & mask) == value or the timeout expires, and returns the last
+// status read. Needs firmware 3.6.
+func (ap *ArduinoPort) WaitStatus(mask, value byte, timeout time.Duration) (byte, error) {
+	us := uint32(timeout / time.Microsecond)
+	_, err := ap.port.Write([]byte{CMD_WAIT_STATUS, mask, value, byte(us >> 24), byte(us >> 16), byte(us >> 8), byte(us)})
+	if err != nil {
+		return 0, err
+	}
 
-	for time.Now().Before(deadline) {
-		status, err := ap.InByte(1)
-		if err != nil {
-			return err
-		}
+	// The response arrives when the wait ends
+	response := make([]byte, 2)
+	if _, err := io.ReadFull(ap.port, response); err != nil {
+		return 0, err
+	}
 
-		if (status & 0xF8) == expected {
-			return nil
-		}
+	if response[0] != RESP_VALUE {
+		return 0, fmt.Errorf("invalid response")
+	}
+
+	return response[1], nil
+}
+
+// WaitForInput waits for specific status value (handshaking). The
+// Arduino polls, so this takes one USB round trip.
+func (ap *ArduinoPort) WaitForInput(expected byte, timeout time.Duration) error {
+	status, err := ap.WaitStatus(0xF8, expected, timeout)
+	if err != nil {
+		return err
+	}
 
-		time.Sleep(10 * time.Millisecond)
+	if (status & 0xF8) != expected {
+		return fmt.Errorf("timeout waiting for input")
 	}
 
-	return fmt.Errorf("timeout waiting for input")
+	return nil
 }
 
 // Initialize performs PMP300 initialization sequence
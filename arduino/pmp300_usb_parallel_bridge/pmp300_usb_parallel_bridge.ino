@@ -7,6 +7,54 @@
  * Hardware: Arduino Uno (or Mega 2560)
  * Interface: USB Serial at 115200 baud
  *
+ * The bridge starts in the unframed 2.x protocol. Hosts that see firmware
+ * 3.x may switch to framed mode ('F' 0x01), where every command and response
+ * carries a length, a sequence number and a CRC-16:
+ *
+ *   0xA5 <len_hi> <len_lo> <seq> <payload...> <crc_hi> <crc_lo>
+ *
+ * The payload is an unframed command or its response. The response echoes
+ * the command's sequence number. The CRC is CRC-16/CCITT-FALSE (poly 0x1021,
+ * init 0xFFFF) over length, sequence and payload. Frames that fail the CRC,
+ * are malformed or skip a sequence number are answered with an error frame
+ * and not executed. After an error frame every further frame is dropped
+ * (ERR_DROPPED) until the host resynchronizes with 'F' 0x01, so pipelined
+ * commands never run out of order.
+ *
+ * Firmware 3.1 adds whole-block commands ('B' read, 'b' write) that run the
+ * complete PMP300 block sequence - intro, 0xA0/0xAB, address and status
+ * handshakes, outro - on the Arduino and stream the 32KB with one response.
+ *
+ * Firmware 3.2 adds CMD_ABORT (0x18), which cuts a running 'n' or 'B'
+ * stream or an 'M' delay short. It is a single byte outside any frame; when
+ * nothing is running it is ignored.
+ *
+ * Firmware 3.3 adds a capability query ('Q') that reports the supported
+ * commands as a feature bitmap, the largest nibble block read and the size
+ * of the serial receive buffer, so hosts no longer infer them from the
+ * version.
+ *
+ * Firmware 3.4 adds a baud rate switch ('U'). The bridge always starts at
+ * 115200; the host may move it to 250000, 500000, 1000000 or 2000000 and
+ * confirms the new rate with a ping, without which the bridge falls back.
+ *
+ * Firmware 3.5 adds a checked nibble read ('N'). Every nibble is sampled
+ * twice and each 512 bytes are followed by their CRC-16, so the host can
+ * tell corrupted spans of a read apart and re-read only those; a skip count
+ * clocks the bytes before them out of the PMP300 without sending them.
+ *
+ * Firmware 3.6 adds a status wait ('H') that polls the status register on
+ * the Arduino until it matches a mask and value or a timeout in
+ * microseconds expires, so a handshake wait is one round trip instead of
+ * one per poll.
+ *
+ * Firmware 3.7 implements the microsecond delay ('D') and data direction
+ * ('S') commands that the protocol always documented.
+ *
+ * Firmware 3.8 paces block writes ('b'): the bridge asks for every chunk
+ * with RESP_READY once the PMP300 acknowledged the one before, so a chunk
+ * never piles up in the 64-byte receive buffer during a handshake.
+ *
  * License: MIT
  */
 
@@ -58,7 +106,8 @@
 // PROTOCOL CONSTANTS
 // ============================================================================
 
-#define SERIAL_BAUD_RATE 115200
+#define SERIAL_BAUD_RATE 115200  // Rate after reset, see CMD_SET_BAUD
+#define BAUD_CONFIRM_MS  1000    // Wait for the confirmation ping
 
 // Commands (Host -> Arduino)
 #define CMD_PING             'P'  // Connection test
@@ -67,9 +116,19 @@
 #define CMD_WRITE_CTRL       'C'  // Write to control register
 #define CMD_READ_STATUS      'R'  // Read status register
 #define CMD_DELAY_MS         'M'  // Delay milliseconds
+#define CMD_DELAY_US         'D'  // Delay microseconds
+#define CMD_SET_DATA_DIR     'S'  // Set data pin direction ('I' or 'O')
 #define CMD_COMMANDOUT       'c'  // COMMANDOUT(data, ctrl1, ctrl2) - optimized
 #define CMD_READ_NIBBLE_BLK  'n'  // Read bytes using nibble protocol
 #define CMD_WRITE_PMP_CHUNK  'w'  // Write 528 bytes with PMP300 control toggling
+#define CMD_FRAMING          'F'  // Select framing mode
+#define CMD_READ_BLOCK       'B'  // Read a 32KB block
+#define CMD_WRITE_BLOCK      'b'  // Write a 32KB block as 64 checked chunks
+#define CMD_ABORT            0x18 // Stop a running stream or delay (ASCII CAN)
+#define CMD_CAPABILITIES     'Q'  // Query features and limits
+#define CMD_SET_BAUD         'U'  // Switch the serial baud rate
+#define CMD_READ_NIBBLE_CHK  'N'  // Checked nibble read with skip
+#define CMD_WAIT_STATUS      'H'  // Poll the status register until it matches
 
 // Responses (Arduino -> Host)
 #define RESP_OK      'K'
@@ -77,15 +136,75 @@
 #define RESP_ERROR   'E'
 #define RESP_PONG    'P'
 #define RESP_VERSION 'I'
+#define RESP_CAPABILITIES 'Q'
+#define RESP_READY   0x11  // 'b': send the next chunk (ASCII DC1)
 
 // Error codes
 #define ERR_UNKNOWN_CMD   0x01
 #define ERR_TIMEOUT       0x02
+#define ERR_CRC           0x03  // Frame or block chunk failed CRC
+#define ERR_FRAME         0x04  // Bad frame length or parameters, command not executed
+#define ERR_DROPPED       0x05  // Frame dropped after an earlier error, command not executed
+#define ERR_NAK           0x06  // PMP300 rejected a handshake
+#define ERR_ACK_TIMEOUT   0x07  // PMP300 did not acknowledge
+#define ERR_BAUD          0x08  // Unsupported baud rate
+#define ERR_PARAM         0x09  // Invalid parameter value
+
+// Data directions of CMD_SET_DATA_DIR
+#define DIR_INPUT         'I'
+#define DIR_OUTPUT        'O'
+
+// Framing
+#define FRAMING_RAW       0x00
+#define FRAMING_CRC16     0x01
+#define FRAME_SYNC        0xA5
+#define FRAME_MAX_PAYLOAD 529   // 'w' + 528 bytes
+
+// Capability feature bits
+#define CAP_COMMANDOUT    0x0001  // 'c'
+#define CAP_NIBBLE_BLOCK  0x0002  // 'n'
+#define CAP_PMP_CHUNK     0x0004  // 'w'
+#define CAP_FRAMING       0x0008  // 'F'
+#define CAP_BLOCK         0x0010  // 'B' and 'b'
+#define CAP_ABORT         0x0020  // CMD_ABORT
+#define CAP_BAUD          0x0040  // 'U'
+#define CAP_NIBBLE_CHECK  0x0080  // 'N'
+#define CAP_WAIT_STATUS   0x0100  // 'H'
+#define CAP_DELAY_US      0x0200  // 'D'
+#define CAP_DATA_DIR      0x0400  // 'S'
+#define CAP_BLOCK_READY   0x0800  // 'b' asks for each chunk with RESP_READY
+#define CAP_FEATURES      (CAP_COMMANDOUT | CAP_NIBBLE_BLOCK | CAP_PMP_CHUNK | \
+                           CAP_FRAMING | CAP_BLOCK | CAP_ABORT | CAP_BAUD | \
+                           CAP_NIBBLE_CHECK | CAP_WAIT_STATUS | CAP_DELAY_US | \
+                           CAP_DATA_DIR | CAP_BLOCK_READY)
+#define MAX_NIBBLE_BLOCK  0xFFFE  // 0xFFFF does not fit a response frame
+#define NIBBLE_CHECK_SPAN 512     // Bytes covered by each 'N' check value
+
+#ifndef SERIAL_RX_BUFFER_SIZE
+  #define SERIAL_RX_BUFFER_SIZE 64
+#endif
+
+// PMP300 block protocol
+#define PMP_CMD_SELECT    0xA8
+#define PMP_CMD_READ      0xA0
+#define PMP_CMD_WRITE     0xAB
+#define BLOCK_SIZE        32768
+#define CHUNK_SIZE        528   // 512 data + 16 end block
+#define BLOCK_CHUNKS      64
+#define ACK_TIMEOUT_MS    1000
+
+// Handshake status as a PC parallel port sees it (Busy inverted)
+#define STATUS_MASK       0xF8
+#define STATUS_ACK_A      0x68
+#define STATUS_ACK_B      0xC8
+#define STATUS_NAK        0x28
+
+const uint8_t introKey[4] = {0xAD, 0x55, 0xAE, 0xAA};
 
 // Firmware version
-#define FW_VERSION_MAJOR  2
-#define FW_VERSION_MINOR  0
-#define FW_VERSION_PATCH  1
+#define FW_VERSION_MAJOR  3
+#define FW_VERSION_MINOR  8
+#define FW_VERSION_PATCH  0
 
 // ============================================================================
 // PIN ARRAYS
@@ -102,6 +221,24 @@ const uint8_t dataPins[8] = {
 
 bool dataIsOutput = true;
 
+// Framed mode
+bool framed = false;           // Framing negotiated by the host
+bool inFrame = false;          // Running a framed command
+bool respStarted = false;      // Response frame header sent
+uint8_t respSeq = 0;           // Sequence number of the response frame
+uint16_t respLen = 0;          // Response length, unless it is an error
+bool rejecting = false;        // Dropping frames after an error frame
+bool seqKnown = false;         // expectedSeq is valid
+uint8_t expectedSeq = 0;       // Sequence number of the next frame to run
+uint8_t frameBuf[FRAME_MAX_PAYLOAD];
+uint16_t frameLen = 0;
+uint16_t framePos = 0;
+uint16_t txCrc = 0;
+
+// Baud rate switch
+uint32_t baudRate = SERIAL_BAUD_RATE;
+uint32_t pendingBaud = 0;      // Switch once the response is sent
+
 // ============================================================================
 // SETUP
 // ============================================================================
@@ -145,20 +282,37 @@ void setup() {
 
 void loop() {
   if (Serial.available()) {
-    uint8_t cmd = Serial.read();
-
-    switch(cmd) {
-      case CMD_PING:           handlePing(); break;
-      case CMD_VERSION:        handleVersion(); break;
-      case CMD_WRITE_DATA:     handleWriteData(); break;
-      case CMD_WRITE_CTRL:     handleWriteControl(); break;
-      case CMD_READ_STATUS:    handleReadStatus(); break;
-      case CMD_DELAY_MS:       handleDelayMs(); break;
-      case CMD_COMMANDOUT:     handleCommandOut(); break;
-      case CMD_READ_NIBBLE_BLK: handleReadNibbleBlock(); break;
-      case CMD_WRITE_PMP_CHUNK: handleWritePMPChunk(); break;
-      default:                 sendError(ERR_UNKNOWN_CMD); break;
+    if (framed) {
+      handleFrame();
+    } else {
+      dispatch(Serial.read());
     }
+    if (pendingBaud) switchBaud();
+  }
+}
+
+void dispatch(uint8_t cmd) {
+  switch(cmd) {
+    case CMD_PING:           handlePing(); break;
+    case CMD_VERSION:        handleVersion(); break;
+    case CMD_WRITE_DATA:     handleWriteData(); break;
+    case CMD_WRITE_CTRL:     handleWriteControl(); break;
+    case CMD_READ_STATUS:    handleReadStatus(); break;
+    case CMD_WAIT_STATUS:    handleWaitStatus(); break;
+    case CMD_DELAY_MS:       handleDelayMs(); break;
+    case CMD_DELAY_US:       handleDelayUs(); break;
+    case CMD_SET_DATA_DIR:   handleSetDataDir(); break;
+    case CMD_COMMANDOUT:     handleCommandOut(); break;
+    case CMD_READ_NIBBLE_BLK: handleReadNibbleBlock(); break;
+    case CMD_READ_NIBBLE_CHK: handleReadNibbleChecked(); break;
+    case CMD_WRITE_PMP_CHUNK: handleWritePMPChunk(); break;
+    case CMD_FRAMING:        handleFraming(); break;
+    case CMD_READ_BLOCK:     handleReadBlock(); break;
+    case CMD_WRITE_BLOCK:    handleWriteBlock(); break;
+    case CMD_CAPABILITIES:   handleCapabilities(); break;
+    case CMD_SET_BAUD:       handleSetBaud(); break;
+    case CMD_ABORT:          break;  // Nothing running, no response
+    default:                 sendError(ERR_UNKNOWN_CMD); break;
   }
 }
 
@@ -167,14 +321,63 @@ void loop() {
 // ============================================================================
 
 void handlePing() {
-  Serial.write(RESP_PONG);
+  sendByte(RESP_PONG);
 }
 
 void handleVersion() {
-  Serial.write(RESP_VERSION);
-  Serial.write(FW_VERSION_MAJOR);
-  Serial.write(FW_VERSION_MINOR);
-  Serial.write(FW_VERSION_PATCH);
+  sendByte(RESP_VERSION);
+  sendByte(FW_VERSION_MAJOR);
+  sendByte(FW_VERSION_MINOR);
+  sendByte(FW_VERSION_PATCH);
+}
+
+// Report supported commands and limits, all values high byte first
+// Protocol: 'Q' -> 'Q' <features> <max_nibble> <rx_buffer>
+void handleCapabilities() {
+  sendByte(RESP_CAPABILITIES);
+  sendByte(CAP_FEATURES >> 8);
+  sendByte(CAP_FEATURES & 0xFF);
+  sendByte(MAX_NIBBLE_BLOCK >> 8);
+  sendByte(MAX_NIBBLE_BLOCK & 0xFF);
+  sendByte(SERIAL_RX_BUFFER_SIZE >> 8);
+  sendByte(SERIAL_RX_BUFFER_SIZE & 0xFF);
+}
+
+// Switch the baud rate, the response is sent at the old rate
+// Protocol: 'U' <baud_3> <baud_2> <baud_1> <baud_0> -> 'K'
+void handleSetBaud() {
+  uint32_t rate = 0;
+  for (uint8_t i = 0; i < 4; i++) rate = (rate << 8) | waitForByte();
+  switch (rate) {
+    case 115200: case 250000: case 500000: case 1000000: case 2000000:
+      break;
+    default:
+      sendError(ERR_BAUD);
+      return;
+  }
+  sendByte(RESP_OK);
+  pendingBaud = rate;
+}
+
+// Change the rate and wait for the host's unframed ping at it. Without the
+// ping within BAUD_CONFIRM_MS the old rate is restored.
+void switchBaud() {
+  uint32_t rate = pendingBaud;
+  pendingBaud = 0;
+  Serial.flush();  // The 'K' goes out at the old rate
+  Serial.end();
+  Serial.begin(rate);
+
+  unsigned long start = millis();
+  while (millis() - start < BAUD_CONFIRM_MS) {
+    if (Serial.available() && Serial.read() == CMD_PING) {
+      Serial.write(RESP_PONG);
+      baudRate = rate;
+      return;
+    }
+  }
+  Serial.end();
+  Serial.begin(baudRate);
 }
 
 // Write byte to data register
@@ -183,7 +386,7 @@ void handleWriteData() {
   uint8_t value = waitForByte();
   if (!dataIsOutput) setDataOutput();
   writeDataByte(value);
-  Serial.write(RESP_OK);
+  sendByte(RESP_OK);
 }
 
 // Write byte to control register
@@ -191,22 +394,71 @@ void handleWriteData() {
 void handleWriteControl() {
   uint8_t value = waitForByte();
   writeControl(value);
-  Serial.write(RESP_OK);
+  sendByte(RESP_OK);
 }
 
 // Read status register
 // Protocol: 'R' -> 'V' <byte>
 void handleReadStatus() {
-  Serial.write(RESP_VALUE);
-  Serial.write(readStatusByte());
+  sendByte(RESP_VALUE);
+  sendByte(readStatusByte());
 }
 
-// Delay milliseconds
+// Poll the status register until (status & mask) == value, the timeout in
+// microseconds expires or CMD_ABORT arrives. The final status is returned
+// either way; the host compares it.
+// Protocol: 'H' <mask> <value> <timeout, 4 bytes> -> 'V' <byte>
+void handleWaitStatus() {
+  uint8_t mask = waitForByte();
+  uint8_t value = waitForByte();
+  uint32_t timeout = 0;
+  for (uint8_t i = 0; i < 4; i++) {
+    timeout = (timeout << 8) | waitForByte();
+  }
+
+  unsigned long start = micros();
+  uint8_t status = readStatusByte();
+  while ((status & mask) != value && micros() - start < timeout && !abortRequested()) {
+    status = readStatusByte();
+  }
+  sendByte(RESP_VALUE);
+  sendByte(status);
+}
+
+// Delay milliseconds, ending early on CMD_ABORT
 // Protocol: 'M' <high> <low> -> 'K'
 void handleDelayMs() {
   uint16_t ms = (waitForByte() << 8) | waitForByte();
-  delay(ms);
-  Serial.write(RESP_OK);
+  for (uint16_t i = 0; i < ms && !abortRequested(); i++) {
+    delay(1);
+  }
+  sendByte(RESP_OK);
+}
+
+// Delay microseconds. delayMicroseconds() is only accurate up to 16383, so
+// longer delays run in 1ms steps.
+// Protocol: 'D' <high> <low> -> 'K'
+void handleDelayUs() {
+  uint16_t us = (waitForByte() << 8) | waitForByte();
+  while (us > 1000) {
+    delayMicroseconds(1000);
+    us -= 1000;
+  }
+  delayMicroseconds(us);
+  sendByte(RESP_OK);
+}
+
+// Set the data pins to inputs, to let the PMP300 drive them, or back to
+// outputs. Commands that write data switch to outputs on their own.
+// Protocol: 'S' <'I' or 'O'> -> 'K', or 'E' ERR_PARAM
+void handleSetDataDir() {
+  uint8_t dir = waitForByte();
+  switch (dir) {
+    case DIR_INPUT:  setDataInput(); break;
+    case DIR_OUTPUT: setDataOutput(); break;
+    default:         sendError(ERR_PARAM); return;
+  }
+  sendByte(RESP_OK);
 }
 
 // Optimized COMMANDOUT - executes data, ctrl1, ctrl2 in one call
@@ -223,19 +475,58 @@ void handleCommandOut() {
   writeControl(ctrl1);
   writeControl(ctrl2);
 
-  Serial.write(RESP_OK);
+  sendByte(RESP_OK);
 }
 
-// Read multiple bytes using PMP300 nibble protocol
+// Read multiple bytes using PMP300 nibble protocol. CMD_ABORT stops the
+// stream; the host discards the partial response.
 // Protocol: 'n' <count_high> <count_low> -> 'K' <data...>
 void handleReadNibbleBlock() {
   uint16_t count = (waitForByte() << 8) | waitForByte();
 
   writeControl(0x04);  // Initial state
-  Serial.write(RESP_OK);
+  sendByte(RESP_OK);
+
+  for (uint16_t i = 0; i < count; i++) {
+    if (abortRequested()) return;
+    sendByte(readNibbleByte());
+  }
+}
+
+// Read bytes using the nibble protocol with integrity checks. skip bytes
+// are clocked out of the PMP300 and dropped. Every NIBBLE_CHECK_SPAN bytes
+// sent, and the last partial span, are followed by their CRC-16, inverted
+// if two samples of a nibble in the span differed. CMD_ABORT stops the
+// stream; the host discards the partial response.
+// Protocol: 'N' <skip_high> <skip_low> <count_high> <count_low>
+//           -> 'K' <span data> <crc_high> <crc_low> ...
+void handleReadNibbleChecked() {
+  uint16_t skip = (waitForByte() << 8) | waitForByte();
+  uint16_t count = (waitForByte() << 8) | waitForByte();
+
+  writeControl(0x04);  // Initial state
+  sendByte(RESP_OK);
+
+  bool glitch = false;
+  for (uint16_t i = 0; i < skip; i++) {
+    if (abortRequested()) return;
+    readNibbleByteChecked(&glitch);
+  }
 
+  uint16_t crc = 0xFFFF;
+  glitch = false;
   for (uint16_t i = 0; i < count; i++) {
-    Serial.write(readNibbleByte());
+    if (abortRequested()) return;
+    uint8_t value = readNibbleByteChecked(&glitch);
+    sendByte(value);
+    crc = crc16Update(crc, value);
+    if ((i + 1) % NIBBLE_CHECK_SPAN == 0 || i + 1 == count) {
+      if (glitch) crc ^= 0xFFFF;
+      sendByte(crc >> 8);
+      sendByte(crc & 0xFF);
+      crc = 0xFFFF;
+      glitch = false;
+    }
   }
 }
 
@@ -258,7 +549,269 @@ void handleWritePMPChunk() {
     }
   }
 
-  Serial.write(RESP_OK);
+  sendByte(RESP_OK);
+}
+
+// Select framing mode, the response is sent in the old mode
+// Protocol: 'F' <mode> -> 'K'
+void handleFraming() {
+  uint8_t mode = waitForByte();
+  if (mode > FRAMING_CRC16) {
+    sendError(ERR_FRAME);
+    return;
+  }
+  sendByte(RESP_OK);
+  framed = (mode == FRAMING_CRC16);
+  rejecting = false;
+  seqKnown = false;
+}
+
+// Read a 32KB block, running intro, 0xA0 and the address handshakes
+// Protocol: 'B' <addr_high> <addr_mid> <addr_low> -> 'K' <32768 bytes>
+//           or 'E' <code> if the PMP300 did not accept the address
+// CMD_ABORT stops the stream and deselects the PMP300.
+void handleReadBlock() {
+  uint32_t addr = readAddress();
+
+  uint8_t err = blockIntro(PMP_CMD_READ, addr);
+  if (err) {
+    pmpOutro();
+    sendError(err);
+    return;
+  }
+
+  writeControl(0x04);
+  sendByte(RESP_OK);
+  for (uint16_t i = 0; i < BLOCK_SIZE; i++) {
+    if (abortRequested()) break;
+    sendByte(readNibbleByte());
+  }
+  pmpOutro();
+}
+
+// Write a 32KB block, running intro, 0xAB and all handshakes. Each chunk
+// is asked for with RESP_READY, sent outside any frame, once the one before
+// was acknowledged, so no chunk arrives while the bridge waits for a
+// handshake. Every chunk is followed by its CRC-16. The last byte of a
+// chunk is held back until the CRC checks, so the PMP300 never completes a
+// corrupted chunk. A failure is answered instead of the next RESP_READY and
+// the host sends nothing more.
+// Protocol: 'b' <addr_high> <addr_mid> <addr_low>
+//           64 x (-> RESP_READY, <528 bytes> <crc_high> <crc_low>)
+//           -> 'K' or 'E' <code>
+void handleWriteBlock() {
+  uint32_t addr = readAddress();
+
+  uint8_t err = blockIntro(PMP_CMD_WRITE, addr);
+  if (!dataIsOutput) setDataOutput();
+
+  for (uint8_t chunk = 0; chunk < BLOCK_CHUNKS && !err; chunk++) {
+    Serial.write(RESP_READY);
+
+    uint16_t crc = 0xFFFF;
+    uint8_t held = 0, crcHigh = 0, value = 0;
+    for (uint16_t i = 0; i < CHUNK_SIZE + 2; i++) {
+      if (!readFrameByte(&value)) {
+        err = ERR_TIMEOUT;
+        break;
+      }
+      if (i < CHUNK_SIZE) {
+        crc = crc16Update(crc, value);
+        // Byte i-1 goes out once byte i arrived; the last waits for the CRC
+        if (i > 0) writeChunkByte(held, i - 1);
+        held = value;
+      } else if (i == CHUNK_SIZE) {
+        crcHigh = value;
+      }
+    }
+    if (err) break;
+
+    if ((((uint16_t)crcHigh << 8) | value) != crc) {
+      err = ERR_CRC;
+      break;
+    }
+    writeChunkByte(held, CHUNK_SIZE - 1);
+    err = waitAck(3 + chunk);
+  }
+
+  pmpOutro();
+  if (err) {
+    sendError(err);
+    return;
+  }
+  sendByte(RESP_OK);
+}
+
+// ============================================================================
+// FRAMED MODE
+// ============================================================================
+
+// Receive one frame, check it and run its command
+void handleFrame() {
+  if (Serial.read() != FRAME_SYNC) return;  // Hunt for sync, dropping stray bytes
+
+  uint8_t header[3];
+  for (uint8_t i = 0; i < 3; i++) {
+    if (!readFrameByte(&header[i])) {
+      rejectFrame(expectedSeq, ERR_TIMEOUT);
+      return;
+    }
+  }
+  uint16_t len = (header[0] << 8) | header[1];
+  uint8_t seq = header[2];
+  if (len == 0 || len > FRAME_MAX_PAYLOAD) {
+    rejectFrame(seq, ERR_FRAME);
+    return;
+  }
+
+  uint16_t crc = 0xFFFF;
+  for (uint8_t i = 0; i < 3; i++) crc = crc16Update(crc, header[i]);
+  for (uint16_t i = 0; i < len; i++) {
+    if (!readFrameByte(&frameBuf[i])) {
+      rejectFrame(seq, ERR_TIMEOUT);
+      return;
+    }
+    crc = crc16Update(crc, frameBuf[i]);
+  }
+  uint8_t crcHigh, crcLow;
+  if (!readFrameByte(&crcHigh) || !readFrameByte(&crcLow)) {
+    rejectFrame(seq, ERR_TIMEOUT);
+    return;
+  }
+  if ((((uint16_t)crcHigh << 8) | crcLow) != crc) {
+    rejectFrame(seq, ERR_CRC);
+    return;
+  }
+
+  // Only a FRAMING command gets through after an error or a lost frame
+  uint8_t cmd = frameBuf[0];
+  if (cmd != CMD_FRAMING && (rejecting || (seqKnown && seq != expectedSeq))) {
+    rejectFrame(seq, ERR_DROPPED);
+    return;
+  }
+
+  int16_t params = paramCount(cmd);
+  if (params < 0) {
+    rejectFrame(seq, ERR_UNKNOWN_CMD);
+    return;
+  }
+  if (len != 1 + params || (cmd == CMD_FRAMING && frameBuf[1] > FRAMING_CRC16)) {
+    rejectFrame(seq, ERR_FRAME);
+    return;
+  }
+  uint16_t length = responseLength(cmd);
+  if (length == 0) {
+    rejectFrame(seq, ERR_FRAME);
+    return;
+  }
+
+  // Parameters come from frameBuf, the response is streamed in a frame
+  frameLen = len;
+  framePos = 1;
+  openResponse(seq, length);
+  dispatch(cmd);
+  endFrame();
+
+  expectedSeq = seq + 1;
+  seqKnown = true;
+}
+
+// Number of parameter bytes of a command, -1 if unknown
+int16_t paramCount(uint8_t cmd) {
+  switch(cmd) {
+    case CMD_PING:            return 0;
+    case CMD_VERSION:         return 0;
+    case CMD_WRITE_DATA:      return 1;
+    case CMD_WRITE_CTRL:      return 1;
+    case CMD_READ_STATUS:     return 0;
+    case CMD_DELAY_MS:        return 2;
+    case CMD_DELAY_US:        return 2;
+    case CMD_SET_DATA_DIR:    return 1;
+    case CMD_COMMANDOUT:      return 3;
+    case CMD_READ_NIBBLE_BLK: return 2;
+    case CMD_WRITE_PMP_CHUNK: return 528;
+    case CMD_FRAMING:         return 1;
+    case CMD_READ_BLOCK:      return 3;
+    case CMD_WRITE_BLOCK:     return 3;  // The chunk stream follows the frame
+    case CMD_CAPABILITIES:    return 0;
+    case CMD_SET_BAUD:        return 4;
+    case CMD_READ_NIBBLE_CHK: return 4;
+    case CMD_WAIT_STATUS:     return 6;
+    default:                  return -1;
+  }
+}
+
+// Response length of the command in frameBuf, 0 if it does not fit a frame.
+// Error responses are always 2 bytes.
+uint16_t responseLength(uint8_t cmd) {
+  switch(cmd) {
+    case CMD_VERSION:     return 4;
+    case CMD_READ_STATUS: return 2;
+    case CMD_WAIT_STATUS: return 2;
+    case CMD_CAPABILITIES: return 7;
+    case CMD_READ_BLOCK:  return 1 + BLOCK_SIZE;
+    case CMD_READ_NIBBLE_BLK: {
+      uint16_t count = (frameBuf[1] << 8) | frameBuf[2];
+      return count == 0xFFFF ? 0 : 1 + count;
+    }
+    case CMD_READ_NIBBLE_CHK: {
+      uint16_t count = (frameBuf[3] << 8) | frameBuf[4];
+      uint32_t len = 1 + (uint32_t)count + 2 * (((uint32_t)count + NIBBLE_CHECK_SPAN - 1) / NIBBLE_CHECK_SPAN);
+      return len > 0xFFFE ? 0 : len;
+    }
+    default:              return 1;
+  }
+}
+
+// Prepare the response frame. Its header goes out with the first response
+// byte, when it is known whether the command failed.
+void openResponse(uint8_t seq, uint16_t len) {
+  inFrame = true;
+  respStarted = false;
+  respSeq = seq;
+  respLen = len;
+}
+
+void beginFrame() {
+  respStarted = true;
+  Serial.write(FRAME_SYNC);
+  txCrc = 0xFFFF;
+  sendByte(respLen >> 8);
+  sendByte(respLen & 0xFF);
+  sendByte(respSeq);
+}
+
+void endFrame() {
+  inFrame = false;
+  if (!respStarted) return;
+  Serial.write(txCrc >> 8);
+  Serial.write(txCrc & 0xFF);
+}
+
+// Answer a frame with an error and drop frames until resynchronized
+void rejectFrame(uint8_t seq, uint8_t code) {
+  openResponse(seq, 2);
+  sendError(code);
+  endFrame();
+}
+
+// Read a frame or block stream byte with the same timeout as waitForByte
+bool readFrameByte(uint8_t *value) {
+  unsigned long start = millis();
+  while (!Serial.available()) {
+    if (millis() - start > 1000) return false;
+  }
+  *value = Serial.read();
+  return true;
+}
+
+// CRC-16/CCITT-FALSE
+uint16_t crc16Update(uint16_t crc, uint8_t value) {
+  crc ^= (uint16_t)value << 8;
+  for (uint8_t i = 0; i < 8; i++) {
+    crc = (crc & 0x8000) ? (crc << 1) ^ 0x1021 : crc << 1;
+  }
+  return crc;
 }
 
 // ============================================================================
@@ -315,12 +868,107 @@ uint8_t readNibbleByte() {
   status = readStatusByte();
   result |= (status & 0xF0);  // No XOR 0x80
 
-  // Reverse bits
-  result = (result & 0xF0) >> 4 | (result & 0x0F) << 4;
-  result = (result & 0xCC) >> 2 | (result & 0x33) << 2;
-  result = (result & 0xAA) >> 1 | (result & 0x55) << 1;
+  return reverseBits(result);
+}
+
+// readNibbleByte sampling every nibble twice. *glitch is set if the samples
+// differ, which means the status lines were not settled.
+uint8_t readNibbleByteChecked(bool *glitch) {
+  uint8_t result, status;
+
+  writeControl(0x00);
+  delayMicroseconds(2);
+  status = readStatusByte() & 0xF0;
+  if ((readStatusByte() & 0xF0) != status) *glitch = true;
+  result = status >> 4;
+
+  writeControl(0x04);
+  delayMicroseconds(2);
+  status = readStatusByte() & 0xF0;
+  if ((readStatusByte() & 0xF0) != status) *glitch = true;
+  result |= status;
+
+  return reverseBits(result);
+}
+
+// Reverse the bit order of a byte
+inline uint8_t reverseBits(uint8_t value) {
+  value = (value & 0xF0) >> 4 | (value & 0x0F) << 4;
+  value = (value & 0xCC) >> 2 | (value & 0x33) << 2;
+  value = (value & 0xAA) >> 1 | (value & 0x55) << 1;
+  return value;
+}
+
+// PC parallel port view of the status register (Busy inverted)
+inline uint8_t readHandshake() {
+  return (readStatusByte() ^ 0x80) & STATUS_MASK;
+}
+
+// COMMANDOUT: data, then two control values
+void commandOut(uint8_t data, uint8_t ctrl1, uint8_t ctrl2) {
+  if (!dataIsOutput) setDataOutput();
+  writeDataByte(data);
+  writeControl(ctrl1);
+  writeControl(ctrl2);
+}
+
+// Wait for the n-th handshake of a PMP300 command, 0 or an error code
+uint8_t waitAck(uint8_t n) {
+  uint8_t expected = (n & 1) ? STATUS_ACK_B : STATUS_ACK_A;
+  unsigned long start = millis();
+  while (millis() - start <= ACK_TIMEOUT_MS) {
+    uint8_t status = readHandshake();
+    if (status == expected) return 0;
+    if (status == STATUS_NAK) return ERR_NAK;
+  }
+  return ERR_ACK_TIMEOUT;
+}
+
+// Latch a parameter byte and wait for the n-th handshake
+uint8_t latchAndAck(uint8_t value, uint8_t n) {
+  commandOut(value, 0x00, 0x04);
+  return waitAck(n);
+}
+
+// Select the PMP300, send the unlock key and latch a block command with
+// its address. Returns 0 or an error code.
+uint8_t blockIntro(uint8_t cmd, uint32_t addr) {
+  writeControl(0x04);
+  commandOut(PMP_CMD_SELECT, 0x0C, 0x04);
+  writeControl(0x00);
+  delay(20);
+  writeControl(0x04);
+  delay(20);
+  for (uint8_t i = 0; i < sizeof(introKey); i++) {
+    uint8_t err = latchAndAck(introKey[i], i);
+    if (err) return err;
+  }
+  commandOut(PMP_CMD_SELECT, 0x0C, 0x04);
+
+  commandOut(cmd, 0x0C, 0x04);
+  for (uint8_t i = 0; i < 3; i++) {
+    uint8_t err = latchAndAck((addr >> (8 * i)) & 0xFF, i);
+    if (err) return err;
+  }
+  return 0;
+}
+
+// Deselect the PMP300 after a block command
+void pmpOutro() {
+  commandOut(PMP_CMD_SELECT, 0x0C, 0x04);
+}
 
-  return result;
+// Read a 24-bit block address parameter, high byte first
+uint32_t readAddress() {
+  uint32_t addr = (uint32_t)waitForByte() << 16;
+  addr |= (uint16_t)waitForByte() << 8;
+  return addr | waitForByte();
+}
+
+// Write byte i of a chunk, toggling control like handleWritePMPChunk
+inline void writeChunkByte(uint8_t value, uint16_t i) {
+  writeDataByte(value);
+  writeControl((i & 1) ? 0x04 : 0x00);
 }
 
 // Set data pins as outputs
@@ -340,8 +988,27 @@ void setDataInput() {
   dataIsOutput = false;
 }
 
-// Wait for serial byte with timeout
+// Send a response byte, adding it to the frame CRC in framed mode. The
+// first byte of a framed response opens the frame; an error response is
+// 2 bytes long and makes the bridge drop frames until resynchronized.
+void sendByte(uint8_t value) {
+  if (inFrame && !respStarted) {
+    if (value == RESP_ERROR) {
+      respLen = 2;
+      rejecting = true;
+    }
+    beginFrame();
+  }
+  Serial.write(value);
+  if (inFrame) txCrc = crc16Update(txCrc, value);
+}
+
+// Wait for serial byte with timeout. In framed mode parameters come from
+// the frame, whose length was checked before dispatch.
 uint8_t waitForByte() {
+  if (inFrame) {
+    return framePos < frameLen ? frameBuf[framePos++] : 0;
+  }
   unsigned long start = millis();
   while (!Serial.available()) {
     if (millis() - start > 1000) {
@@ -352,7 +1019,16 @@ uint8_t waitForByte() {
   return Serial.read();
 }
 
+// Consume a pending CMD_ABORT. Any other byte is left for the main loop.
+bool abortRequested() {
+  if (Serial.available() && Serial.peek() == CMD_ABORT) {
+    Serial.read();
+    return true;
+  }
+  return false;
+}
+
 void sendError(uint8_t code) {
-  Serial.write(RESP_ERROR);
-  Serial.write(code);
+  sendByte(RESP_ERROR);
+  sendByte(code);
 }
@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/murdinc/pmp300/pkg/arduino"
+)
+
+// BAUD_FILE remembers the rate that worked for each bridge, relative to the
+// user config directory
+const BAUD_FILE = "pmp300/baud.json"
+
+// applyBaud switches an opened bridge to the --baud rate. Without the flag
+// the rate remembered for the bridge is used, if any. A rate that does not
+// work only costs speed: the bridge stays at a working rate, a warning is
+// printed and the remembered rate is forgotten.
+func applyBaud(ctx context.Context, port *arduino.Port) error {
+	bauds := loadBauds()
+	key := bridgeKey(port.Device())
+
+	var rates []int
+	switch baudFlag {
+	case "":
+		rate, ok := bauds[key]
+		if !ok || rate == port.Baud() {
+			return nil
+		}
+		rates = []int{rate}
+	case "max":
+		rates = arduino.BAUD_RATES
+	default:
+		rate, err := arduino.ParseBaud(baudFlag)
+		if err != nil {
+			return err
+		}
+		rates = []int{rate}
+	}
+
+	for _, rate := range rates {
+		err := port.SetBaudContext(ctx, rate)
+		if err == nil {
+			if rate != arduino.DEFAULT_BAUD {
+				fmt.Printf("Using %d baud\n", rate)
+			}
+			if bauds[key] != rate {
+				bauds[key] = rate
+				saveBauds(bauds)
+			}
+			return nil
+		}
+		if !errors.Is(err, arduino.ErrBaudRate) && !errors.Is(err, arduino.ErrOldFirmware) {
+			return err
+		}
+		fmt.Printf("Warning: %v\n", err)
+		if errors.Is(err, arduino.ErrOldFirmware) {
+			break
+		}
+	}
+	if _, ok := bauds[key]; ok {
+		delete(bauds, key)
+		saveBauds(bauds)
+	}
+	return nil
+}
+
+// bridgeKey identifies a bridge across reconnects: by its USB serial number
+// where the OS reports one, as the device path may change, else by path
+func bridgeKey(device string) string {
+	ports, err := arduino.ListPorts()
+	if err != nil {
+		return device
+	}
+	resolved, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		resolved = device
+	}
+	for _, pi := range ports {
+		if pi.Device == resolved && pi.SerialNumber != "" {
+			return "usb:" + pi.USB() + ":" + pi.SerialNumber
+		}
+	}
+	return device
+}
+
+// baudPath returns the path of BAUD_FILE, or "" without a config directory
+func baudPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, BAUD_FILE)
+}
+
+// loadBauds reads the remembered rates. A missing or broken file counts
+// as empty.
+func loadBauds() map[string]int {
+	bauds := map[string]int{}
+	if path := baudPath(); path != "" {
+		if data, err := os.ReadFile(path); err == nil {
+			json.Unmarshal(data, &bauds)
+		}
+	}
+	return bauds
+}
+
+// saveBauds writes the remembered rates. Failures are ignored: remembering
+// a rate only saves the next run a --baud flag.
+func saveBauds(bauds map[string]int) {
+	path := baudPath()
+	if path == "" {
+		return
+	}
+	data, err := json.MarshalIndent(bauds, "", "  ")
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return
+	}
+	os.WriteFile(path, append(data, '\n'), 0o644)
+}
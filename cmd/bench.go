@@ -0,0 +1,248 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/murdinc/pmp300/pkg/arduino"
+	"github.com/murdinc/pmp300/pkg/pmp300"
+	"github.com/spf13/cobra"
+)
+
+var (
+	benchCountFlag int
+	benchJSONFlag  string
+)
+
+var benchCmd = &cobra.Command{
+	Use:   "bench",
+	Short: "Measure the speed of the Arduino bridge",
+	Long: `Measure the link to the Arduino bridge, to tell USB latency, firmware
+bit-banging and the PMP300 itself apart:
+
+  ping        round trip of a ping, the USB and serial latency
+  commandout  pipelined COMMANDOUT commands per second
+  nibble      ReadNibbleBlock throughput, as used by downloads (checked
+              reads with firmware 3.5)
+  chunk       WritePMPChunk throughput, as used by uploads
+
+The PMP300 stays deselected: commandout repeats the deselect command, and
+nibble reads and chunks go to a deselected player, which ignores them. It
+need not be connected. --json writes the results with full latency
+histograms, for comparing firmware builds.
+
+Examples:
+  pmp300 bench
+  pmp300 bench --count 50 --baud 1000000
+  pmp300 bench --json fw-3.4.0.json`,
+	RunE: runBench,
+}
+
+func init() {
+	rootCmd.AddCommand(benchCmd)
+	benchCmd.Flags().IntVarP(&benchCountFlag, "count", "n", 100, "Operations per measurement (commandout runs 10 times as many)")
+	benchCmd.Flags().StringVar(&benchJSONFlag, "json", "", "Also write the results as JSON to this file")
+}
+
+// benchReport is the JSON form of a bench run
+type benchReport struct {
+	Time         time.Time     `json:"time"`
+	Device       string        `json:"device"`
+	Firmware     string        `json:"firmware"`
+	Capabilities string        `json:"capabilities"`
+	Framed       bool          `json:"framed"`
+	Baud         int           `json:"baud"`
+	Buckets      []int64       `json:"latency_buckets_ns"` // Histogram bucket bounds
+	Results      []benchResult `json:"results"`
+}
+
+// benchResult is one measurement
+type benchResult struct {
+	Name        string               `json:"name"`
+	Ops         int                  `json:"ops"`
+	Bytes       int64                `json:"bytes"` // Payload moved, 0 for ping and commandout
+	Seconds     float64              `json:"seconds"`
+	OpsPerSec   float64              `json:"ops_per_sec"`
+	BytesPerSec float64              `json:"bytes_per_sec"`
+	Resyncs     int                  `json:"resyncs"`
+	Stats       arduino.CommandStats `json:"stats"`
+}
+
+func runBench(cmd *cobra.Command, args []string) error {
+	ctx := cmd.Context()
+	if benchCountFlag < 1 {
+		return fmt.Errorf("--count must be at least 1")
+	}
+
+	device, err := getDevice(ctx)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Connecting to %s...\n", device)
+
+	port, err := openTransport(ctx, device)
+	if err != nil {
+		return err
+	}
+	defer port.Close()
+
+	ap, ok := port.(*arduino.Port)
+	if !ok {
+		return fmt.Errorf("bench measures the Arduino bridge; %s is not one", device)
+	}
+	version, err := ap.GetVersionContext(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get version: %w", err)
+	}
+
+	report := benchReport{
+		Time:         time.Now().UTC(),
+		Device:       device,
+		Firmware:     version.String(),
+		Capabilities: ap.Capabilities().String(),
+		Framed:       ap.Framed(),
+		Baud:         ap.Baud(),
+	}
+	for _, bound := range arduino.LATENCY_BUCKETS {
+		report.Buckets = append(report.Buckets, int64(bound))
+	}
+	fmt.Printf("Firmware %s, %d baud, %s\n", report.Firmware, report.Baud, framingName(report.Framed))
+	fmt.Printf("Capabilities: %s\n\n", report.Capabilities)
+
+	nibbleSize := benchNibbleSize(ap)
+	nibbleCommand := "READ_NIBBLE_BLK"
+	if ap.HasNibbleCheck() {
+		nibbleCommand = "READ_NIBBLE_CHK"
+	}
+	chunk := make([]byte, arduino.CHUNK_SIZE)
+	benches := []struct {
+		name    string
+		command string // Command measured, as named in trace files
+		ops     int
+		bytes   int // Payload per op
+		run     func(ctx context.Context) func() error
+	}{
+		{"ping", "PING", benchCountFlag, 0, func(ctx context.Context) func() error {
+			err := ap.PingContext(ctx)
+			return func() error { return err }
+		}},
+		{"commandout", "COMMANDOUT", 10 * benchCountFlag, 0, func(ctx context.Context) func() error {
+			return ap.SubmitCommandOutContext(ctx, pmp300.PMP_CMD_SELECT, 0x0C, 0x04)
+		}},
+		{"nibble", nibbleCommand, benchCountFlag, nibbleSize, func(ctx context.Context) func() error {
+			wait := ap.SubmitReadNibbleBlockContext(ctx, uint16(nibbleSize))
+			return func() error { _, err := wait(); return err }
+		}},
+		{"chunk", "WRITE_PMP_CHUNK", benchCountFlag, len(chunk), func(ctx context.Context) func() error {
+			return ap.SubmitWritePMPChunkContext(ctx, chunk)
+		}},
+	}
+
+	fmt.Printf("%-11s %7s %9s %11s %11s %9s %9s %9s %7s\n", "TEST", "OPS", "TIME", "OPS/S", "KB/S", "MEAN", "P50", "P99", "ERRORS")
+	for _, b := range benches {
+		ap.ResetStats()
+		start := time.Now()
+		waits := make([]func() error, b.ops)
+		for i := range waits {
+			waits[i] = b.run(ctx)
+		}
+		var firstErr error
+		for _, wait := range waits {
+			// Corrupted spans are counted separately
+			if err := wait(); err != nil && !errors.Is(err, arduino.ErrChecksum) && firstErr == nil {
+				firstErr = err
+			}
+		}
+		elapsed := time.Since(start)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		stats := ap.Stats()
+		r := benchResult{
+			Name:      b.name,
+			Ops:       b.ops,
+			Bytes:     int64(b.ops * b.bytes),
+			Seconds:   elapsed.Seconds(),
+			OpsPerSec: float64(b.ops) / elapsed.Seconds(),
+			Resyncs:   stats.Resyncs,
+			Stats:     stats.Command(b.command),
+		}
+		r.BytesPerSec = float64(r.Bytes) / elapsed.Seconds()
+		report.Results = append(report.Results, r)
+
+		kbs := "-"
+		if r.Bytes > 0 {
+			kbs = fmt.Sprintf("%.1f", r.BytesPerSec/1024)
+		}
+		lat := r.Stats.Latency
+		fmt.Printf("%-11s %7d %9s %11.0f %11s %9s %9s %9s %7d\n", r.Name, r.Ops, elapsed.Round(time.Millisecond), r.OpsPerSec, kbs,
+			formatLatency(lat.Mean()), formatLatency(lat.Percentile(0.5)), formatLatency(lat.Percentile(0.99)), r.Stats.Errors)
+		if firstErr != nil {
+			fmt.Printf("  first error: %v\n", firstErr)
+		}
+		if r.Stats.Retries > 0 || r.Resyncs > 0 || r.Stats.Corrupt > 0 {
+			fmt.Printf("  %d retries, %d resyncs, %d corrupted spans\n", r.Stats.Retries, r.Resyncs, r.Stats.Corrupt)
+		}
+	}
+	// The nibble reads and chunks toggled the control lines
+	if err := ap.CommandOutContext(ctx, pmp300.PMP_CMD_SELECT, 0x0C, 0x04); err != nil {
+		return err
+	}
+
+	fmt.Printf("\nnibble reads %d bytes per command. Latencies of pipelined commands\n", nibbleSize)
+	fmt.Println("include the time queued behind earlier ones.")
+
+	if benchJSONFlag != "" {
+		return writeBenchJSON(report)
+	}
+	return nil
+}
+
+// benchNibbleSize returns the ReadNibbleBlock count used by downloads: the
+// largest power of two pages the firmware takes, up to a block
+func benchNibbleSize(ap *arduino.Port) int {
+	size := pmp300.BLOCK_SIZE
+	for size > pmp300.PAGE_SIZE && size > ap.MaxNibbleBlock() {
+		size /= 2
+	}
+	return size
+}
+
+// framingName describes the protocol in use
+func framingName(framed bool) string {
+	if framed {
+		return "framed"
+	}
+	return "unframed"
+}
+
+// formatLatency rounds a latency for the table
+func formatLatency(d time.Duration) string {
+	switch {
+	case d >= time.Second:
+		return d.Round(time.Millisecond).String()
+	case d >= time.Millisecond:
+		return d.Round(10 * time.Microsecond).String()
+	default:
+		return d.Round(time.Microsecond).String()
+	}
+}
+
+// writeBenchJSON writes a bench report to --json
+func writeBenchJSON(report benchReport) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(benchJSONFlag, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write results: %w", err)
+	}
+	fmt.Printf("Results written to %s\n", benchJSONFlag)
+	return nil
+}
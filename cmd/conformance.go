@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/murdinc/pmp300/pkg/bridgesim"
+	"github.com/murdinc/pmp300/pkg/conformance"
+	"github.com/murdinc/pmp300/pkg/emulator"
+	"github.com/murdinc/pmp300/pkg/pmp300"
+	"github.com/spf13/cobra"
+)
+
+var conformanceLegacyFlag bool
+
+var conformanceCmd = &cobra.Command{
+	Use:   "conformance",
+	Short: "Check the bridge simulator against the protocol specification",
+	Long: `Run every command documented in PROTOCOL.md against the bridge simulator,
+with an emulated PMP300 attached, and compare each answer with the spec.
+Commands the simulated firmware does not report in its capabilities are
+skipped. The simulator mirrors the firmware sketch, so a failure means the
+spec, the simulator or the sketch needs fixing.
+
+Examples:
+  pmp300 conformance
+  pmp300 conformance --legacy`,
+	RunE: runConformance,
+}
+
+func init() {
+	rootCmd.AddCommand(conformanceCmd)
+	conformanceCmd.Flags().BoolVar(&conformanceLegacyFlag, "legacy", false, "Check the 2.x firmware simulation")
+}
+
+func runConformance(cmd *cobra.Command, args []string) error {
+	rio := emulator.New(emulator.NewFlash(pmp300.BLOCKS_INTERNAL))
+	defer rio.Close()
+	sim := bridgesim.New(rio)
+	sim.Legacy = conformanceLegacyFlag
+
+	fmt.Printf("Checking %s", sim.Banner())
+	link := conformance.Simulate(sim)
+	defer link.Close()
+
+	passed, skipped := 0, 0
+	failed, err := conformance.Run(link, func(r conformance.Result) {
+		switch {
+		case r.Skipped:
+			skipped++
+			fmt.Printf("  SKIP  %s\n", r.Section)
+		case r.Err != nil:
+			fmt.Printf("  FAIL  %s: %v\n", r.Section, r.Err)
+		default:
+			passed++
+			fmt.Printf("  PASS  %s\n", r.Section)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("\n%d passed, %d failed, %d skipped\n", passed, failed, skipped)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d sections do not conform", failed, len(conformance.Cases))
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/murdinc/pmp300/pkg/pmp300"
+	"github.com/spf13/cobra"
+)
+
+var defragPlanFlag bool
+
+var defragCmd = &cobra.Command{
+	Use:   "defrag",
+	Short: "Gather the free space into one run",
+	Long: `Relocate file blocks so that all free blocks form one run, so that an upload
+as large as the free space fits. Uploads need a contiguous run of free blocks;
+after deleting files from the middle the free space can be scattered.
+
+The plan moves as few blocks as possible; files stay in their playback order
+and keep their contents. It is shown with an estimated time before anything
+is written. Files are moved one at a time, and the directory is rewritten
+after each, so an interrupted defrag resumes when run again.
+
+The directory must pass 'pmp300 fsck' first.
+
+Examples:
+  pmp300 defrag
+  pmp300 defrag --plan
+  pmp300 defrag --external --force`,
+	RunE: runDefrag,
+}
+
+func init() {
+	rootCmd.AddCommand(defragCmd)
+	defragCmd.Flags().BoolVar(&defragPlanFlag, "plan", false, "Only show the plan")
+	defragCmd.Flags().BoolVarP(&forceFlag, "force", "f", false, "Skip the confirmation prompt")
+}
+
+func runDefrag(cmd *cobra.Command, args []string) error {
+	ctx := cmd.Context()
+
+	pmp, port, err := getInitializedPMPDevice(ctx)
+	if err != nil {
+		return err
+	}
+	defer port.Close()
+
+	fmt.Printf("Planning defrag of %s...\n", pmp.GetCurrentStorage())
+	plan, err := pmp.PlanDefragContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Free space: %d blocks, largest run %d\n", plan.FreeBlocks, plan.LargestRun)
+	if len(plan.Moves) == 0 {
+		fmt.Println("✓ Free space is already contiguous")
+		return nil
+	}
+
+	fmt.Printf("\nMoving %d blocks of %d files:\n", plan.Blocks, len(plan.Moves))
+	for _, m := range plan.Moves {
+		fmt.Printf("  %-30s %3d blocks  %s -> %s\n", m.Name, len(m.From), pmp300.BlockRanges(m.From), pmp300.BlockRanges(m.To))
+	}
+	if estimate := plan.Estimate(); estimate < time.Second {
+		fmt.Println("\nEstimated time: under a second")
+	} else {
+		fmt.Printf("\nEstimated time: %s\n", estimate.Round(time.Second))
+	}
+
+	if defragPlanFlag {
+		return nil
+	}
+
+	if !forceFlag {
+		fmt.Print("Defragment now? (y/N): ")
+		reader := bufio.NewReader(os.Stdin)
+		response, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		response = strings.TrimSpace(strings.ToLower(response))
+		if response != "y" && response != "yes" {
+			fmt.Println("Cancelled.")
+			return nil
+		}
+	}
+
+	err = pmp.DefragContext(ctx, plan, blockProgress())
+	fmt.Println()
+	if err != nil {
+		return fmt.Errorf("defrag failed: %w (run it again to resume)", err)
+	}
+
+	fmt.Printf("✓ Moved %d blocks; %d free blocks now in one run\n", plan.Blocks, plan.FreeBlocks)
+	printTransferStats(pmp)
+	return nil
+}
@@ -2,11 +2,11 @@ package cmd
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"os"
 	"strings"
 
-	"github.com/murdinc/pmp300/pkg/arduino"
 	"github.com/murdinc/pmp300/pkg/pmp300"
 	"github.com/spf13/cobra"
 )
@@ -39,6 +39,8 @@ func init() {
 }
 
 func runDelete(cmd *cobra.Command, args []string) error {
+	ctx := cmd.Context()
+
 	if !deleteAllFlag && len(args) == 0 {
 		return fmt.Errorf("specify filename to delete or use --all")
 	}
@@ -47,33 +49,24 @@ func runDelete(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("cannot specify filename with --all")
 	}
 
-	device, err := getDevice()
+	pmp, port, err := openPMP(ctx)
 	if err != nil {
 		return err
 	}
-
-	fmt.Printf("Connecting to %s...\n", device)
-
-	port, err := arduino.Open(device)
-	if err != nil {
-		return fmt.Errorf("failed to open Arduino: %w", err)
-	}
 	defer port.Close()
 
-	pmp := pmp300.New(port)
-
 	fmt.Println("Initializing PMP300...")
-	if err := pmp.Initialize(); err != nil {
+	if err := pmp.InitializeContext(ctx); err != nil {
 		return fmt.Errorf("initialization failed: %w", err)
 	}
 
 	if deleteAllFlag {
-		return deleteAll(pmp)
+		return deleteAll(ctx, pmp)
 	}
 
 	// Delete individual files
 	for _, filename := range args {
-		if err := deleteOne(pmp, filename); err != nil {
+		if err := deleteOne(ctx, pmp, filename); err != nil {
 			fmt.Printf("✗ Failed to delete %s: %v\n", filename, err)
 		}
 	}
@@ -81,7 +74,7 @@ func runDelete(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
-func deleteOne(pmp *pmp300.Device, filename string) error {
+func deleteOne(ctx context.Context, pmp *pmp300.Device, filename string) error {
 	// Confirm deletion unless force flag is set
 	if !forceFlag {
 		fmt.Printf("Delete %s? (y/N): ", filename)
@@ -98,7 +91,7 @@ func deleteOne(pmp *pmp300.Device, filename string) error {
 	}
 
 	fmt.Printf("Deleting %s...\n", filename)
-	if err := pmp.DeleteFile(filename); err != nil {
+	if err := pmp.DeleteFileContext(ctx, filename); err != nil {
 		return err
 	}
 
@@ -106,9 +99,9 @@ func deleteOne(pmp *pmp300.Device, filename string) error {
 	return nil
 }
 
-func deleteAll(pmp *pmp300.Device) error {
+func deleteAll(ctx context.Context, pmp *pmp300.Device) error {
 	// Read file count first
-	info, err := pmp.GetDeviceInfo()
+	info, err := pmp.GetDeviceInfoContext(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to get device info: %w", err)
 	}
@@ -134,7 +127,7 @@ func deleteAll(pmp *pmp300.Device) error {
 	}
 
 	fmt.Println("Deleting all files...")
-	if err := pmp.DeleteAllFiles(); err != nil {
+	if err := pmp.DeleteAllFilesContext(ctx); err != nil {
 		return fmt.Errorf("failed to delete all files: %w", err)
 	}
 
@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/murdinc/pmp300/pkg/arduino"
+	"github.com/spf13/cobra"
+)
+
+var devicesCmd = &cobra.Command{
+	Use:   "devices",
+	Short: "List serial ports and the PMP300 bridges connected to them",
+	Long: `List the serial ports of this system with their USB vendor and product
+IDs and serial numbers. Every USB port is probed with a ping and a version
+query to find the ones running the PMP300 bridge firmware.
+
+When exactly one bridge is connected, every other command uses it without
+--device or PMP300_DEVICE.
+
+Probing opens each port, which resets most Arduino boards.`,
+	RunE: runDevices,
+}
+
+func init() {
+	rootCmd.AddCommand(devicesCmd)
+}
+
+func runDevices(cmd *cobra.Command, args []string) error {
+	fmt.Println("Probing serial ports...")
+	ports, err := arduino.Discover(cmd.Context())
+	if err != nil {
+		return err
+	}
+	if len(ports) == 0 {
+		fmt.Println("No serial ports found.")
+		return nil
+	}
+
+	fmt.Printf("\n%-24s %-10s %-20s %s\n", "DEVICE", "USB", "SERIAL", "STATUS")
+	for _, pi := range ports {
+		usb := pi.USB()
+		if usb == "" {
+			usb = "-"
+		}
+		serial := pi.SerialNumber
+		if serial == "" {
+			serial = "-"
+		}
+		fmt.Printf("%-24s %-10s %-20s %s\n", pi.Device, usb, serial, portStatus(pi))
+	}
+
+	bridges := arduino.Bridges(ports)
+	fmt.Printf("\n%d bridge(s) found\n", len(bridges))
+	if len(bridges) == 1 {
+		fmt.Printf("Commands will use %s automatically\n", bridges[0].Device)
+	}
+	return nil
+}
+
+// portStatus describes the probe result of a port
+func portStatus(pi arduino.PortInfo) string {
+	var lerr *arduino.LockError
+	switch {
+	case !pi.Probed:
+		return "not probed (not USB)"
+	case errors.As(pi.Err, &lerr) && lerr.PID == 0:
+		return "PMP300 bridge, in use by another process"
+	case errors.As(pi.Err, &lerr):
+		return fmt.Sprintf("PMP300 bridge, in use by process %d", lerr.PID)
+	case pi.Bridge:
+		return fmt.Sprintf("PMP300 bridge v%s", pi.Version)
+	case errors.Is(pi.Err, arduino.ErrOldFirmware):
+		return fmt.Sprintf("PMP300 bridge v%s, too old (reflash with pmp300 flash)", pi.Version)
+	case errors.Is(pi.Err, arduino.ErrNoDevice):
+		return "no bridge (no response)"
+	case errors.Is(pi.Err, arduino.ErrDesync):
+		return "no bridge (other firmware)"
+	default:
+		return fmt.Sprintf("error: %v", pi.Err)
+	}
+}
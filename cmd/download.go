@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 
+	"github.com/murdinc/pmp300/pkg/pmp300"
 	"github.com/spf13/cobra"
 )
 
@@ -39,6 +40,7 @@ func init() {
 }
 
 func runDownload(cmd *cobra.Command, args []string) error {
+	ctx := cmd.Context()
 
 	if allFlag {
 		if len(args) > 0 {
@@ -64,7 +66,7 @@ func runDownload(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("output file already exists: %s (remove it first or use --output to specify different path)", outputPath)
 	}
 
-	pmp, port, err := getInitializedPMPDevice()
+	pmp, port, err := getInitializedPMPDevice(ctx)
 	if err != nil {
 		return err
 	}
@@ -73,7 +75,7 @@ func runDownload(cmd *cobra.Command, args []string) error {
 	fmt.Printf("Downloading %s...\n", filename)
 
 	var lastProgress int
-	data, err := pmp.DownloadFile(filename, func(current, total int) {
+	data, err := pmp.DownloadFileContext(ctx, filename, func(current, total int) {
 		percent := (current * 100) / total
 		if percent != lastProgress {
 			fmt.Printf("\rProgress: %d%% (%d / %d bytes)", percent, current, total)
@@ -92,11 +94,14 @@ func runDownload(cmd *cobra.Command, args []string) error {
 	}
 
 	fmt.Printf("✓ Downloaded %d bytes to %s\n", len(data), outputPath)
+	printTransferStats(pmp)
 
 	return nil
 }
 
 func runDownloadAll(cmd *cobra.Command, args []string) error {
+	ctx := cmd.Context()
+
 	// Determine output directory
 	outputDir := outputFlag
 	if outputDir == "" {
@@ -108,14 +113,14 @@ func runDownloadAll(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("failed to create output directory: %w", err)
 	}
 
-	pmp, port, err := getInitializedPMPDevice()
+	pmp, port, err := getInitializedPMPDevice(ctx)
 	if err != nil {
 		return err
 	}
 	defer port.Close()
 
 	fmt.Printf("Reading file list from %s...\n", pmp.GetCurrentStorage())
-	files, err := pmp.ListFiles()
+	files, err := pmp.ListFilesContext(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to list files: %w", err)
 	}
@@ -140,7 +145,7 @@ func runDownloadAll(cmd *cobra.Command, args []string) error {
 		fmt.Printf("[%d/%d] Downloading %s...\n", i+1, len(files), filename)
 
 		var lastProgress int
-		data, err := pmp.DownloadFile(filename, func(current, total int) {
+		data, err := pmp.DownloadFileContext(ctx, filename, func(current, total int) {
 			percent := (current * 100) / total
 			if percent != lastProgress {
 				fmt.Printf("\rProgress: %d%% (%d / %d bytes)", percent, current, total)
@@ -149,6 +154,9 @@ func runDownloadAll(cmd *cobra.Command, args []string) error {
 		})
 		if err != nil {
 			fmt.Printf("\nDownload failed for %s: %v\n", filename, err)
+			if ctx.Err() != nil {
+				return fmt.Errorf("download interrupted: %w", ctx.Err())
+			}
 			continue // Continue to the next file
 		}
 		fmt.Println()
@@ -163,5 +171,14 @@ func runDownloadAll(cmd *cobra.Command, args []string) error {
 	}
 
 	fmt.Println("All downloads complete.")
+	printTransferStats(pmp)
 	return nil
 }
+
+// printTransferStats reports corrupted reads that were recovered, if any
+func printTransferStats(pmp *pmp300.Device) {
+	s := pmp.TransferStats()
+	if s.CorruptSpans > 0 || s.BlockRetries > 0 {
+		fmt.Printf("Recovered %d corrupted spans in %d re-reads and %d block retries\n", s.CorruptSpans, s.Rereads, s.BlockRetries)
+	}
+}
@@ -24,8 +24,10 @@ func init() {
 }
 
 func runDumpHeaders(cmd *cobra.Command, args []string) error {
+	ctx := cmd.Context()
+
 	// Initialize device, handle storage switching based on global externalFlag
-	pmp, port, err := getInitializedPMPDevice()
+	pmp, port, err := getInitializedPMPDevice(ctx)
 	if err != nil {
 		return err
 	}
@@ -37,7 +39,7 @@ func runDumpHeaders(cmd *cobra.Command, args []string) error {
 		fmt.Printf("Error switching to internal storage: %v\n", err)
 	} else {
 		fmt.Println("Switched to Internal Flash.")
-		internalDir, err := pmp.ReadDirectory()
+		internalDir, err := pmp.ReadDirectoryContext(ctx)
 		if internalDir != nil { // Always print if a directory struct was returned, even with errors
 			printDirectoryDetails(pmp, internalDir)
 		}
@@ -52,11 +54,11 @@ func runDumpHeaders(cmd *cobra.Command, args []string) error {
 		fmt.Printf("Error switching to external storage: %v\n", err)
 	} else {
 		fmt.Println("Switched to External SmartMedia.")
-		if present, err := pmp.DetectExternalStorage(); err != nil || !present {
+		if present, err := pmp.DetectExternalStorageContext(ctx); err != nil || !present {
 			fmt.Printf("External SmartMedia card not detected or unreadable: %v\n", err)
 			fmt.Println("Please ensure a SmartMedia card is inserted and properly seated.")
 		} else {
-			externalDir, err := pmp.ReadDirectory()
+			externalDir, err := pmp.ReadDirectoryContext(ctx)
 			if externalDir != nil { // Always print if a directory struct was returned, even with errors
 				printDirectoryDetails(pmp, externalDir)
 			}
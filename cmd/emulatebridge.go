@@ -0,0 +1,117 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/murdinc/pmp300/pkg/bridgesim"
+	"github.com/murdinc/pmp300/pkg/emulator"
+	"github.com/murdinc/pmp300/pkg/pmp300"
+	"github.com/spf13/cobra"
+)
+
+var (
+	emuImageFlag      string
+	emuBlocksFlag     int
+	emuCardFlag       string
+	emuCardBlocksFlag int
+	emuBootDelayFlag  time.Duration
+	emuLegacyFlag     bool
+	emuMaxBaudFlag    int
+	emuGlitchFlag     float64
+)
+
+var emulateBridgeCmd = &cobra.Command{
+	Use:   "emulate-bridge",
+	Short: "Simulate the Arduino bridge and a PMP300 on a pseudo-terminal",
+	Long: `Open a pseudo-terminal that behaves like an Arduino running the PMP300
+bridge firmware with an emulated PMP300 attached.
+
+The simulator speaks the same serial protocol as the firmware, including
+'E' error responses and the 1 second parameter timeout. Opening the port
+resets the simulated board, just like DTR does on a real Arduino.
+Baud rate switches always succeed, unless --max-baud simulates a USB chip
+that cannot keep up. --glitch-rate corrupts nibble reads now and then, as
+unsettled status lines would, to exercise the checked reads of firmware 3.5.
+
+Point any other pmp300 command at the printed device path. Storage is kept
+in memory unless --image (and --card for SmartMedia) name image files.
+Linux only.
+
+Examples:
+  pmp300 emulate-bridge
+  pmp300 emulate-bridge --image rio.img --blocks 2048
+  pmp300 emulate-bridge --card smartmedia.img --card-blocks 512`,
+	RunE: runEmulateBridge,
+}
+
+func init() {
+	rootCmd.AddCommand(emulateBridgeCmd)
+	emulateBridgeCmd.Flags().StringVar(&emuImageFlag, "image", "", "Internal flash image file (default: in memory)")
+	emulateBridgeCmd.Flags().IntVar(&emuBlocksFlag, "blocks", pmp300.BLOCKS_INTERNAL, "Internal flash size in 32KB blocks (1024 or 2048)")
+	emulateBridgeCmd.Flags().StringVar(&emuCardFlag, "card", "", "SmartMedia image file (inserts a card)")
+	emulateBridgeCmd.Flags().IntVar(&emuCardBlocksFlag, "card-blocks", 0, "SmartMedia size in 32KB blocks (inserts a card)")
+	emulateBridgeCmd.Flags().DurationVar(&emuBootDelayFlag, "boot-delay", 1500*time.Millisecond, "Simulated Arduino reset time after the port is opened")
+	emulateBridgeCmd.Flags().BoolVar(&emuLegacyFlag, "legacy", false, "Simulate 2.x firmware (no framed protocol)")
+	emulateBridgeCmd.Flags().IntVar(&emuMaxBaudFlag, "max-baud", 0, "Fail baud rate switches above this rate (default: accept all)")
+	emulateBridgeCmd.Flags().Float64Var(&emuGlitchFlag, "glitch-rate", 0, "Probability that a nibble read sees unsettled status lines (e.g. 0.0001)")
+}
+
+func runEmulateBridge(cmd *cobra.Command, args []string) error {
+	if emuBlocksFlag != pmp300.BLOCKS_INTERNAL && emuBlocksFlag != pmp300.BLOCKS_INTERNAL_SE {
+		return fmt.Errorf("--blocks must be %d or %d", pmp300.BLOCKS_INTERNAL, pmp300.BLOCKS_INTERNAL_SE)
+	}
+
+	internal, err := openEmulatorFlash(emuImageFlag, emuBlocksFlag)
+	if err != nil {
+		return err
+	}
+	rio := emulator.New(internal)
+	defer rio.Close()
+
+	if emuCardFlag != "" || emuCardBlocksFlag > 0 {
+		card, err := openEmulatorFlash(emuCardFlag, emuCardBlocksFlag)
+		if err != nil {
+			return err
+		}
+		rio.InsertCard(card)
+	}
+
+	pty, err := bridgesim.OpenPTY()
+	if err != nil {
+		return err
+	}
+	defer pty.Close()
+
+	sim := bridgesim.New(rio)
+	sim.Legacy = emuLegacyFlag
+	sim.MaxBaud = emuMaxBaudFlag
+	sim.GlitchRate = emuGlitchFlag
+
+	fmt.Printf("Bridge simulator running on %s\n", pty.SlavePath())
+	fmt.Printf("  Firmware:       %s", sim.Banner())
+	fmt.Printf("  Internal flash: %d blocks\n", internal.Blocks())
+	if card := rio.External(); card != nil {
+		fmt.Printf("  SmartMedia:     %d blocks\n", card.Blocks())
+	} else {
+		fmt.Println("  SmartMedia:     none")
+	}
+	fmt.Println("\nTo use with pmp300:")
+	fmt.Printf("  export PMP300_DEVICE=%s\n", pty.SlavePath())
+	fmt.Println("\nPress Ctrl-C to stop.")
+
+	return pty.Serve(sim, emuBootDelayFlag, func(format string, args ...any) {
+		fmt.Printf("[%s] %s\n", time.Now().Format("15:04:05"), fmt.Sprintf(format, args...))
+	})
+}
+
+// openEmulatorFlash opens a file-backed flash, or an in-memory one when path is empty
+func openEmulatorFlash(path string, blocks int) (*emulator.Flash, error) {
+	if path == "" {
+		if blocks <= 0 {
+			return nil, fmt.Errorf("block count required for in-memory storage")
+		}
+		return emulator.NewFlash(blocks), nil
+	}
+	return emulator.OpenFlash(path, blocks)
+}
@@ -8,6 +8,7 @@ import (
 	"runtime"
 	"strings"
 
+	"github.com/murdinc/pmp300/pkg/arduino"
 	"github.com/spf13/cobra"
 )
 
@@ -92,6 +93,13 @@ func runFlash(cmd *cobra.Command, args []string) error {
 	}
 	fmt.Println("✓ Compilation successful")
 
+	// Keep pmp300 commands off the port while the board is reprogrammed
+	lock, err := arduino.LockDevice(cmd.Context(), port, waitFlag)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
 	// Upload sketch
 	fmt.Printf("\nUploading to %s...\n", port)
 	if err := uploadSketch(sketchPath, board, port); err != nil {
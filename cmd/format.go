@@ -38,6 +38,8 @@ func init() {
 }
 
 func runFormat(cmd *cobra.Command, args []string) error {
+	ctx := cmd.Context()
+
 	// Confirm format unless force flag is set
 	if !forceFlag {
 		targetStorage := "internal flash"
@@ -58,7 +60,7 @@ func runFormat(cmd *cobra.Command, args []string) error {
 		}
 	}
 
-	pmp, port, err := getInitializedPMPDevice()
+	pmp, port, err := getInitializedPMPDevice(ctx)
 	if err != nil {
 		return err
 	}
@@ -66,7 +68,7 @@ func runFormat(cmd *cobra.Command, args []string) error {
 
 	if externalFlag { // externalFlag is now global
 		// Check if external storage is present and formatted
-		present, err := pmp.DetectExternalStorage()
+		present, err := pmp.DetectExternalStorageContext(ctx)
 
 		if err != nil { // This means "present but corrupted"
 			fmt.Printf("Warning: %v. Attempting to format anyway.\n", err)
@@ -80,14 +82,14 @@ func runFormat(cmd *cobra.Command, args []string) error {
 		fmt.Println("Bad block checking enabled - this will take a VERY long time!")
 	}
 
-	if err := pmp.FormatDevice(checkBadBlocksFlag); err != nil {
+	if err := pmp.FormatDeviceContext(ctx, checkBadBlocksFlag); err != nil {
 		return fmt.Errorf("format failed: %w", err)
 	}
 
 	fmt.Println("\n✓ Format complete!")
 
 	// Show device info
-	info, err := pmp.GetDeviceInfo()
+	info, err := pmp.GetDeviceInfoContext(ctx)
 	if err != nil {
 		fmt.Printf("Warning: Could not get device info after format (checksum or parsing error): %v\n", err)
 		// Try to proceed with what info we have, if any was returned
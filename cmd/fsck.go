@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/murdinc/pmp300/pkg/pmp300"
+	"github.com/spf13/cobra"
+)
+
+var (
+	fsckRepairFlag bool
+	fsckAdoptFlag  bool
+)
+
+var fsckCmd = &cobra.Command{
+	Use:   "fsck",
+	Short: "Check the directory for consistency",
+	Long: `Check the directory of the internal flash or SmartMedia card for consistency:
+the header checksums and block counters, the entry count, every file's block
+chain, and the block usage map against the chains.
+
+Files are checked in playback order. A file that shares blocks with an
+earlier one is cross-linked; the repair drops the later file. Blocks marked
+used that belong to no file are orphaned; the repair frees them. Entries
+past the entry count are stale, left over from a directory that was not fully
+rewritten; the repair clears them, or with --adopt-stale keeps them as files
+if their chains hold up.
+
+With --repair, the changes to the directory are shown and, once confirmed,
+a corrected directory block is written. File data is never touched. Consider
+'pmp300 image dump' first.
+
+Examples:
+  pmp300 fsck
+  pmp300 fsck --external
+  pmp300 fsck --repair
+  pmp300 fsck --repair --adopt-stale`,
+	RunE: runFsck,
+}
+
+func init() {
+	rootCmd.AddCommand(fsckCmd)
+	fsckCmd.Flags().BoolVar(&fsckRepairFlag, "repair", false, "Write a corrected directory")
+	fsckCmd.Flags().BoolVar(&fsckAdoptFlag, "adopt-stale", false, "Keep entries past the entry count as files")
+	fsckCmd.Flags().BoolVarP(&forceFlag, "force", "f", false, "Skip the confirmation prompt")
+}
+
+func runFsck(cmd *cobra.Command, args []string) error {
+	ctx := cmd.Context()
+
+	pmp, port, err := getInitializedPMPDevice(ctx)
+	if err != nil {
+		return err
+	}
+	defer port.Close()
+
+	fmt.Printf("Checking %s...\n", pmp.GetCurrentStorage())
+	res, err := pmp.CheckDirectoryWithOptionsContext(ctx, pmp300.CheckOptions{AdoptStale: fsckAdoptFlag})
+	if err != nil {
+		return err
+	}
+
+	if res.Clean() {
+		h := res.Directory.Header
+		fmt.Printf("✓ No problems: %d files, %d blocks used, %d free, %d bad\n", h.EntryCount, h.BlocksUsed, h.BlocksRemaining, h.BlocksBad)
+		return nil
+	}
+
+	fmt.Printf("\n%d problems found:\n", len(res.Problems))
+	for _, p := range res.Problems {
+		if p.Fixed {
+			fmt.Printf("  ✗ %s\n", p.Message)
+		} else {
+			fmt.Printf("  ✗ %s (not repairable)\n", p.Message)
+		}
+	}
+
+	if !fsckRepairFlag || res.Repaired == nil {
+		if res.Repaired != nil {
+			fmt.Println("\nRun with --repair to fix them.")
+		}
+		return fmt.Errorf("%s directory has %d problems", pmp.GetCurrentStorage(), len(res.Problems))
+	}
+
+	fmt.Println("\nDirectory changes:")
+	for _, line := range pmp300.DiffDirectories(res.Directory, res.Repaired) {
+		fmt.Printf("  %s\n", line)
+	}
+
+	if !forceFlag {
+		fmt.Print("\nWrite the repaired directory? (y/N): ")
+		reader := bufio.NewReader(os.Stdin)
+		response, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		response = strings.TrimSpace(strings.ToLower(response))
+		if response != "y" && response != "yes" {
+			fmt.Println("Cancelled.")
+			return nil
+		}
+	}
+
+	if err := pmp.RepairDirectoryContext(ctx, res); err != nil {
+		return fmt.Errorf("repair failed: %w", err)
+	}
+	fmt.Println("✓ Directory repaired")
+
+	if n := res.Unfixed(); n > 0 {
+		return fmt.Errorf("%d problems could not be repaired", n)
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/murdinc/pmp300/pkg/pmp300"
+	"github.com/spf13/cobra"
+)
+
+var imageCmd = &cobra.Command{
+	Use:   "image",
+	Short: "Back up and restore a whole storage block by block",
+	Long: `Dump every block of the internal flash or SmartMedia card to an image file,
+or write an image back. Unlike 'download --all', an image keeps everything:
+playback order, timestamps, the bad block map and any directory contents the
+parser does not understand.
+
+Each image has a JSON manifest next to it (IMAGE.json) with the storage type,
+geometry, directory header and a SHA-256 of every block. Images can be opened
+with --image and --card like the player itself.`,
+}
+
+var imageDumpCmd = &cobra.Command{
+	Use:   "dump FILE",
+	Short: "Read every block of the storage into an image file",
+	Long: `Read every block of the storage into an image file and write its manifest.
+
+An interrupted dump resumes where it stopped when run again, unless the
+directory on the player has changed since.
+
+Examples:
+  pmp300 image dump rio.img
+  pmp300 image dump smartmedia.img --external`,
+	Args: cobra.ExactArgs(1),
+	RunE: runImageDump,
+}
+
+var imageRestoreCmd = &cobra.Command{
+	Use:   "restore FILE",
+	Short: "Write an image file back to the storage",
+	Long: `Write an image made by 'image dump' back to the storage it came from.
+
+The image is checked against its manifest first. Blocks on the player that
+already match the image are skipped, so an interrupted restore resumes when
+run again. The directory block is written last.
+
+WARNING: This replaces ALL FILES on the storage!
+
+Examples:
+  pmp300 image restore rio.img
+  pmp300 image restore smartmedia.img --external --force`,
+	Args: cobra.ExactArgs(1),
+	RunE: runImageRestore,
+}
+
+func init() {
+	rootCmd.AddCommand(imageCmd)
+	imageCmd.AddCommand(imageDumpCmd)
+	imageCmd.AddCommand(imageRestoreCmd)
+	imageRestoreCmd.Flags().BoolVarP(&forceFlag, "force", "f", false, "Skip the confirmation prompt")
+}
+
+func runImageDump(cmd *cobra.Command, args []string) error {
+	ctx := cmd.Context()
+	path := args[0]
+
+	pmp, port, err := getInitializedPMPDevice(ctx)
+	if err != nil {
+		return err
+	}
+	defer port.Close()
+
+	fmt.Printf("Dumping %s to %s...\n", pmp.GetCurrentStorage(), path)
+	m, err := pmp.DumpImageContext(ctx, path, blockProgress())
+	fmt.Println()
+	if err != nil {
+		if _, serr := os.Stat(pmp300.ManifestPath(path)); serr == nil {
+			return fmt.Errorf("dump failed: %w (run it again to resume)", err)
+		}
+		return fmt.Errorf("dump failed: %w", err)
+	}
+
+	fmt.Printf("✓ Dumped %d blocks to %s\n", m.Blocks, path)
+	fmt.Printf("  Manifest: %s\n", pmp300.ManifestPath(path))
+	if m.DirectoryError != "" {
+		fmt.Printf("  Warning: %s\n", m.DirectoryError)
+	} else if m.Header != nil {
+		fmt.Printf("  Directory: %d files, %d blocks used, %d bad\n", m.Header.EntryCount, m.Header.BlocksUsed, m.Header.BlocksBad)
+	}
+	printTransferStats(pmp)
+	return nil
+}
+
+func runImageRestore(cmd *cobra.Command, args []string) error {
+	ctx := cmd.Context()
+	path := args[0]
+
+	m, err := pmp300.ReadManifest(path)
+	if err != nil {
+		return fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	if !forceFlag {
+		fmt.Printf("WARNING: This will REPLACE ALL FILES on the PMP300's %s with %s (dumped %s)!\n", m.Storage, path, m.Dumped.Format("2006-01-02 15:04"))
+		fmt.Print("Are you sure you want to restore the image? (y/N): ")
+		reader := bufio.NewReader(os.Stdin)
+		response, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		response = strings.TrimSpace(strings.ToLower(response))
+		if response != "y" && response != "yes" {
+			fmt.Println("Cancelled.")
+			return nil
+		}
+	}
+
+	pmp, port, err := getInitializedPMPDevice(ctx)
+	if err != nil {
+		return err
+	}
+	defer port.Close()
+
+	fmt.Printf("Restoring %s to %s...\n", path, pmp.GetCurrentStorage())
+	stats, err := pmp.RestoreImageContext(ctx, path, blockProgress())
+	fmt.Println()
+	if err != nil {
+		if stats.Written+stats.Skipped > 0 {
+			return fmt.Errorf("restore failed after writing %d blocks: %w (run it again to resume)", stats.Written, err)
+		}
+		return fmt.Errorf("restore failed: %w", err)
+	}
+
+	fmt.Printf("✓ Restored %s: %d blocks written, %d already matched\n", path, stats.Written, stats.Skipped)
+	printTransferStats(pmp)
+	return nil
+}
+
+// blockProgress prints the progress of a whole storage transfer
+func blockProgress() pmp300.ProgressFunc {
+	lastProgress := -1
+	return func(current, total int) {
+		percent := (current * 100) / total
+		if percent != lastProgress {
+			fmt.Printf("\rProgress: %d%% (%d / %d blocks)", percent, current/pmp300.BLOCK_SIZE, total/pmp300.BLOCK_SIZE)
+			lastProgress = percent
+		}
+	}
+}
@@ -25,34 +25,34 @@ func init() {
 }
 
 func runInfo(cmd *cobra.Command, args []string) error {
-	device, err := getDevice()
-	if err != nil {
-		return err
-	}
-
-	fmt.Printf("Connecting to %s...\n", device)
+	ctx := cmd.Context()
 
-	port, err := arduino.Open(device)
+	pmp, port, err := openPMP(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to open Arduino: %w", err)
+		return err
 	}
 	defer port.Close()
 
-	// Get Arduino version
-	version, err := port.GetVersion()
-	if err != nil {
-		return fmt.Errorf("failed to get Arduino version: %w", err)
+	// Get Arduino version (native parallel ports have no firmware)
+	var version *arduino.Version
+	var caps arduino.Capabilities
+	var baud int
+	if ap, ok := port.(*arduino.Port); ok {
+		version, err = ap.GetVersion()
+		if err != nil {
+			return fmt.Errorf("failed to get Arduino version: %w", err)
+		}
+		caps = ap.Capabilities()
+		baud = ap.Baud()
 	}
 
-	pmp := pmp300.New(port)
-
 	fmt.Println("Initializing PMP300...")
-	if err := pmp.Initialize(); err != nil {
+	if err := pmp.InitializeContext(ctx); err != nil {
 		return fmt.Errorf("initialization failed: %w", err)
 	}
 
 	fmt.Println("Reading device information...")
-	info, err := pmp.GetDeviceInfo()
+	info, err := pmp.GetDeviceInfoContext(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to get device info: %w", err)
 	}
@@ -88,9 +88,25 @@ func runInfo(cmd *cobra.Command, args []string) error {
 	fmt.Printf("  Version:      %d\n", info.Version)
 	fmt.Printf("  Block size:   32 KB\n")
 
-	fmt.Printf("\nBridge:\n")
-	fmt.Printf("  Device:       %s\n", port.Device())
-	fmt.Printf("  Firmware:     v%s\n", version)
+	if images, ok := port.(*pmp300.Images); ok {
+		fmt.Printf("\nImages:\n")
+		if images.Internal != nil {
+			fmt.Printf("  Internal:     %s\n", images.Internal.Path())
+		}
+		if images.External != nil {
+			fmt.Printf("  SmartMedia:   %s\n", images.External.Path())
+		}
+	} else if t, ok := port.(transport); ok {
+		fmt.Printf("\nBridge:\n")
+		fmt.Printf("  Device:       %s\n", t.Device())
+		if version != nil {
+			fmt.Printf("  Firmware:     v%s\n", version)
+			fmt.Printf("  Features:     %s\n", caps)
+			fmt.Printf("  Baud rate:    %d\n", baud)
+		} else {
+			fmt.Printf("  Firmware:     none (native parallel port)\n")
+		}
+	}
 
 	fmt.Printf("\nStorage:\n")
 	fmt.Printf("  Active:       %s\n", pmp.GetCurrentStorage())
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"time"
 
-	"github.com/murdinc/pmp300/pkg/arduino"
 	"github.com/murdinc/pmp300/pkg/pmp300"
 	"github.com/spf13/cobra"
 )
@@ -36,23 +35,16 @@ func init() {
 }
 
 func runList(cmd *cobra.Command, args []string) error {
-	device, err := getDevice()
-	if err != nil {
-		return err
-	}
+	ctx := cmd.Context()
 
-	fmt.Printf("Connecting to %s...\n", device)
-
-	port, err := arduino.Open(device)
+	pmp, port, err := openPMP(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to open Arduino: %w", err)
+		return err
 	}
 	defer port.Close()
 
-	pmp := pmp300.New(port)
-
 	fmt.Println("Initializing PMP300...")
-	if err := pmp.Initialize(); err != nil {
+	if err := pmp.InitializeContext(ctx); err != nil {
 		return fmt.Errorf("initialization failed: %w", err)
 	}
 
@@ -62,7 +54,7 @@ func runList(cmd *cobra.Command, args []string) error {
 	}
 
 	fmt.Printf("Reading file list from %s...\n", pmp.GetCurrentStorage())
-	files, err := pmp.ListFiles()
+	files, err := pmp.ListFilesContext(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to list files: %w", err)
 	}
@@ -79,7 +71,10 @@ func runList(cmd *cobra.Command, args []string) error {
 	if tagsFlag {
 		fmt.Println("Reading ID3 tags...")
 		for i := range files {
-			if err := pmp.ReadFileID3Tags(&files[i]); err != nil {
+			if err := pmp.ReadFileID3TagsContext(ctx, &files[i]); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
 				fmt.Printf("  Warning: Could not read tags for %s: %v\n", files[i].Name, err)
 			}
 		}
@@ -134,7 +129,7 @@ func runList(cmd *cobra.Command, args []string) error {
 
 	// Show device info
 	fmt.Println()
-	info, err := pmp.GetDeviceInfo()
+	info, err := pmp.GetDeviceInfoContext(ctx)
 	if err == nil {
 		// C++ fields: BlocksAvailable=total, BlocksRemaining=free, BlocksUsed=used, BlocksBad=bad
 		usedMB := float64(info.BlocksUsed) * 32.0 / 1024.0
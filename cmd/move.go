@@ -4,8 +4,6 @@ import (
 	"fmt"
 	"strconv"
 
-	"github.com/murdinc/pmp300/pkg/arduino"
-	"github.com/murdinc/pmp300/pkg/pmp300"
 	"github.com/spf13/cobra"
 )
 
@@ -29,6 +27,8 @@ func init() {
 }
 
 func runMove(cmd *cobra.Command, args []string) error {
+	ctx := cmd.Context()
+
 	// Parse positions (convert from 1-based to 0-based)
 	from, err := strconv.Atoi(args[0])
 	if err != nil {
@@ -42,28 +42,19 @@ func runMove(cmd *cobra.Command, args []string) error {
 	}
 	to-- // Convert to 0-based
 
-	device, err := getDevice()
+	pmp, port, err := openPMP(ctx)
 	if err != nil {
 		return err
 	}
-
-	fmt.Printf("Connecting to %s...\n", device)
-
-	port, err := arduino.Open(device)
-	if err != nil {
-		return fmt.Errorf("failed to open Arduino: %w", err)
-	}
 	defer port.Close()
 
-	pmp := pmp300.New(port)
-
 	fmt.Println("Initializing PMP300...")
-	if err := pmp.Initialize(); err != nil {
+	if err := pmp.InitializeContext(ctx); err != nil {
 		return fmt.Errorf("initialization failed: %w", err)
 	}
 
 	// Get current file list to show what we're moving
-	files, err := pmp.ListFiles()
+	files, err := pmp.ListFilesContext(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to list files: %w", err)
 	}
@@ -79,7 +70,7 @@ func runMove(cmd *cobra.Command, args []string) error {
 	fmt.Printf("Moving '%s' from position %d to position %d...\n", fromFile, from+1, to+1)
 
 	// Perform move
-	if err := pmp.MoveFile(from, to); err != nil {
+	if err := pmp.MoveFileContext(ctx, from, to); err != nil {
 		return fmt.Errorf("move failed: %w", err)
 	}
 
@@ -87,7 +78,7 @@ func runMove(cmd *cobra.Command, args []string) error {
 
 	// Show new order
 	fmt.Println("\nNew playback order:")
-	files, _ = pmp.ListFiles()
+	files, _ = pmp.ListFilesContext(ctx)
 	for i, file := range files {
 		marker := ""
 		if i == to {
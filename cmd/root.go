@@ -1,10 +1,16 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
+	"strings"
+	"time"
 
 	"github.com/murdinc/pmp300/pkg/arduino"
+	"github.com/murdinc/pmp300/pkg/parport"
 	"github.com/murdinc/pmp300/pkg/pmp300"
 	"github.com/spf13/cobra"
 )
@@ -12,8 +18,20 @@ import (
 var (
 	deviceFlag   string
 	externalFlag bool
+	recordFlag   string
+	timeoutFlag  time.Duration
+	baudFlag     string
+	waitFlag     bool
+
+	imageFlag      string
+	cardFlag       string
+	blocksFlag     int
+	cardBlocksFlag int
 )
 
+// traceFile is the open --record trace, closed when the command finishes
+var traceFile *os.File
+
 var rootCmd = &cobra.Command{
 	Use:   "pmp300",
 	Short: "CLI tool for Diamond Rio PMP300 MP3 player",
@@ -26,7 +44,20 @@ on modern computers without native parallel ports.`,
 }
 
 func Execute() {
-	if err := rootCmd.Execute(); err != nil {
+	// Ctrl-C cancels the running command, which stops the transfer cleanly
+	// after the current chunk. A second Ctrl-C kills the process.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	err := rootCmd.ExecuteContext(ctx)
+	stop()
+	if traceFile != nil {
+		traceFile.Close()
+	}
+	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
@@ -34,26 +65,25 @@ func Execute() {
 
 func init() {
 	// Global flag for serial device
-	rootCmd.PersistentFlags().StringVarP(&deviceFlag, "device", "d", "", "Serial device (e.g., /dev/cu.usbmodem14201)")
+	rootCmd.PersistentFlags().StringVarP(&deviceFlag, "device", "d", "", "Serial device (e.g., /dev/cu.usbmodem14201), parport:///dev/parport0 or a serve-bridge address (tcp://host:7300)")
 	rootCmd.PersistentFlags().BoolVar(&externalFlag, "external", false, "Use external storage for operations")
+	rootCmd.PersistentFlags().StringVar(&recordFlag, "record", "", "Record all bridge serial traffic to a trace file (replay with --device replay://FILE)")
+	rootCmd.PersistentFlags().DurationVar(&timeoutFlag, "timeout", arduino.DEFAULT_TIMEOUT, "Longest wait for a response from the bridge")
+	rootCmd.PersistentFlags().BoolVar(&waitFlag, "wait", false, "Wait for other pmp300 commands using the device to finish instead of failing")
+	rootCmd.PersistentFlags().StringVar(&baudFlag, "baud", "", "Bridge baud rate: a rate, \"max\" to find the fastest that works, or empty for the rate remembered for the bridge")
+	rootCmd.PersistentFlags().StringVar(&imageFlag, "image", "", "Work on an internal flash image file instead of the player (created if missing)")
+	rootCmd.PersistentFlags().StringVar(&cardFlag, "card", "", "Work on a SmartMedia image file instead of the player (created if missing)")
+	rootCmd.PersistentFlags().IntVar(&blocksFlag, "blocks", 0, "Size of a new --image in 32KB blocks: 1024 or 2048 (default 1024)")
+	rootCmd.PersistentFlags().IntVar(&cardBlocksFlag, "card-blocks", 0, "Size of a new --card image in 32KB blocks")
 }
 
-// getInitializedPMPDevice returns an initialized PMP300 device with storage set and the opened Arduino port
-func getInitializedPMPDevice() (*pmp300.Device, *arduino.Port, error) {
-	devPath, err := getDevice()
+// getInitializedPMPDevice returns an initialized PMP300 device with storage set and the opened backend
+func getInitializedPMPDevice(ctx context.Context) (*pmp300.Device, io.Closer, error) {
+	pmp, port, err := openPMP(ctx)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	fmt.Printf("Connecting to %s...\n", devPath)
-
-	port, err := arduino.Open(devPath)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to open Arduino: %w", err)
-	}
-
-	pmp := pmp300.New(port)
-
 	if externalFlag {
 		fmt.Println("Switching to external storage...")
 		if err := pmp.SwitchStorage(pmp300.StorageExternal); err != nil {
@@ -61,7 +91,7 @@ func getInitializedPMPDevice() (*pmp300.Device, *arduino.Port, error) {
 			return nil, nil, fmt.Errorf("failed to switch to external storage: %w", err)
 		}
 		// Call CheckPresent here to populate d.externalBlockCount
-		_, _, err := pmp.CheckPresent()
+		_, _, err := pmp.CheckPresentContext(ctx)
 		if err != nil {
 			port.Close()
 			return nil, nil, fmt.Errorf("failed to detect device after switching to external storage: %w", err)
@@ -74,7 +104,7 @@ func getInitializedPMPDevice() (*pmp300.Device, *arduino.Port, error) {
 			return nil, nil, fmt.Errorf("failed to switch to internal storage: %w", err)
 		}
 		// For internal, also call CheckPresent to set d.specialEdition if applicable
-		_, _, err := pmp.CheckPresent()
+		_, _, err := pmp.CheckPresentContext(ctx)
 		if err != nil {
 			port.Close()
 			return nil, nil, fmt.Errorf("failed to detect device after switching to internal storage: %w", err)
@@ -82,7 +112,7 @@ func getInitializedPMPDevice() (*pmp300.Device, *arduino.Port, error) {
 	}
 
 	fmt.Println("Initializing PMP300...")
-	if err := pmp.Initialize(); err != nil {
+	if err := pmp.InitializeContext(ctx); err != nil {
 		port.Close() // Close port on initialization failure
 		return nil, nil, fmt.Errorf("initialization failed: %w", err)
 	}
@@ -90,8 +120,82 @@ func getInitializedPMPDevice() (*pmp300.Device, *arduino.Port, error) {
 	return pmp, port, nil
 }
 
-// getDevice returns the device path, checking environment variable if not set
-func getDevice() (string, error) {
+// openPMP opens the image files named by --image and --card, or else the
+// bridge, and returns the device with the backend to close
+func openPMP(ctx context.Context) (*pmp300.Device, io.Closer, error) {
+	if imageFlag != "" || cardFlag != "" {
+		images, err := openImages()
+		if err != nil {
+			return nil, nil, err
+		}
+		return pmp300.NewFromBlockDevice(images), images, nil
+	}
+
+	device, err := getDevice(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fmt.Printf("Connecting to %s...\n", device)
+
+	port, err := openTransport(ctx, device)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pmp300.New(port), port, nil
+}
+
+// openImages opens --image as internal flash and --card as the SmartMedia
+// card. Missing files are created with --blocks (default 1024) and
+// --card-blocks; existing ones keep their size.
+func openImages() (*pmp300.Images, error) {
+	if blocksFlag != 0 && blocksFlag != pmp300.BLOCKS_INTERNAL && blocksFlag != pmp300.BLOCKS_INTERNAL_SE {
+		return nil, fmt.Errorf("--blocks must be %d or %d", pmp300.BLOCKS_INTERNAL, pmp300.BLOCKS_INTERNAL_SE)
+	}
+
+	images := &pmp300.Images{}
+	if imageFlag != "" {
+		blocks := 0
+		if _, err := os.Stat(imageFlag); os.IsNotExist(err) {
+			blocks = blocksFlag
+			if blocks == 0 {
+				blocks = pmp300.BLOCKS_INTERNAL
+			}
+		}
+		img, err := pmp300.OpenImage(imageFlag, blocks)
+		if err != nil {
+			return nil, err
+		}
+		if img.Blocks() != pmp300.BLOCKS_INTERNAL && img.Blocks() != pmp300.BLOCKS_INTERNAL_SE {
+			img.Close()
+			return nil, fmt.Errorf("internal flash image must have %d or %d blocks, %s has %d", pmp300.BLOCKS_INTERNAL, pmp300.BLOCKS_INTERNAL_SE, imageFlag, img.Blocks())
+		}
+		fmt.Printf("Opened internal flash image %s (%d blocks)\n", imageFlag, img.Blocks())
+		images.Internal = img
+	}
+	if cardFlag != "" {
+		blocks := 0
+		if _, err := os.Stat(cardFlag); os.IsNotExist(err) {
+			if cardBlocksFlag == 0 {
+				images.Close()
+				return nil, fmt.Errorf("SmartMedia image %s does not exist; give --card-blocks to create it", cardFlag)
+			}
+			blocks = cardBlocksFlag
+		}
+		img, err := pmp300.OpenImage(cardFlag, blocks)
+		if err != nil {
+			images.Close()
+			return nil, err
+		}
+		fmt.Printf("Opened SmartMedia image %s (%d blocks)\n", cardFlag, img.Blocks())
+		images.External = img
+	}
+	return images, nil
+}
+
+// getDevice returns the device path, checking environment variable if not set.
+// Without either it auto-selects the bridge if exactly one is connected.
+func getDevice(ctx context.Context) (string, error) {
 	if deviceFlag != "" {
 		return deviceFlag, nil
 	}
@@ -101,5 +205,76 @@ func getDevice() (string, error) {
 		return dev, nil
 	}
 
-	return "", fmt.Errorf("device not specified. Use --device flag or set PMP300_DEVICE environment variable")
+	ports, err := arduino.Discover(ctx)
+	if err != nil {
+		return "", fmt.Errorf("device not specified and auto-discovery failed: %w", err)
+	}
+	bridges := arduino.Bridges(ports)
+	switch len(bridges) {
+	case 0:
+		return "", fmt.Errorf("device not specified and no bridge found. Use --device flag or set PMP300_DEVICE environment variable")
+	case 1:
+		if bridges[0].Version != nil {
+			fmt.Printf("Found bridge v%s on %s\n", bridges[0].Version, bridges[0].Device)
+		} else {
+			fmt.Printf("Found bridge on %s\n", bridges[0].Device)
+		}
+		return bridges[0].Device, nil
+	}
+	var names []string
+	for _, b := range bridges {
+		names = append(names, b.Device)
+	}
+	return "", fmt.Errorf("device not specified and %d bridges found (%s). Use --device flag or set PMP300_DEVICE environment variable", len(bridges), strings.Join(names, ", "))
+}
+
+// transport is an opened device backend: the Arduino bridge or a native parallel port
+type transport interface {
+	pmp300.Transport
+	Close() error
+	Device() string
+}
+
+// openTransport opens the backend named by a device address.
+// parport:///dev/parport0 selects a native parallel port via ppdev,
+// replay://session.pmptrace replays a --record trace,
+// tcp://host:port and unix:///path connect to a serve-bridge relay;
+// anything else is a serial device running the bridge firmware.
+func openTransport(ctx context.Context, device string) (transport, error) {
+	if path, ok := strings.CutPrefix(device, "parport://"); ok {
+		port, err := parport.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open parallel port: %w", err)
+		}
+		return port, nil
+	}
+
+	if path, ok := strings.CutPrefix(device, "replay://"); ok {
+		port, err := arduino.OpenReplay(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open replay: %w", err)
+		}
+		return port, nil
+	}
+
+	// The bridge keeps the rate of the last session until it is reset
+	opts := arduino.Options{Timeout: timeoutFlag, Wait: waitFlag, Baud: loadBauds()[bridgeKey(device)]}
+	if recordFlag != "" {
+		f, err := os.Create(recordFlag)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create trace file: %w", err)
+		}
+		traceFile = f
+		opts.Trace = f
+	}
+
+	port, err := arduino.OpenWithOptionsContext(ctx, device, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open Arduino: %w", err)
+	}
+	if err := applyBaud(ctx, port); err != nil {
+		port.Close()
+		return nil, err
+	}
+	return port, nil
 }
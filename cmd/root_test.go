@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/murdinc/pmp300/pkg/pmp300"
+)
+
+// setImageFlags sets the image flags for a test
+func setImageFlags(t *testing.T, image, card string, blocks, cardBlocks int) {
+	t.Helper()
+	imageFlag, cardFlag, blocksFlag, cardBlocksFlag = image, card, blocks, cardBlocks
+	t.Cleanup(func() {
+		imageFlag, cardFlag, blocksFlag, cardBlocksFlag = "", "", 0, 0
+	})
+}
+
+// TestOpenImages checks how --image and --card open and create images
+func TestOpenImages(t *testing.T) {
+	dir := t.TempDir()
+	rio := filepath.Join(dir, "rio.img")
+	card := filepath.Join(dir, "card.img")
+	small := filepath.Join(dir, "small.img")
+	if err := os.WriteFile(small, make([]byte, 4*pmp300.BLOCK_SIZE), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name               string
+		image, card        string
+		blocks, cardBlocks int
+		internal, external int    // Blocks of the images opened, 0 for none
+		err                string // Part of the error, if the open fails
+	}{
+		{name: "new internal image", image: rio, internal: pmp300.BLOCKS_INTERNAL},
+		{name: "existing internal image", image: rio, blocks: pmp300.BLOCKS_INTERNAL_SE, internal: pmp300.BLOCKS_INTERNAL},
+		{name: "missing card", card: card, err: "--card-blocks"},
+		{name: "new card", card: card, cardBlocks: 256, external: 256},
+		{name: "both", image: rio, card: card, internal: pmp300.BLOCKS_INTERNAL, external: 256},
+		{name: "new SE image", image: filepath.Join(dir, "se.img"), blocks: pmp300.BLOCKS_INTERNAL_SE, internal: pmp300.BLOCKS_INTERNAL_SE},
+		{name: "bad block count", image: filepath.Join(dir, "bad.img"), blocks: 100, err: "--blocks"},
+		{name: "internal image of a card's size", image: small, err: "internal flash image"},
+		{name: "missing card with an image", image: rio, card: filepath.Join(dir, "none.img"), err: "--card-blocks"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			setImageFlags(t, tc.image, tc.card, tc.blocks, tc.cardBlocks)
+			images, err := openImages()
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Errorf("error %v, want one about %s", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer images.Close()
+			for _, img := range []struct {
+				name   string
+				image  *pmp300.Image
+				blocks int
+			}{
+				{"internal", images.Internal, tc.internal},
+				{"external", images.External, tc.external},
+			} {
+				switch {
+				case img.blocks == 0 && img.image != nil:
+					t.Errorf("%s image opened", img.name)
+				case img.blocks != 0 && img.image == nil:
+					t.Errorf("no %s image", img.name)
+				case img.image != nil && img.image.Blocks() != img.blocks:
+					t.Errorf("%s image has %d blocks, want %d", img.name, img.image.Blocks(), img.blocks)
+				}
+			}
+		})
+	}
+
+	// A failed open creates no card image
+	if _, err := os.Stat(filepath.Join(dir, "none.img")); !os.IsNotExist(err) {
+		t.Errorf("missing card image was created: %v", err)
+	}
+}
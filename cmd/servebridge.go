@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/murdinc/pmp300/pkg/arduino"
+	"github.com/spf13/cobra"
+)
+
+var listenFlag string
+
+var serveBridgeCmd = &cobra.Command{
+	Use:   "serve-bridge",
+	Short: "Share the bridge with other machines over TCP or a Unix socket",
+	Long: `Open the local bridge's serial port and relay the bridge protocol to
+network clients, so the PMP300 can be managed from other machines. Clients
+use the listen address as their device:
+
+  pmp300 list --device tcp://bench:7300
+  pmp300 list --device unix:///run/pmp300.sock
+
+One client is served at a time; others are refused until it disconnects.
+The serial port stays open between clients, so the board is not reset.
+The relay is not authenticated or encrypted: listen on trusted networks
+only, or on a Unix socket.
+
+Examples:
+  pmp300 serve-bridge
+  pmp300 serve-bridge --listen 127.0.0.1:7300
+  pmp300 serve-bridge --listen unix:///run/pmp300.sock --device /dev/ttyACM0`,
+	RunE: runServeBridge,
+}
+
+func init() {
+	rootCmd.AddCommand(serveBridgeCmd)
+	serveBridgeCmd.Flags().StringVar(&listenFlag, "listen", fmt.Sprintf(":%d", arduino.RELAY_PORT), "Address to listen on: host:port, tcp://host:port or unix:///path")
+}
+
+func runServeBridge(cmd *cobra.Command, args []string) error {
+	ctx := cmd.Context()
+
+	device, err := getDevice(ctx)
+	if err != nil {
+		return err
+	}
+	if _, _, ok := arduino.RelayAddress(device); ok || strings.Contains(device, "://") {
+		return fmt.Errorf("serve-bridge needs a local serial device, not %s", device)
+	}
+
+	network, address, ok := arduino.RelayAddress(listenFlag)
+	if !ok {
+		network, address = "tcp", listenFlag
+	}
+	if network == "unix" {
+		removeStaleSocket(address)
+	}
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	defer l.Close()
+
+	srv, err := arduino.NewRelayServer(ctx, device, waitFlag)
+	if err != nil {
+		return fmt.Errorf("failed to open Arduino: %w", err)
+	}
+	defer srv.Close()
+	srv.Logf = func(format string, args ...any) {
+		fmt.Printf("[%s] %s\n", time.Now().Format("15:04:05"), fmt.Sprintf(format, args...))
+	}
+
+	fmt.Printf("Serving bridge %s on %s://%s\n", device, network, l.Addr())
+	fmt.Println("Press Ctrl-C to stop.")
+	return srv.Serve(ctx, l)
+}
+
+// removeStaleSocket removes a Unix socket left behind by a server that did
+// not shut down. A socket that still accepts connections is left alone, so
+// the listen fails.
+func removeStaleSocket(path string) {
+	fi, err := os.Stat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return
+	}
+	os.Remove(path)
+}
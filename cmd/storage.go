@@ -3,7 +3,6 @@ package cmd
 import (
 	"fmt"
 
-	"github.com/murdinc/pmp300/pkg/arduino"
 	"github.com/murdinc/pmp300/pkg/pmp300"
 	"github.com/spf13/cobra"
 )
@@ -28,30 +27,22 @@ var storageListCmd = &cobra.Command{
 	RunE:  runStorageList,
 }
 
-
 func init() {
 	rootCmd.AddCommand(storageCmd)
 	storageCmd.AddCommand(storageListCmd)
 }
 
 func runStorageList(cmd *cobra.Command, args []string) error {
-	device, err := getDevice()
-	if err != nil {
-		return err
-	}
+	ctx := cmd.Context()
 
-	fmt.Printf("Connecting to %s...\n", device)
-
-	port, err := arduino.Open(device)
+	pmp, port, err := openPMP(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to open Arduino: %w", err)
+		return err
 	}
 	defer port.Close()
 
-	pmp := pmp300.New(port)
-
 	fmt.Println("Initializing PMP300...")
-	if err := pmp.Initialize(); err != nil {
+	if err := pmp.InitializeContext(ctx); err != nil {
 		return fmt.Errorf("initialization failed: %w", err)
 	}
 
@@ -65,7 +56,7 @@ func runStorageList(cmd *cobra.Command, args []string) error {
 		pmp.SwitchStorage(pmp300.StorageInternal)
 	}
 
-	internalInfo, internalErr := pmp.GetDeviceInfo()
+	internalInfo, internalErr := pmp.GetDeviceInfoContext(ctx)
 	if internalErr == nil {
 		totalMB := float64(internalInfo.BlocksAvailable) * 32.0 / 1024.0
 		usedMB := float64(internalInfo.BlocksUsed) * 32.0 / 1024.0
@@ -76,11 +67,11 @@ func runStorageList(cmd *cobra.Command, args []string) error {
 
 	// Try to detect external SmartMedia
 	fmt.Println("\nChecking external SmartMedia...")
-	hasExternal, _ := pmp.DetectExternalStorage()
+	hasExternal, _ := pmp.DetectExternalStorageContext(ctx)
 
 	if hasExternal {
 		pmp.SwitchStorage(pmp300.StorageExternal)
-		externalInfo, externalErr := pmp.GetDeviceInfo()
+		externalInfo, externalErr := pmp.GetDeviceInfoContext(ctx)
 		if externalErr == nil {
 			totalMB := float64(externalInfo.BlocksAvailable) * 32.0 / 1024.0
 			usedMB := float64(externalInfo.BlocksUsed) * 32.0 / 1024.0
@@ -99,4 +90,3 @@ func runStorageList(cmd *cobra.Command, args []string) error {
 
 	return nil
 }
-
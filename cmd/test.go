@@ -28,34 +28,42 @@ func init() {
 }
 
 func runTest(cmd *cobra.Command, args []string) error {
-	device, err := getDevice()
+	ctx := cmd.Context()
+
+	device, err := getDevice(ctx)
 	if err != nil {
 		return err
 	}
 
-	fmt.Printf("Connecting to Arduino on %s...\n", device)
+	fmt.Printf("Connecting to %s...\n", device)
 
-	port, err := arduino.Open(device)
+	port, err := openTransport(ctx, device)
 	if err != nil {
-		return fmt.Errorf("failed to open Arduino: %w", err)
+		return err
 	}
 	defer port.Close()
 
-	fmt.Println("✓ Arduino connected")
-
-	// Get firmware version
-	version, err := port.GetVersion()
-	if err != nil {
-		return fmt.Errorf("failed to get version: %w", err)
+	if ap, ok := port.(*arduino.Port); ok {
+		fmt.Println("✓ Arduino connected")
+
+		// Get firmware version
+		version, err := ap.GetVersion()
+		if err != nil {
+			return fmt.Errorf("failed to get version: %w", err)
+		}
+		fmt.Printf("✓ Firmware version: %s\n", version)
+		fmt.Printf("✓ Capabilities: %s\n", ap.Capabilities())
+		fmt.Printf("✓ Baud rate: %d\n", ap.Baud())
+
+		// Test ping
+		fmt.Print("Testing ping... ")
+		if err := ap.Ping(); err != nil {
+			return fmt.Errorf("ping failed: %w", err)
+		}
+		fmt.Println("OK")
+	} else {
+		fmt.Println("✓ Parallel port claimed")
 	}
-	fmt.Printf("✓ Firmware version: %s\n", version)
-
-	// Test ping
-	fmt.Print("Testing ping... ")
-	if err := port.Ping(); err != nil {
-		return fmt.Errorf("ping failed: %w", err)
-	}
-	fmt.Println("OK")
 
 	// Test basic I/O
 	fmt.Print("Testing control register write... ")
@@ -74,7 +82,7 @@ func runTest(cmd *cobra.Command, args []string) error {
 	// Initialize PMP300
 	fmt.Println("\nInitializing PMP300...")
 	pmp := pmp300.New(port)
-	if err := pmp.Initialize(); err != nil {
+	if err := pmp.InitializeContext(ctx); err != nil {
 		return fmt.Errorf("PMP300 initialization failed: %w", err)
 	}
 	fmt.Println("✓ Initialization sequence sent")
@@ -83,7 +91,7 @@ func runTest(cmd *cobra.Command, args []string) error {
 	fmt.Println("\nAttempting to detect PMP300 device...")
 	fmt.Println("(This will fail if no PMP300 is connected - that's OK for testing Arduino)")
 
-	_, err = pmp.GetDeviceInfo()
+	_, err = pmp.GetDeviceInfoContext(ctx)
 	if err != nil {
 		fmt.Printf("\n⚠ Warning: Could not read from PMP300 device\n")
 		fmt.Printf("   Error: %v\n", err)
@@ -6,7 +6,6 @@ import (
 	"path/filepath"
 	"strings"
 
-	"github.com/murdinc/pmp300/pkg/arduino"
 	"github.com/murdinc/pmp300/pkg/pmp300"
 	"github.com/spf13/cobra"
 )
@@ -55,10 +54,7 @@ func validateUploadArgs(cmd *cobra.Command, args []string) error {
 }
 
 func runUpload(cmd *cobra.Command, args []string) error {
-	device, err := getDevice()
-	if err != nil {
-		return err
-	}
+	ctx := cmd.Context()
 
 	var filesToUpload []string
 
@@ -104,23 +100,19 @@ func runUpload(cmd *cobra.Command, args []string) error {
 		}
 	}
 
-	fmt.Printf("Connecting to %s...\n", device)
-
-	port, err := arduino.Open(device)
+	pmp, port, err := openPMP(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to open Arduino: %w", err)
+		return err
 	}
 	defer port.Close()
 
-	pmp := pmp300.New(port)
-
 	if uploadExternalFlag {
 		fmt.Println("Switching to external SmartMedia card...")
 		if err := pmp.SwitchStorage(pmp300.StorageExternal); err != nil {
 			return fmt.Errorf("failed to switch to external storage: %w", err)
 		}
 		// Check if external storage is present and formatted
-		if present, err := pmp.DetectExternalStorage(); err != nil || !present {
+		if present, err := pmp.DetectExternalStorageContext(ctx); err != nil || !present {
 			fmt.Println("No external SmartMedia card detected or card is unreadable.")
 			fmt.Println("Please ensure a SmartMedia card is inserted and properly seated.")
 			return fmt.Errorf("external SmartMedia card not found or unreadable")
@@ -134,7 +126,7 @@ func runUpload(cmd *cobra.Command, args []string) error {
 	}
 
 	fmt.Println("Initializing PMP300...")
-	if err := pmp.Initialize(); err != nil {
+	if err := pmp.InitializeContext(ctx); err != nil {
 		return fmt.Errorf("initialization failed: %w", err)
 	}
 
@@ -156,7 +148,7 @@ func runUpload(cmd *cobra.Command, args []string) error {
 
 		// Upload with progress
 		var lastProgress int
-		err = pmp.UploadFile(filepath.Base(filePath), data, func(current, total int) {
+		err = pmp.UploadFileContext(ctx, filepath.Base(filePath), data, func(current, total int) {
 			percent := (current * 100) / total
 			if percent != lastProgress {
 				fmt.Printf("\r  Progress: %d%%", percent)
@@ -166,6 +158,9 @@ func runUpload(cmd *cobra.Command, args []string) error {
 
 		if err != nil {
 			fmt.Printf("\n  ✗ Upload failed: %v\n", err)
+			if ctx.Err() != nil {
+				return fmt.Errorf("upload interrupted: %w", ctx.Err())
+			}
 			continue
 		}
 
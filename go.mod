@@ -5,11 +5,11 @@ go 1.21
 require (
 	github.com/spf13/cobra v1.8.0
 	go.bug.st/serial v1.6.4
+	golang.org/x/sys v0.19.0
 )
 
 require (
 	github.com/creack/goselect v0.1.2 // indirect
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
-	golang.org/x/sys v0.19.0 // indirect
 )
@@ -1,7 +1,11 @@
 package arduino
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"time"
 
 	"go.bug.st/serial"
@@ -17,7 +21,41 @@ const (
 	CMD_DELAY_MS        = 'M'
 	CMD_COMMANDOUT      = 'c' // Optimized COMMANDOUT(data, ctrl1, ctrl2)
 	CMD_READ_NIBBLE_BLK = 'n'
-	CMD_WRITE_PMP_CHUNK = 'w' // Write 528 bytes with PMP300 control toggling
+	CMD_WRITE_PMP_CHUNK = 'w'  // Write 528 bytes with PMP300 control toggling
+	CMD_FRAMING         = 'F'  // Select framing mode (firmware 3.x)
+	CMD_READ_BLOCK      = 'B'  // Read a whole 32KB block (firmware 3.1)
+	CMD_WRITE_BLOCK     = 'b'  // Write a whole 32KB block (firmware 3.1)
+	CMD_ABORT           = 0x18 // Stop a running stream or delay (ASCII CAN, firmware 3.2)
+)
+
+// Response timing
+const (
+	DEFAULT_TIMEOUT = 10 * time.Second       // Longest wait for a response byte
+	READ_POLL       = 100 * time.Millisecond // Serial read timeout, how often contexts are checked
+	DRAIN_QUIET     = 200 * time.Millisecond // Silence that ends a drain after an abort
+)
+
+// Block command geometry - must match Arduino firmware
+const (
+	BLOCK_SIZE   = 32768 // Bytes returned by ReadBlock
+	CHUNK_SIZE   = 528   // 512 data bytes plus the 16-byte end block
+	BLOCK_CHUNKS = 64    // Chunks sent by WriteBlock
+
+	// WRITE_BLOCK_PIECE is what WriteBlock sends on each RESP_READY: a
+	// chunk followed by its CRC-16
+	WRITE_BLOCK_PIECE = CHUNK_SIZE + 2
+)
+
+// First firmware version with the block commands
+const (
+	BLOCK_MIN_MAJOR = 3
+	BLOCK_MIN_MINOR = 1
+)
+
+// First firmware version that paces WriteBlock with RESP_READY
+const (
+	BLOCK_READY_MIN_MAJOR = 3
+	BLOCK_READY_MIN_MINOR = 8
 )
 
 // Response bytes
@@ -27,12 +65,63 @@ const (
 	RESP_ERROR   = 'E'
 	RESP_PONG    = 'P'
 	RESP_VERSION = 'I'
+	RESP_READY   = 0x11 // WriteBlock: send the next chunk (ASCII DC1, firmware 3.8)
 )
 
 // Port represents connection to Arduino USB-Parallel bridge
 type Port struct {
-	port   serial.Port
+	port   serialPort
 	device string
+	lock   *Lock // Held while the serial device is open
+
+	version *Version     // Firmware version, once queried
+	caps    Capabilities // Firmware capabilities, once negotiated
+	framed  bool         // Framed mode negotiated
+	seq     byte         // Sequence number of the last framed command
+	unread  []byte       // Response bytes read ahead, returned by readFull first
+
+	baud       int           // Line rate
+	timeout    time.Duration // Longest wait for a response byte
+	window     int           // Pipeline window in bytes
+	inflight   []*call       // Submitted commands awaiting responses
+	needResync bool          // The link broke; Resync before the next command
+
+	stats   map[byte]*CommandStats // Link statistics by command
+	resyncs int
+}
+
+// serialPort is the part of serial.Port used by Port
+type serialPort interface {
+	io.ReadWriteCloser
+	ResetInputBuffer() error
+	ResetOutputBuffer() error
+	SetMode(mode *serial.Mode) error
+}
+
+// Options configures how a Port is opened
+type Options struct {
+	// Trace receives a record of all serial traffic (see OpenReplay)
+	Trace io.Writer
+
+	// Unframed keeps the 2.x protocol even if the firmware supports framing
+	Unframed bool
+
+	// Window bounds the command bytes queued in the bridge by Submit calls
+	// (default PIPELINE_WINDOW, 1 disables pipelining)
+	Window int
+
+	// Timeout is the longest wait for a response byte (default
+	// DEFAULT_TIMEOUT). Contexts can set shorter deadlines per call.
+	Timeout time.Duration
+
+	// Wait blocks until another process using the device closes it,
+	// instead of failing with a *LockError
+	Wait bool
+
+	// Baud is the rate the bridge was left at by the last session, tried
+	// before DEFAULT_BAUD. Close keeps the bridge at its rate. Relay
+	// clients always start at DEFAULT_BAUD.
+	Baud int
 }
 
 // Version contains firmware version information
@@ -46,48 +135,151 @@ func (v Version) String() string {
 	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
 }
 
+// AtLeast reports whether v is min or newer
+func (v Version) AtLeast(min Version) bool {
+	if v.Major != min.Major {
+		return v.Major > min.Major
+	}
+	if v.Minor != min.Minor {
+		return v.Minor > min.Minor
+	}
+	return v.Patch >= min.Patch
+}
+
 // Open opens connection to Arduino on specified serial device
 func Open(device string) (*Port, error) {
-	mode := &serial.Mode{
-		BaudRate: 115200,
-		DataBits: 8,
-		Parity:   serial.NoParity,
-		StopBits: serial.OneStopBit,
-	}
+	return OpenWithOptions(device, Options{})
+}
 
-	port, err := serial.Open(device, mode)
+// OpenWithOptions opens connection to Arduino on specified serial device.
+// A tcp://host:port or unix:///path address connects to a bridge shared
+// with serve-bridge instead (see RelayServer). A serial device is locked
+// while it is open; if another process has it open, OpenWithOptions fails
+// with a *LockError unless opts.Wait is set.
+func OpenWithOptions(device string, opts Options) (*Port, error) {
+	return OpenWithOptionsContext(context.Background(), device, opts)
+}
+
+// OpenWithOptionsContext is OpenWithOptions with a context, which bounds
+// the wait for the lock and for the bridge to start
+func OpenWithOptionsContext(ctx context.Context, device string, opts Options) (*Port, error) {
+	ap := newPort(device, opts)
+
+	var port serialPort
+	var err error
+	if network, address, ok := RelayAddress(device); ok {
+		// The server returns the bridge to DEFAULT_BAUD between clients
+		opts.Baud = 0
+		port, err = dialRelay(network, address, ap.timeout)
+	} else {
+		if ap.lock, err = LockDevice(ctx, device, opts.Wait); err != nil {
+			return nil, err
+		}
+		port, err = openSerial(device)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to open serial port: %w", err)
+		ap.lock.Unlock()
+		return nil, err
 	}
-
-	if err = port.SetReadTimeout(10 * time.Second); err != nil {
-		port.Close()
-		return nil, fmt.Errorf("failed to set read timeout: %w", err)
+	if err := ap.start(ctx, port, opts); err != nil {
+		return nil, err
 	}
+	return ap, nil
+}
 
-	ap := &Port{port: port, device: device}
+// newPort returns a Port for device with the defaults of opts filled in
+func newPort(device string, opts Options) *Port {
+	ap := &Port{device: device, baud: DEFAULT_BAUD, window: opts.Window, timeout: opts.Timeout}
+	if ap.window <= 0 {
+		ap.window = PIPELINE_WINDOW
+	}
+	if ap.timeout <= 0 {
+		ap.timeout = DEFAULT_TIMEOUT
+	}
+	return ap
+}
 
-	// Wait for Arduino to reset
-	time.Sleep(2 * time.Second)
+// start talks to the bridge on a freshly opened port: it waits until the
+// bridge answers and negotiates the protocol. The port is closed if that
+// fails.
+func (p *Port) start(ctx context.Context, port serialPort, opts Options) error {
+	p.port = port
+	if opts.Trace != nil {
+		rec, err := newRecorder(port, opts.Trace, p.device)
+		if err != nil {
+			p.closePort()
+			return err
+		}
+		p.port = rec
+	}
 
-	// Flush buffers and test connection
+	// Flush buffers and wait for a bridge that was reset by the open
 	port.ResetInputBuffer()
 	port.ResetOutputBuffer()
 
-	if err := ap.Ping(); err != nil {
-		port.Close()
-		return nil, fmt.Errorf("ping failed: %w", err)
+	// A bridge left at a faster rate answers a ping there at once
+	if opts.Baud == 0 || opts.Baud == DEFAULT_BAUD || p.tryBaud(ctx, opts.Baud) != nil {
+		if err := p.waitReady(ctx); err != nil {
+			if !errors.Is(err, ErrNoDevice) && !errors.Is(err, ErrDesync) {
+				p.closePort()
+				return err
+			}
+			if p.recoverBaud(ctx) != nil {
+				p.closePort()
+				return err
+			}
+		}
 	}
 
-	return ap, nil
+	if err := p.negotiate(!opts.Unframed); err != nil {
+		p.closePort()
+		return err
+	}
+	return nil
+}
+
+// openSerial opens a serial device at DEFAULT_BAUD with READ_POLL reads
+func openSerial(device string) (serial.Port, error) {
+	// Best effort: without it every open resets the board, which only costs
+	// time
+	keepDTR(device)
+
+	port, err := serial.Open(device, serialMode(DEFAULT_BAUD))
+	if err != nil {
+		var perr *serial.PortError
+		if errors.Is(err, fs.ErrNotExist) || (errors.As(err, &perr) && perr.Code() == serial.PortNotFound) {
+			return nil, fmt.Errorf("%w: %s: %v", ErrNoDevice, device, err)
+		}
+		return nil, fmt.Errorf("failed to open serial port: %w", err)
+	}
+
+	if err = port.SetReadTimeout(READ_POLL); err != nil {
+		port.Close()
+		return nil, fmt.Errorf("failed to set read timeout: %w", err)
+	}
+	return port, nil
 }
 
-// Close closes the serial port
+// Close closes the serial port. A framed bridge is switched back to the
+// 2.x protocol first, for boards that do not reset when the port is
+// opened. The bridge keeps its rate, which the next session finds with
+// Options.Baud or by trying each rate.
 func (p *Port) Close() error {
-	if p.port != nil {
-		return p.port.Close()
+	if p.port == nil {
+		return nil
 	}
-	return nil
+	p.Flush()
+	if p.framed {
+		p.Framing(FRAMING_RAW)
+	}
+	return p.closePort()
+}
+
+// closePort closes the serial port and releases its lock
+func (p *Port) closePort() error {
+	err := p.port.Close()
+	p.lock.Unlock()
+	return err
 }
 
 // Device returns the serial device path
@@ -95,156 +287,264 @@ func (p *Port) Device() string {
 	return p.device
 }
 
-// Ping tests connection
+// Ping tests connection. It fails with ErrNoDevice if the bridge does not
+// answer and ErrDesync if it answers with anything but a pong.
 func (p *Port) Ping() error {
+	return p.PingContext(context.Background())
+}
+
+// PingContext is Ping with a context
+func (p *Port) PingContext(ctx context.Context) error {
+	if p.framed {
+		if _, err := p.exchange(ctx, []byte{CMD_PING}, RESP_PONG, 0); err != nil {
+			return fmt.Errorf("ping failed: %w", err)
+		}
+		return nil
+	}
+	if err := p.FlushContext(ctx); err != nil {
+		return err
+	}
+	if p.needResync {
+		return p.Resync(ctx)
+	}
+	return p.ping(ctx, 0)
+}
+
+// ping sends an unframed ping, skipping up to strays other bytes before the
+// pong
+func (p *Port) ping(ctx context.Context, strays int) error {
+	c := &call{req: []byte{CMD_PING}, want: RESP_PONG, size: 1}
+	p.countSent(c)
+	c.err = p.pingPong(ctx, strays)
+	p.countDone(c)
+	return c.err
+}
+
+// pingPong runs an unframed ping
+func (p *Port) pingPong(ctx context.Context, strays int) error {
 	if _, err := p.port.Write([]byte{CMD_PING}); err != nil {
 		return err
 	}
 	resp := make([]byte, 1)
-	if n, err := p.port.Read(resp); err != nil || n != 1 || resp[0] != RESP_PONG {
-		return fmt.Errorf("ping failed")
+	for i := 0; i <= strays; i++ {
+		if _, err := p.readFull(ctx, resp); err != nil {
+			return fmt.Errorf("ping failed: %w", err)
+		}
+		if resp[0] == RESP_PONG {
+			return nil
+		}
 	}
-	return nil
+	return fmt.Errorf("ping failed: %w: answered 0x%02X", ErrDesync, resp[0])
 }
 
 // GetVersion returns firmware version
 func (p *Port) GetVersion() (*Version, error) {
-	if _, err := p.port.Write([]byte{CMD_VERSION}); err != nil {
-		return nil, err
-	}
-	resp := make([]byte, 4)
-	if _, err := p.readFull(resp); err != nil {
+	return p.GetVersionContext(context.Background())
+}
+
+// GetVersionContext is GetVersion with a context
+func (p *Port) GetVersionContext(ctx context.Context) (*Version, error) {
+	resp, err := p.exchange(ctx, []byte{CMD_VERSION}, RESP_VERSION, 3)
+	if err != nil {
 		return nil, err
 	}
-	if resp[0] != RESP_VERSION {
-		return nil, fmt.Errorf("invalid version response")
-	}
-	return &Version{Major: resp[1], Minor: resp[2], Patch: resp[3]}, nil
+	p.version = &Version{Major: resp[0], Minor: resp[1], Patch: resp[2]}
+	return p.version, nil
 }
 
 // OutByte writes a byte to data (offset=0) or control (offset=2) register
 func (p *Port) OutByte(offset uint16, value byte) error {
-	var cmd byte
-	if offset == 0 {
-		cmd = CMD_WRITE_DATA
-	} else if offset == 2 {
-		cmd = CMD_WRITE_CTRL
-	} else {
-		return fmt.Errorf("invalid offset: %d", offset)
-	}
+	return p.OutByteContext(context.Background(), offset, value)
+}
 
-	if _, err := p.port.Write([]byte{cmd, value}); err != nil {
-		return err
-	}
-	return p.waitOK()
+// OutByteContext is OutByte with a context
+func (p *Port) OutByteContext(ctx context.Context, offset uint16, value byte) error {
+	return p.SubmitOutByteContext(ctx, offset, value)()
 }
 
 // InByte reads status register (offset must be 1)
 func (p *Port) InByte(offset uint16) (byte, error) {
-	if offset != 1 {
-		return 0, fmt.Errorf("invalid offset: %d", offset)
-	}
-	if _, err := p.port.Write([]byte{CMD_READ_STATUS}); err != nil {
-		return 0, err
-	}
-	resp := make([]byte, 2)
-	if _, err := p.readFull(resp); err != nil {
-		return 0, err
-	}
-	if resp[0] != RESP_VALUE {
-		return 0, fmt.Errorf("invalid status response")
-	}
-	return resp[1], nil
+	return p.InByteContext(context.Background(), offset)
+}
+
+// InByteContext is InByte with a context
+func (p *Port) InByteContext(ctx context.Context, offset uint16) (byte, error) {
+	return p.SubmitInByteContext(ctx, offset)()
 }
 
 // DelayMilliseconds delays for specified milliseconds
 func (p *Port) DelayMilliseconds(ms uint16) error {
-	if _, err := p.port.Write([]byte{CMD_DELAY_MS, byte(ms >> 8), byte(ms & 0xFF)}); err != nil {
-		return err
-	}
-	return p.waitOK()
+	return p.DelayMillisecondsContext(context.Background(), ms)
+}
+
+// DelayMillisecondsContext is DelayMilliseconds with a context. Firmware
+// 3.2 cuts the delay short when the context is cancelled.
+func (p *Port) DelayMillisecondsContext(ctx context.Context, ms uint16) error {
+	return p.SubmitDelayMillisecondsContext(ctx, ms)()
 }
 
 // CommandOut executes COMMANDOUT(data, ctrl1, ctrl2) in one USB round-trip
 // This is the optimized version - replaces 3 round-trips with 1
 func (p *Port) CommandOut(data, ctrl1, ctrl2 byte) error {
-	if _, err := p.port.Write([]byte{CMD_COMMANDOUT, data, ctrl1, ctrl2}); err != nil {
-		return err
-	}
-	return p.waitOK()
+	return p.CommandOutContext(context.Background(), data, ctrl1, ctrl2)
+}
+
+// CommandOutContext is CommandOut with a context
+func (p *Port) CommandOutContext(ctx context.Context, data, ctrl1, ctrl2 byte) error {
+	return p.SubmitCommandOutContext(ctx, data, ctrl1, ctrl2)()
 }
 
 // ReadNibbleBlock reads multiple bytes using PMP300 nibble protocol
 func (p *Port) ReadNibbleBlock(count uint16) ([]byte, error) {
-	if _, err := p.port.Write([]byte{CMD_READ_NIBBLE_BLK, byte(count >> 8), byte(count & 0xFF)}); err != nil {
-		return nil, err
-	}
-
-	// Wait for OK
-	if err := p.waitOK(); err != nil {
-		return nil, err
-	}
+	return p.ReadNibbleBlockContext(context.Background(), count)
+}
 
-	// Read data
-	data := make([]byte, count)
-	if _, err := p.readFull(data); err != nil {
-		return nil, err
-	}
-	return data, nil
+// ReadNibbleBlockContext is ReadNibbleBlock with a context. Firmware 3.2
+// stops streaming when the context is cancelled.
+func (p *Port) ReadNibbleBlockContext(ctx context.Context, count uint16) ([]byte, error) {
+	return p.SubmitReadNibbleBlockContext(ctx, count)()
 }
 
 // WritePMPChunk writes 528 bytes (512 data + 16 end block) with PMP300 control toggling
 // This is highly optimized - sends all data in one USB transfer, Arduino handles control toggling
 func (p *Port) WritePMPChunk(data []byte) error {
-	if len(data) != 528 {
-		return fmt.Errorf("chunk must be exactly 528 bytes, got %d", len(data))
+	return p.WritePMPChunkContext(context.Background(), data)
+}
+
+// WritePMPChunkContext is WritePMPChunk with a context. A chunk that was
+// sent is always written completely.
+func (p *Port) WritePMPChunkContext(ctx context.Context, data []byte) error {
+	return p.SubmitWritePMPChunkContext(ctx, data)()
+}
+
+// HasBlockCommands reports whether the firmware has ReadBlock and WriteBlock.
+// Firmware 3.1 to 3.7 has both, but its WriteBlock takes the whole stream
+// unpaced and overruns its receive buffer while the PMP300 acknowledges a
+// chunk, so the block commands are only used from firmware 3.8.
+func (p *Port) HasBlockCommands() bool {
+	return p.caps.Has(CAP_BLOCK | CAP_BLOCK_READY)
+}
+
+// ReadBlock reads the 32KB block at a 24-bit page address. The bridge runs
+// the whole sequence: io intro, 0xA0, the address handshakes and the outro.
+func (p *Port) ReadBlock(addr uint32) ([]byte, error) {
+	return p.ReadBlockContext(context.Background(), addr)
+}
+
+// ReadBlockContext is ReadBlock with a context. Firmware 3.2 stops
+// streaming and deselects the PMP300 when the context is cancelled.
+func (p *Port) ReadBlockContext(ctx context.Context, addr uint32) ([]byte, error) {
+	if !p.caps.Has(CAP_BLOCK) {
+		return nil, fmt.Errorf("%w: block commands need firmware %d.%d or newer; reflash with pmp300 flash", ErrOldFirmware, BLOCK_MIN_MAJOR, BLOCK_MIN_MINOR)
 	}
+	return p.exchange(ctx, []byte{CMD_READ_BLOCK, byte(addr >> 16), byte(addr >> 8), byte(addr)}, RESP_OK, BLOCK_SIZE)
+}
 
-	// Send command followed by all 528 bytes
-	buf := make([]byte, 1+528)
-	buf[0] = CMD_WRITE_PMP_CHUNK
-	copy(buf[1:], data)
+// WriteBlock writes a 32KB block at a 24-bit page address. chunks holds
+// BLOCK_CHUNKS chunks of CHUNK_SIZE bytes, as WritePMPChunk takes them. The
+// bridge runs the whole 0xAB sequence including every handshake and checks
+// each chunk's CRC before the PMP300 completes it. It asks for every chunk
+// with RESP_READY, so no more than one chunk is ever on its way.
+func (p *Port) WriteBlock(addr uint32, chunks []byte) error {
+	return p.WriteBlockContext(context.Background(), addr, chunks)
+}
 
-	if _, err := p.port.Write(buf); err != nil {
-		return err
+// WriteBlockContext is WriteBlock with a context. A block that was sent is
+// always written completely; cancelling only stops the wait for its status.
+func (p *Port) WriteBlockContext(ctx context.Context, addr uint32, chunks []byte) error {
+	if !p.HasBlockCommands() {
+		return fmt.Errorf("%w: block writes need firmware %d.%d or newer; reflash with pmp300 flash", ErrOldFirmware, BLOCK_READY_MIN_MAJOR, BLOCK_READY_MIN_MINOR)
 	}
-	return p.waitOK()
+	if len(chunks) != BLOCK_CHUNKS*CHUNK_SIZE {
+		return fmt.Errorf("block must be exactly %d bytes, got %d", BLOCK_CHUNKS*CHUNK_SIZE, len(chunks))
+	}
+
+	pieces := make([][]byte, BLOCK_CHUNKS)
+	for i := range pieces {
+		chunk := chunks[i*CHUNK_SIZE : (i+1)*CHUNK_SIZE]
+		crc := UpdateCRC16(CRC16_INIT, chunk...)
+		pieces[i] = append(append(make([]byte, 0, WRITE_BLOCK_PIECE), chunk...), byte(crc>>8), byte(crc))
+	}
+
+	req := []byte{CMD_WRITE_BLOCK, byte(addr >> 16), byte(addr >> 8), byte(addr)}
+	_, err := p.wait(ctx, p.submitPaced(ctx, req, pieces, RESP_OK, 0))
+	return err
 }
 
 // GetNibbleByte reads one byte using nibble protocol (for single bytes, uses block command)
 func (p *Port) GetNibbleByte() (byte, error) {
-	data, err := p.ReadNibbleBlock(1)
+	return p.GetNibbleByteContext(context.Background())
+}
+
+// GetNibbleByteContext is GetNibbleByte with a context
+func (p *Port) GetNibbleByteContext(ctx context.Context) (byte, error) {
+	data, err := p.ReadNibbleBlockContext(ctx, 1)
 	if err != nil {
 		return 0, err
 	}
 	return data[0], nil
 }
 
-// Helper: wait for OK response
-func (p *Port) waitOK() error {
-	resp := make([]byte, 1)
-	if _, err := p.readFull(resp); err != nil {
-		return err
-	}
-	if resp[0] == RESP_ERROR {
-		errCode := make([]byte, 1)
-		p.port.Read(errCode)
-		return fmt.Errorf("arduino error: 0x%02X", errCode[0])
+// Helper: send a command and wait for its response. The response must start
+// with want, followed by n bytes which are returned.
+func (p *Port) exchange(ctx context.Context, req []byte, want byte, n int) ([]byte, error) {
+	return p.wait(ctx, p.submit(ctx, req, want, n))
+}
+
+// Helper: check the leading response byte, rest holds an error code
+func checkResponse(got, want byte, rest []byte) error {
+	if got == RESP_ERROR && want != RESP_ERROR {
+		var code byte
+		if len(rest) > 0 {
+			code = rest[0]
+		}
+		return &BridgeError{Code: code}
 	}
-	if resp[0] != RESP_OK {
-		return fmt.Errorf("expected OK, got 0x%02X", resp[0])
+	if got != want {
+		return fmt.Errorf("%w: expected %s, got 0x%02X", ErrDesync, responseNames[want], got)
 	}
 	return nil
 }
 
-// Helper: read exactly len(buf) bytes
-func (p *Port) readFull(buf []byte) (int, error) {
-	total := 0
+// Response names used in errors
+var responseNames = map[byte]string{
+	RESP_OK:      "OK",
+	RESP_VALUE:   "value",
+	RESP_ERROR:   "error",
+	RESP_PONG:    "pong",
+	RESP_VERSION: "version",
+
+	RESP_CAPABILITIES: "capabilities",
+}
+
+// Helper: read exactly len(buf) bytes. The serial port returns empty reads
+// every READ_POLL, when the context is checked; after p.timeout without a
+// byte the read times out. Counting polls rather than wall time keeps
+// replayed traces deterministic. A timeout before the first byte is
+// ErrNoDevice, one after it ErrDesync.
+func (p *Port) readFull(ctx context.Context, buf []byte) (int, error) {
+	total := copy(buf, p.unread)
+	p.unread = p.unread[total:]
+	var idle time.Duration
 	for total < len(buf) {
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
 		n, err := p.port.Read(buf[total:])
 		if err != nil {
 			return total, err
 		}
+		if n == 0 {
+			idle += READ_POLL
+			if idle >= p.timeout {
+				if total == 0 {
+					return total, fmt.Errorf("%w: no response within %v", ErrNoDevice, p.timeout)
+				}
+				return total, fmt.Errorf("%w: read timeout after %d of %d bytes", ErrDesync, total, len(buf))
+			}
+			continue
+		}
+		idle = 0
 		total += n
 	}
 	return total, nil
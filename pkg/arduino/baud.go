@@ -0,0 +1,280 @@
+package arduino
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// Baud rate switch (firmware 3.4):
+//
+//	'U' <baud_3> <baud_2> <baud_1> <baud_0> -> 'K'
+//
+// The 'K' is sent at the old rate, then both sides switch. The host
+// confirms with an unframed CMD_PING at the new rate, which the bridge
+// answers with an unframed RESP_PONG. A bridge that sees no ping within
+// BAUD_CONFIRM returns to the old rate. Unsupported rates are refused with
+// ERR_BAUD. The bridge starts at DEFAULT_BAUD after every reset and keeps
+// a rate it switched to until then, across sessions.
+const CMD_SET_BAUD = 'U'
+
+// ERR_BAUD refuses a rate the firmware does not support
+const ERR_BAUD = 0x08
+
+// DEFAULT_BAUD is the rate the firmware starts with
+const DEFAULT_BAUD = 115200
+
+// BAUD_CONFIRM is how long the bridge waits for the confirmation ping
+const BAUD_CONFIRM = time.Second
+
+// BAUD_VERIFY is how many capability queries are pipelined to check a new
+// rate. Their responses are compared, so corruption shows even unframed.
+const BAUD_VERIFY = 32
+
+// First firmware version with CMD_SET_BAUD
+const (
+	BAUD_MIN_MAJOR = 3
+	BAUD_MIN_MINOR = 4
+)
+
+// BAUD_RATES are the rates the firmware accepts, fastest first. All are
+// exact divisions of the 16 MHz clock, except 115200. The 16U2 USB chip of
+// the Uno and Mega keeps up with all of them; CH340 clones may not.
+var BAUD_RATES = []int{2000000, 1000000, 500000, 250000, DEFAULT_BAUD}
+
+// ErrBaudRate means a rate switch failed but the link works: the bridge
+// refused the rate or the link was unstable at it, and the port fell back
+// to a working rate (see Port.Baud).
+var ErrBaudRate = errors.New("bridge: baud rate not usable")
+
+// ParseBaud parses a baud rate, which must be one of BAUD_RATES
+func ParseBaud(s string) (int, error) {
+	rate, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || !slices.Contains(BAUD_RATES, rate) {
+		return 0, fmt.Errorf("unsupported baud rate %q (supported: %s)", s, baudList())
+	}
+	return rate, nil
+}
+
+// baudList formats BAUD_RATES for messages
+func baudList() string {
+	names := make([]string, len(BAUD_RATES))
+	for i, rate := range BAUD_RATES {
+		names[i] = strconv.Itoa(rate)
+	}
+	return strings.Join(names, ", ")
+}
+
+// Baud returns the current line rate
+func (p *Port) Baud() int {
+	return p.baud
+}
+
+// SetBaud switches bridge and port to rate and checks the link with a burst
+// of pipelined queries. If the switch fails the port falls back to a rate
+// that works, normally the old one, and returns an error matching
+// ErrBaudRate. Other errors mean the bridge was lost. It needs firmware 3.4.
+func (p *Port) SetBaud(rate int) error {
+	return p.SetBaudContext(context.Background(), rate)
+}
+
+// SetBaudContext is SetBaud with a context
+func (p *Port) SetBaudContext(ctx context.Context, rate int) error {
+	if rate == p.baud {
+		return nil
+	}
+	if !slices.Contains(BAUD_RATES, rate) {
+		return fmt.Errorf("unsupported baud rate %d (supported: %s)", rate, baudList())
+	}
+	if !p.caps.Has(CAP_BAUD) {
+		return fmt.Errorf("%w: baud rate switching needs firmware %d.%d or newer; reflash with pmp300 flash", ErrOldFirmware, BAUD_MIN_MAJOR, BAUD_MIN_MINOR)
+	}
+	if err := p.FlushContext(ctx); err != nil {
+		return err
+	}
+
+	old := p.baud
+	err := p.switchBaud(ctx, rate)
+	if err == nil {
+		if err = p.verifyBaud(ctx); err == nil {
+			return nil
+		}
+		// The bridge took the rate but the link is unstable at it
+		if p.switchBaud(ctx, old) == nil {
+			return fmt.Errorf("%w: link unstable at %d baud: %v", ErrBaudRate, rate, err)
+		}
+	}
+	var berr *BridgeError
+	if errors.As(err, &berr) && berr.Code == ERR_BAUD {
+		if p.needResync {
+			if rerr := p.Resync(ctx); rerr != nil {
+				return rerr
+			}
+		}
+		return fmt.Errorf("%w: bridge refused %d baud", ErrBaudRate, rate)
+	}
+
+	// Where the bridge ended up depends on which bytes got through
+	if serr := p.settleBaud(ctx, old, rate); serr != nil {
+		return serr
+	}
+	return fmt.Errorf("%w: %d baud failed, using %d: %v", ErrBaudRate, rate, p.baud, err)
+}
+
+// switchBaud runs the CMD_SET_BAUD handshake. p.baud is only changed once
+// the bridge confirmed the new rate.
+func (p *Port) switchBaud(ctx context.Context, rate int) error {
+	req := []byte{CMD_SET_BAUD, byte(rate >> 24), byte(rate >> 16), byte(rate >> 8), byte(rate)}
+	if _, err := p.exchange(ctx, req, RESP_OK, 0); err != nil {
+		return err
+	}
+	if err := p.setMode(rate); err != nil {
+		return err
+	}
+	p.port.ResetInputBuffer()
+
+	saved := p.timeout
+	p.timeout = BAUD_CONFIRM
+	defer func() { p.timeout = saved }()
+	if err := p.ping(ctx, 0); err != nil {
+		p.needResync = true
+		return err
+	}
+	p.baud = rate
+	return nil
+}
+
+// verifyBaud pipelines BAUD_VERIFY capability queries and checks that
+// every response matches the negotiated capabilities
+func (p *Port) verifyBaud(ctx context.Context) error {
+	calls := make([]*call, BAUD_VERIFY)
+	for i := range calls {
+		calls[i] = p.submit(ctx, []byte{CMD_CAPABILITIES}, RESP_CAPABILITIES, 6)
+	}
+	want := []byte{
+		byte(p.caps.Features >> 8), byte(p.caps.Features),
+		byte(p.caps.MaxNibbleBlock >> 8), byte(p.caps.MaxNibbleBlock),
+		byte(p.caps.BufferSize >> 8), byte(p.caps.BufferSize),
+	}
+	for _, c := range calls {
+		resp, err := p.wait(ctx, c)
+		if err != nil {
+			return err
+		}
+		if string(resp) != string(want) {
+			p.needResync = true
+			return fmt.Errorf("%w: corrupted response % X", ErrDesync, resp)
+		}
+	}
+	return nil
+}
+
+// settleBaud finds the rate of a bridge after a failed switch. A bridge
+// that missed the confirmation ping returns to the old rate on its own,
+// one whose pong got lost keeps the new rate. Each rate is tried with a
+// short timeout once the bridge's confirmation wait is over. Cancelling the
+// wait leaves the port at the old rate, resynchronized by the next call.
+func (p *Port) settleBaud(ctx context.Context, rates ...int) error {
+	select {
+	case <-ctx.Done():
+		// The bridge most likely returns to the old rate
+		p.setMode(rates[0])
+		p.baud = rates[0]
+		p.needResync = true
+		return ctx.Err()
+	case <-time.After(BAUD_CONFIRM):
+	}
+
+	saved := p.timeout
+	p.timeout = BAUD_CONFIRM
+	defer func() { p.timeout = saved }()
+	var err error
+	for _, rate := range rates {
+		if err = p.setMode(rate); err != nil {
+			return err
+		}
+		p.baud = rate
+		p.port.ResetInputBuffer()
+		if err = p.Resync(ctx); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("bridge lost while switching baud rate, replug it: %w", err)
+}
+
+// tryBaud pings the bridge at rate, where the last session may have left
+// it. The port returns to DEFAULT_BAUD if the bridge does not answer.
+func (p *Port) tryBaud(ctx context.Context, rate int) error {
+	if err := p.setMode(rate); err != nil {
+		return err
+	}
+	saved := p.timeout
+	p.timeout = BAUD_CONFIRM
+	defer func() { p.timeout = saved }()
+	p.port.ResetInputBuffer()
+	if err := p.pingPong(ctx, 0); err != nil {
+		p.setMode(DEFAULT_BAUD)
+		p.port.ResetInputBuffer()
+		return err
+	}
+	p.baud = rate
+	return nil
+}
+
+// recoverBaud looks for a bridge left at a higher rate by an earlier
+// session, trying every rate with the framing reset of waitReady and a
+// ping. The port stays at the rate that answers.
+func (p *Port) recoverBaud(ctx context.Context) error {
+	saved := p.timeout
+	p.timeout = BAUD_CONFIRM
+	defer func() { p.timeout = saved }()
+	for _, rate := range BAUD_RATES {
+		if rate == DEFAULT_BAUD {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := p.setMode(rate); err != nil {
+			return err
+		}
+		p.port.ResetInputBuffer()
+		if _, err := p.port.Write(AppendFrame(nil, 0, []byte{CMD_FRAMING, FRAMING_RAW})); err != nil {
+			return err
+		}
+		if err := p.drain(); err != nil {
+			continue
+		}
+		p.port.ResetInputBuffer()
+		if p.ping(ctx, 0) == nil {
+			p.baud = rate
+			return nil
+		}
+	}
+	p.setMode(DEFAULT_BAUD)
+	return fmt.Errorf("%w: no answer at any baud rate", ErrNoDevice)
+}
+
+// setMode changes the line rate of the serial port
+func (p *Port) setMode(rate int) error {
+	if err := p.port.SetMode(serialMode(rate)); err != nil {
+		return fmt.Errorf("failed to set %d baud: %w", rate, err)
+	}
+	return nil
+}
+
+// serialMode returns the 8N1 line settings of the bridge at rate
+func serialMode(rate int) *serial.Mode {
+	return &serial.Mode{
+		BaudRate: rate,
+		DataBits: 8,
+		Parity:   serial.NoParity,
+		StopBits: serial.OneStopBit,
+	}
+}
@@ -0,0 +1,153 @@
+package arduino_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/murdinc/pmp300/pkg/arduino"
+	"github.com/murdinc/pmp300/pkg/bridgesim"
+)
+
+// TestParseBaud checks that only the firmware's rates are accepted
+func TestParseBaud(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		rate int
+	}{
+		{"115200", 115200},
+		{" 2000000\n", 2000000},
+		{"250000", 250000},
+		{"9600", 0},
+		{"fast", 0},
+		{"", 0},
+	} {
+		rate, err := arduino.ParseBaud(tc.s)
+		if rate != tc.rate || (err == nil) != (tc.rate != 0) {
+			t.Errorf("ParseBaud(%q) = %d, %v", tc.s, rate, err)
+		}
+	}
+}
+
+// checkBaud checks that host and bridge are at rate and the link works
+func checkBaud(t *testing.T, port *arduino.Port, sim *bridgesim.Simulator, rate int) {
+	t.Helper()
+	if port.Baud() != rate || sim.Baud() != rate {
+		t.Errorf("host at %d baud, bridge at %d, want %d", port.Baud(), sim.Baud(), rate)
+	}
+	if err := port.Ping(); err != nil {
+		t.Errorf("ping at %d baud: %v", port.Baud(), err)
+	}
+}
+
+// TestSetBaud switches to a faster rate and back
+func TestSetBaud(t *testing.T) {
+	for _, unframed := range []bool{false, true} {
+		sim := newSim(t)
+		port := openSim(t, newSimLink(t, sim, true), arduino.Options{Unframed: unframed})
+		defer port.Close()
+
+		if err := port.SetBaud(1000000); err != nil {
+			t.Fatalf("unframed %v: %v", unframed, err)
+		}
+		checkBaud(t, port, sim, 1000000)
+		if err := port.SetBaud(arduino.DEFAULT_BAUD); err != nil {
+			t.Fatalf("unframed %v: back to the default: %v", unframed, err)
+		}
+		checkBaud(t, port, sim, arduino.DEFAULT_BAUD)
+	}
+}
+
+// TestSetBaudRefused checks the fallback when the firmware refuses 'U'
+func TestSetBaudRefused(t *testing.T) {
+	sim := newSim(t)
+	sim.Rates = []int{arduino.DEFAULT_BAUD, 250000}
+	port := openSim(t, newSimLink(t, sim, true), arduino.Options{})
+	defer port.Close()
+
+	err := port.SetBaud(2000000)
+	if !errors.Is(err, arduino.ErrBaudRate) {
+		t.Fatalf("refused rate: %v, want ErrBaudRate", err)
+	}
+	checkBaud(t, port, sim, arduino.DEFAULT_BAUD)
+	if err := port.SetBaud(250000); err != nil {
+		t.Fatal(err)
+	}
+	checkBaud(t, port, sim, 250000)
+}
+
+// TestSetBaudUnusable switches to a rate the USB chip cannot carry: the
+// confirmation is lost, and host and bridge settle back at the old rate
+func TestSetBaudUnusable(t *testing.T) {
+	sim := newSim(t)
+	sim.MaxBaud = 500000
+	port := openSim(t, newSimLink(t, sim, true), arduino.Options{})
+	defer port.Close()
+
+	err := port.SetBaud(2000000)
+	if !errors.Is(err, arduino.ErrBaudRate) {
+		t.Fatalf("unusable rate: %v, want ErrBaudRate", err)
+	}
+	checkBaud(t, port, sim, arduino.DEFAULT_BAUD)
+}
+
+// TestSetBaudCancel checks that cancelling stops the wait for a bridge
+// whose switch failed
+func TestSetBaudCancel(t *testing.T) {
+	sim := newSim(t)
+	sim.MaxBaud = 500000
+	port := openSim(t, newSimLink(t, sim, true), arduino.Options{})
+	defer port.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(arduino.BAUD_CONFIRM+arduino.BAUD_CONFIRM/2, cancel)
+	start := time.Now()
+	err := port.SetBaudContext(ctx, 2000000)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled switch: %v, want cancelled", err)
+	}
+	if d := time.Since(start); d > 2*arduino.BAUD_CONFIRM {
+		t.Errorf("cancelled switch returned after %v", d)
+	}
+}
+
+// TestBaudKept closes a port at a faster rate. The bridge stays there; the
+// next session finds it by trying each rate, or at once given the rate.
+func TestBaudKept(t *testing.T) {
+	sim := newSim(t)
+	link := newSimLink(t, sim, true)
+	port := openSim(t, link, arduino.Options{})
+	if err := port.SetBaud(500000); err != nil {
+		t.Fatal(err)
+	}
+	if err := port.Close(); err != nil {
+		t.Fatal(err)
+	}
+	<-link.done
+	if sim.Baud() != 500000 {
+		t.Fatalf("bridge at %d baud after close, want 500000", sim.Baud())
+	}
+
+	link = newSimLink(t, sim, false)
+	port = openSim(t, link, arduino.Options{})
+	checkBaud(t, port, sim, 500000)
+	port.Close()
+	<-link.done
+
+	start := time.Now()
+	link = newSimLink(t, sim, false)
+	port = openSim(t, link, arduino.Options{Baud: 500000})
+	if d := time.Since(start); d > arduino.BAUD_CONFIRM {
+		t.Errorf("open at the rate the bridge was left at took %v", d)
+	}
+	checkBaud(t, port, sim, 500000)
+	port.Close()
+	<-link.done
+
+	// A reset bridge is back at the default rate
+	link = newSimLink(t, sim, true)
+	port = openSim(t, link, arduino.Options{Baud: 500000})
+	defer port.Close()
+	checkBaud(t, port, sim, arduino.DEFAULT_BAUD)
+}
@@ -0,0 +1,70 @@
+package arduino_test
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/murdinc/pmp300/pkg/arduino"
+	"github.com/murdinc/pmp300/pkg/pmp300"
+)
+
+// unchecked is a port whose nibble reads are taken to be unchecked, like
+// those of firmware 3.1 to 3.4
+type unchecked struct {
+	*arduino.Port
+}
+
+func (unchecked) HasNibbleCheck() bool {
+	return false
+}
+
+// TestBlockReadGlitches downloads a file over status lines that glitch.
+// Checked nibble reads catch the glitches and re-read the spans; the block
+// read, which has no check, passes them on. This is why block reads are
+// only used without checked reads.
+func TestBlockReadGlitches(t *testing.T) {
+	data := make([]byte, 3*pmp300.BLOCK_SIZE)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	sim := newSim(t)
+	link := newSimLink(t, sim, true)
+	port := openSim(t, link, arduino.Options{})
+	upload(t, port, data)
+	port.Close()
+	<-link.done
+
+	sim.GlitchRate = 1e-4
+	port = openSim(t, newSimLink(t, sim, true), arduino.Options{})
+	defer port.Close()
+
+	pmp := pmp300.New(port)
+	if err := pmp.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := pmp.DownloadFile("song.mp3", nil)
+	if err != nil {
+		t.Fatalf("checked download: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("checked download differs from the upload")
+	}
+	if s := pmp.TransferStats(); s.CorruptSpans == 0 {
+		t.Error("no corrupted spans were caught: the glitches did not happen")
+	}
+	if calls := port.Stats().Command("READ_BLOCK").Calls; calls != 0 {
+		t.Errorf("%d block reads with checked nibble reads available", calls)
+	}
+
+	pmp = pmp300.New(unchecked{port})
+	if err := pmp.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	got, err = pmp.DownloadFile("song.mp3", nil)
+	if port.Stats().Command("READ_BLOCK").Calls == 0 {
+		t.Fatal("block reads were not used without checked nibble reads")
+	}
+	if err == nil && bytes.Equal(got, data) {
+		t.Error("block reads passed on no glitch")
+	}
+}
@@ -0,0 +1,167 @@
+package arduino
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Capability query (firmware 3.3):
+//
+//	'Q' -> 'Q' <features_hi> <features_lo> <max_nibble_hi> <max_nibble_lo>
+//	         <rx_buffer_hi> <rx_buffer_lo>
+//
+// Older firmware does not know 'Q'; its capabilities follow from its
+// version.
+const (
+	CMD_CAPABILITIES  = 'Q'
+	RESP_CAPABILITIES = 'Q'
+)
+
+// Feature bits of the capability query
+const (
+	CAP_COMMANDOUT   = 1 << 0  // 'c' COMMANDOUT (firmware 2.0)
+	CAP_NIBBLE_BLOCK = 1 << 1  // 'n' nibble block reads (firmware 2.0)
+	CAP_PMP_CHUNK    = 1 << 2  // 'w' chunk writes (firmware 2.0)
+	CAP_FRAMING      = 1 << 3  // 'F' framed mode (firmware 3.0)
+	CAP_BLOCK        = 1 << 4  // 'B' and 'b' block commands (firmware 3.1)
+	CAP_ABORT        = 1 << 5  // CMD_ABORT (firmware 3.2)
+	CAP_BAUD         = 1 << 6  // 'U' baud rate switch (firmware 3.4)
+	CAP_NIBBLE_CHECK = 1 << 7  // 'N' checked nibble reads (firmware 3.5)
+	CAP_WAIT_STATUS  = 1 << 8  // 'H' status wait (firmware 3.6)
+	CAP_DELAY_US     = 1 << 9  // 'D' microsecond delay (firmware 3.7)
+	CAP_DATA_DIR     = 1 << 10 // 'S' data direction (firmware 3.7)
+	CAP_BLOCK_READY  = 1 << 11 // 'b' asks for each chunk with RESP_READY (firmware 3.8)
+)
+
+// REQUIRED_CAPS are the features the host cannot work without. Firmware
+// lacking any of them is refused when the port is opened.
+const REQUIRED_CAPS = CAP_COMMANDOUT | CAP_NIBBLE_BLOCK | CAP_PMP_CHUNK
+
+// First firmware version with the capability query
+const (
+	CAPS_MIN_MAJOR = 3
+	CAPS_MIN_MINOR = 3
+)
+
+// First firmware version with CMD_ABORT
+const (
+	ABORT_MIN_MAJOR = 3
+	ABORT_MIN_MINOR = 2
+)
+
+// MAX_NIBBLE_BLOCK is the largest ReadNibbleBlock count of firmware without
+// the capability query. 0xFFFF does not fit a response frame.
+const MAX_NIBBLE_BLOCK = 0xFFFE
+
+// Feature names, in bit order
+var capabilityNames = []string{"commandout", "nibble-block", "pmp-chunk", "framing", "block", "abort", "baud", "nibble-check", "wait-status", "delay-us", "data-dir", "block-ready"}
+
+// Capabilities describes what the firmware supports
+type Capabilities struct {
+	Features       uint16 // CAP_* bits
+	MaxNibbleBlock int    // Largest ReadNibbleBlock count
+	BufferSize     int    // Serial receive buffer in bytes
+}
+
+// Has reports whether all features in mask are supported
+func (c Capabilities) Has(mask uint16) bool {
+	return c.Features&mask == mask
+}
+
+func (c Capabilities) String() string {
+	return featureNames(c.Features)
+}
+
+// featureNames lists the names of the features in mask
+func featureNames(mask uint16) string {
+	var names []string
+	for i, name := range capabilityNames {
+		if mask&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	if mask>>len(capabilityNames) != 0 {
+		names = append(names, fmt.Sprintf("0x%04X", mask>>len(capabilityNames)<<len(capabilityNames)))
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ", ")
+}
+
+// versionCapabilities returns the capabilities of firmware without the
+// capability query
+func versionCapabilities(v Version) Capabilities {
+	c := Capabilities{MaxNibbleBlock: MAX_NIBBLE_BLOCK, BufferSize: PIPELINE_WINDOW}
+	if v.Major >= 2 {
+		c.Features |= CAP_COMMANDOUT | CAP_NIBBLE_BLOCK | CAP_PMP_CHUNK
+	}
+	if v.Major >= FRAMING_MIN_MAJOR {
+		c.Features |= CAP_FRAMING
+	}
+	if v.AtLeast(Version{Major: BLOCK_MIN_MAJOR, Minor: BLOCK_MIN_MINOR}) {
+		c.Features |= CAP_BLOCK
+	}
+	if v.AtLeast(Version{Major: ABORT_MIN_MAJOR, Minor: ABORT_MIN_MINOR}) {
+		c.Features |= CAP_ABORT
+	}
+	return c
+}
+
+// Capabilities returns the capabilities negotiated when the port was opened
+func (p *Port) Capabilities() Capabilities {
+	return p.caps
+}
+
+// MaxNibbleBlock returns the largest count ReadNibbleBlock accepts
+func (p *Port) MaxNibbleBlock() int {
+	if p.HasNibbleCheck() {
+		return min(p.caps.MaxNibbleBlock, MAX_CHECKED_NIBBLE_BLOCK)
+	}
+	return p.caps.MaxNibbleBlock
+}
+
+// QueryCapabilities sends the capability query. It needs firmware 3.3.
+func (p *Port) QueryCapabilities() (Capabilities, error) {
+	return p.QueryCapabilitiesContext(context.Background())
+}
+
+// QueryCapabilitiesContext is QueryCapabilities with a context
+func (p *Port) QueryCapabilitiesContext(ctx context.Context) (Capabilities, error) {
+	resp, err := p.exchange(ctx, []byte{CMD_CAPABILITIES}, RESP_CAPABILITIES, 6)
+	if err != nil {
+		return Capabilities{}, fmt.Errorf("failed to query capabilities: %w", err)
+	}
+	return Capabilities{
+		Features:       uint16(resp[0])<<8 | uint16(resp[1]),
+		MaxNibbleBlock: int(resp[2])<<8 | int(resp[3]),
+		BufferSize:     int(resp[4])<<8 | int(resp[5]),
+	}, nil
+}
+
+// loadCapabilities queries or infers the capabilities of the firmware
+// version in p.version, refuses firmware lacking REQUIRED_CAPS and bounds
+// the pipeline window by the bridge's receive buffer
+func (p *Port) loadCapabilities(ctx context.Context, query bool) error {
+	caps := versionCapabilities(*p.version)
+	if query {
+		var err error
+		if caps, err = p.QueryCapabilitiesContext(ctx); err != nil {
+			return err
+		}
+	}
+	if missing := REQUIRED_CAPS &^ caps.Features; missing != 0 {
+		return &FirmwareError{Version: *p.version, Missing: missing}
+	}
+	p.caps = caps
+	if caps.BufferSize > 0 && caps.BufferSize < p.window {
+		p.window = caps.BufferSize
+	}
+	return nil
+}
+
+// hasQuery reports whether firmware v answers the capability query
+func hasQuery(v Version) bool {
+	return v.AtLeast(Version{Major: CAPS_MIN_MAJOR, Minor: CAPS_MIN_MINOR})
+}
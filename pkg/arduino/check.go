@@ -0,0 +1,133 @@
+package arduino
+
+import (
+	"context"
+	"fmt"
+)
+
+// Checked nibble read (firmware 3.5):
+//
+//	'N' <skip_hi> <skip_lo> <count_hi> <count_lo>
+//	    -> 'K' (<span data> <crc_hi> <crc_lo>)...
+//
+// Like 'n', but every NIBBLE_CHECK_SPAN bytes, and the last shorter span,
+// are followed by their CRC-16. The bridge samples every nibble twice and
+// inverts the CRC of a span whose samples differed, so glitches on the
+// status lines show as well as corruption on the serial line. skip bytes
+// are clocked out of the PMP300 and dropped first, to re-read a span in the
+// middle of a block.
+const CMD_READ_NIBBLE_CHK = 'N'
+
+// NIBBLE_CHECK_SPAN is the number of bytes covered by one check
+const NIBBLE_CHECK_SPAN = 512
+
+// MAX_CHECKED_NIBBLE_BLOCK is the largest count of a checked read whose
+// response, checks included, fits a frame
+const MAX_CHECKED_NIBBLE_BLOCK = 0xFE00
+
+// First firmware version with CMD_READ_NIBBLE_CHK
+const (
+	NIBBLE_CHECK_MIN_MAJOR = 3
+	NIBBLE_CHECK_MIN_MINOR = 5
+)
+
+// ChecksumError is returned with the data of a checked nibble read in
+// which some spans failed their check. The other spans are good.
+type ChecksumError struct {
+	Spans []int // Indexes of the corrupted spans, NIBBLE_CHECK_SPAN bytes each
+	Count int   // Bytes read
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("%v: %d of %d spans failed the check (first at byte %d)",
+		ErrChecksum, len(e.Spans), checkSpans(e.Count), e.Spans[0]*NIBBLE_CHECK_SPAN)
+}
+
+// Is matches ErrChecksum
+func (e *ChecksumError) Is(target error) bool {
+	return target == ErrChecksum
+}
+
+// HasNibbleCheck reports whether the firmware has checked nibble reads.
+// ReadNibbleBlock then uses them on its own.
+func (p *Port) HasNibbleCheck() bool {
+	return p.caps.Has(CAP_NIBBLE_CHECK)
+}
+
+// ReadNibbleRange reads count bytes with the nibble protocol after reading
+// and dropping skip bytes, checking every span. Corrupted spans are
+// reported by a *ChecksumError, returned together with the data. It needs
+// firmware 3.5.
+func (p *Port) ReadNibbleRange(skip, count uint16) ([]byte, error) {
+	return p.ReadNibbleRangeContext(context.Background(), skip, count)
+}
+
+// ReadNibbleRangeContext is ReadNibbleRange with a context
+func (p *Port) ReadNibbleRangeContext(ctx context.Context, skip, count uint16) ([]byte, error) {
+	return p.SubmitReadNibbleRangeContext(ctx, skip, count)()
+}
+
+// SubmitReadNibbleRange queues ReadNibbleRange
+func (p *Port) SubmitReadNibbleRange(skip, count uint16) func() ([]byte, error) {
+	return p.SubmitReadNibbleRangeContext(context.Background(), skip, count)
+}
+
+// SubmitReadNibbleRangeContext is SubmitReadNibbleRange with a context
+func (p *Port) SubmitReadNibbleRangeContext(ctx context.Context, skip, count uint16) func() ([]byte, error) {
+	if !p.HasNibbleCheck() {
+		return func() ([]byte, error) {
+			return nil, fmt.Errorf("%w: checked nibble reads need firmware %d.%d or newer; reflash with pmp300 flash", ErrOldFirmware, NIBBLE_CHECK_MIN_MAJOR, NIBBLE_CHECK_MIN_MINOR)
+		}
+	}
+	if int(count) > MAX_CHECKED_NIBBLE_BLOCK {
+		return func() ([]byte, error) {
+			return nil, fmt.Errorf("checked nibble read of %d bytes exceeds %d", count, MAX_CHECKED_NIBBLE_BLOCK)
+		}
+	}
+	req := []byte{CMD_READ_NIBBLE_CHK, byte(skip >> 8), byte(skip), byte(count >> 8), byte(count)}
+	c := p.submit(ctx, req, RESP_OK, int(count)+2*checkSpans(int(count)))
+	return func() ([]byte, error) {
+		resp, err := p.wait(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		return p.verifySpans(req, resp, int(count))
+	}
+}
+
+// verifySpans strips the checks from a checked read's response and
+// compares them with the data
+func (p *Port) verifySpans(req, resp []byte, count int) ([]byte, error) {
+	data := make([]byte, 0, count)
+	var bad []int
+	for span := 0; len(data) < count; span++ {
+		n := min(NIBBLE_CHECK_SPAN, count-len(data))
+		chunk := resp[:n]
+		check := uint16(resp[n])<<8 | uint16(resp[n+1])
+		resp = resp[n+2:]
+		if UpdateCRC16(CRC16_INIT, chunk...) != check {
+			bad = append(bad, span)
+		}
+		data = append(data, chunk...)
+	}
+	if len(bad) > 0 {
+		p.commandStats(req).Corrupt += len(bad)
+		return data, &ChecksumError{Spans: bad, Count: count}
+	}
+	return data, nil
+}
+
+// checkSpans returns the number of checks in a read of count bytes
+func checkSpans(count int) int {
+	return (count + NIBBLE_CHECK_SPAN - 1) / NIBBLE_CHECK_SPAN
+}
+
+// CorruptRanges returns the corrupted byte ranges of the data as [start,
+// end) pairs, for callers that do not import this package
+func (e *ChecksumError) CorruptRanges() [][2]int {
+	ranges := make([][2]int, len(e.Spans))
+	for i, span := range e.Spans {
+		ranges[i] = [2]int{span * NIBBLE_CHECK_SPAN, min((span+1)*NIBBLE_CHECK_SPAN, e.Count)}
+	}
+	return ranges
+}
@@ -0,0 +1,59 @@
+package arduino_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/murdinc/pmp300/pkg/arduino"
+)
+
+// TestReadNibbleRangeCheck corrupts a byte of a checked read on the serial
+// line. The read returns all its data and names the span that failed.
+func TestReadNibbleRangeCheck(t *testing.T) {
+	link := newSimLink(t, newSim(t), true)
+	port := openSim(t, link, arduino.Options{Unframed: true})
+	defer port.Close()
+	port.ResetStats()
+
+	const count = 3*arduino.NIBBLE_CHECK_SPAN - 100
+	clean, err := port.ReadNibbleRange(0, count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clean) != count {
+		t.Fatalf("read %d bytes, want %d", len(clean), count)
+	}
+
+	// Byte 600 is in the second span; 'K' and the first span's data and
+	// check come before it
+	sent := 0
+	link.tamper(nil, func(data []byte) []byte {
+		if at := 1 + arduino.NIBBLE_CHECK_SPAN + 2 + 88 - sent; at >= 0 && at < len(data) {
+			data[at] ^= 0x01
+		}
+		sent += len(data)
+		return data
+	})
+	data, err := port.ReadNibbleRange(0, count)
+	link.tamper(nil, nil)
+
+	var cerr *arduino.ChecksumError
+	if !errors.As(err, &cerr) || !errors.Is(err, arduino.ErrChecksum) {
+		t.Fatalf("corrupted read: %v, want a ChecksumError", err)
+	}
+	if len(cerr.Spans) != 1 || cerr.Spans[0] != 1 || cerr.Count != count {
+		t.Errorf("corrupted spans %v of %d bytes, want [1] of %d", cerr.Spans, cerr.Count, count)
+	}
+	if r := cerr.CorruptRanges(); len(r) != 1 || r[0] != [2]int{arduino.NIBBLE_CHECK_SPAN, 2 * arduino.NIBBLE_CHECK_SPAN} {
+		t.Errorf("corrupted ranges %v", r)
+	}
+	if len(data) != count || data[600] == clean[600] {
+		t.Errorf("the corrupted data was not returned")
+	}
+	if corrupt := port.Stats().Command("READ_NIBBLE_CHK").Corrupt; corrupt != 1 {
+		t.Errorf("%d corrupted spans counted, want 1", corrupt)
+	}
+	if err := port.Ping(); err != nil {
+		t.Errorf("ping after the corrupted read: %v", err)
+	}
+}
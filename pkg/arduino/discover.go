@@ -0,0 +1,155 @@
+package arduino
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.bug.st/serial"
+	"go.bug.st/serial/enumerator"
+)
+
+// PROBE_TIMEOUT is the response timeout used while probing a port. A bridge
+// answers a ping within milliseconds once it has booted.
+const PROBE_TIMEOUT = time.Second
+
+// PortInfo describes a serial port found by ListPorts
+type PortInfo struct {
+	Device       string
+	IsUSB        bool
+	VID          string // USB vendor ID as 4 hex digits, empty if not USB
+	PID          string // USB product ID
+	SerialNumber string
+	Product      string
+
+	// Set by Discover: Bridge reports whether the port runs the PMP300
+	// bridge firmware, Version is its firmware version. Err is why a probed
+	// port is not a bridge, or a *LockError for a bridge that another
+	// process has open; its Version is unknown.
+	Probed  bool
+	Bridge  bool
+	Version *Version
+	Err     error
+}
+
+// USB returns the port's "VID:PID", or "" if it is not a USB port
+func (pi PortInfo) USB() string {
+	if !pi.IsUSB {
+		return ""
+	}
+	return fmt.Sprintf("%s:%s", strings.ToLower(pi.VID), strings.ToLower(pi.PID))
+}
+
+// ListPorts enumerates the serial ports of the system, sorted by device
+// path. USB details are filled in where the OS provides them.
+func ListPorts() ([]PortInfo, error) {
+	var ports []PortInfo
+	details, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		// Not every OS has detailed enumeration; fall back to plain names
+		names, nerr := serial.GetPortsList()
+		if nerr != nil {
+			return nil, fmt.Errorf("failed to enumerate serial ports: %w", errors.Join(err, nerr))
+		}
+		for _, name := range names {
+			ports = append(ports, PortInfo{Device: name})
+		}
+	} else {
+		for _, d := range details {
+			ports = append(ports, PortInfo{
+				Device:       d.Name,
+				IsUSB:        d.IsUSB,
+				VID:          d.VID,
+				PID:          d.PID,
+				SerialNumber: d.SerialNumber,
+				Product:      d.Product,
+			})
+		}
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i].Device < ports[j].Device })
+	return ports, nil
+}
+
+// Discover lists the serial ports and probes every USB port with Ping and
+// GetVersion, in parallel. Ports other than USB are listed unprobed: the
+// bridge is always attached by USB, and probing arbitrary UARTs would
+// disturb whatever is connected to them.
+func Discover(ctx context.Context) ([]PortInfo, error) {
+	ports, err := ListPorts()
+	if err != nil {
+		return nil, err
+	}
+	return probePorts(ctx, ports)
+}
+
+// probePorts probes the USB ports of a ListPorts result in parallel
+func probePorts(ctx context.Context, ports []PortInfo) ([]PortInfo, error) {
+	var wg sync.WaitGroup
+	for i := range ports {
+		if !ports[i].IsUSB {
+			continue
+		}
+		wg.Add(1)
+		go func(pi *PortInfo) {
+			defer wg.Done()
+			pi.Version, pi.Err = Probe(ctx, pi.Device)
+			pi.Probed = true
+			pi.Bridge = pi.Err == nil || errors.Is(pi.Err, ErrLocked)
+		}(&ports[i])
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ports, nil
+}
+
+// Bridges returns the ports of a Discover result that run the bridge
+// firmware
+func Bridges(ports []PortInfo) []PortInfo {
+	var bridges []PortInfo
+	for _, pi := range ports {
+		if pi.Bridge {
+			bridges = append(bridges, pi)
+		}
+	}
+	return bridges
+}
+
+// Probe opens device, pings it and queries the firmware version. It fails
+// with ErrNoDevice or ErrDesync if the port does not run the bridge
+// firmware, and with a *FirmwareError, together with the version, if the
+// firmware is too old. The port is left in the unframed 2.x protocol.
+func Probe(ctx context.Context, device string) (*Version, error) {
+	type result struct {
+		version *Version
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		p, err := OpenWithOptions(device, Options{Unframed: true, Timeout: PROBE_TIMEOUT})
+		if err != nil {
+			var ferr *FirmwareError
+			if errors.As(err, &ferr) {
+				done <- result{version: &ferr.Version, err: err}
+				return
+			}
+			done <- result{err: err}
+			return
+		}
+		version := p.version
+		p.Close()
+		done <- result{version: version}
+	}()
+	select {
+	case r := <-done:
+		return r.version, r.err
+	case <-ctx.Done():
+		// The open finishes within the reset delay and probe timeout
+		return nil, ctx.Err()
+	}
+}
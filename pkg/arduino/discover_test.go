@@ -0,0 +1,90 @@
+//go:build linux
+
+package arduino_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/murdinc/pmp300/pkg/arduino"
+	"github.com/murdinc/pmp300/pkg/bridgesim"
+)
+
+// ptyDevice opens a pseudo-terminal and, given a simulator, serves it as a
+// bridge. It returns the device path; the PTY is closed when the test ends.
+func ptyDevice(t *testing.T, sim *bridgesim.Simulator) string {
+	t.Helper()
+	pty, err := bridgesim.OpenPTY()
+	if err != nil {
+		t.Skip(err)
+	}
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		if sim != nil {
+			pty.Serve(sim, 10*time.Millisecond, t.Logf)
+		}
+	}()
+	t.Cleanup(func() {
+		pty.Close()
+		<-served
+	})
+	return pty.SlavePath()
+}
+
+// TestDiscover probes a bridge among ports that are not bridges and picks
+// it out
+func TestDiscover(t *testing.T) {
+	bridge := ptyDevice(t, newSim(t))
+	silent := ptyDevice(t, nil)
+	uart := ptyDevice(t, newSim(t))
+	missing := "/dev/pmp300-missing"
+
+	ports, err := arduino.ProbePorts(context.Background(), []arduino.PortInfo{
+		{Device: silent, IsUSB: true},
+		{Device: bridge, IsUSB: true},
+		{Device: missing, IsUSB: true},
+		{Device: uart},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	byDevice := make(map[string]arduino.PortInfo)
+	for _, pi := range ports {
+		byDevice[pi.Device] = pi
+	}
+
+	if pi := byDevice[bridge]; !pi.Probed || !pi.Bridge || pi.Err != nil {
+		t.Errorf("bridge: probed %v, bridge %v, error %v", pi.Probed, pi.Bridge, pi.Err)
+	} else if pi.Version == nil || pi.Version.Major != bridgesim.FW_VERSION_MAJOR || pi.Version.Minor != bridgesim.FW_VERSION_MINOR {
+		t.Errorf("bridge: version %v", pi.Version)
+	}
+	for _, device := range []string{silent, missing} {
+		if pi := byDevice[device]; !pi.Probed || pi.Bridge || !errors.Is(pi.Err, arduino.ErrNoDevice) {
+			t.Errorf("%s: probed %v, bridge %v, error %v; want ErrNoDevice", device, pi.Probed, pi.Bridge, pi.Err)
+		}
+	}
+	// A bridge on a port other than USB is left alone
+	if pi := byDevice[uart]; pi.Probed || pi.Bridge {
+		t.Errorf("port other than USB: probed %v, bridge %v", pi.Probed, pi.Bridge)
+	}
+
+	bridges := arduino.Bridges(ports)
+	if len(bridges) != 1 || bridges[0].Device != bridge {
+		t.Errorf("bridges %v, want only %s", bridges, bridge)
+	}
+}
+
+// TestDiscoverCancel checks that cancelling stops a probe of a port that
+// does not answer
+func TestDiscoverCancel(t *testing.T) {
+	silent := ptyDevice(t, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := arduino.ProbePorts(ctx, []arduino.PortInfo{{Device: silent, IsUSB: true}})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("cancelled discovery: %v, want the deadline", err)
+	}
+}
@@ -0,0 +1,107 @@
+package arduino
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors reported by Port methods, for use with errors.Is. Error codes sent
+// by the firmware are returned as *BridgeError, which matches the sentinel
+// for its code.
+var (
+	// ErrUnknownCommand means the firmware does not implement a command
+	ErrUnknownCommand = errors.New("bridge: unknown command")
+
+	// ErrParamTimeout means the firmware gave up waiting for a parameter
+	// or stream byte of a command
+	ErrParamTimeout = errors.New("bridge: parameter timeout")
+
+	// ErrNAK means the PMP300 rejected a handshake of a block command
+	ErrNAK = errors.New("bridge: PMP300 rejected handshake")
+
+	// ErrAckTimeout means the PMP300 did not acknowledge a block command
+	ErrAckTimeout = errors.New("bridge: PMP300 handshake timeout")
+
+	// ErrDesync means host and bridge disagree about the byte stream: an
+	// unexpected response, a corrupted frame or a partial response. Resync
+	// recovers the link.
+	ErrDesync = errors.New("bridge: link out of step")
+
+	// ErrNoDevice means nothing answers on the serial port: the port does
+	// not exist or the bridge does not respond
+	ErrNoDevice = errors.New("bridge: no device responding")
+
+	// ErrOldFirmware means the firmware lacks a command the host needs.
+	// Opening a port with such firmware fails with a *FirmwareError.
+	ErrOldFirmware = errors.New("bridge: firmware too old")
+
+	// ErrLocked means another process has the device open. Opening a
+	// locked port fails with a *LockError naming the process.
+	ErrLocked = errors.New("bridge: device in use")
+
+	// ErrChecksum means a checked nibble read failed its integrity check.
+	// The read returns a *ChecksumError naming the corrupted spans.
+	ErrChecksum = errors.New("bridge: nibble read corrupted")
+
+	// ErrStatusTimeout means the status register did not reach the value a
+	// WaitStatus waited for
+	ErrStatusTimeout = errors.New("bridge: timeout waiting for status")
+)
+
+// Names of firmware error codes used in messages
+var errorNames = map[byte]string{
+	ERR_UNKNOWN_CMD: "unknown command",
+	ERR_TIMEOUT:     "parameter timeout",
+	ERR_CRC:         "CRC mismatch",
+	ERR_FRAME:       "malformed frame",
+	ERR_DROPPED:     "frame dropped",
+	ERR_NAK:         "PMP300 rejected handshake",
+	ERR_ACK_TIMEOUT: "PMP300 handshake timeout",
+	ERR_BAUD:        "unsupported baud rate",
+	ERR_PARAM:       "invalid parameter",
+}
+
+// BridgeError is an error response ('E' <code>) from the firmware
+type BridgeError struct {
+	Code byte
+}
+
+func (e *BridgeError) Error() string {
+	if name, ok := errorNames[e.Code]; ok {
+		return fmt.Sprintf("arduino error: 0x%02X (%s)", e.Code, name)
+	}
+	return fmt.Sprintf("arduino error: 0x%02X", e.Code)
+}
+
+// Is matches the sentinel error for the code. Frames the bridge rejected or
+// dropped count as ErrDesync.
+func (e *BridgeError) Is(target error) bool {
+	switch target {
+	case ErrUnknownCommand:
+		return e.Code == ERR_UNKNOWN_CMD
+	case ErrParamTimeout:
+		return e.Code == ERR_TIMEOUT
+	case ErrNAK:
+		return e.Code == ERR_NAK
+	case ErrAckTimeout:
+		return e.Code == ERR_ACK_TIMEOUT
+	case ErrDesync:
+		return e.Code == ERR_CRC || e.Code == ERR_FRAME || e.Code == ERR_DROPPED
+	}
+	return false
+}
+
+// FirmwareError refuses firmware that lacks required features
+type FirmwareError struct {
+	Version Version
+	Missing uint16 // CAP_* bits the host needs
+}
+
+func (e *FirmwareError) Error() string {
+	return fmt.Sprintf("bridge firmware v%s lacks %s; reflash with pmp300 flash", e.Version, featureNames(e.Missing))
+}
+
+// Is matches ErrOldFirmware
+func (e *FirmwareError) Is(target error) bool {
+	return target == ErrOldFirmware
+}
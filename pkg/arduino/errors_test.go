@@ -0,0 +1,125 @@
+package arduino_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/murdinc/pmp300/pkg/arduino"
+	"github.com/murdinc/pmp300/pkg/pmp300"
+)
+
+// TestBridgeErrorIs checks that firmware error codes match their sentinels
+// through the wrapping of the layers above
+func TestBridgeErrorIs(t *testing.T) {
+	sentinels := []error{
+		arduino.ErrUnknownCommand,
+		arduino.ErrParamTimeout,
+		arduino.ErrNAK,
+		arduino.ErrAckTimeout,
+		arduino.ErrDesync,
+	}
+	for _, tc := range []struct {
+		code byte
+		want error
+	}{
+		{arduino.ERR_UNKNOWN_CMD, arduino.ErrUnknownCommand},
+		{arduino.ERR_TIMEOUT, arduino.ErrParamTimeout},
+		{arduino.ERR_NAK, arduino.ErrNAK},
+		{arduino.ERR_ACK_TIMEOUT, arduino.ErrAckTimeout},
+		{arduino.ERR_CRC, arduino.ErrDesync},
+		{arduino.ERR_FRAME, arduino.ErrDesync},
+		{arduino.ERR_DROPPED, arduino.ErrDesync},
+		{arduino.ERR_PARAM, nil},
+	} {
+		err := fmt.Errorf("block 3: %w", fmt.Errorf("read failed: %w", &arduino.BridgeError{Code: tc.code}))
+		for _, sentinel := range sentinels {
+			if got := errors.Is(err, sentinel); got != (sentinel == tc.want) {
+				t.Errorf("code 0x%02X: errors.Is(%v) = %v", tc.code, sentinel, got)
+			}
+		}
+		var berr *arduino.BridgeError
+		if !errors.As(err, &berr) || berr.Code != tc.code {
+			t.Errorf("code 0x%02X: errors.As found %v", tc.code, berr)
+		}
+	}
+}
+
+// TestBridgeErrors provokes firmware errors on a simulated bridge
+func TestBridgeErrors(t *testing.T) {
+	t.Run("NAK", func(t *testing.T) {
+		link := newSimLink(t, newSim(t), true)
+		port := openSim(t, link, arduino.Options{})
+		defer port.Close()
+
+		// No card is inserted, so the player rejects the address
+		_, err := port.ReadBlock(pmp300.ADDRESS_EXTERNAL)
+		if !errors.Is(err, arduino.ErrNAK) {
+			t.Errorf("block read from a missing card: %v, want ErrNAK", err)
+		}
+		if err := port.Ping(); err != nil {
+			t.Errorf("ping after the NAK: %v", err)
+		}
+	})
+
+	t.Run("parameter timeout", func(t *testing.T) {
+		link := newSimLink(t, newSim(t), true)
+		port := openSim(t, link, arduino.Options{Unframed: true})
+		defer port.Close()
+
+		// The value byte of the write never arrives
+		link.tamper(func(data []byte) []byte {
+			if data[0] == arduino.CMD_WRITE_DATA {
+				return data[:len(data)-1]
+			}
+			return data
+		}, nil)
+		err := port.OutByte(0, 0x42)
+		link.tamper(nil, nil)
+		if !errors.Is(err, arduino.ErrParamTimeout) {
+			t.Errorf("write missing its value: %v, want ErrParamTimeout", err)
+		}
+		if err := port.Ping(); err != nil {
+			t.Errorf("ping after the timeout: %v", err)
+		}
+	})
+}
+
+// TestResyncMidCommand leaves the bridge waiting for the rest of a command
+// and checks that Resync brings it back
+func TestResyncMidCommand(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		unframed bool
+		partial  []byte
+	}{
+		{"unframed command", true, []byte{arduino.CMD_WRITE_DATA, 0x00}},
+		{"frame header", false, []byte{arduino.FRAME_SYNC, 0x00}},
+		{"frame payload", false, []byte{arduino.FRAME_SYNC, 0x00, 0x04, 0x01, arduino.CMD_WRITE_DATA}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			link := newSimLink(t, newSim(t), true)
+			port := openSim(t, link, arduino.Options{Unframed: tc.unframed})
+			defer port.Close()
+
+			link.inject(tc.partial)
+			start := time.Now()
+			if err := port.Resync(context.Background()); err != nil {
+				t.Fatalf("resync: %v", err)
+			}
+			// The bridge gives up on the command after its parameter
+			// timeout of 1s
+			if d := time.Since(start); d > 3*time.Second {
+				t.Errorf("resync took %v", d)
+			}
+			if err := port.OutByte(0, 0x42); err != nil {
+				t.Errorf("write after the resync: %v", err)
+			}
+			if port.Framed() == tc.unframed {
+				t.Errorf("framed %v after the resync", port.Framed())
+			}
+		})
+	}
+}
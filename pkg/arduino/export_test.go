@@ -0,0 +1,25 @@
+package arduino
+
+import "context"
+
+// SerialPort is the part of a serial port that Port uses
+type SerialPort = serialPort
+
+// OpenPort opens a Port on a serial port that is already open, such as a
+// link to a simulated bridge
+func OpenPort(ctx context.Context, device string, port SerialPort, opts Options) (*Port, error) {
+	p := newPort(device, opts)
+	if err := p.start(ctx, port, opts); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// ProbePorts is Discover on a given list of ports
+var ProbePorts = probePorts
+
+// Abandon closes the port without resetting the bridge, like a client that
+// is killed
+func (p *Port) Abandon() error {
+	return p.closePort()
+}
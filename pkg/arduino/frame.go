@@ -0,0 +1,192 @@
+package arduino
+
+import (
+	"context"
+	"fmt"
+)
+
+// Framed mode (firmware 3.x). After 'F' FRAMING_CRC16 every command and
+// every response travels in a frame:
+//
+//	FRAME_SYNC <len_hi> <len_lo> <seq> <payload...> <crc_hi> <crc_lo>
+//
+// The payload is an unframed command (command byte plus parameters) or its
+// response. The firmware echoes the command's sequence number in the
+// response. The CRC is CRC-16/CCITT-FALSE over length, sequence and payload.
+//
+// The chunk stream of CMD_WRITE_BLOCK follows its frame unframed, protected
+// by a CRC per chunk.
+//
+// Sequence numbers of executed frames must be consecutive. After any error
+// frame the bridge answers every further frame with ERR_DROPPED, without
+// running it, until a CMD_FRAMING frame arrives. Commands are therefore
+// never executed out of order, even with several in flight.
+const (
+	FRAME_SYNC        = 0xA5
+	FRAME_HEADER_SIZE = 4   // sync, length (2), sequence
+	FRAME_MAX_PAYLOAD = 529 // 'w' plus a 528-byte chunk
+)
+
+// Framing modes selected with CMD_FRAMING
+const (
+	FRAMING_RAW   = 0x00 // Unframed 2.x protocol
+	FRAMING_CRC16 = 0x01 // Framed with sequence numbers and CRC-16
+)
+
+// Error codes - must match Arduino firmware
+const (
+	ERR_UNKNOWN_CMD = 0x01
+	ERR_TIMEOUT     = 0x02
+	ERR_CRC         = 0x03 // Frame or block chunk failed its CRC
+	ERR_FRAME       = 0x04 // Bad frame length or parameters, command not executed
+	ERR_DROPPED     = 0x05 // Frame dropped after an earlier error, command not executed
+	ERR_NAK         = 0x06 // PMP300 rejected a handshake of a block command
+	ERR_ACK_TIMEOUT = 0x07 // PMP300 did not acknowledge a block command
+	ERR_PARAM       = 0x09 // Invalid parameter value (firmware 3.7)
+)
+
+// FRAMING_MIN_MAJOR is the first firmware major version with framed mode
+const FRAMING_MIN_MAJOR = 3
+
+// FRAME_RETRIES is how often a frame the bridge rejected unexecuted is resent
+const FRAME_RETRIES = 3
+
+// CRC16_INIT is the initial CRC-16/CCITT-FALSE value
+const CRC16_INIT = 0xFFFF
+
+// UpdateCRC16 adds data to a CRC-16/CCITT-FALSE (polynomial 0x1021)
+func UpdateCRC16(crc uint16, data ...byte) uint16 {
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// AppendFrame appends a frame carrying payload to buf
+func AppendFrame(buf []byte, seq byte, payload []byte) []byte {
+	start := len(buf)
+	buf = append(buf, FRAME_SYNC, byte(len(payload)>>8), byte(len(payload)), seq)
+	buf = append(buf, payload...)
+	crc := UpdateCRC16(CRC16_INIT, buf[start+1:]...)
+	return append(buf, byte(crc>>8), byte(crc))
+}
+
+// Framing switches the bridge between FRAMING_RAW and FRAMING_CRC16. The
+// switch command itself is sent in the current mode.
+func (p *Port) Framing(mode byte) error {
+	return p.FramingContext(context.Background(), mode)
+}
+
+// FramingContext is Framing with a context
+func (p *Port) FramingContext(ctx context.Context, mode byte) error {
+	if _, err := p.exchange(ctx, []byte{CMD_FRAMING, mode}, RESP_OK, 0); err != nil {
+		return fmt.Errorf("failed to set framing mode %d: %w", mode, err)
+	}
+	p.framed = mode == FRAMING_CRC16
+	return nil
+}
+
+// negotiate queries the firmware version and capabilities and, if framing
+// is wanted, switches to framed mode when the firmware supports it
+func (p *Port) negotiate(framing bool) error {
+	version, err := p.GetVersion()
+	if err != nil {
+		return fmt.Errorf("failed to get version: %w", err)
+	}
+	if err := p.loadCapabilities(context.Background(), hasQuery(*version)); err != nil {
+		return err
+	}
+	if !framing || !p.caps.Has(CAP_FRAMING) {
+		return nil
+	}
+	return p.Framing(FRAMING_CRC16)
+}
+
+// Framed reports whether the port is in framed mode
+func (p *Port) Framed() bool {
+	return p.framed
+}
+
+// readFrame reads the next response frame, discarding bytes before its
+// sync byte
+func (p *Port) readFrame(ctx context.Context) (seq byte, payload []byte, err error) {
+	if err := p.huntSync(ctx); err != nil {
+		return 0, nil, err
+	}
+	header := make([]byte, FRAME_HEADER_SIZE)
+	header[0] = FRAME_SYNC
+	if _, err := p.readFull(ctx, header[1:]); err != nil {
+		return 0, nil, err
+	}
+	length := int(header[1])<<8 | int(header[2])
+	if length == 0 {
+		return 0, nil, fmt.Errorf("%w: invalid response frame length %d", ErrDesync, length)
+	}
+
+	body := make([]byte, length+2)
+	if _, err := p.readFull(ctx, body); err != nil {
+		return 0, nil, err
+	}
+	crc := UpdateCRC16(CRC16_INIT, header[1:]...)
+	crc = UpdateCRC16(crc, body[:length]...)
+	if got := uint16(body[length])<<8 | uint16(body[length+1]); got != crc {
+		return 0, nil, fmt.Errorf("%w: response frame CRC mismatch (seq %d): got 0x%04X, computed 0x%04X", ErrDesync, header[3], got, crc)
+	}
+	return header[3], body[:length], nil
+}
+
+// resync recovers the frame stream after an error frame. The bridge drops
+// every frame after an error until it receives CMD_FRAMING, so a fresh
+// FRAMING command is sent and all responses before its answer discarded.
+// It is sent again if the bridge took it as part of an unfinished frame.
+func (p *Port) resync(ctx context.Context) error {
+	for attempt := 0; attempt <= FRAME_RETRIES; attempt++ {
+		p.seq++
+		seq := p.seq
+		if _, err := p.port.Write(AppendFrame(nil, seq, []byte{CMD_FRAMING, FRAMING_CRC16})); err != nil {
+			return err
+		}
+		for {
+			got, payload, err := p.readFrame(ctx)
+			if err != nil {
+				return fmt.Errorf("resync failed: %w", err)
+			}
+			if got != seq {
+				// Frames sent before are dropped. Any other error means the
+				// bridge was partway through a frame, which swallowed ours.
+				if len(payload) == 2 && payload[0] == RESP_ERROR && payload[1] != ERR_DROPPED {
+					break
+				}
+				continue
+			}
+			if payload[0] == RESP_OK {
+				return nil
+			}
+			break
+		}
+	}
+	return fmt.Errorf("resync failed: %w: bridge rejected %d attempts", ErrDesync, FRAME_RETRIES+1)
+}
+
+// huntSync reads until a sync byte
+func (p *Port) huntSync(ctx context.Context) error {
+	b := make([]byte, 1)
+	for skipped := 0; ; skipped++ {
+		if _, err := p.readFull(ctx, b); err != nil {
+			return err
+		}
+		if b[0] == FRAME_SYNC {
+			return nil
+		}
+		if skipped >= FRAME_MAX_PAYLOAD+FRAME_HEADER_SIZE+2 {
+			return fmt.Errorf("%w: no response frame: skipped %d bytes", ErrDesync, skipped)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package arduino_test
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/murdinc/pmp300/pkg/arduino"
+)
+
+// TestCRC16 checks the CRC-16/CCITT-FALSE check value
+func TestCRC16(t *testing.T) {
+	if crc := arduino.UpdateCRC16(arduino.CRC16_INIT, []byte("123456789")...); crc != 0x29B1 {
+		t.Errorf("CRC of \"123456789\" = 0x%04X, want 0x29B1", crc)
+	}
+	crc := arduino.UpdateCRC16(arduino.CRC16_INIT, []byte("1234")...)
+	if crc = arduino.UpdateCRC16(crc, []byte("56789")...); crc != 0x29B1 {
+		t.Errorf("CRC of \"123456789\" in two parts = 0x%04X, want 0x29B1", crc)
+	}
+}
+
+// TestAppendFrame checks the frame layout
+func TestAppendFrame(t *testing.T) {
+	frame := arduino.AppendFrame([]byte{0xEE}, 7, []byte{'W', 0x42})
+	crc := arduino.UpdateCRC16(arduino.CRC16_INIT, 0x00, 0x02, 7, 'W', 0x42)
+	want := []byte{0xEE, arduino.FRAME_SYNC, 0x00, 0x02, 7, 'W', 0x42, byte(crc >> 8), byte(crc)}
+	if !bytes.Equal(frame, want) {
+		t.Errorf("frame % X, want % X", frame, want)
+	}
+}
+
+// once returns a tamper function that applies f to the first frame
+// carrying cmd, and leaves everything else alone
+func once(cmd byte, f func(frame []byte)) func([]byte) []byte {
+	done := false
+	return func(data []byte) []byte {
+		if !done && len(data) > arduino.FRAME_HEADER_SIZE && data[0] == arduino.FRAME_SYNC && data[arduino.FRAME_HEADER_SIZE] == cmd {
+			f(data)
+			done = true
+		}
+		return data
+	}
+}
+
+// reseal recomputes the CRC of a frame
+func reseal(frame []byte) {
+	crc := arduino.UpdateCRC16(arduino.CRC16_INIT, frame[1:len(frame)-2]...)
+	frame[len(frame)-2], frame[len(frame)-1] = byte(crc>>8), byte(crc)
+}
+
+// TestCorruptedResponse checks that a response frame failing its CRC fails
+// the call with ErrDesync, and that the next call resyncs and works
+func TestCorruptedResponse(t *testing.T) {
+	link := newSimLink(t, newSim(t), true)
+	port := openSim(t, link, arduino.Options{})
+	defer port.Close()
+
+	link.tamper(nil, once(arduino.RESP_VERSION, func(frame []byte) { frame[5] ^= 0x01 }))
+	_, err := port.GetVersion()
+	if !errors.Is(err, arduino.ErrDesync) || !strings.Contains(err.Error(), "CRC mismatch") {
+		t.Fatalf("corrupted response: %v, want a CRC mismatch", err)
+	}
+	v, err := port.GetVersion()
+	if err != nil {
+		t.Fatalf("after the corrupted response: %v", err)
+	}
+	if v.Major != 3 {
+		t.Errorf("version %v after the corrupted response", v)
+	}
+	if resyncs := port.Stats().Resyncs; resyncs != 1 {
+		t.Errorf("%d resyncs, want 1", resyncs)
+	}
+}
+
+// TestSequenceMismatch checks that a response to another frame than the
+// one waited for fails the call with ErrDesync
+func TestSequenceMismatch(t *testing.T) {
+	link := newSimLink(t, newSim(t), true)
+	port := openSim(t, link, arduino.Options{})
+	defer port.Close()
+
+	link.tamper(nil, once(arduino.RESP_VERSION, func(frame []byte) {
+		frame[3]++
+		reseal(frame)
+	}))
+	_, err := port.GetVersion()
+	if !errors.Is(err, arduino.ErrDesync) || !strings.Contains(err.Error(), "sequence mismatch") {
+		t.Fatalf("response with the wrong sequence number: %v, want a sequence mismatch", err)
+	}
+	if err := port.Ping(); err != nil {
+		t.Fatalf("after the sequence mismatch: %v", err)
+	}
+}
+
+// TestResend corrupts the first of several pipelined frames on its way to
+// the bridge. The bridge rejects it and drops the frames behind it; all are
+// resent after a resync and succeed.
+func TestResend(t *testing.T) {
+	link := newSimLink(t, newSim(t), true)
+	port := openSim(t, link, arduino.Options{})
+	defer port.Close()
+
+	link.tamper(once(arduino.CMD_WRITE_DATA, func(frame []byte) { frame[5] ^= 0xFF }), nil)
+	var waits []func() error
+	for i := 0; i < 5; i++ {
+		waits = append(waits, port.SubmitOutByte(0, byte(i)))
+	}
+	for i, wait := range waits {
+		if err := wait(); err != nil {
+			t.Errorf("write %d: %v", i, err)
+		}
+	}
+
+	stats := port.Stats()
+	if stats.Resyncs != 1 {
+		t.Errorf("%d resyncs, want 1", stats.Resyncs)
+	}
+	cs := stats.Command("WRITE_DATA")
+	if cs.Calls != 5 || cs.Errors != 0 || cs.Retries != 5 {
+		t.Errorf("WRITE_DATA: %d calls, %d errors, %d retries; want 5, 0, 5", cs.Calls, cs.Errors, cs.Retries)
+	}
+}
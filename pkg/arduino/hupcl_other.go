@@ -0,0 +1,8 @@
+//go:build !linux && !darwin && !freebsd && !openbsd
+
+package arduino
+
+// keepDTR does nothing; opening the port may reset the board
+func keepDTR(device string) error {
+	return nil
+}
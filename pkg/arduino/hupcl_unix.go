@@ -0,0 +1,34 @@
+//go:build linux || darwin || freebsd || openbsd
+
+package arduino
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// keepDTR clears HUPCL on a serial device, so that closing it no longer
+// drops DTR. Most Arduinos reset when DTR is asserted; with DTR kept high
+// the next open finds the bridge running. The first open after the board
+// was plugged in still resets it.
+func keepDTR(device string) error {
+	fd, err := unix.Open(device, unix.O_RDWR|unix.O_NOCTTY|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	t, err := unix.IoctlGetTermios(fd, ioctlGetTermios)
+	if err != nil {
+		return fmt.Errorf("failed to get termios: %w", err)
+	}
+	if t.Cflag&unix.HUPCL == 0 {
+		return nil
+	}
+	t.Cflag &^= unix.HUPCL
+	if err := unix.IoctlSetTermios(fd, ioctlSetTermios, t); err != nil {
+		return fmt.Errorf("failed to clear HUPCL: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package arduino
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Lock is an advisory lock on a serial device, held by a Port or a
+// RelayServer while it has the device open. Two processes talking to one
+// bridge at the same time would interleave their bytes and corrupt both
+// sessions. The lock is taken on the device node itself, so every path to
+// the device and every user shares it, and it is released when its holder
+// exits, however it exits.
+type Lock struct {
+	file *os.File
+}
+
+// errLockHeld means another process holds the lock of a device
+var errLockHeld = errors.New("lock held")
+
+// LockError is returned when another process holds the lock of a device
+type LockError struct {
+	Device string
+	PID    int // Process holding the lock, 0 if unknown
+}
+
+func (e *LockError) Error() string {
+	if e.PID == 0 {
+		return fmt.Sprintf("%s is in use by another process (use --wait to wait for it)", e.Device)
+	}
+	return fmt.Sprintf("%s is in use by process %d (use --wait to wait for it)", e.Device, e.PID)
+}
+
+// Is matches ErrLocked
+func (e *LockError) Is(target error) bool {
+	return target == ErrLocked
+}
+
+// LockDevice takes the lock of device. If another process holds it,
+// LockDevice fails with a *LockError, or with wait polls every READ_POLL
+// until it is free or ctx is done. Symlinks such as /dev/serial/by-id names
+// lock the device they point to. A device that does not exist fails with
+// ErrNoDevice.
+func LockDevice(ctx context.Context, device string, wait bool) (*Lock, error) {
+	for {
+		f, err := lockDevice(device)
+		if err == nil {
+			return &Lock{file: f}, nil
+		}
+		if err != errLockHeld {
+			return nil, err
+		}
+		if !wait {
+			return nil, &LockError{Device: device, PID: lockHolder(device)}
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(READ_POLL):
+		}
+	}
+}
+
+// Unlock releases the lock
+func (l *Lock) Unlock() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	err := l.file.Close() // Closing releases the lock
+	l.file = nil
+	return err
+}
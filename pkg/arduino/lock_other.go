@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd && !openbsd
+
+package arduino
+
+import "os"
+
+// lockDevice does nothing; the OS opens serial ports exclusively
+func lockDevice(device string) (*os.File, error) {
+	return nil, nil
+}
@@ -0,0 +1,118 @@
+//go:build linux || darwin || freebsd || openbsd
+
+package arduino_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/murdinc/pmp300/pkg/arduino"
+)
+
+// lockTarget returns a file standing in for a serial device, and a symlink
+// to it like the names in /dev/serial/by-id
+func lockTarget(t *testing.T) (device, link string) {
+	t.Helper()
+	dir := t.TempDir()
+	device = filepath.Join(dir, "ttyACM0")
+	if err := os.WriteFile(device, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	link = filepath.Join(dir, "usb-Arduino_Uno-if00")
+	if err := os.Symlink(device, link); err != nil {
+		t.Fatal(err)
+	}
+	return device, link
+}
+
+// TestLockDevice checks that a locked device cannot be locked again, by any
+// of its names, until it is unlocked
+func TestLockDevice(t *testing.T) {
+	device, link := lockTarget(t)
+	ctx := context.Background()
+
+	lock, err := arduino.LockDevice(ctx, device, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{device, link} {
+		_, err := arduino.LockDevice(ctx, name, false)
+		var lerr *arduino.LockError
+		if !errors.As(err, &lerr) || !errors.Is(err, arduino.ErrLocked) {
+			t.Fatalf("second lock of %s: %v, want a LockError", name, err)
+		}
+		if lerr.Device != name {
+			t.Errorf("lock error names %s, want %s", lerr.Device, name)
+		}
+		// The lock belongs to its open file, so it is held against this
+		// process too
+		if runtime.GOOS == "linux" && lerr.PID != os.Getpid() {
+			t.Errorf("lock held by process %d, want %d", lerr.PID, os.Getpid())
+		}
+	}
+
+	if err := lock.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	lock, err = arduino.LockDevice(ctx, link, false)
+	if err != nil {
+		t.Fatalf("lock after unlock: %v", err)
+	}
+	lock.Unlock()
+}
+
+// TestLockDeviceWait checks that waiting for a lock blocks until it is
+// released, or until the wait is cancelled
+func TestLockDeviceWait(t *testing.T) {
+	device, _ := lockTarget(t)
+	lock, err := arduino.LockDevice(context.Background(), device, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := arduino.LockDevice(ctx, device, true); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("cancelled wait: %v, want the deadline", err)
+	}
+
+	type result struct {
+		lock *arduino.Lock
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		lock, err := arduino.LockDevice(context.Background(), device, true)
+		done <- result{lock, err}
+	}()
+	select {
+	case r := <-done:
+		t.Fatalf("wait returned while the lock was held: %v", r.err)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	lock.Unlock()
+	select {
+	case r := <-done:
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		r.lock.Unlock()
+	case <-time.After(time.Second):
+		t.Fatal("wait did not return after unlock")
+	}
+}
+
+// TestLockMissingDevice checks that a device that does not exist is told
+// apart from a locked one
+func TestLockMissingDevice(t *testing.T) {
+	_, err := arduino.LockDevice(context.Background(), filepath.Join(t.TempDir(), "ttyACM9"), false)
+	if !errors.Is(err, arduino.ErrNoDevice) {
+		t.Errorf("missing device: %v, want ErrNoDevice", err)
+	}
+}
@@ -0,0 +1,37 @@
+//go:build linux || darwin || freebsd || openbsd
+
+package arduino
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockDevice opens device, without making it the controlling terminal or
+// waiting for carrier, and takes an exclusive flock on it. A port another
+// process opened exclusively (TIOCEXCL, as every pmp300 Port does) cannot
+// be opened and counts as locked too.
+func lockDevice(device string) (*os.File, error) {
+	f, err := os.OpenFile(device, os.O_RDONLY|unix.O_NOCTTY|unix.O_NONBLOCK, 0)
+	if err != nil {
+		switch {
+		case errors.Is(err, unix.EBUSY):
+			return nil, errLockHeld
+		case errors.Is(err, fs.ErrNotExist):
+			return nil, fmt.Errorf("%w: %v", ErrNoDevice, err)
+		}
+		return nil, fmt.Errorf("failed to lock %s: %w", device, err)
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		f.Close()
+		if err == unix.EWOULDBLOCK {
+			return nil, errLockHeld
+		}
+		return nil, fmt.Errorf("failed to lock %s: %w", device, err)
+	}
+	return f, nil
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package arduino
+
+// lockHolder returns 0: the holder of a lock is only known on Linux
+func lockHolder(device string) int {
+	return 0
+}
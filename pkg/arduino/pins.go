@@ -0,0 +1,87 @@
+package arduino
+
+import (
+	"context"
+	"fmt"
+)
+
+// Microsecond delay and data direction (firmware 3.7):
+//
+//	'D' <us_hi> <us_lo> -> 'K'
+//	'S' <'I' or 'O'>    -> 'K', or 'E' ERR_PARAM
+//
+// Commands that write the data register switch the pins back to outputs on
+// their own.
+const (
+	CMD_DELAY_US     = 'D'
+	CMD_SET_DATA_DIR = 'S'
+)
+
+// Data directions of SetDataDirection
+const (
+	DATA_INPUT  = 'I' // Pins released, so the PMP300 can drive them
+	DATA_OUTPUT = 'O' // Pins driven by the bridge
+)
+
+// First firmware version with CMD_DELAY_US and CMD_SET_DATA_DIR
+const (
+	PINS_MIN_MAJOR = 3
+	PINS_MIN_MINOR = 7
+)
+
+// DelayMicroseconds delays on the bridge for up to 65535 microseconds
+func (p *Port) DelayMicroseconds(us uint16) error {
+	return p.DelayMicrosecondsContext(context.Background(), us)
+}
+
+// DelayMicrosecondsContext is DelayMicroseconds with a context
+func (p *Port) DelayMicrosecondsContext(ctx context.Context, us uint16) error {
+	return p.SubmitDelayMicrosecondsContext(ctx, us)()
+}
+
+// SubmitDelayMicroseconds queues DelayMicroseconds
+func (p *Port) SubmitDelayMicroseconds(us uint16) func() error {
+	return p.SubmitDelayMicrosecondsContext(context.Background(), us)
+}
+
+// SubmitDelayMicrosecondsContext is SubmitDelayMicroseconds with a context
+func (p *Port) SubmitDelayMicrosecondsContext(ctx context.Context, us uint16) func() error {
+	if !p.caps.Has(CAP_DELAY_US) {
+		return func() error { return pinsFirmwareError("microsecond delays") }
+	}
+	c := p.submit(ctx, []byte{CMD_DELAY_US, byte(us >> 8), byte(us)}, RESP_OK, 0)
+	return func() error { _, err := p.wait(ctx, c); return err }
+}
+
+// SetDataDirection makes the data pins inputs (DATA_INPUT) or outputs
+// (DATA_OUTPUT)
+func (p *Port) SetDataDirection(dir byte) error {
+	return p.SetDataDirectionContext(context.Background(), dir)
+}
+
+// SetDataDirectionContext is SetDataDirection with a context
+func (p *Port) SetDataDirectionContext(ctx context.Context, dir byte) error {
+	return p.SubmitSetDataDirectionContext(ctx, dir)()
+}
+
+// SubmitSetDataDirection queues SetDataDirection
+func (p *Port) SubmitSetDataDirection(dir byte) func() error {
+	return p.SubmitSetDataDirectionContext(context.Background(), dir)
+}
+
+// SubmitSetDataDirectionContext is SubmitSetDataDirection with a context
+func (p *Port) SubmitSetDataDirectionContext(ctx context.Context, dir byte) func() error {
+	if dir != DATA_INPUT && dir != DATA_OUTPUT {
+		return func() error { return fmt.Errorf("invalid data direction: 0x%02X", dir) }
+	}
+	if !p.caps.Has(CAP_DATA_DIR) {
+		return func() error { return pinsFirmwareError("setting the data direction") }
+	}
+	c := p.submit(ctx, []byte{CMD_SET_DATA_DIR, dir}, RESP_OK, 0)
+	return func() error { _, err := p.wait(ctx, c); return err }
+}
+
+// pinsFirmwareError refuses a firmware 3.7 command on older firmware
+func pinsFirmwareError(what string) error {
+	return fmt.Errorf("%w: %s needs firmware %d.%d or newer; reflash with pmp300 flash", ErrOldFirmware, what, PINS_MIN_MAJOR, PINS_MIN_MINOR)
+}
@@ -0,0 +1,463 @@
+package arduino
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// PIPELINE_WINDOW is the default number of command bytes in flight. It
+// matches the 64-byte serial receive buffer of the Uno and Mega; more would
+// overrun it while a slow command (a delay, a chunk write) runs. The oldest
+// command counts as well, as the bridge may not have taken it from the
+// buffer yet.
+const PIPELINE_WINDOW = 64
+
+// RESYNC_ATTEMPTS is how often Resync drains and pings before giving up
+const RESYNC_ATTEMPTS = 3
+
+// call is a command in flight. Responses are read strictly in submission
+// order, so waiting for a call first completes every call before it.
+type call struct {
+	req    []byte   // Unframed command
+	stream []byte   // Sent after the command, outside its frame
+	pieces [][]byte // Paced stream, sent a piece at a time on RESP_READY
+	next   int      // Pieces sent
+	size   int      // Bytes written, including framing
+	seq    byte     // Frame sequence number
+	want   byte     // Expected leading response byte
+	n      int      // Response bytes after the leading byte
+
+	attempts int       // Resends after the bridge rejected the frame
+	sent     time.Time // First sent, for the latency statistics
+
+	done bool
+	resp []byte
+	err  error
+}
+
+// submit writes a command without waiting for its response. The window is
+// kept by completing the oldest calls first.
+func (p *Port) submit(ctx context.Context, req []byte, want byte, n int) *call {
+	return p.submitStream(ctx, req, nil, want, n)
+}
+
+// submitStream submits a command that is followed by a data stream. A
+// stream longer than the window is only sent once the bridge is idle. After
+// the link broke it is resynchronized first.
+func (p *Port) submitStream(ctx context.Context, req, stream []byte, want byte, n int) *call {
+	return p.enqueue(ctx, &call{req: req, stream: stream, want: want, n: n})
+}
+
+// submitPaced submits a command whose stream the bridge asks for piece by
+// piece. It is only sent once the bridge is idle, and nothing is sent behind
+// it until it completes, as the bridge would take those bytes for pieces.
+func (p *Port) submitPaced(ctx context.Context, req []byte, pieces [][]byte, want byte, n int) *call {
+	return p.enqueue(ctx, &call{req: req, pieces: pieces, want: want, n: n})
+}
+
+// enqueue sends c once it fits the window
+func (p *Port) enqueue(ctx context.Context, c *call) *call {
+	for len(p.inflight) > 0 && (c.pieces != nil || p.inflight[0].pieces != nil || p.queued()+p.wireSize(c) > p.window) {
+		p.complete(ctx)
+	}
+	if err := ctx.Err(); err != nil {
+		c.done, c.err = true, err
+		return c
+	}
+	if p.needResync {
+		if err := p.Resync(ctx); err != nil {
+			c.done, c.err = true, err
+			return c
+		}
+	}
+	if err := p.send(c); err != nil {
+		c.done, c.err = true, err
+		return c
+	}
+	p.inflight = append(p.inflight, c)
+	return c
+}
+
+// send writes a call, framing it with the next sequence number in framed mode
+func (p *Port) send(c *call) error {
+	wire := c.req
+	if p.framed {
+		p.seq++
+		c.seq = p.seq
+		wire = AppendFrame(nil, c.seq, c.req)
+	}
+	if len(c.stream) > 0 {
+		wire = append(append([]byte(nil), wire...), c.stream...)
+	}
+	c.size = len(wire)
+	c.next = 0
+	p.countSent(c)
+	_, err := p.port.Write(wire)
+	return err
+}
+
+// wireSize is the number of bytes c takes on the wire
+func (p *Port) wireSize(c *call) int {
+	size := len(c.req) + len(c.stream)
+	if p.framed {
+		size += FRAME_HEADER_SIZE + 2
+	}
+	return size
+}
+
+// queued returns the bytes of the calls in flight
+func (p *Port) queued() int {
+	total := 0
+	for _, c := range p.inflight {
+		total += c.size
+	}
+	return total
+}
+
+// wait completes calls up to and including c and returns its response
+func (p *Port) wait(ctx context.Context, c *call) ([]byte, error) {
+	for !c.done {
+		p.complete(ctx)
+	}
+	return c.resp, c.err
+}
+
+// complete reads the response of the oldest call in flight. After an error
+// frame the stream is resynchronized and the calls the bridge dropped are
+// resent; a rejected call itself is resent up to FRAME_RETRIES times. When
+// the response stream breaks or ctx is done, every call in flight fails.
+// A broken stream is resynchronized before the next command; an unframed
+// error response counts as broken, as the firmware may carry on with the
+// command or take its parameters for commands.
+func (p *Port) complete(ctx context.Context) {
+	c := p.inflight[0]
+	for {
+		resp, code, err := p.readResponse(ctx, c)
+		if err != nil && code == 0 {
+			if ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+				if aerr := p.abort(); aerr != nil {
+					err = fmt.Errorf("%w (abort failed: %v)", err, aerr)
+					p.needResync = true
+				}
+			} else if !p.framed || !errors.As(err, new(*BridgeError)) {
+				p.needResync = true
+			}
+			p.fail(err)
+			return
+		}
+		if code != 0 {
+			// Recovery runs to the end even if ctx is done meanwhile
+			p.resyncs++
+			if rerr := p.resync(context.WithoutCancel(ctx)); rerr != nil {
+				p.needResync = true
+				p.fail(fmt.Errorf("%w (%v)", err, rerr))
+				return
+			}
+			retry := frameRejected(code) && c.attempts < FRAME_RETRIES
+			if retry {
+				c.attempts++
+			} else {
+				p.inflight = p.inflight[1:]
+				c.done, c.err = true, err
+				p.countDone(c)
+			}
+			if serr := p.resend(); serr != nil {
+				p.fail(serr)
+				return
+			}
+			if !retry {
+				return
+			}
+			continue
+		}
+		p.inflight = p.inflight[1:]
+		c.done, c.resp = true, resp
+		p.countDone(c)
+		return
+	}
+}
+
+// resend sends the calls in flight again after a resync. They were sent
+// within the window before, so they fit again.
+func (p *Port) resend() error {
+	for _, c := range p.inflight {
+		if err := p.send(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fail fails every call in flight
+func (p *Port) fail(err error) {
+	for _, c := range p.inflight {
+		c.done, c.err = true, err
+		p.countDone(c)
+	}
+	p.inflight = nil
+}
+
+// abort brings the bridge back to idle after a wait was cancelled with
+// calls in flight. CMD_ABORT stops a running stream or delay, everything
+// the bridge still sends is discarded, and the link is checked: framed mode
+// is resynchronized, the 2.x protocol pinged. Whether the calls in flight
+// ran is unknown.
+func (p *Port) abort() error {
+	if _, err := p.port.Write([]byte{CMD_ABORT}); err != nil {
+		return err
+	}
+	if err := p.drain(); err != nil {
+		return err
+	}
+	if p.framed {
+		return p.resync(context.Background())
+	}
+	// Firmware without CMD_ABORT finishes a delay first, then answers it
+	// and the abort byte ('K', 'E' 0x01) ahead of the pong
+	return p.ping(context.Background(), 3)
+}
+
+// Resync recovers the link after an error. Calls in flight fail, a running
+// stream is aborted and its output drained, and the bridge is pinged (or
+// framed mode renegotiated) until it answers cleanly. It returns
+// ErrNoDevice if the bridge stops answering. The pipeline resyncs on its
+// own before the next command after the link broke; PMP300 state is up to
+// the caller.
+func (p *Port) Resync(ctx context.Context) error {
+	p.fail(fmt.Errorf("%w: resynchronizing", ErrDesync))
+	p.resyncs++
+	var err error
+	for attempt := 0; attempt < RESYNC_ATTEMPTS; attempt++ {
+		if cerr := ctx.Err(); cerr != nil {
+			return cerr
+		}
+		if err = p.abort(); err == nil {
+			p.needResync = false
+			return nil
+		}
+	}
+	if errors.Is(err, ErrNoDevice) {
+		return fmt.Errorf("resync failed: %w", err)
+	}
+	return fmt.Errorf("resync failed after %d attempts: %w", RESYNC_ATTEMPTS, err)
+}
+
+// drain discards input until the bridge has been quiet for DRAIN_QUIET
+func (p *Port) drain() error {
+	p.unread = nil
+	buf := make([]byte, 256)
+	start := time.Now()
+	var idle time.Duration
+	for idle < DRAIN_QUIET {
+		n, err := p.port.Read(buf)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			idle = 0
+		} else {
+			idle += READ_POLL
+		}
+		if time.Since(start) > p.timeout {
+			return fmt.Errorf("%w: bridge still sending after %v", ErrDesync, p.timeout)
+		}
+	}
+	return nil
+}
+
+// Flush waits for every submitted command and returns the first error
+func (p *Port) Flush() error {
+	return p.FlushContext(context.Background())
+}
+
+// FlushContext is Flush with a context
+func (p *Port) FlushContext(ctx context.Context) error {
+	calls := p.inflight
+	for len(p.inflight) > 0 {
+		p.complete(ctx)
+	}
+	for _, c := range calls {
+		if c.err != nil {
+			return c.err
+		}
+	}
+	return nil
+}
+
+// readResponse reads and checks the response to c. In framed mode code is
+// the error code of an error frame, after which the bridge drops frames
+// until resynchronized.
+func (p *Port) readResponse(ctx context.Context, c *call) (resp []byte, code byte, err error) {
+	if err := p.pace(ctx, c); err != nil {
+		return nil, 0, err
+	}
+	if p.framed {
+		seq, payload, err := p.readFrame(ctx)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(payload) == 2 && payload[0] == RESP_ERROR && c.want != RESP_ERROR {
+			return nil, payload[1], checkResponse(payload[0], c.want, payload[1:])
+		}
+		if seq != c.seq {
+			return nil, 0, fmt.Errorf("%w: response sequence mismatch: expected %d, got %d", ErrDesync, c.seq, seq)
+		}
+		if err := checkResponse(payload[0], c.want, payload[1:]); err != nil {
+			return nil, 0, err
+		}
+		if len(payload) != 1+c.n {
+			return nil, 0, fmt.Errorf("%w: response length %d, expected %d", ErrDesync, len(payload), 1+c.n)
+		}
+		return payload[1:], 0, nil
+	}
+
+	// Unframed, anything unexpected leaves the stream out of step
+	head := make([]byte, 1+c.n)
+	if _, err := p.readFull(ctx, head[:1]); err != nil {
+		return nil, 0, err
+	}
+	if head[0] == RESP_ERROR {
+		errCode := make([]byte, 1)
+		if _, err := p.readFull(ctx, errCode); err != nil {
+			return nil, 0, err
+		}
+		return nil, 0, checkResponse(head[0], c.want, errCode)
+	}
+	if err := checkResponse(head[0], c.want, nil); err != nil {
+		return nil, 0, err
+	}
+	if _, err := p.readFull(ctx, head[1:]); err != nil {
+		return nil, 0, err
+	}
+	return head[1:], 0, nil
+}
+
+// pace sends the pieces of a paced stream, each when the bridge asks for it
+// with RESP_READY. Any other byte starts the response, which the bridge
+// sends instead after a failure; it is kept for readFull. The pieces are
+// sent regardless of ctx, so the PMP300 is not left in the middle of a
+// block.
+func (p *Port) pace(ctx context.Context, c *call) error {
+	ctx = context.WithoutCancel(ctx)
+	b := make([]byte, 1)
+	for c.next < len(c.pieces) {
+		if _, err := p.readFull(ctx, b); err != nil {
+			return err
+		}
+		if b[0] != RESP_READY {
+			p.unread = b
+			return nil
+		}
+		piece := c.pieces[c.next]
+		p.commandStats(c.req).BytesOut += int64(len(piece))
+		if _, err := p.port.Write(piece); err != nil {
+			return err
+		}
+		c.next++
+	}
+	return nil
+}
+
+// frameRejected reports error codes for frames that were not executed and
+// can be resent
+func frameRejected(code byte) bool {
+	return code == ERR_CRC || code == ERR_FRAME || code == ERR_TIMEOUT || code == ERR_DROPPED
+}
+
+// SubmitOutByte queues OutByte. The returned function waits for its result.
+func (p *Port) SubmitOutByte(offset uint16, value byte) func() error {
+	return p.SubmitOutByteContext(context.Background(), offset, value)
+}
+
+// SubmitOutByteContext is SubmitOutByte with a context, which also bounds
+// the wait
+func (p *Port) SubmitOutByteContext(ctx context.Context, offset uint16, value byte) func() error {
+	var cmd byte
+	switch offset {
+	case 0:
+		cmd = CMD_WRITE_DATA
+	case 2:
+		cmd = CMD_WRITE_CTRL
+	default:
+		return func() error { return fmt.Errorf("invalid offset: %d", offset) }
+	}
+	c := p.submit(ctx, []byte{cmd, value}, RESP_OK, 0)
+	return func() error { _, err := p.wait(ctx, c); return err }
+}
+
+// SubmitInByte queues InByte. The returned function waits for the status.
+func (p *Port) SubmitInByte(offset uint16) func() (byte, error) {
+	return p.SubmitInByteContext(context.Background(), offset)
+}
+
+// SubmitInByteContext is SubmitInByte with a context
+func (p *Port) SubmitInByteContext(ctx context.Context, offset uint16) func() (byte, error) {
+	if offset != 1 {
+		return func() (byte, error) { return 0, fmt.Errorf("invalid offset: %d", offset) }
+	}
+	c := p.submit(ctx, []byte{CMD_READ_STATUS}, RESP_VALUE, 1)
+	return func() (byte, error) {
+		resp, err := p.wait(ctx, c)
+		if err != nil {
+			return 0, err
+		}
+		return resp[0], nil
+	}
+}
+
+// SubmitDelayMilliseconds queues DelayMilliseconds
+func (p *Port) SubmitDelayMilliseconds(ms uint16) func() error {
+	return p.SubmitDelayMillisecondsContext(context.Background(), ms)
+}
+
+// SubmitDelayMillisecondsContext is SubmitDelayMilliseconds with a context
+func (p *Port) SubmitDelayMillisecondsContext(ctx context.Context, ms uint16) func() error {
+	c := p.submit(ctx, []byte{CMD_DELAY_MS, byte(ms >> 8), byte(ms & 0xFF)}, RESP_OK, 0)
+	return func() error { _, err := p.wait(ctx, c); return err }
+}
+
+// SubmitCommandOut queues CommandOut
+func (p *Port) SubmitCommandOut(data, ctrl1, ctrl2 byte) func() error {
+	return p.SubmitCommandOutContext(context.Background(), data, ctrl1, ctrl2)
+}
+
+// SubmitCommandOutContext is SubmitCommandOut with a context
+func (p *Port) SubmitCommandOutContext(ctx context.Context, data, ctrl1, ctrl2 byte) func() error {
+	c := p.submit(ctx, []byte{CMD_COMMANDOUT, data, ctrl1, ctrl2}, RESP_OK, 0)
+	return func() error { _, err := p.wait(ctx, c); return err }
+}
+
+// SubmitReadNibbleBlock queues ReadNibbleBlock. The returned function waits
+// for the data.
+func (p *Port) SubmitReadNibbleBlock(count uint16) func() ([]byte, error) {
+	return p.SubmitReadNibbleBlockContext(context.Background(), count)
+}
+
+// SubmitReadNibbleBlockContext is SubmitReadNibbleBlock with a context.
+// Firmware 3.5 checks the read (see ReadNibbleRange).
+func (p *Port) SubmitReadNibbleBlockContext(ctx context.Context, count uint16) func() ([]byte, error) {
+	if p.HasNibbleCheck() {
+		return p.SubmitReadNibbleRangeContext(ctx, 0, count)
+	}
+	c := p.submit(ctx, []byte{CMD_READ_NIBBLE_BLK, byte(count >> 8), byte(count & 0xFF)}, RESP_OK, int(count))
+	return func() ([]byte, error) { return p.wait(ctx, c) }
+}
+
+// SubmitWritePMPChunk queues WritePMPChunk
+func (p *Port) SubmitWritePMPChunk(data []byte) func() error {
+	return p.SubmitWritePMPChunkContext(context.Background(), data)
+}
+
+// SubmitWritePMPChunkContext is SubmitWritePMPChunk with a context
+func (p *Port) SubmitWritePMPChunkContext(ctx context.Context, data []byte) func() error {
+	if len(data) != 528 {
+		return func() error { return fmt.Errorf("chunk must be exactly 528 bytes, got %d", len(data)) }
+	}
+	buf := make([]byte, 1+528)
+	buf[0] = CMD_WRITE_PMP_CHUNK
+	copy(buf[1:], data)
+	c := p.submit(ctx, buf, RESP_OK, 0)
+	return func() error { _, err := p.wait(ctx, c); return err }
+}
@@ -0,0 +1,125 @@
+package arduino_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/murdinc/pmp300/pkg/arduino"
+)
+
+// TestPipelineWindow submits delays, which keep the bridge busy, to a slow
+// bridge faster than it works them off. The bytes waiting for the bridge
+// must never exceed the window.
+func TestPipelineWindow(t *testing.T) {
+	for _, tc := range []struct {
+		window   int
+		unframed bool
+	}{
+		{0, false},
+		{0, true},
+		{16, false},
+	} {
+		t.Run(fmt.Sprintf("window %d unframed %v", tc.window, tc.unframed), func(t *testing.T) {
+			link := newSimLink(t, newSim(t), true)
+			port := openSim(t, link, arduino.Options{Window: tc.window, Unframed: tc.unframed})
+			defer port.Close()
+			link.setDelay(50 * time.Microsecond)
+
+			window := tc.window
+			if window == 0 {
+				window = arduino.PIPELINE_WINDOW
+			}
+			command := 3 // 'M' <high> <low>
+			if !tc.unframed {
+				command += arduino.FRAME_HEADER_SIZE + 2
+			}
+
+			link.peakQueued()
+			var waits []func() error
+			for i := 0; i < 40; i++ {
+				waits = append(waits, port.SubmitDelayMilliseconds(2))
+				waits = append(waits, port.SubmitOutByte(0, byte(i)))
+			}
+			for i, wait := range waits {
+				if err := wait(); err != nil {
+					t.Fatalf("call %d: %v", i, err)
+				}
+			}
+			peak := link.peakQueued()
+			if peak > window {
+				t.Errorf("%d bytes waited for the bridge, window is %d", peak, window)
+			}
+			if peak < window-command {
+				t.Errorf("at most %d bytes waited for the bridge: the window of %d was never filled", peak, window)
+			}
+		})
+	}
+}
+
+// TestPipelineError checks that a command the bridge refuses fails on its
+// own wait, while the pipelined commands around it succeed
+func TestPipelineError(t *testing.T) {
+	for _, unframed := range []bool{false, true} {
+		t.Run(fmt.Sprintf("unframed %v", unframed), func(t *testing.T) {
+			link := newSimLink(t, newSim(t), true)
+			port := openSim(t, link, arduino.Options{Unframed: unframed})
+			defer port.Close()
+
+			// The third write reaches the bridge as an unknown command
+			writes := 0
+			link.tamper(func(data []byte) []byte {
+				cmd := 0
+				if !unframed {
+					cmd = arduino.FRAME_HEADER_SIZE
+				}
+				if len(data) > cmd && data[cmd] == arduino.CMD_WRITE_DATA {
+					if writes++; writes == 3 {
+						data[cmd] = 'Z'
+						if !unframed {
+							reseal(data)
+						}
+					}
+				}
+				return data
+			}, nil)
+
+			var waits []func() error
+			for i := 0; i < 6; i++ {
+				waits = append(waits, port.SubmitOutByte(0, byte(i)))
+			}
+			last := waits[len(waits)-1]()
+			errs := make([]error, len(waits))
+			for i, wait := range waits {
+				errs[i] = wait()
+			}
+			for i := 0; i < 2; i++ {
+				if errs[i] != nil {
+					t.Errorf("write %d before the refused one: %v", i, errs[i])
+				}
+			}
+			if !errors.Is(errs[2], arduino.ErrUnknownCommand) {
+				t.Errorf("refused write: %v, want ErrUnknownCommand", errs[2])
+			}
+			if !unframed {
+				// The bridge dropped the frames behind the refused one; they
+				// were resent
+				if last != nil {
+					t.Errorf("last write: %v", last)
+				}
+				for i := 3; i < len(errs); i++ {
+					if errs[i] != nil {
+						t.Errorf("write %d after the refused one: %v", i, errs[i])
+					}
+				}
+			}
+			if err := port.Flush(); err != nil {
+				t.Errorf("flush after the error was reported: %v", err)
+			}
+			if err := port.Ping(); err != nil {
+				t.Errorf("ping after the error: %v", err)
+			}
+		})
+	}
+}
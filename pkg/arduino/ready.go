@@ -0,0 +1,69 @@
+package arduino
+
+import (
+	"bytes"
+	"context"
+	"time"
+)
+
+// BOOT_TIMEOUT is the longest wait for the ready banner of a board that was
+// reset by opening the port: bootloader plus setup()
+const BOOT_TIMEOUT = 3 * time.Second
+
+// READY_BANNER ends the line the firmware prints at the end of setup()
+var READY_BANNER = []byte("Ready\r\n")
+
+// waitReady waits until the bridge answers. A bridge that is already
+// running answers the ping with a lone pong, which may take a while over a
+// relay or a busy USB hub. A board that was reset when the port was opened
+// is waited for until it prints its ready banner. A bridge that is silent
+// either way may still be in framed mode, left behind by a host that never
+// closed the port; it is switched back to the 2.x protocol. Like readFull,
+// the wait counts polls rather than wall time.
+func (p *Port) waitReady(ctx context.Context) error {
+	if _, err := p.port.Write([]byte{CMD_PING}); err != nil {
+		return err
+	}
+
+	// The banner starts with a 'P' as well, but it is printed in one go
+	var received []byte
+	buf := make([]byte, 256)
+	var idle time.Duration
+	for !bytes.Contains(received, READY_BANNER) && idle < BOOT_TIMEOUT {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, err := p.port.Read(buf)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			idle += READ_POLL
+			continue
+		}
+		if received == nil && n == 1 && buf[0] == RESP_PONG {
+			return nil
+		}
+		// The board is booting, or the ping got lost in a half-sent
+		// command or a frame
+		received = append(received, buf[:n]...)
+	}
+
+	if !bytes.Contains(received, READY_BANNER) {
+		// CMD_FRAMING gets through in any state of framed mode; in the 2.x
+		// protocol the frame is answered with errors and a 'K', all drained
+		if _, err := p.port.Write(AppendFrame(nil, 0, []byte{CMD_FRAMING, FRAMING_RAW})); err != nil {
+			return err
+		}
+		if err := p.drain(); err != nil {
+			return err
+		}
+	}
+	p.port.ResetInputBuffer()
+
+	// A bridge answers within milliseconds once it has booted
+	saved := p.timeout
+	p.timeout = min(p.timeout, PROBE_TIMEOUT)
+	defer func() { p.timeout = saved }()
+	return p.PingContext(ctx)
+}
@@ -0,0 +1,40 @@
+package arduino_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/murdinc/pmp300/pkg/arduino"
+)
+
+// TestWaitReadySlowLink opens a running bridge whose answers take several
+// polls to arrive, as over a relay. Its pong must be taken as such rather
+// than waiting out the banner and resetting framed mode.
+func TestWaitReadySlowLink(t *testing.T) {
+	sim := newSim(t)
+	link := newSimLink(t, sim, true)
+	port := openSim(t, link, arduino.Options{})
+	if err := port.Close(); err != nil {
+		t.Fatal(err)
+	}
+	<-link.done
+
+	link = newSimLink(t, sim, false)
+	link.setLatency(3 * arduino.READ_POLL)
+	start := time.Now()
+	port = openSim(t, link, arduino.Options{})
+	defer port.Close()
+	if d := time.Since(start); d >= arduino.BOOT_TIMEOUT {
+		t.Errorf("open took %v, as long as a boot", d)
+	}
+	reset := arduino.AppendFrame(nil, 0, []byte{arduino.CMD_FRAMING, arduino.FRAMING_RAW})
+	for _, w := range link.hostWrites() {
+		if bytes.Equal(w, reset) {
+			t.Error("framed mode was reset on a bridge that answered")
+		}
+	}
+	if err := port.Ping(); err != nil {
+		t.Error(err)
+	}
+}
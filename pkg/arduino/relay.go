@@ -0,0 +1,426 @@
+package arduino
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// Relay protocol. serve-bridge relays the serial byte stream of a bridge
+// over TCP or a Unix socket in messages of
+//
+//	<type> <len_hi> <len_lo> <payload...>
+//
+// RELAY_DATA carries serial bytes in either direction. The client also
+// sends RELAY_BAUD (the rate, 4 bytes high first) and RELAY_PURGE, which
+// the server applies to its serial port in stream order. The server opens
+// every connection with RELAY_HELLO (protocol version), or RELAY_ERROR
+// (reason) followed by closing it.
+const (
+	RELAY_HELLO = 'H'
+	RELAY_DATA  = 'D'
+	RELAY_BAUD  = 'U'
+	RELAY_PURGE = 'X'
+	RELAY_ERROR = 'E'
+)
+
+// RELAY_VERSION is the relay protocol version sent in RELAY_HELLO
+const RELAY_VERSION = 1
+
+// RELAY_PORT is the default TCP port of serve-bridge
+const RELAY_PORT = 7300
+
+// RELAY_MAX_PAYLOAD is the largest message payload
+const RELAY_MAX_PAYLOAD = 0xFFFF
+
+// RELAY_BUSY_WAIT is how long a client waits for the previous one to
+// finish before it is refused. It covers the previous client's disconnect
+// still being on its way when a script runs the next command.
+const RELAY_BUSY_WAIT = 2 * time.Second
+
+// RelayAddress splits a relay device address, tcp://host:port or
+// unix:///path/to/socket, into network and address. ok is false for
+// anything else, such as a serial device path.
+func RelayAddress(device string) (network, address string, ok bool) {
+	for _, network := range []string{"tcp", "unix"} {
+		if address, ok := strings.CutPrefix(device, network+"://"); ok {
+			return network, address, true
+		}
+	}
+	return "", "", false
+}
+
+// writeRelayMessage writes one message, splitting data messages that
+// exceed RELAY_MAX_PAYLOAD
+func writeRelayMessage(w io.Writer, typ byte, payload []byte) error {
+	for {
+		n := min(len(payload), RELAY_MAX_PAYLOAD)
+		msg := append([]byte{typ, byte(n >> 8), byte(n)}, payload[:n]...)
+		if _, err := w.Write(msg); err != nil {
+			return err
+		}
+		payload = payload[n:]
+		if len(payload) == 0 {
+			return nil
+		}
+	}
+}
+
+// readRelayMessage reads one message
+func readRelayMessage(r *bufio.Reader) (typ byte, payload []byte, err error) {
+	var header [3]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	payload = make([]byte, int(header[1])<<8|int(header[2]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+// relayPort is the client side of a relay connection. It stands in for the
+// serial port: reads time out every READ_POLL like the serial port's do.
+type relayPort struct {
+	conn net.Conn
+
+	mu      sync.Mutex // Serializes writes
+	data    chan []byte
+	err     error // Why data was closed
+	pending []byte
+}
+
+// dialRelay connects to a serve-bridge server and waits for its hello
+func dialRelay(network, address string, timeout time.Duration) (*relayPort, error) {
+	conn, err := net.DialTimeout(network, address, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNoDevice, err)
+	}
+	// The server holds a client for up to RELAY_BUSY_WAIT before it answers
+	// one that finds the bridge in use
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(timeout + RELAY_BUSY_WAIT))
+	typ, payload, err := readRelayMessage(r)
+	conn.SetReadDeadline(time.Time{})
+	switch {
+	case err != nil:
+		conn.Close()
+		return nil, fmt.Errorf("%w: %s://%s sent no relay greeting: %v", ErrNoDevice, network, address, err)
+	case typ == RELAY_ERROR:
+		conn.Close()
+		return nil, fmt.Errorf("relay %s://%s refused: %s", network, address, payload)
+	case typ != RELAY_HELLO || len(payload) != 1 || payload[0] != RELAY_VERSION:
+		conn.Close()
+		return nil, fmt.Errorf("%s://%s is not a pmp300 relay of version %d", network, address, RELAY_VERSION)
+	}
+
+	rp := &relayPort{conn: conn, data: make(chan []byte, 64)}
+	go rp.receive(r)
+	return rp, nil
+}
+
+// receive queues incoming serial data until the connection ends
+func (rp *relayPort) receive(r *bufio.Reader) {
+	defer close(rp.data)
+	for {
+		typ, payload, err := readRelayMessage(r)
+		if err != nil {
+			rp.err = fmt.Errorf("relay connection lost: %w", err)
+			return
+		}
+		switch typ {
+		case RELAY_DATA:
+			rp.data <- payload
+		case RELAY_ERROR:
+			rp.err = fmt.Errorf("relay: %s", payload)
+			return
+		}
+	}
+}
+
+func (rp *relayPort) Read(buf []byte) (int, error) {
+	if len(rp.pending) == 0 {
+		timer := time.NewTimer(READ_POLL)
+		defer timer.Stop()
+		select {
+		case data, ok := <-rp.data:
+			if !ok {
+				return 0, rp.err
+			}
+			rp.pending = data
+		case <-timer.C:
+			return 0, nil
+		}
+	}
+	n := copy(buf, rp.pending)
+	rp.pending = rp.pending[n:]
+	return n, nil
+}
+
+func (rp *relayPort) Write(buf []byte) (int, error) {
+	if err := rp.send(RELAY_DATA, buf); err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+// ResetInputBuffer discards what has arrived and purges the server's
+// serial input. Bytes already on their way are not caught.
+func (rp *relayPort) ResetInputBuffer() error {
+	rp.pending = nil
+	for {
+		select {
+		case _, ok := <-rp.data:
+			if !ok {
+				return rp.err
+			}
+		default:
+			return rp.send(RELAY_PURGE, nil)
+		}
+	}
+}
+
+func (rp *relayPort) ResetOutputBuffer() error { return nil }
+
+// SetMode changes the rate of the server's serial port
+func (rp *relayPort) SetMode(mode *serial.Mode) error {
+	rate := mode.BaudRate
+	return rp.send(RELAY_BAUD, []byte{byte(rate >> 24), byte(rate >> 16), byte(rate >> 8), byte(rate)})
+}
+
+func (rp *relayPort) Close() error {
+	return rp.conn.Close()
+}
+
+func (rp *relayPort) send(typ byte, payload []byte) error {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	return writeRelayMessage(rp.conn, typ, payload)
+}
+
+// RelayServer shares a bridge's serial port with network clients, one at a
+// time. It keeps the port open between clients, so the board is not reset.
+type RelayServer struct {
+	device string
+	port   serial.Port
+	lock   *Lock
+
+	// Logf receives connection events (default: discarded)
+	Logf func(format string, args ...any)
+
+	busy   chan struct{} // Holds a token while a client is served
+	baud   int           // Rate of the serial port
+	mu     sync.Mutex
+	client string // The client being served, for messages
+}
+
+// NewRelayServer opens the serial device of a bridge for relaying. The
+// device stays locked until Close, so local commands cannot interfere with
+// clients; with wait it waits for the device like Options.Wait.
+func NewRelayServer(ctx context.Context, device string, wait bool) (*RelayServer, error) {
+	lock, err := LockDevice(ctx, device, wait)
+	if err != nil {
+		return nil, err
+	}
+	port, err := openSerial(device)
+	if err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+	return &RelayServer{
+		device: device,
+		port:   port,
+		lock:   lock,
+		baud:   DEFAULT_BAUD,
+		Logf:   func(string, ...any) {},
+		busy:   make(chan struct{}, 1),
+	}, nil
+}
+
+// Close closes the serial port and releases its lock
+func (s *RelayServer) Close() error {
+	err := s.port.Close()
+	s.lock.Unlock()
+	return err
+}
+
+// Serve accepts clients on l until ctx is done or l fails. A client that
+// connects while another is being served waits up to RELAY_BUSY_WAIT, then
+// it is refused.
+func (s *RelayServer) Serve(ctx context.Context, l net.Listener) error {
+	stop := context.AfterFunc(ctx, func() { l.Close() })
+	defer stop()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+// handle relays between one client and the serial port until the client
+// disconnects
+func (s *RelayServer) handle(conn net.Conn) {
+	defer conn.Close()
+	who := "client " + conn.RemoteAddr().String()
+	if conn.RemoteAddr().Network() == "unix" {
+		who = "local client"
+	}
+
+	timer := time.NewTimer(RELAY_BUSY_WAIT)
+	select {
+	case s.busy <- struct{}{}:
+		timer.Stop()
+	case <-timer.C:
+		s.mu.Lock()
+		busy := s.client
+		s.mu.Unlock()
+		s.Logf("Refused %s, bridge in use by %s", who, busy)
+		writeRelayMessage(conn, RELAY_ERROR, []byte("bridge in use by "+busy))
+		return
+	}
+	defer func() { <-s.busy }()
+	s.mu.Lock()
+	s.client = who
+	s.mu.Unlock()
+
+	// Every client starts like a fresh open: at the default rate, with
+	// nothing stale in the input
+	var mu sync.Mutex
+	send := func(typ byte, payload []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return writeRelayMessage(conn, typ, payload)
+	}
+	if err := s.setBaud(DEFAULT_BAUD); err != nil {
+		send(RELAY_ERROR, []byte(err.Error()))
+		return
+	}
+	s.port.ResetInputBuffer()
+	if err := send(RELAY_HELLO, []byte{RELAY_VERSION}); err != nil {
+		return
+	}
+	s.Logf("Connected %s", who)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, 4096)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			n, err := s.port.Read(buf)
+			if err != nil {
+				s.Logf("Serial port failed: %v", err)
+				send(RELAY_ERROR, []byte(err.Error()))
+				conn.Close()
+				return
+			}
+			if n > 0 && send(RELAY_DATA, buf[:n]) != nil {
+				conn.Close()
+				return
+			}
+		}
+	}()
+
+	err := s.receive(bufio.NewReader(conn), send)
+	close(done)
+	wg.Wait()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+		s.Logf("Disconnected %s: %v", who, err)
+	} else {
+		s.Logf("Disconnected %s", who)
+	}
+
+	// A client that did not close its Port may have left the bridge in
+	// framed mode, at a faster rate or in the middle of a command
+	if err := s.resetBridge(); err != nil {
+		s.Logf("Failed to reset the bridge: %v", err)
+	}
+}
+
+// resetBridge brings the bridge back to where a fresh open finds it: idle,
+// unframed and at DEFAULT_BAUD. A running stream is aborted and framed mode
+// reset, then the bridge is pinged at the rate the client left the port
+// at, at the default rate, and at the other rates if need be.
+func (s *RelayServer) resetBridge() error {
+	ctx := context.Background()
+	p := newPort(s.device, Options{})
+	p.port = s.port
+	p.baud = s.baud
+	reset := AppendFrame([]byte{CMD_ABORT}, 0, []byte{CMD_FRAMING, FRAMING_RAW})
+	if _, err := s.port.Write(reset); err != nil {
+		return err
+	}
+	if err := p.drain(); err != nil {
+		return err
+	}
+	if p.tryBaud(ctx, s.baud) != nil && (s.baud == DEFAULT_BAUD || p.tryBaud(ctx, DEFAULT_BAUD) != nil) {
+		if err := p.recoverBaud(ctx); err != nil {
+			return err
+		}
+	}
+	if p.baud != DEFAULT_BAUD {
+		if err := p.switchBaud(ctx, DEFAULT_BAUD); err != nil {
+			return err
+		}
+	}
+	s.baud = DEFAULT_BAUD
+	return nil
+}
+
+// receive applies a client's messages to the serial port
+func (s *RelayServer) receive(r *bufio.Reader, send func(byte, []byte) error) error {
+	for {
+		typ, payload, err := readRelayMessage(r)
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case RELAY_DATA:
+			if _, err := s.port.Write(payload); err != nil {
+				send(RELAY_ERROR, []byte(err.Error()))
+				return err
+			}
+		case RELAY_BAUD:
+			if len(payload) != 4 {
+				return fmt.Errorf("malformed baud message")
+			}
+			rate := int(payload[0])<<24 | int(payload[1])<<16 | int(payload[2])<<8 | int(payload[3])
+			if err := s.setBaud(rate); err != nil {
+				send(RELAY_ERROR, []byte(err.Error()))
+				return err
+			}
+		case RELAY_PURGE:
+			s.port.ResetInputBuffer()
+		default:
+			return fmt.Errorf("unknown relay message 0x%02X", typ)
+		}
+	}
+}
+
+// setBaud sets the rate of the serial port
+func (s *RelayServer) setBaud(rate int) error {
+	if err := s.port.SetMode(serialMode(rate)); err != nil {
+		return fmt.Errorf("failed to set %d baud: %w", rate, err)
+	}
+	s.baud = rate
+	return nil
+}
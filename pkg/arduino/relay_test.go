@@ -0,0 +1,202 @@
+//go:build linux
+
+package arduino_test
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/murdinc/pmp300/pkg/arduino"
+	"github.com/murdinc/pmp300/pkg/bridgesim"
+	"github.com/murdinc/pmp300/pkg/emulator"
+	"github.com/murdinc/pmp300/pkg/pmp300"
+)
+
+// relayBridge starts a simulated bridge on a pseudo-terminal and a relay for
+// it listening on a TCP port and a Unix socket. It returns the addresses
+// clients open; everything is stopped when the test ends.
+func relayBridge(t *testing.T) (tcp, unix string) {
+	t.Helper()
+	pty, err := bridgesim.OpenPTY()
+	if err != nil {
+		t.Skip(err)
+	}
+	rio := emulator.New(emulator.NewFlash(pmp300.BLOCKS_INTERNAL))
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		pty.Serve(bridgesim.New(rio), 10*time.Millisecond, t.Logf)
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	srv, err := arduino.NewRelayServer(ctx, pty.SlavePath(), false)
+	if err != nil {
+		cancel()
+		pty.Close()
+		t.Fatal(err)
+	}
+
+	tl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sock := filepath.Join(t.TempDir(), "relay.sock")
+	ul, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{}, 2)
+	for _, l := range []net.Listener{tl, ul} {
+		go func(l net.Listener) {
+			srv.Serve(ctx, l)
+			done <- struct{}{}
+		}(l)
+	}
+
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		<-done
+		srv.Close()
+		pty.Close()
+		<-served
+	})
+	return "tcp://" + tl.Addr().String(), "unix://" + sock
+}
+
+// openRelay opens a bridge through the relay and checks it answers
+func openRelay(t *testing.T, address string) *arduino.Port {
+	t.Helper()
+	port, err := arduino.OpenWithOptions(address, arduino.Options{})
+	if err != nil {
+		t.Fatalf("open %s: %v", address, err)
+	}
+	if err := port.Ping(); err != nil {
+		port.Close()
+		t.Fatalf("ping %s: %v", address, err)
+	}
+	return port
+}
+
+// TestRelay runs a player session over each transport in turn, the second
+// picking up the board the first client left
+func TestRelay(t *testing.T) {
+	tcp, unix := relayBridge(t)
+	data := make([]byte, 70000)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	port := openRelay(t, tcp)
+	if port.Device() != tcp {
+		t.Errorf("Device() = %q, want %q", port.Device(), tcp)
+	}
+	v, err := port.GetVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Major != bridgesim.FW_VERSION_MAJOR || v.Minor != bridgesim.FW_VERSION_MINOR {
+		t.Errorf("version %d.%d over the relay", v.Major, v.Minor)
+	}
+	pmp := pmp300.New(port)
+	if err := pmp.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	if err := pmp.FormatDevice(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := pmp.UploadFile("song.mp3", data, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := port.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	port = openRelay(t, unix)
+	defer port.Close()
+	pmp = pmp300.New(port)
+	if err := pmp.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := pmp.DownloadFile("song.mp3", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("file uploaded over TCP differs when downloaded over the Unix socket")
+	}
+}
+
+// TestRelayBusy checks that a second client waits for the first: it is
+// served if the first disconnects within RELAY_BUSY_WAIT, and refused
+// otherwise
+func TestRelayBusy(t *testing.T) {
+	tcp, unix := relayBridge(t)
+
+	first := openRelay(t, tcp)
+	start := time.Now()
+	if _, err := arduino.OpenWithOptions(unix, arduino.Options{}); err == nil {
+		t.Fatal("second client opened while the first is connected")
+	} else if !strings.Contains(err.Error(), "refused") || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("second client failed with %v, want refused as in use", err)
+	}
+	if waited := time.Since(start); waited < arduino.RELAY_BUSY_WAIT {
+		t.Errorf("second client refused after %v, want at least %v", waited, arduino.RELAY_BUSY_WAIT)
+	}
+	if err := first.Ping(); err != nil {
+		t.Errorf("first client after the refusal: %v", err)
+	}
+
+	// Closing the first client while the second waits hands over the bridge
+	opened := make(chan error, 1)
+	go func() {
+		second, err := arduino.OpenWithOptions(unix, arduino.Options{})
+		if err == nil {
+			err = second.Ping()
+			second.Close()
+		}
+		opened <- err
+	}()
+	time.Sleep(arduino.RELAY_BUSY_WAIT / 4)
+	if err := first.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-opened; err != nil {
+		t.Errorf("waiting client after the first closed: %v", err)
+	}
+}
+
+// TestRelayAbandoned reconnects after a client disconnected without closing
+// its port, leaving the bridge in framed mode at a faster rate. The server
+// resets the bridge for the next client, which finds it at once.
+func TestRelayAbandoned(t *testing.T) {
+	tcp, unix := relayBridge(t)
+
+	first := openRelay(t, tcp)
+	if !first.Framed() {
+		t.Fatal("bridge not framed over the relay")
+	}
+	if err := first.SetBaud(1000000); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Abandon(); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	second := openRelay(t, unix)
+	defer second.Close()
+	if d := time.Since(start); d >= arduino.BOOT_TIMEOUT {
+		t.Errorf("open after the abandoned client took %v", d)
+	}
+	if second.Baud() != arduino.DEFAULT_BAUD {
+		t.Errorf("second client at %d baud", second.Baud())
+	}
+	if _, err := second.GetVersion(); err != nil {
+		t.Error(err)
+	}
+}
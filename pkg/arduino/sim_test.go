@@ -0,0 +1,300 @@
+package arduino_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"go.bug.st/serial"
+
+	"github.com/murdinc/pmp300/pkg/arduino"
+	"github.com/murdinc/pmp300/pkg/bridgesim"
+	"github.com/murdinc/pmp300/pkg/emulator"
+	"github.com/murdinc/pmp300/pkg/pmp300"
+)
+
+// newSim returns a simulated bridge with an emulated PMP300 attached
+func newSim(t *testing.T) *bridgesim.Simulator {
+	t.Helper()
+	rio := emulator.New(emulator.NewFlash(pmp300.BLOCKS_INTERNAL))
+	t.Cleanup(func() { rio.Close() })
+	return bridgesim.New(rio)
+}
+
+// BOOT_DELAY is how long a simulated board takes to boot after a reset
+const BOOT_DELAY = 50 * time.Millisecond
+
+// simLink is a serial port connected to a simulator running in process.
+// Reads return what the bridge sent or time out after READ_POLL, like the
+// serial port's. Tests can slow the bridge down, delay what it sends and
+// tamper with the bytes either way.
+type simLink struct {
+	done chan struct{} // Closed when the simulator has returned
+
+	mu      sync.Mutex
+	wake    chan struct{} // Signalled when output arrives
+	input   *sync.Cond    // Signalled when the host writes
+	closed  bool
+	pending []byte     // Written by the host, not yet taken by the bridge
+	output  []outChunk // Sent by the bridge, not yet read by the host
+	writes  [][]byte   // Every write of the host
+	rate    int        // Line rate set by the host
+
+	written  int // Bytes written by the host
+	consumed int // Bytes taken by the bridge
+	peak     int // Most bytes written but not yet taken
+
+	delay   time.Duration // Per byte taken by the bridge
+	latency time.Duration // Before the host sees what the bridge sent
+
+	hostHook   func([]byte) []byte // Changes the bytes of each host write
+	bridgeHook func([]byte) []byte // Changes the bytes the bridge sends
+}
+
+// outChunk is bridge output that reaches the host at a given time
+type outChunk struct {
+	at   time.Time
+	data []byte
+}
+
+// newSimLink connects a link to sim. With reset the simulated board boots
+// first and prints its banner, as a board does when opening the port resets
+// it; otherwise the bridge carries on where the last link left it. Bytes
+// sent while the link and the bridge are at different rates are lost. The
+// link is closed when the test ends.
+func newSimLink(t *testing.T, sim *bridgesim.Simulator, reset bool) *simLink {
+	t.Helper()
+	l := &simLink{
+		done: make(chan struct{}),
+		wake: make(chan struct{}, 1),
+		rate: arduino.DEFAULT_BAUD,
+	}
+	l.input = sync.NewCond(&l.mu)
+	sim.LineRate = l.lineRate
+
+	go func() {
+		defer close(l.done)
+		run := sim.Run
+		if reset {
+			// The bootloader takes what arrives while the board boots
+			time.Sleep(BOOT_DELAY)
+			l.ResetOutputBuffer()
+		} else {
+			run = sim.Resume
+		}
+		in := make(chan byte)
+		go l.forward(in)
+		run(in, bridgeSide{l})
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		<-l.done
+	})
+	return l
+}
+
+// forward hands the host's bytes to the bridge one at a time, like the
+// receive buffer the firmware reads with Serial.read()
+func (l *simLink) forward(in chan<- byte) {
+	defer close(in)
+	for {
+		l.mu.Lock()
+		for len(l.pending) == 0 && !l.closed {
+			l.input.Wait()
+		}
+		if l.closed {
+			l.mu.Unlock()
+			return
+		}
+		b := l.pending[0]
+		l.pending = l.pending[1:]
+		delay := l.delay
+		l.mu.Unlock()
+
+		time.Sleep(delay)
+		in <- b
+
+		l.mu.Lock()
+		l.consumed++
+		l.mu.Unlock()
+	}
+}
+
+// bridgeSide is the bridge's end of a link
+type bridgeSide struct {
+	l *simLink
+}
+
+func (b bridgeSide) Write(buf []byte) (int, error) {
+	l := b.l
+	data := append([]byte(nil), buf...)
+	l.mu.Lock()
+	if l.bridgeHook != nil {
+		data = l.bridgeHook(data)
+	}
+	l.output = append(l.output, outChunk{at: time.Now().Add(l.latency), data: data})
+	l.mu.Unlock()
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+	return len(buf), nil
+}
+
+func (l *simLink) Write(buf []byte) (int, error) {
+	data := append([]byte(nil), buf...)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return 0, errors.New("link closed")
+	}
+	if l.hostHook != nil {
+		data = l.hostHook(data)
+	}
+	l.writes = append(l.writes, data)
+	l.pending = append(l.pending, data...)
+	l.written += len(data)
+	l.peak = max(l.peak, l.written-l.consumed)
+	l.input.Signal()
+	return len(buf), nil
+}
+
+func (l *simLink) Read(buf []byte) (int, error) {
+	deadline := time.Now().Add(arduino.READ_POLL)
+	for {
+		l.mu.Lock()
+		if l.closed {
+			l.mu.Unlock()
+			return 0, errors.New("link closed")
+		}
+		now := time.Now()
+		n := 0
+		for len(l.output) > 0 && n < len(buf) && !l.output[0].at.After(now) {
+			c := copy(buf[n:], l.output[0].data)
+			n += c
+			if l.output[0].data = l.output[0].data[c:]; len(l.output[0].data) == 0 {
+				l.output = l.output[1:]
+			}
+		}
+		wait := time.Until(deadline)
+		if len(l.output) > 0 {
+			wait = min(wait, time.Until(l.output[0].at))
+		}
+		l.mu.Unlock()
+
+		if n > 0 {
+			return n, nil
+		}
+		if time.Now().After(deadline) {
+			return 0, nil
+		}
+		select {
+		case <-l.wake:
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (l *simLink) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	l.input.Broadcast()
+	return nil
+}
+
+// ResetInputBuffer discards what the bridge sent and the host has not read
+func (l *simLink) ResetInputBuffer() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for len(l.output) > 0 && !l.output[0].at.After(now) {
+		l.output = l.output[1:]
+	}
+	return nil
+}
+
+// ResetOutputBuffer discards what the host wrote and the bridge has not
+// taken
+func (l *simLink) ResetOutputBuffer() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pending = nil
+	l.written = l.consumed
+	return nil
+}
+
+func (l *simLink) SetMode(mode *serial.Mode) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = mode.BaudRate
+	return nil
+}
+
+// lineRate returns the rate set by the host
+func (l *simLink) lineRate() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// inject writes bytes to the bridge behind the host's back
+func (l *simLink) inject(data []byte) {
+	l.Write(data)
+}
+
+// setDelay slows the bridge down to take a byte every d
+func (l *simLink) setDelay(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.delay = d
+}
+
+// setLatency delays everything the bridge sends by d
+func (l *simLink) setLatency(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.latency = d
+}
+
+// tamper installs functions that change, or drop, the host's writes and
+// the bridge's output; nil leaves a direction alone
+func (l *simLink) tamper(host, bridge func([]byte) []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.hostHook, l.bridgeHook = host, bridge
+}
+
+// peakQueued returns the most bytes that were written but not yet taken by
+// the bridge since the last call
+func (l *simLink) peakQueued() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	peak := l.peak
+	l.peak = l.written - l.consumed
+	return peak
+}
+
+// hostWrites returns the host's writes so far
+func (l *simLink) hostWrites() [][]byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([][]byte(nil), l.writes...)
+}
+
+// drop is a tamper function that loses every byte
+func drop([]byte) []byte {
+	return nil
+}
+
+// openSim opens a Port on link
+func openSim(t *testing.T, link *simLink, opts arduino.Options) *arduino.Port {
+	t.Helper()
+	port, err := arduino.OpenPort(context.Background(), "sim", link, opts)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	return port
+}
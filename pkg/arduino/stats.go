@@ -0,0 +1,209 @@
+package arduino
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// LATENCY_BUCKETS are the upper bounds of the latency histogram buckets. A
+// final bucket counts everything slower than the last bound.
+var LATENCY_BUCKETS = []time.Duration{
+	100 * time.Microsecond, 250 * time.Microsecond, 500 * time.Microsecond,
+	time.Millisecond, 2500 * time.Microsecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second,
+}
+
+// Histogram is a latency histogram over LATENCY_BUCKETS
+type Histogram struct {
+	Counts []int         `json:"counts"` // Per bucket, plus one for slower
+	Sum    time.Duration `json:"sum_ns"`
+	Min    time.Duration `json:"min_ns"`
+	Max    time.Duration `json:"max_ns"`
+}
+
+// Add records one latency
+func (h *Histogram) Add(d time.Duration) {
+	if h.Counts == nil {
+		h.Counts = make([]int, len(LATENCY_BUCKETS)+1)
+	}
+	i := sort.Search(len(LATENCY_BUCKETS), func(i int) bool { return d <= LATENCY_BUCKETS[i] })
+	h.Counts[i]++
+	if h.Count() == 1 || d < h.Min {
+		h.Min = d
+	}
+	if d > h.Max {
+		h.Max = d
+	}
+	h.Sum += d
+}
+
+// Count returns the number of latencies recorded
+func (h Histogram) Count() int {
+	total := 0
+	for _, n := range h.Counts {
+		total += n
+	}
+	return total
+}
+
+// Mean returns the mean latency
+func (h Histogram) Mean() time.Duration {
+	n := h.Count()
+	if n == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(n)
+}
+
+// Percentile returns the upper bound of the bucket holding quantile q
+// (0 to 1), capped at Max
+func (h Histogram) Percentile(q float64) time.Duration {
+	n := h.Count()
+	if n == 0 {
+		return 0
+	}
+	rank := int(q*float64(n-1)) + 1
+	for i, count := range h.Counts {
+		rank -= count
+		if rank <= 0 && i < len(LATENCY_BUCKETS) {
+			return min(LATENCY_BUCKETS[i], h.Max)
+		}
+	}
+	return h.Max
+}
+
+// merge adds the latencies of o
+func (h *Histogram) merge(o Histogram) {
+	if o.Count() == 0 {
+		return
+	}
+	if h.Count() == 0 || o.Min < h.Min {
+		h.Min = o.Min
+	}
+	if h.Counts == nil {
+		h.Counts = make([]int, len(LATENCY_BUCKETS)+1)
+	}
+	for i, n := range o.Counts {
+		h.Counts[i] += n
+	}
+	h.Max = max(h.Max, o.Max)
+	h.Sum += o.Sum
+}
+
+// CommandStats counts the traffic of one command. Latency runs from
+// sending a command to the end of its response, so for pipelined commands
+// it includes the time spent queued behind earlier ones.
+type CommandStats struct {
+	Name     string    `json:"name"`
+	Calls    int       `json:"calls"`     // Round trips, failed ones included
+	Errors   int       `json:"errors"`    // Calls that failed
+	Retries  int       `json:"retries"`   // Resends after a rejected frame or resync
+	BytesOut int64     `json:"bytes_out"` // Including framing and streams
+	BytesIn  int64     `json:"bytes_in"`  // Responses, including framing
+	Corrupt  int       `json:"corrupt"`   // Spans failing a nibble read check
+	Latency  Histogram `json:"latency"`   // Of successful calls
+}
+
+// Stats is a snapshot of the link statistics of a Port
+type Stats struct {
+	Commands []CommandStats `json:"commands"` // By command, busiest first
+	Resyncs  int            `json:"resyncs"`  // Link recoveries
+}
+
+// Total sums the statistics of all commands
+func (s Stats) Total() CommandStats {
+	total := CommandStats{Name: "TOTAL"}
+	for _, cs := range s.Commands {
+		total.Calls += cs.Calls
+		total.Errors += cs.Errors
+		total.Retries += cs.Retries
+		total.BytesOut += cs.BytesOut
+		total.BytesIn += cs.BytesIn
+		total.Corrupt += cs.Corrupt
+		total.Latency.merge(cs.Latency)
+	}
+	return total
+}
+
+// Command returns the statistics of the command named name, as in
+// trace files (PING, COMMANDOUT, ...)
+func (s Stats) Command(name string) CommandStats {
+	for _, cs := range s.Commands {
+		if cs.Name == name {
+			return cs
+		}
+	}
+	return CommandStats{Name: name}
+}
+
+// Stats returns the link statistics since the port was opened or
+// ResetStats was called
+func (p *Port) Stats() Stats {
+	var s Stats
+	for _, cs := range p.stats {
+		cs := *cs
+		cs.Latency.Counts = append([]int(nil), cs.Latency.Counts...)
+		s.Commands = append(s.Commands, cs)
+	}
+	sort.Slice(s.Commands, func(i, j int) bool {
+		a, b := s.Commands[i], s.Commands[j]
+		if a.Calls != b.Calls {
+			return a.Calls > b.Calls
+		}
+		return a.Name < b.Name
+	})
+	s.Resyncs = p.resyncs
+	return s
+}
+
+// ResetStats clears the link statistics
+func (p *Port) ResetStats() {
+	p.stats = nil
+	p.resyncs = 0
+}
+
+// commandStats returns the counters of the command starting req
+func (p *Port) commandStats(req []byte) *CommandStats {
+	if p.stats == nil {
+		p.stats = map[byte]*CommandStats{}
+	}
+	cs, ok := p.stats[req[0]]
+	if !ok {
+		name, known := commandNames[req[0]]
+		if !known {
+			name = fmt.Sprintf("?%02X", req[0])
+		}
+		cs = &CommandStats{Name: name}
+		p.stats[req[0]] = cs
+	}
+	return cs
+}
+
+// countSent counts the bytes of a write of c; later writes are retries
+func (p *Port) countSent(c *call) {
+	cs := p.commandStats(c.req)
+	cs.BytesOut += int64(c.size)
+	if c.sent.IsZero() {
+		c.sent = time.Now()
+	} else {
+		cs.Retries++
+	}
+}
+
+// countDone counts a finished call
+func (p *Port) countDone(c *call) {
+	cs := p.commandStats(c.req)
+	cs.Calls++
+	if c.err != nil {
+		cs.Errors++
+		return
+	}
+	cs.BytesIn += int64(1 + c.n)
+	if p.framed {
+		cs.BytesIn += FRAME_HEADER_SIZE + 2
+	}
+	cs.Latency.Add(time.Since(c.sent))
+}
@@ -0,0 +1,151 @@
+package arduino_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/murdinc/pmp300/pkg/arduino"
+	"github.com/murdinc/pmp300/pkg/pmp300"
+)
+
+// TestHistogram checks the bucketing and summary of latencies
+func TestHistogram(t *testing.T) {
+	var h arduino.Histogram
+	for _, d := range []time.Duration{
+		50 * time.Microsecond, 300 * time.Microsecond, 300 * time.Microsecond,
+		800 * time.Microsecond, 3 * time.Millisecond, 2 * time.Second,
+	} {
+		h.Add(d)
+	}
+	if h.Count() != 6 || h.Min != 50*time.Microsecond || h.Max != 2*time.Second {
+		t.Errorf("count %d, min %v, max %v", h.Count(), h.Min, h.Max)
+	}
+	if want := (2*time.Second + 4450*time.Microsecond) / 6; h.Mean() != want {
+		t.Errorf("mean %v, want %v", h.Mean(), want)
+	}
+	// The slowest bucket counts everything past the last bound
+	if n := h.Counts[len(arduino.LATENCY_BUCKETS)]; n != 1 {
+		t.Errorf("%d latencies past the last bound, want 1", n)
+	}
+	for _, tc := range []struct {
+		q    float64
+		want time.Duration
+	}{
+		{0, 100 * time.Microsecond},
+		{0.5, 500 * time.Microsecond},
+		{0.7, time.Millisecond},
+		{1, 2 * time.Second},
+	} {
+		if got := h.Percentile(tc.q); got != tc.want {
+			t.Errorf("percentile %v: %v, want %v", tc.q, got, tc.want)
+		}
+	}
+
+	var empty arduino.Histogram
+	if empty.Mean() != 0 || empty.Percentile(0.5) != 0 {
+		t.Error("an empty histogram has latencies")
+	}
+}
+
+// frameSize is the size on the wire of a frame with n payload bytes
+func frameSize(n int) int64 {
+	return int64(arduino.FRAME_HEADER_SIZE + n + 2)
+}
+
+// TestStats counts the traffic of a framed session on a simulated bridge
+func TestStats(t *testing.T) {
+	link := newSimLink(t, newSim(t), true)
+	port := openSim(t, link, arduino.Options{})
+	defer port.Close()
+	port.ResetStats()
+
+	for i := 0; i < 3; i++ {
+		if err := port.OutByte(0, byte(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := port.InByte(1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// No card is inserted, so the player rejects the address
+	if _, err := port.ReadBlock(pmp300.ADDRESS_EXTERNAL); !errors.Is(err, arduino.ErrNAK) {
+		t.Fatalf("block read from a missing card: %v, want ErrNAK", err)
+	}
+
+	s := port.Stats()
+	if s.Commands[0].Name != "WRITE_DATA" {
+		t.Errorf("busiest command %s, want WRITE_DATA", s.Commands[0].Name)
+	}
+	out := s.Command("WRITE_DATA")
+	if out.Calls != 3 || out.Errors != 0 || out.Retries != 0 {
+		t.Errorf("WRITE_DATA: %d calls, %d errors, %d retries", out.Calls, out.Errors, out.Retries)
+	}
+	if want := 3 * frameSize(2); out.BytesOut != want {
+		t.Errorf("WRITE_DATA: %d bytes out, want %d", out.BytesOut, want)
+	}
+	if want := 3 * frameSize(1); out.BytesIn != want {
+		t.Errorf("WRITE_DATA: %d bytes in, want %d", out.BytesIn, want)
+	}
+	if out.Latency.Count() != 3 || out.Latency.Min <= 0 {
+		t.Errorf("WRITE_DATA: %d latencies, fastest %v", out.Latency.Count(), out.Latency.Min)
+	}
+	in := s.Command("READ_STATUS")
+	if in.Calls != 2 || in.BytesIn != 2*frameSize(2) {
+		t.Errorf("READ_STATUS: %d calls, %d bytes in", in.Calls, in.BytesIn)
+	}
+	// A failed call counts, but not its latency
+	if block := s.Command("READ_BLOCK"); block.Calls != 1 || block.Errors != 1 || block.Latency.Count() != 0 {
+		t.Errorf("READ_BLOCK: %d calls, %d errors, %d latencies", block.Calls, block.Errors, block.Latency.Count())
+	}
+
+	total := s.Total()
+	if total.Calls != 6 || total.Errors != 1 || total.Latency.Count() != 5 {
+		t.Errorf("total: %d calls, %d errors, %d latencies", total.Calls, total.Errors, total.Latency.Count())
+	}
+	if total.Latency.Max != max(out.Latency.Max, in.Latency.Max) {
+		t.Errorf("total: slowest %v", total.Latency.Max)
+	}
+
+	port.ResetStats()
+	if s := port.Stats(); len(s.Commands) != 0 || s.Resyncs != 0 {
+		t.Errorf("after reset: %d commands, %d resyncs", len(s.Commands), s.Resyncs)
+	}
+}
+
+// TestStatsRetry checks that a frame the bridge rejects counts as a retry
+// of its call and a resync of the link
+func TestStatsRetry(t *testing.T) {
+	link := newSimLink(t, newSim(t), true)
+	port := openSim(t, link, arduino.Options{})
+	defer port.Close()
+	port.ResetStats()
+
+	// The CRC of the first write is broken on the way
+	broken := false
+	link.tamper(func(data []byte) []byte {
+		if !broken && len(data) > arduino.FRAME_HEADER_SIZE && data[arduino.FRAME_HEADER_SIZE] == arduino.CMD_WRITE_DATA {
+			broken = true
+			data[len(data)-1] ^= 0xFF
+		}
+		return data
+	}, nil)
+	if err := port.OutByte(0, 0x42); err != nil {
+		t.Fatal(err)
+	}
+	link.tamper(nil, nil)
+
+	s := port.Stats()
+	out := s.Command("WRITE_DATA")
+	if out.Calls != 1 || out.Errors != 0 || out.Retries != 1 {
+		t.Errorf("WRITE_DATA: %d calls, %d errors, %d retries; want 1, 0, 1", out.Calls, out.Errors, out.Retries)
+	}
+	if want := 2 * frameSize(2); out.BytesOut != want {
+		t.Errorf("WRITE_DATA: %d bytes out, want %d", out.BytesOut, want)
+	}
+	if s.Resyncs != 1 {
+		t.Errorf("%d resyncs, want 1", s.Resyncs)
+	}
+}
@@ -0,0 +1,395 @@
+package arduino
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// Trace files are line oriented text, one record per Read or Write on the
+// serial port:
+//
+//	# pmp300 trace v1
+//	# device /dev/ttyACM0
+//	0.000012 > 63 A8 0C 04  # COMMANDOUT
+//	0.001530 < 4B
+//	0.001544 ! read timeout
+//
+// The first field is seconds since the port was opened. '>' is a write
+// (one write per command, annotated with the command names), '<' is what a
+// single read returned and '!' is an error returned by the port. Reads that
+// timed out without data are not recorded; on replay, a read with a write
+// up next times out.
+const TRACE_HEADER = "# pmp300 trace v1"
+
+// Trace record directions
+const (
+	TRACE_WRITE = '>'
+	TRACE_READ  = '<'
+	TRACE_ERROR = '!'
+)
+
+// Parameter byte counts of each command, used to frame writes in a trace
+var commandParams = map[byte]int{
+	CMD_PING:            0,
+	CMD_VERSION:         0,
+	CMD_WRITE_DATA:      1,
+	CMD_WRITE_CTRL:      1,
+	CMD_READ_STATUS:     0,
+	CMD_DELAY_MS:        2,
+	CMD_COMMANDOUT:      3,
+	CMD_READ_NIBBLE_BLK: 2,
+	CMD_WRITE_PMP_CHUNK: 528,
+	CMD_FRAMING:         1,
+	CMD_READ_BLOCK:      3,
+	CMD_WRITE_BLOCK:     3,
+	CMD_CAPABILITIES:    0,
+	CMD_SET_BAUD:        4,
+	CMD_READ_NIBBLE_CHK: 4,
+	CMD_WAIT_STATUS:     6,
+	CMD_DELAY_US:        2,
+	CMD_SET_DATA_DIR:    1,
+}
+
+// Command names used in trace annotations
+var commandNames = map[byte]string{
+	CMD_PING:            "PING",
+	CMD_VERSION:         "VERSION",
+	CMD_WRITE_DATA:      "WRITE_DATA",
+	CMD_WRITE_CTRL:      "WRITE_CTRL",
+	CMD_READ_STATUS:     "READ_STATUS",
+	CMD_DELAY_MS:        "DELAY_MS",
+	CMD_COMMANDOUT:      "COMMANDOUT",
+	CMD_READ_NIBBLE_BLK: "READ_NIBBLE_BLK",
+	CMD_WRITE_PMP_CHUNK: "WRITE_PMP_CHUNK",
+	CMD_FRAMING:         "FRAMING",
+	CMD_READ_BLOCK:      "READ_BLOCK",
+	CMD_WRITE_BLOCK:     "WRITE_BLOCK",
+	CMD_CAPABILITIES:    "CAPABILITIES",
+	CMD_SET_BAUD:        "SET_BAUD",
+	CMD_READ_NIBBLE_CHK: "READ_NIBBLE_CHK",
+	CMD_WAIT_STATUS:     "WAIT_STATUS",
+	CMD_DELAY_US:        "DELAY_US",
+	CMD_SET_DATA_DIR:    "SET_DATA_DIR",
+}
+
+// describeCommands names the commands in a write. A WriteBlock chunk is
+// written on its own, without a command byte.
+func describeCommands(buf []byte) string {
+	if len(buf) == WRITE_BLOCK_PIECE {
+		return "WRITE_BLOCK chunk"
+	}
+	var names []string
+	for len(buf) > 0 {
+		if buf[0] == FRAME_SYNC && len(buf) >= FRAME_HEADER_SIZE {
+			length := int(buf[1])<<8 | int(buf[2])
+			if FRAME_HEADER_SIZE+length+2 <= len(buf) {
+				payload := buf[FRAME_HEADER_SIZE : FRAME_HEADER_SIZE+length]
+				names = append(names, fmt.Sprintf("[%d] %s", buf[3], describeCommands(payload)))
+				buf = buf[FRAME_HEADER_SIZE+length+2:]
+				continue
+			}
+		}
+		name, ok := commandNames[buf[0]]
+		if !ok {
+			names = append(names, fmt.Sprintf("?%02X", buf[0]))
+			break
+		}
+		names = append(names, name)
+		n := 1 + commandParams[buf[0]]
+		if n > len(buf) {
+			names = append(names, "(truncated)")
+			break
+		}
+		buf = buf[n:]
+	}
+	return strings.Join(names, " ")
+}
+
+// recorder logs all traffic of a serial port to a trace
+type recorder struct {
+	serialPort
+
+	mu    sync.Mutex
+	w     io.Writer
+	start time.Time
+}
+
+// newRecorder wraps port and writes the trace header to w
+func newRecorder(port serialPort, w io.Writer, device string) (*recorder, error) {
+	if _, err := fmt.Fprintf(w, "%s\n# device %s\n# start %s\n",
+		TRACE_HEADER, device, time.Now().Format(time.RFC3339)); err != nil {
+		return nil, fmt.Errorf("failed to write trace: %w", err)
+	}
+	return &recorder{serialPort: port, w: w, start: time.Now()}, nil
+}
+
+func (r *recorder) Write(buf []byte) (int, error) {
+	n, err := r.serialPort.Write(buf)
+	r.record(TRACE_WRITE, buf[:n], describeCommands(buf[:n]))
+	if err != nil {
+		r.record(TRACE_ERROR, nil, err.Error())
+	}
+	return n, err
+}
+
+func (r *recorder) Read(buf []byte) (int, error) {
+	n, err := r.serialPort.Read(buf)
+	if n > 0 {
+		r.record(TRACE_READ, buf[:n], "")
+	}
+	if err != nil {
+		r.record(TRACE_ERROR, nil, err.Error())
+	}
+	return n, err
+}
+
+// SetMode notes a change of the line rate in the trace
+func (r *recorder) SetMode(mode *serial.Mode) error {
+	err := r.serialPort.SetMode(mode)
+	r.mu.Lock()
+	fmt.Fprintf(r.w, "# %.6f baud %d\n", time.Since(r.start).Seconds(), mode.BaudRate)
+	r.mu.Unlock()
+	if err != nil {
+		r.record(TRACE_ERROR, nil, err.Error())
+	}
+	return err
+}
+
+// record writes one trace line. Trace write errors are ignored so that a
+// full disk never breaks a transfer.
+func (r *recorder) record(dir byte, data []byte, note string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var line strings.Builder
+	fmt.Fprintf(&line, "%.6f %c", time.Since(r.start).Seconds(), dir)
+	if dir == TRACE_ERROR {
+		line.WriteString(" " + note)
+	} else {
+		if len(data) > 0 {
+			fmt.Fprintf(&line, " % X", data)
+		}
+		if note != "" {
+			line.WriteString("  # " + note)
+		}
+	}
+	line.WriteByte('\n')
+	io.WriteString(r.w, line.String())
+}
+
+// traceRecord is one parsed trace line
+type traceRecord struct {
+	line int
+	dir  byte
+	data []byte
+	err  string
+}
+
+// replayer serves a recorded trace back in place of a serial port. Writes
+// must match the recorded writes byte for byte; reads return what the
+// recorded reads returned, or time out where the trace has a write next.
+type replayer struct {
+	records []traceRecord
+	next    int
+	pending []byte
+}
+
+// OpenReplay opens a Port that replays a trace recorded with Options.Trace.
+// The recorded session must start at Open, as traces written by the CLI do.
+func OpenReplay(path string) (*Port, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open trace: %w", err)
+	}
+	defer f.Close()
+
+	records, err := parseTrace(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse trace %s: %w", path, err)
+	}
+
+	ap := &Port{port: &replayer{records: records}, device: path, baud: DEFAULT_BAUD, window: PIPELINE_WINDOW, timeout: DEFAULT_TIMEOUT}
+	if err := ap.waitReady(context.Background()); err != nil {
+		if ap.recoverBaud(context.Background()) != nil {
+			return nil, err
+		}
+	}
+	if err := ap.negotiateReplay(); err != nil {
+		return nil, err
+	}
+	return ap, nil
+}
+
+// parseTrace reads all records of a trace
+func parseTrace(r io.Reader) ([]traceRecord, error) {
+	var records []traceRecord
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if lineNum == 1 && line != TRACE_HEADER {
+			return nil, fmt.Errorf("not a pmp300 trace")
+		}
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		ts, rest, _ := strings.Cut(line, " ")
+		if _, err := strconv.ParseFloat(ts, 64); err != nil || rest == "" {
+			return nil, fmt.Errorf("line %d: malformed record", lineNum)
+		}
+		rec := traceRecord{line: lineNum, dir: rest[0]}
+		body := strings.TrimSpace(rest[1:])
+
+		switch rec.dir {
+		case TRACE_ERROR:
+			rec.err = body
+		case TRACE_WRITE, TRACE_READ:
+			body, _, _ = strings.Cut(body, "#")
+			data, err := hex.DecodeString(strings.ReplaceAll(body, " ", ""))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNum, err)
+			}
+			rec.data = data
+		default:
+			return nil, fmt.Errorf("line %d: unknown direction %q", lineNum, rec.dir)
+		}
+		records = append(records, rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if lineNum == 0 {
+		return nil, fmt.Errorf("not a pmp300 trace")
+	}
+	return records, nil
+}
+
+// take returns the next record, which must have direction dir
+func (r *replayer) take(dir byte) (traceRecord, error) {
+	if r.next >= len(r.records) {
+		return traceRecord{}, io.EOF
+	}
+	rec := r.records[r.next]
+	if rec.dir == TRACE_ERROR {
+		r.next++
+		return traceRecord{}, errors.New(rec.err)
+	}
+	if rec.dir != dir {
+		return traceRecord{}, fmt.Errorf("replay diverged at trace line %d: expected %c, got %c", rec.line, rec.dir, dir)
+	}
+	r.next++
+	return rec, nil
+}
+
+func (r *replayer) Write(buf []byte) (int, error) {
+	rec, err := r.take(TRACE_WRITE)
+	if err != nil {
+		return 0, err
+	}
+	if string(rec.data) != string(buf) {
+		return 0, fmt.Errorf("replay diverged at trace line %d: wrote % X, trace has % X", rec.line, buf, rec.data)
+	}
+	return len(buf), r.trailingError()
+}
+
+func (r *replayer) Read(buf []byte) (int, error) {
+	if len(r.pending) == 0 {
+		if r.next < len(r.records) && r.records[r.next].dir == TRACE_WRITE {
+			return 0, nil
+		}
+		rec, err := r.take(TRACE_READ)
+		if err != nil {
+			return 0, err
+		}
+		r.pending = rec.data
+	}
+	n := copy(buf, r.pending)
+	r.pending = r.pending[n:]
+	if len(r.pending) > 0 {
+		return n, nil
+	}
+	return n, r.trailingError()
+}
+
+// trailingError returns an error recorded right after the last record
+func (r *replayer) trailingError() error {
+	if r.next < len(r.records) && r.records[r.next].dir == TRACE_ERROR {
+		r.next++
+		return errors.New(r.records[r.next-1].err)
+	}
+	return nil
+}
+
+func (r *replayer) Close() error             { return nil }
+func (r *replayer) ResetInputBuffer() error  { return nil }
+func (r *replayer) ResetOutputBuffer() error { return nil }
+
+// SetMode is a no-op: the trace holds the bytes as received at every rate
+func (r *replayer) SetMode(mode *serial.Mode) error { return nil }
+
+// negotiateReplay queries the version and capabilities and negotiates
+// framing and baud rate switches if the recorded session did
+func (p *Port) negotiateReplay() error {
+	r := p.port.(*replayer)
+	if r.nextWrite(CMD_VERSION) {
+		if _, err := p.GetVersion(); err != nil {
+			return fmt.Errorf("failed to get version: %w", err)
+		}
+		if err := p.loadCapabilities(context.Background(), r.nextWrite(CMD_CAPABILITIES)); err != nil {
+			return err
+		}
+	} else {
+		// Traces of 2.x sessions start without a version query
+		p.caps = versionCapabilities(Version{Major: 2})
+	}
+	if r.nextWrite(CMD_FRAMING, FRAMING_CRC16) {
+		if err := p.Framing(FRAMING_CRC16); err != nil {
+			return err
+		}
+	}
+	// The CLI switches rates right after opening, trying several with
+	// --baud max
+	for rate, ok := r.nextBaud(); ok; rate, ok = r.nextBaud() {
+		if err := p.SetBaud(rate); err != nil && !errors.Is(err, ErrBaudRate) {
+			return err
+		}
+	}
+	return nil
+}
+
+// nextWrite reports whether the next record writes exactly data
+func (r *replayer) nextWrite(data ...byte) bool {
+	return r.next < len(r.records) && r.records[r.next].dir == TRACE_WRITE &&
+		string(r.records[r.next].data) == string(data)
+}
+
+// nextBaud returns the rate of the next record if it is a CMD_SET_BAUD
+// write, framed or not
+func (r *replayer) nextBaud() (int, bool) {
+	if r.next >= len(r.records) || r.records[r.next].dir != TRACE_WRITE {
+		return 0, false
+	}
+	data := r.records[r.next].data
+	if len(data) > FRAME_HEADER_SIZE && data[0] == FRAME_SYNC {
+		data = data[FRAME_HEADER_SIZE:]
+	}
+	if len(data) < 5 || data[0] != CMD_SET_BAUD {
+		return 0, false
+	}
+	return int(data[1])<<24 | int(data[2])<<16 | int(data[3])<<8 | int(data[4]), true
+}
@@ -0,0 +1,138 @@
+package arduino_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/murdinc/pmp300/pkg/arduino"
+	"github.com/murdinc/pmp300/pkg/pmp300"
+)
+
+// upload formats the player and uploads a file
+func upload(t *testing.T, port *arduino.Port, data []byte) {
+	t.Helper()
+	pmp := pmp300.New(port)
+	if err := pmp.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	if err := pmp.FormatDevice(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := pmp.UploadFile("song.mp3", data, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// download checks that the player holds the uploaded file. Then the bridge
+// misses a ping, which times out, and the link is recovered.
+func download(t *testing.T, port *arduino.Port, link *simLink, data []byte) {
+	t.Helper()
+	pmp := pmp300.New(port)
+	if err := pmp.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := pmp.DownloadFile("song.mp3", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded file differs from the upload")
+	}
+
+	if link != nil {
+		link.tamper(nil, drop)
+	}
+	if err := port.Ping(); !errors.Is(err, arduino.ErrNoDevice) {
+		t.Fatalf("ping the bridge did not answer: %v, want ErrNoDevice", err)
+	}
+	if link != nil {
+		link.tamper(nil, nil)
+	}
+	if err := port.Resync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := port.Ping(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// recordSession uploads a file to a simulated player, then records a
+// download session and returns the path of its trace. Uploads write the
+// time into the directory, so only the download replays.
+func recordSession(t *testing.T, data []byte) string {
+	t.Helper()
+	sim := newSim(t)
+	link := newSimLink(t, sim, true)
+	port := openSim(t, link, arduino.Options{})
+	upload(t, port, data)
+	if err := port.Close(); err != nil {
+		t.Fatal(err)
+	}
+	<-link.done
+
+	var trace bytes.Buffer
+	link = newSimLink(t, sim, true)
+	port = openSim(t, link, arduino.Options{Trace: &trace, Timeout: 2 * time.Second})
+	download(t, port, link, data)
+	if err := port.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "session.pmptrace")
+	if err := os.WriteFile(path, trace.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// TestTraceReplay records a session and replays it: the same calls get the
+// same answers without a bridge
+func TestTraceReplay(t *testing.T) {
+	data := make([]byte, 40000)
+	rand.New(rand.NewSource(1)).Read(data)
+	path := recordSession(t, data)
+
+	trace, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if empty := regexp.MustCompile(`(?m)^[0-9.]+ <\s*$`).FindAll(trace, -1); len(empty) > 0 {
+		t.Errorf("trace records %d empty reads", len(empty))
+	}
+
+	port, err := arduino.OpenReplay(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !port.Framed() {
+		t.Error("replay did not negotiate framing like the session")
+	}
+	download(t, port, nil, data)
+	if err := port.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestTraceDiverged checks that a replay refuses writes the session did not
+// make
+func TestTraceDiverged(t *testing.T) {
+	data := make([]byte, 1000)
+	path := recordSession(t, data)
+
+	port, err := arduino.OpenReplay(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = port.OutByte(0, 0x5A)
+	if err == nil || !strings.Contains(err.Error(), "replay diverged") {
+		t.Errorf("write the session did not make: %v, want a divergence", err)
+	}
+}
@@ -0,0 +1,94 @@
+package arduino
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Status wait (firmware 3.6):
+//
+//	'H' <mask> <value> <timeout_3> <timeout_2> <timeout_1> <timeout_0>
+//	    -> 'V' <status>
+//
+// The bridge polls the status register until (status & mask) == value or
+// the timeout in microseconds expires, and returns the last status read.
+// CMD_ABORT ends the wait early.
+const CMD_WAIT_STATUS = 'H'
+
+// MAX_WAIT_STATUS is the longest timeout the command encodes
+const MAX_WAIT_STATUS = time.Duration(1<<32-1) * time.Microsecond
+
+// HasWaitStatus reports whether the firmware polls the status register
+// itself. WaitStatus polls from the host otherwise.
+func (p *Port) HasWaitStatus() bool {
+	return p.caps.Has(CAP_WAIT_STATUS)
+}
+
+// WaitStatus waits until (status & mask) == value, with the status as raw
+// line levels like InByte, and returns the last status read. If the timeout
+// expires first, the error wraps ErrStatusTimeout. With firmware 3.6 the
+// bridge polls and the wait takes one round trip; the timeout must then be
+// shorter than the port's response timeout.
+func (p *Port) WaitStatus(mask, value byte, timeout time.Duration) (byte, error) {
+	return p.WaitStatusContext(context.Background(), mask, value, timeout)
+}
+
+// WaitStatusContext is WaitStatus with a context
+func (p *Port) WaitStatusContext(ctx context.Context, mask, value byte, timeout time.Duration) (byte, error) {
+	return p.SubmitWaitStatusContext(ctx, mask, value, timeout)()
+}
+
+// SubmitWaitStatus queues WaitStatus. The returned function waits for the
+// status.
+func (p *Port) SubmitWaitStatus(mask, value byte, timeout time.Duration) func() (byte, error) {
+	return p.SubmitWaitStatusContext(context.Background(), mask, value, timeout)
+}
+
+// SubmitWaitStatusContext is SubmitWaitStatus with a context. Without the
+// firmware command the status is polled before it returns.
+func (p *Port) SubmitWaitStatusContext(ctx context.Context, mask, value byte, timeout time.Duration) func() (byte, error) {
+	if !p.HasWaitStatus() {
+		status, err := p.pollStatus(ctx, mask, value, timeout)
+		return func() (byte, error) { return status, err }
+	}
+	if timeout >= p.timeout || timeout > MAX_WAIT_STATUS {
+		return func() (byte, error) {
+			return 0, fmt.Errorf("status wait of %v exceeds the response timeout of %v", timeout, p.timeout)
+		}
+	}
+
+	us := uint32(timeout / time.Microsecond)
+	req := []byte{CMD_WAIT_STATUS, mask, value, byte(us >> 24), byte(us >> 16), byte(us >> 8), byte(us)}
+	c := p.submit(ctx, req, RESP_VALUE, 1)
+	return func() (byte, error) {
+		resp, err := p.wait(ctx, c)
+		if err != nil {
+			return 0, err
+		}
+		return resp[0], statusMatch(resp[0], mask, value, timeout)
+	}
+}
+
+// pollStatus waits for a status with one read per round trip, for firmware
+// without CMD_WAIT_STATUS
+func (p *Port) pollStatus(ctx context.Context, mask, value byte, timeout time.Duration) (byte, error) {
+	start := time.Now()
+	for {
+		status, err := p.SubmitInByteContext(ctx, 1)()
+		if err != nil {
+			return 0, err
+		}
+		if status&mask == value || time.Since(start) >= timeout {
+			return status, statusMatch(status, mask, value, timeout)
+		}
+	}
+}
+
+// statusMatch returns the error of a wait that ended on status
+func statusMatch(status, mask, value byte, timeout time.Duration) error {
+	if status&mask == value {
+		return nil
+	}
+	return fmt.Errorf("%w: 0x%02X under mask 0x%02X within %v (last 0x%02X)", ErrStatusTimeout, value, mask, timeout, status)
+}
@@ -0,0 +1,114 @@
+package arduino_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/murdinc/pmp300/pkg/arduino"
+	"github.com/murdinc/pmp300/pkg/pmp300"
+)
+
+// TestWaitStatus waits for statuses that are there and that never come, on
+// the bridge and, without the firmware command, from the host
+func TestWaitStatus(t *testing.T) {
+	for _, legacy := range []bool{false, true} {
+		t.Run(fmt.Sprintf("legacy %v", legacy), func(t *testing.T) {
+			sim := newSim(t)
+			sim.Legacy = legacy
+			port := openSim(t, newSimLink(t, sim, true), arduino.Options{Unframed: legacy})
+			defer port.Close()
+			if port.HasWaitStatus() == legacy {
+				t.Fatalf("status wait on the bridge: %v", port.HasWaitStatus())
+			}
+
+			idle, err := port.InByte(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			port.ResetStats()
+
+			status, err := port.WaitStatus(0xF0, idle&0xF0, 100*time.Millisecond)
+			if err != nil || status != idle {
+				t.Errorf("wait for the current status: 0x%02X, %v; want 0x%02X", status, err, idle)
+			}
+
+			const timeout = 50 * time.Millisecond
+			start := time.Now()
+			status, err = port.WaitStatus(0x80, ^idle&0x80, timeout)
+			d := time.Since(start)
+			if !errors.Is(err, arduino.ErrStatusTimeout) || status != idle {
+				t.Errorf("wait for a status that never comes: 0x%02X, %v; want 0x%02X and ErrStatusTimeout", status, err, idle)
+			}
+			if d < timeout || d > timeout+500*time.Millisecond {
+				t.Errorf("wait of %v took %v", timeout, d)
+			}
+
+			// The bridge waits in one round trip per wait
+			s := port.Stats()
+			if legacy {
+				if n := s.Command("READ_STATUS").Calls; n < 2 {
+					t.Errorf("%d status reads polling from the host", n)
+				}
+			} else if s.Command("WAIT_STATUS").Calls != 2 || s.Command("READ_STATUS").Calls != 0 {
+				t.Errorf("%d status waits and %d status reads, want 2 and 0",
+					s.Command("WAIT_STATUS").Calls, s.Command("READ_STATUS").Calls)
+			}
+		})
+	}
+}
+
+// TestWaitStatusLimits checks the timeouts a wait on the bridge refuses,
+// and that cancelling ends a wait at once
+func TestWaitStatusLimits(t *testing.T) {
+	port := openSim(t, newSimLink(t, newSim(t), true), arduino.Options{Timeout: time.Second})
+	defer port.Close()
+	idle, err := port.InByte(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := port.WaitStatus(0x80, ^idle&0x80, time.Second); err == nil || errors.Is(err, arduino.ErrStatusTimeout) {
+		t.Errorf("wait as long as the response timeout: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = port.WaitStatusContext(ctx, 0x80, ^idle&0x80, 900*time.Millisecond)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("cancelled wait: %v, want the deadline", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("cancelled wait returned after %v", d)
+	}
+	if err := port.Ping(); err != nil {
+		t.Errorf("ping after the cancelled wait: %v", err)
+	}
+}
+
+// TestWaitStatusHandshakes checks that the device layer waits for the
+// PMP300's handshakes on the bridge
+func TestWaitStatusHandshakes(t *testing.T) {
+	port := openSim(t, newSimLink(t, newSim(t), true), arduino.Options{})
+	defer port.Close()
+
+	pmp := pmp300.New(port)
+	if err := pmp.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	port.ResetStats()
+	if err := pmp.FormatDevice(false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pmp.ListFiles(); err != nil {
+		t.Fatal(err)
+	}
+	s := port.Stats()
+	if s.Command("WAIT_STATUS").Calls == 0 || s.Command("READ_STATUS").Calls != 0 {
+		t.Errorf("%d status waits and %d status reads for the handshakes",
+			s.Command("WAIT_STATUS").Calls, s.Command("READ_STATUS").Calls)
+	}
+}
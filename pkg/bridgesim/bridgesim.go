@@ -0,0 +1,1099 @@
+// Package bridgesim simulates the pmp300_usb_parallel_bridge firmware. It
+// speaks the same serial byte protocol as the sketch and drives a set of
+// parallel port pins, normally an emulated PMP300 from pkg/emulator.
+package bridgesim
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/rand"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/murdinc/pmp300/pkg/arduino"
+	"github.com/murdinc/pmp300/pkg/pmp300"
+)
+
+// Unlock key sent by the block commands' intro
+var introKey = []byte{0xAD, 0x55, 0xAE, 0xAA}
+
+// Error codes - must match Arduino firmware
+const (
+	ERR_UNKNOWN_CMD = 0x01
+	ERR_TIMEOUT     = 0x02
+	ERR_CRC         = 0x03
+	ERR_FRAME       = 0x04
+	ERR_DROPPED     = 0x05
+	ERR_NAK         = 0x06
+	ERR_ACK_TIMEOUT = 0x07
+	ERR_BAUD        = 0x08
+	ERR_PARAM       = 0x09
+)
+
+// ACK_TIMEOUT is how long the block commands wait for a PMP300 handshake
+const ACK_TIMEOUT = time.Second
+
+// Firmware version reported by the simulator
+const (
+	FW_VERSION_MAJOR = 3
+	FW_VERSION_MINOR = 8
+	FW_VERSION_PATCH = 0
+)
+
+// Version reported in Legacy mode, the last firmware without framing
+const (
+	LEGACY_VERSION_MAJOR = 2
+	LEGACY_VERSION_MINOR = 0
+	LEGACY_VERSION_PATCH = 1
+)
+
+// Limits reported by the capability query
+const (
+	MAX_NIBBLE_BLOCK = 0xFFFE
+	RX_BUFFER_SIZE   = 64 // Serial receive buffer of the Uno and Mega
+)
+
+// Features reported by the capability query
+const FEATURES = arduino.CAP_COMMANDOUT | arduino.CAP_NIBBLE_BLOCK | arduino.CAP_PMP_CHUNK |
+	arduino.CAP_FRAMING | arduino.CAP_BLOCK | arduino.CAP_ABORT | arduino.CAP_BAUD |
+	arduino.CAP_NIBBLE_CHECK | arduino.CAP_WAIT_STATUS | arduino.CAP_DELAY_US | arduino.CAP_DATA_DIR |
+	arduino.CAP_BLOCK_READY
+
+// BOARD_TYPE is reported in the ready banner
+const BOARD_TYPE = "Simulator"
+
+// Pins is the parallel port side of the bridge. Control values are register
+// values (the firmware's writeControl applies the hardware inversion), status
+// values are raw line levels.
+type Pins interface {
+	WriteData(value byte)
+	WriteControl(value byte)
+	ReadStatus() byte
+}
+
+// Simulator runs the firmware main loop against a byte stream
+type Simulator struct {
+	pins Pins
+
+	// ByteTimeout is waitForByte's parameter timeout (1s in the firmware)
+	ByteTimeout time.Duration
+
+	// Legacy simulates 2.x firmware, which has no framed mode
+	Legacy bool
+
+	// MaxBaud simulates a USB chip that cannot keep up with faster rates:
+	// the confirmation ping of a faster switch never arrives. 0 accepts
+	// every rate the firmware supports.
+	MaxBaud int
+
+	// GlitchRate is the probability that a nibble read sees unsettled
+	// status lines: its first sample has a flipped bit. Checked reads catch
+	// it by the second sample; unchecked reads pass the corrupted byte on.
+	GlitchRate float64
+
+	// Rates are the rates 'U' accepts (default arduino.BAUD_RATES)
+	Rates []int
+
+	// LineRate, if set, returns the host's line rate. Bytes sent while it
+	// differs from the bridge's rate are lost both ways, as on a serial
+	// line. PTY.Serve sets it to the rate of the slave.
+	LineRate func() int
+
+	in     <-chan byte
+	out    *bufio.Writer
+	closed bool
+	peeked bool // next holds a byte taken from in by abortRequested
+	next   byte
+
+	dataIsOutput bool
+
+	baud        atomic.Int64 // Line rate
+	pendingBaud int          // Baud rate to switch to once the response is sent
+
+	// Framed mode
+	framed      bool
+	inFrame     bool
+	respStarted bool
+	respSeq     byte
+	respLen     int
+	rejecting   bool
+	seqKnown    bool
+	expectedSeq byte
+	frameBuf    []byte
+	framePos    int
+	txCrc       uint16
+}
+
+// New returns a simulator driving pins
+func New(pins Pins) *Simulator {
+	return &Simulator{
+		pins:        pins,
+		ByteTimeout: time.Second,
+	}
+}
+
+// Banner returns the line the firmware prints at the end of setup()
+func (s *Simulator) Banner() string {
+	v := s.version()
+	return fmt.Sprintf("PMP300 Bridge v%d.%d.%d (%s) Ready\r\n", v[0], v[1], v[2], BOARD_TYPE)
+}
+
+// version returns the simulated firmware version
+func (s *Simulator) version() [3]byte {
+	if s.Legacy {
+		return [3]byte{LEGACY_VERSION_MAJOR, LEGACY_VERSION_MINOR, LEGACY_VERSION_PATCH}
+	}
+	return [3]byte{FW_VERSION_MAJOR, FW_VERSION_MINOR, FW_VERSION_PATCH}
+}
+
+// Run executes setup() and then loop() until in is closed. Bytes are taken
+// from in so that parameter timeouts behave like Serial.available().
+func (s *Simulator) Run(in <-chan byte, out io.Writer) error {
+	s.connect(in, out)
+	s.framed = false
+	s.setup()
+	return s.loop()
+}
+
+// Resume runs loop() on a new connection without a reset, as a board does
+// when the host reopens the port without toggling DTR. Framed mode is kept.
+func (s *Simulator) Resume(in <-chan byte, out io.Writer) error {
+	s.connect(in, out)
+	return s.loop()
+}
+
+// Baud returns the bridge's line rate
+func (s *Simulator) Baud() int {
+	return int(s.baud.Load())
+}
+
+// heard reports whether a byte on the line now gets through
+func (s *Simulator) heard() bool {
+	return s.LineRate == nil || s.LineRate() == s.Baud()
+}
+
+// lineWriter loses what the bridge sends at another rate than the host's
+type lineWriter struct {
+	s   *Simulator
+	out io.Writer
+}
+
+func (w lineWriter) Write(p []byte) (int, error) {
+	if !w.s.heard() {
+		return len(p), nil
+	}
+	return w.out.Write(p)
+}
+
+// connect attaches the serial streams
+func (s *Simulator) connect(in <-chan byte, out io.Writer) {
+	s.in = in
+	s.out = bufio.NewWriter(lineWriter{s, out})
+	s.closed = false
+	s.peeked = false
+}
+
+// loop runs the firmware main loop until in is closed
+func (s *Simulator) loop() error {
+	for !s.closed {
+		b, ok := s.readByte()
+		if !ok {
+			break
+		}
+		if s.framed {
+			s.handleFrame(b)
+		} else {
+			s.dispatch(b)
+		}
+		if err := s.out.Flush(); err != nil {
+			return err
+		}
+		if s.pendingBaud != 0 {
+			if err := s.switchBaud(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ============================================================================
+// SETUP / LOOP
+// ============================================================================
+
+func (s *Simulator) setup() {
+	s.baud.Store(arduino.DEFAULT_BAUD)
+	s.setDataOutput()
+	s.pins.WriteControl(0x04)
+	s.out.WriteString(s.Banner())
+	s.out.Flush()
+}
+
+func (s *Simulator) dispatch(cmd byte) {
+	switch cmd {
+	case arduino.CMD_PING:
+		s.handlePing()
+	case arduino.CMD_VERSION:
+		s.handleVersion()
+	case arduino.CMD_WRITE_DATA:
+		s.handleWriteData()
+	case arduino.CMD_WRITE_CTRL:
+		s.handleWriteControl()
+	case arduino.CMD_READ_STATUS:
+		s.handleReadStatus()
+	case arduino.CMD_DELAY_MS:
+		s.handleDelayMs()
+	case arduino.CMD_COMMANDOUT:
+		s.handleCommandOut()
+	case arduino.CMD_READ_NIBBLE_BLK:
+		s.handleReadNibbleBlock()
+	case arduino.CMD_WRITE_PMP_CHUNK:
+		s.handleWritePMPChunk()
+	case arduino.CMD_READ_NIBBLE_CHK:
+		if s.Legacy {
+			s.sendError(ERR_UNKNOWN_CMD)
+			return
+		}
+		s.handleReadNibbleChecked()
+	case arduino.CMD_WAIT_STATUS:
+		if s.Legacy {
+			s.sendError(ERR_UNKNOWN_CMD)
+			return
+		}
+		s.handleWaitStatus()
+	case arduino.CMD_DELAY_US:
+		if s.Legacy {
+			s.sendError(ERR_UNKNOWN_CMD)
+			return
+		}
+		s.handleDelayUs()
+	case arduino.CMD_SET_DATA_DIR:
+		if s.Legacy {
+			s.sendError(ERR_UNKNOWN_CMD)
+			return
+		}
+		s.handleSetDataDir()
+	case arduino.CMD_FRAMING:
+		if s.Legacy {
+			s.sendError(ERR_UNKNOWN_CMD)
+			return
+		}
+		s.handleFraming()
+	case arduino.CMD_CAPABILITIES:
+		if s.Legacy {
+			s.sendError(ERR_UNKNOWN_CMD)
+			return
+		}
+		s.handleCapabilities()
+	case arduino.CMD_SET_BAUD:
+		if s.Legacy {
+			s.sendError(ERR_UNKNOWN_CMD)
+			return
+		}
+		s.handleSetBaud()
+	case arduino.CMD_ABORT:
+		// Nothing to abort; the host drains the link after sending it
+		if s.Legacy {
+			s.sendError(ERR_UNKNOWN_CMD)
+		}
+	case arduino.CMD_READ_BLOCK, arduino.CMD_WRITE_BLOCK:
+		if s.Legacy {
+			s.sendError(ERR_UNKNOWN_CMD)
+			return
+		}
+		if cmd == arduino.CMD_READ_BLOCK {
+			s.handleReadBlock()
+		} else {
+			s.handleWriteBlock()
+		}
+	default:
+		s.sendError(ERR_UNKNOWN_CMD)
+	}
+}
+
+// ============================================================================
+// COMMAND HANDLERS
+// ============================================================================
+
+func (s *Simulator) handlePing() {
+	s.sendByte(arduino.RESP_PONG)
+}
+
+func (s *Simulator) handleVersion() {
+	v := s.version()
+	s.sendBytes(arduino.RESP_VERSION, v[0], v[1], v[2])
+}
+
+// Protocol: 'Q' -> 'Q' <features> <max_nibble> <rx_buffer>, high bytes first
+func (s *Simulator) handleCapabilities() {
+	s.sendByte(arduino.RESP_CAPABILITIES)
+	for _, v := range []uint16{FEATURES, MAX_NIBBLE_BLOCK, RX_BUFFER_SIZE} {
+		s.sendBytes(byte(v>>8), byte(v))
+	}
+}
+
+// Protocol: 'U' <baud, 4 bytes high first> -> 'K', sent at the old rate.
+// The switch happens after the response, in switchBaud.
+func (s *Simulator) handleSetBaud() {
+	var rate int
+	for i := 0; i < 4; i++ {
+		rate = rate<<8 | int(s.waitForByte())
+	}
+	rates := s.Rates
+	if rates == nil {
+		rates = arduino.BAUD_RATES
+	}
+	if !slices.Contains(rates, rate) {
+		s.sendError(ERR_BAUD)
+		return
+	}
+	s.sendByte(arduino.RESP_OK)
+	s.pendingBaud = rate
+}
+
+// switchBaud switches to the new rate and waits BAUD_CONFIRM for the
+// host's unframed ping, dropping anything else, and answers it with a pong.
+// Without the ping it returns to the old rate. Rates above MaxBaud lose
+// every byte.
+func (s *Simulator) switchBaud() error {
+	garbled := s.MaxBaud > 0 && s.pendingBaud > s.MaxBaud
+	old := s.baud.Swap(int64(s.pendingBaud))
+	s.pendingBaud = 0
+	timer := time.NewTimer(arduino.BAUD_CONFIRM)
+	defer timer.Stop()
+	for {
+		select {
+		case b, ok := <-s.in:
+			if !ok {
+				s.closed = true
+				return nil
+			}
+			if b == arduino.CMD_PING && !garbled && s.heard() {
+				s.out.WriteByte(arduino.RESP_PONG)
+				return s.out.Flush()
+			}
+		case <-timer.C:
+			s.baud.Store(old)
+			return nil
+		}
+	}
+}
+
+// Protocol: 'W' <byte> -> 'K'
+func (s *Simulator) handleWriteData() {
+	value := s.waitForByte()
+	if !s.dataIsOutput {
+		s.setDataOutput()
+	}
+	s.pins.WriteData(value)
+	s.sendByte(arduino.RESP_OK)
+}
+
+// Protocol: 'C' <byte> -> 'K'
+func (s *Simulator) handleWriteControl() {
+	value := s.waitForByte()
+	s.pins.WriteControl(value)
+	s.sendByte(arduino.RESP_OK)
+}
+
+// Protocol: 'R' -> 'V' <byte>
+func (s *Simulator) handleReadStatus() {
+	s.sendBytes(arduino.RESP_VALUE, s.pins.ReadStatus())
+}
+
+// Protocol: 'H' <mask> <value> <timeout, 4 bytes> -> 'V' <byte> (ends
+// early on CMD_ABORT)
+func (s *Simulator) handleWaitStatus() {
+	mask := s.waitForByte()
+	value := s.waitForByte()
+	var us uint32
+	for i := 0; i < 4; i++ {
+		us = us<<8 | uint32(s.waitForByte())
+	}
+	timeout := time.Duration(us) * time.Microsecond
+
+	start := time.Now()
+	status := s.pins.ReadStatus()
+	if status&mask != value {
+		s.out.Flush()
+	}
+	for status&mask != value && time.Since(start) < timeout && !s.abortRequested() {
+		time.Sleep(10 * time.Microsecond)
+		status = s.pins.ReadStatus()
+	}
+	s.sendBytes(arduino.RESP_VALUE, status)
+}
+
+// Protocol: 'M' <high> <low> -> 'K' (ends early on CMD_ABORT)
+func (s *Simulator) handleDelayMs() {
+	ms := uint16(s.waitForByte())<<8 | uint16(s.waitForByte())
+	s.out.Flush()
+	for i := uint16(0); i < ms && !s.abortRequested(); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	s.sendByte(arduino.RESP_OK)
+}
+
+// Protocol: 'D' <high> <low> -> 'K'
+func (s *Simulator) handleDelayUs() {
+	us := uint16(s.waitForByte())<<8 | uint16(s.waitForByte())
+	s.out.Flush()
+	time.Sleep(time.Duration(us) * time.Microsecond)
+	s.sendByte(arduino.RESP_OK)
+}
+
+// Protocol: 'S' <'I' or 'O'> -> 'K', or 'E' ERR_PARAM
+func (s *Simulator) handleSetDataDir() {
+	switch s.waitForByte() {
+	case arduino.DATA_INPUT:
+		s.dataIsOutput = false
+	case arduino.DATA_OUTPUT:
+		s.setDataOutput()
+	default:
+		s.sendError(ERR_PARAM)
+		return
+	}
+	s.sendByte(arduino.RESP_OK)
+}
+
+// Protocol: 'c' <data> <ctrl1> <ctrl2> -> 'K'
+func (s *Simulator) handleCommandOut() {
+	data := s.waitForByte()
+	ctrl1 := s.waitForByte()
+	ctrl2 := s.waitForByte()
+
+	if !s.dataIsOutput {
+		s.setDataOutput()
+	}
+
+	s.pins.WriteData(data)
+	s.pins.WriteControl(ctrl1)
+	s.pins.WriteControl(ctrl2)
+
+	s.sendByte(arduino.RESP_OK)
+}
+
+// Protocol: 'n' <count_high> <count_low> -> 'K' <data...> (cut short on
+// CMD_ABORT)
+func (s *Simulator) handleReadNibbleBlock() {
+	count := uint16(s.waitForByte())<<8 | uint16(s.waitForByte())
+
+	s.pins.WriteControl(0x04)
+	s.sendByte(arduino.RESP_OK)
+
+	for i := uint16(0); i < count; i++ {
+		if s.abortRequested() {
+			return
+		}
+		s.sendByte(s.readNibbleByte())
+	}
+}
+
+// Protocol: 'N' <skip, 2 bytes> <count, 2 bytes> -> 'K' followed by every
+// span of up to NIBBLE_CHECK_SPAN bytes and its CRC-16, inverted if the
+// span saw a glitch (cut short on CMD_ABORT)
+func (s *Simulator) handleReadNibbleChecked() {
+	skip := int(s.waitForByte())<<8 | int(s.waitForByte())
+	count := int(s.waitForByte())<<8 | int(s.waitForByte())
+
+	s.pins.WriteControl(0x04)
+	s.sendByte(arduino.RESP_OK)
+
+	var glitch bool
+	for i := 0; i < skip; i++ {
+		if s.abortRequested() {
+			return
+		}
+		s.readNibbleByteChecked(&glitch)
+	}
+
+	crc := uint16(arduino.CRC16_INIT)
+	glitch = false
+	for i := 0; i < count; i++ {
+		if s.abortRequested() {
+			return
+		}
+		value := s.readNibbleByteChecked(&glitch)
+		s.sendByte(value)
+		crc = arduino.UpdateCRC16(crc, value)
+		if (i+1)%arduino.NIBBLE_CHECK_SPAN == 0 || i+1 == count {
+			if glitch {
+				crc ^= 0xFFFF
+			}
+			s.sendBytes(byte(crc>>8), byte(crc))
+			crc = arduino.CRC16_INIT
+			glitch = false
+		}
+	}
+}
+
+// Protocol: 'w' <528 bytes> -> 'K'
+func (s *Simulator) handleWritePMPChunk() {
+	if !s.dataIsOutput {
+		s.setDataOutput()
+	}
+
+	for i := 0; i < 528; i++ {
+		value := s.waitForByte()
+		s.pins.WriteData(value)
+
+		if i&1 == 0 {
+			s.pins.WriteControl(0x00)
+		} else {
+			s.pins.WriteControl(0x04)
+		}
+	}
+
+	s.sendByte(arduino.RESP_OK)
+}
+
+// Protocol: 'F' <mode> -> 'K' (sent in the old mode)
+func (s *Simulator) handleFraming() {
+	mode := s.waitForByte()
+	if mode > arduino.FRAMING_CRC16 {
+		s.sendError(ERR_FRAME)
+		return
+	}
+	s.sendByte(arduino.RESP_OK)
+	s.framed = mode == arduino.FRAMING_CRC16
+	s.rejecting = false
+	s.seqKnown = false
+}
+
+// Protocol: 'B' <addr_high> <addr_mid> <addr_low> -> 'K' <32768 bytes> or
+// 'E' <code> (cut short on CMD_ABORT)
+func (s *Simulator) handleReadBlock() {
+	addr := s.readAddress()
+
+	if code := s.blockIntro(pmp300.PMP_CMD_READ, addr); code != 0 {
+		s.pmpOutro()
+		s.sendError(code)
+		return
+	}
+
+	s.pins.WriteControl(0x04)
+	s.sendByte(arduino.RESP_OK)
+	for i := 0; i < arduino.BLOCK_SIZE; i++ {
+		if s.abortRequested() {
+			break
+		}
+		s.sendByte(s.readNibbleByte())
+	}
+	s.pmpOutro()
+}
+
+// Protocol: 'b' <addr_high> <addr_mid> <addr_low>
+// 64 x (-> RESP_READY, <528 bytes> <crc_high> <crc_low>) -> 'K' or 'E' <code>
+//
+// Each chunk is asked for with RESP_READY, outside any frame, once the one
+// before was acknowledged. The last byte of each chunk is held back until
+// its CRC checks. A failure is answered instead of the next RESP_READY.
+func (s *Simulator) handleWriteBlock() {
+	addr := s.readAddress()
+
+	code := s.blockIntro(pmp300.PMP_CMD_WRITE, addr)
+	if !s.dataIsOutput {
+		s.setDataOutput()
+	}
+
+	for chunk := 0; chunk < arduino.BLOCK_CHUNKS && code == 0; chunk++ {
+		s.out.WriteByte(arduino.RESP_READY)
+		s.out.Flush()
+
+		crc := uint16(arduino.CRC16_INIT)
+		var held, crcHigh, value byte
+		for i := 0; i < arduino.CHUNK_SIZE+2; i++ {
+			var ok bool
+			if value, ok = s.readFrameByte(); !ok {
+				code = ERR_TIMEOUT
+				break
+			}
+			switch {
+			case i < arduino.CHUNK_SIZE:
+				crc = arduino.UpdateCRC16(crc, value)
+				if i > 0 {
+					s.writeChunkByte(held, i-1)
+				}
+				held = value
+			case i == arduino.CHUNK_SIZE:
+				crcHigh = value
+			}
+		}
+		if code != 0 {
+			break
+		}
+
+		if uint16(crcHigh)<<8|uint16(value) != crc {
+			code = ERR_CRC
+			break
+		}
+		s.writeChunkByte(held, arduino.CHUNK_SIZE-1)
+		code = s.waitAck(3 + chunk)
+	}
+
+	s.pmpOutro()
+	if code != 0 {
+		s.sendError(code)
+		return
+	}
+	s.sendByte(arduino.RESP_OK)
+}
+
+// ============================================================================
+// FRAMED MODE
+// ============================================================================
+
+// handleFrame receives the frame starting with b, checks it and runs its
+// command. Bytes other than the sync byte are dropped.
+func (s *Simulator) handleFrame(b byte) {
+	if b != arduino.FRAME_SYNC {
+		return
+	}
+
+	var header [3]byte
+	for i := range header {
+		var ok bool
+		if header[i], ok = s.readFrameByte(); !ok {
+			s.rejectFrame(s.expectedSeq, ERR_TIMEOUT)
+			return
+		}
+	}
+	length := int(header[0])<<8 | int(header[1])
+	seq := header[2]
+	if length == 0 || length > arduino.FRAME_MAX_PAYLOAD {
+		s.rejectFrame(seq, ERR_FRAME)
+		return
+	}
+
+	crc := arduino.UpdateCRC16(arduino.CRC16_INIT, header[:]...)
+	payload := make([]byte, length)
+	for i := range payload {
+		var ok bool
+		if payload[i], ok = s.readFrameByte(); !ok {
+			s.rejectFrame(seq, ERR_TIMEOUT)
+			return
+		}
+	}
+	crc = arduino.UpdateCRC16(crc, payload...)
+	crcHigh, ok1 := s.readFrameByte()
+	crcLow, ok2 := s.readFrameByte()
+	if !ok1 || !ok2 {
+		s.rejectFrame(seq, ERR_TIMEOUT)
+		return
+	}
+	if uint16(crcHigh)<<8|uint16(crcLow) != crc {
+		s.rejectFrame(seq, ERR_CRC)
+		return
+	}
+
+	// Only a FRAMING command gets through after an error or a lost frame
+	cmd := payload[0]
+	if cmd != arduino.CMD_FRAMING && (s.rejecting || (s.seqKnown && seq != s.expectedSeq)) {
+		s.rejectFrame(seq, ERR_DROPPED)
+		return
+	}
+
+	params, known := paramCounts[cmd]
+	if !known || (s.Legacy && legacyUnknown[cmd]) {
+		s.rejectFrame(seq, ERR_UNKNOWN_CMD)
+		return
+	}
+	if length != 1+params || (cmd == arduino.CMD_FRAMING && payload[1] > arduino.FRAMING_CRC16) {
+		s.rejectFrame(seq, ERR_FRAME)
+		return
+	}
+	respLen := 1
+	switch cmd {
+	case arduino.CMD_VERSION:
+		respLen = 4
+	case arduino.CMD_READ_STATUS, arduino.CMD_WAIT_STATUS:
+		respLen = 2
+	case arduino.CMD_CAPABILITIES:
+		respLen = 7
+	case arduino.CMD_READ_BLOCK:
+		respLen = 1 + arduino.BLOCK_SIZE
+	case arduino.CMD_READ_NIBBLE_BLK:
+		count := int(payload[1])<<8 | int(payload[2])
+		if count == 0xFFFF {
+			s.rejectFrame(seq, ERR_FRAME)
+			return
+		}
+		respLen = 1 + count
+	case arduino.CMD_READ_NIBBLE_CHK:
+		count := int(payload[3])<<8 | int(payload[4])
+		respLen = 1 + count + 2*((count+arduino.NIBBLE_CHECK_SPAN-1)/arduino.NIBBLE_CHECK_SPAN)
+		if respLen > 0xFFFE {
+			s.rejectFrame(seq, ERR_FRAME)
+			return
+		}
+	}
+
+	s.frameBuf = payload
+	s.framePos = 1
+	s.openResponse(seq, respLen)
+	s.dispatch(cmd)
+	s.endFrame()
+
+	s.expectedSeq = seq + 1
+	s.seqKnown = true
+}
+
+// Parameter byte counts, as in the firmware's paramCount
+var paramCounts = map[byte]int{
+	arduino.CMD_PING:            0,
+	arduino.CMD_VERSION:         0,
+	arduino.CMD_WRITE_DATA:      1,
+	arduino.CMD_WRITE_CTRL:      1,
+	arduino.CMD_READ_STATUS:     0,
+	arduino.CMD_DELAY_MS:        2,
+	arduino.CMD_COMMANDOUT:      3,
+	arduino.CMD_READ_NIBBLE_BLK: 2,
+	arduino.CMD_WRITE_PMP_CHUNK: 528,
+	arduino.CMD_FRAMING:         1,
+	arduino.CMD_READ_BLOCK:      3,
+	arduino.CMD_WRITE_BLOCK:     3, // The chunk stream follows the frame
+	arduino.CMD_CAPABILITIES:    0,
+	arduino.CMD_SET_BAUD:        4,
+	arduino.CMD_READ_NIBBLE_CHK: 4,
+	arduino.CMD_WAIT_STATUS:     6,
+	arduino.CMD_DELAY_US:        2,
+	arduino.CMD_SET_DATA_DIR:    1,
+}
+
+// Commands added after the last firmware simulated by Legacy
+var legacyUnknown = map[byte]bool{
+	arduino.CMD_FRAMING:     true,
+	arduino.CMD_READ_BLOCK:  true,
+	arduino.CMD_WRITE_BLOCK: true,
+
+	arduino.CMD_CAPABILITIES: true,
+	arduino.CMD_SET_BAUD:     true,
+
+	arduino.CMD_READ_NIBBLE_CHK: true,
+	arduino.CMD_WAIT_STATUS:     true,
+	arduino.CMD_DELAY_US:        true,
+	arduino.CMD_SET_DATA_DIR:    true,
+}
+
+// openResponse prepares the response frame. Its header goes out with the
+// first response byte, when it is known whether the command failed.
+func (s *Simulator) openResponse(seq byte, length int) {
+	s.inFrame = true
+	s.respStarted = false
+	s.respSeq = seq
+	s.respLen = length
+}
+
+func (s *Simulator) beginFrame() {
+	s.respStarted = true
+	s.out.WriteByte(arduino.FRAME_SYNC)
+	s.txCrc = arduino.CRC16_INIT
+	s.sendBytes(byte(s.respLen>>8), byte(s.respLen), s.respSeq)
+}
+
+func (s *Simulator) endFrame() {
+	s.inFrame = false
+	if !s.respStarted {
+		return
+	}
+	s.out.Write([]byte{byte(s.txCrc >> 8), byte(s.txCrc)})
+}
+
+// rejectFrame answers a frame with an error and drops frames until the
+// host resynchronizes
+func (s *Simulator) rejectFrame(seq, code byte) {
+	s.openResponse(seq, 2)
+	s.sendError(code)
+	s.endFrame()
+}
+
+// readFrameByte waits for a frame or block stream byte with the parameter
+// timeout
+func (s *Simulator) readFrameByte() (byte, bool) {
+	if b, ok := s.takePeeked(); ok {
+		return b, true
+	}
+	if s.closed {
+		return 0, false
+	}
+	return s.receive(s.ByteTimeout)
+}
+
+// receive takes a byte from the host, flushing the output and waiting up
+// to timeout if none is there. Bytes lost on the line are skipped. It fails
+// on timeout, and once in is closed, which sets closed.
+func (s *Simulator) receive(timeout time.Duration) (byte, bool) {
+	var timer *time.Timer
+	for {
+		var b byte
+		var ok bool
+		select {
+		case b, ok = <-s.in:
+		default:
+			if timer == nil {
+				s.out.Flush()
+				timer = time.NewTimer(timeout)
+				defer timer.Stop()
+			}
+			select {
+			case b, ok = <-s.in:
+			case <-timer.C:
+				return 0, false
+			}
+		}
+		if !ok {
+			s.closed = true
+			return 0, false
+		}
+		if s.heard() {
+			return b, true
+		}
+	}
+}
+
+// ============================================================================
+// LOW-LEVEL HELPERS
+// ============================================================================
+
+// readNibbleByte mirrors the firmware: no Busy XOR, then reverse the bits
+func (s *Simulator) readNibbleByte() byte {
+	s.pins.WriteControl(0x00)
+	result := (s.sampleStatus() & 0xF0) >> 4
+
+	s.pins.WriteControl(0x04)
+	result |= s.sampleStatus() & 0xF0
+
+	return reverseBits(result)
+}
+
+// readNibbleByteChecked samples every nibble twice like the firmware and
+// sets *glitch if the samples differ
+func (s *Simulator) readNibbleByteChecked(glitch *bool) byte {
+	s.pins.WriteControl(0x00)
+	status := s.sampleStatus() & 0xF0
+	if s.pins.ReadStatus()&0xF0 != status {
+		*glitch = true
+	}
+	result := status >> 4
+
+	s.pins.WriteControl(0x04)
+	status = s.sampleStatus() & 0xF0
+	if s.pins.ReadStatus()&0xF0 != status {
+		*glitch = true
+	}
+	result |= status
+
+	return reverseBits(result)
+}
+
+// sampleStatus reads the status lines, flipping a data bit at GlitchRate
+func (s *Simulator) sampleStatus() byte {
+	status := s.pins.ReadStatus()
+	if s.GlitchRate > 0 && rand.Float64() < s.GlitchRate {
+		status ^= 0x10 << rand.Intn(4)
+	}
+	return status
+}
+
+// reverseBits reverses the bit order of a byte
+func reverseBits(b byte) byte {
+	b = (b&0xF0)>>4 | (b&0x0F)<<4
+	b = (b&0xCC)>>2 | (b&0x33)<<2
+	b = (b&0xAA)>>1 | (b&0x55)<<1
+	return b
+}
+
+// readHandshake returns the status as a PC parallel port sees it
+func (s *Simulator) readHandshake() byte {
+	return (s.pins.ReadStatus() ^ pmp300.STATUS_BUSY) & pmp300.STATUS_MASK
+}
+
+func (s *Simulator) commandOut(data, ctrl1, ctrl2 byte) {
+	if !s.dataIsOutput {
+		s.setDataOutput()
+	}
+	s.pins.WriteData(data)
+	s.pins.WriteControl(ctrl1)
+	s.pins.WriteControl(ctrl2)
+}
+
+// waitAck waits for the n-th handshake, returning 0 or an error code
+func (s *Simulator) waitAck(n int) byte {
+	expected := byte(pmp300.STATUS_ACK_A)
+	if n%2 == 1 {
+		expected = pmp300.STATUS_ACK_B
+	}
+	deadline := time.Now().Add(ACK_TIMEOUT)
+	for {
+		switch s.readHandshake() {
+		case expected:
+			return 0
+		case pmp300.STATUS_NAK:
+			return ERR_NAK
+		}
+		if time.Now().After(deadline) {
+			return ERR_ACK_TIMEOUT
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (s *Simulator) latchAndAck(value byte, n int) byte {
+	s.commandOut(value, 0x00, 0x04)
+	return s.waitAck(n)
+}
+
+// blockIntro selects the PMP300, sends the unlock key and latches a block
+// command with its address
+func (s *Simulator) blockIntro(cmd byte, addr uint32) byte {
+	s.pins.WriteControl(0x04)
+	s.commandOut(pmp300.PMP_CMD_SELECT, 0x0C, 0x04)
+	s.pins.WriteControl(0x00)
+	s.out.Flush()
+	time.Sleep(20 * time.Millisecond)
+	s.pins.WriteControl(0x04)
+	time.Sleep(20 * time.Millisecond)
+	for i, key := range introKey {
+		if code := s.latchAndAck(key, i); code != 0 {
+			return code
+		}
+	}
+	s.commandOut(pmp300.PMP_CMD_SELECT, 0x0C, 0x04)
+
+	s.commandOut(cmd, 0x0C, 0x04)
+	for i := 0; i < 3; i++ {
+		if code := s.latchAndAck(byte(addr>>(8*i)), i); code != 0 {
+			return code
+		}
+	}
+	return 0
+}
+
+func (s *Simulator) pmpOutro() {
+	s.commandOut(pmp300.PMP_CMD_SELECT, 0x0C, 0x04)
+}
+
+// readAddress reads a 24-bit block address parameter, high byte first
+func (s *Simulator) readAddress() uint32 {
+	addr := uint32(s.waitForByte()) << 16
+	addr |= uint32(s.waitForByte()) << 8
+	return addr | uint32(s.waitForByte())
+}
+
+func (s *Simulator) writeChunkByte(value byte, i int) {
+	s.pins.WriteData(value)
+	if i&1 == 0 {
+		s.pins.WriteControl(0x00)
+	} else {
+		s.pins.WriteControl(0x04)
+	}
+}
+
+func (s *Simulator) setDataOutput() {
+	s.pins.WriteData(0x00)
+	s.dataIsOutput = true
+}
+
+// abortRequested consumes a pending CMD_ABORT, like the firmware's
+// Serial.peek() check. Any other byte stays queued.
+func (s *Simulator) abortRequested() bool {
+	if s.Legacy || s.peeked || s.closed {
+		return false
+	}
+	select {
+	case b, ok := <-s.in:
+		if !ok {
+			s.closed = true
+			return false
+		}
+		if !s.heard() {
+			return false
+		}
+		if b == arduino.CMD_ABORT {
+			return true
+		}
+		s.peeked, s.next = true, b
+	default:
+	}
+	return false
+}
+
+// takePeeked returns the byte kept by abortRequested
+func (s *Simulator) takePeeked() (byte, bool) {
+	if !s.peeked {
+		return 0, false
+	}
+	s.peeked = false
+	return s.next, true
+}
+
+// readByte blocks for the next command byte
+func (s *Simulator) readByte() (byte, bool) {
+	if b, ok := s.takePeeked(); ok {
+		return b, true
+	}
+	s.out.Flush()
+	for {
+		b, ok := <-s.in
+		if !ok {
+			s.closed = true
+			return 0, false
+		}
+		if s.heard() {
+			return b, true
+		}
+	}
+}
+
+// waitForByte waits for a parameter byte. Like the firmware it sends a
+// timeout error and returns 0, leaving the handler to carry on. In framed
+// mode parameters come from the frame.
+func (s *Simulator) waitForByte() byte {
+	if s.inFrame {
+		if s.framePos >= len(s.frameBuf) {
+			return 0
+		}
+		s.framePos++
+		return s.frameBuf[s.framePos-1]
+	}
+	if b, ok := s.takePeeked(); ok {
+		return b
+	}
+	if s.closed {
+		return 0
+	}
+	b, ok := s.receive(s.ByteTimeout)
+	if !ok && !s.closed {
+		s.sendError(ERR_TIMEOUT)
+	}
+	return b
+}
+
+// sendByte sends a response byte, adding it to the frame CRC in framed mode.
+// The first byte of a framed response opens the frame; an error response is
+// 2 bytes long and makes the bridge drop frames until resynchronized.
+func (s *Simulator) sendByte(b byte) {
+	if s.inFrame && !s.respStarted {
+		if b == arduino.RESP_ERROR {
+			s.respLen = 2
+			s.rejecting = true
+		}
+		s.beginFrame()
+	}
+	s.out.WriteByte(b)
+	if s.inFrame {
+		s.txCrc = arduino.UpdateCRC16(s.txCrc, b)
+	}
+}
+
+func (s *Simulator) sendBytes(data ...byte) {
+	for _, b := range data {
+		s.sendByte(b)
+	}
+}
+
+func (s *Simulator) sendError(code byte) {
+	s.sendBytes(arduino.RESP_ERROR, code)
+}
@@ -0,0 +1,174 @@
+//go:build linux
+
+package bridgesim
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// PTY is a pseudo-terminal whose slave side stands in for the bridge's
+// serial device
+type PTY struct {
+	master *os.File
+	fd     int // master's, taken once so that Serve does not race Close
+	slave  string
+}
+
+// OpenPTY allocates a pseudo-terminal with a raw slave
+func OpenPTY() (*PTY, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open /dev/ptmx: %w", err)
+	}
+	fd := int(master.Fd())
+
+	if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+		master.Close()
+		return nil, fmt.Errorf("failed to unlock pty: %w", err)
+	}
+	n, err := unix.IoctlGetInt(fd, unix.TIOCGPTN)
+	if err != nil {
+		master.Close()
+		return nil, fmt.Errorf("failed to get pty number: %w", err)
+	}
+
+	p := &PTY{master: master, fd: fd, slave: fmt.Sprintf("/dev/pts/%d", n)}
+
+	// Opening and closing the slave once makes it raw and puts the master in
+	// the hung-up state, so the first client open can be detected.
+	if err := p.makeRaw(); err != nil {
+		master.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// SlavePath returns the device path clients open, e.g. /dev/pts/3
+func (p *PTY) SlavePath() string {
+	return p.slave
+}
+
+// Close releases the pseudo-terminal
+func (p *PTY) Close() error {
+	return p.master.Close()
+}
+
+// Serve runs the simulator for every client that opens the slave. Opening
+// the port resets the board like DTR does on a real Arduino: input is
+// discarded for bootDelay, then setup() prints the ready banner. As on a
+// real serial port, DTR is only toggled if HUPCL was set when the previous
+// client closed the slave; otherwise the board carries on where it was.
+// Bytes are lost while the slave is at another rate than the bridge. Serve
+// returns when the PTY is closed.
+func (p *PTY) Serve(sim *Simulator, bootDelay time.Duration, logf func(format string, args ...any)) error {
+	fd := p.fd
+	reset := true // Power-on
+	if sim.LineRate == nil && p.lineRate() != 0 {
+		sim.LineRate = p.lineRate
+	}
+	for {
+		if err := p.waitOpen(fd); err != nil {
+			return err
+		}
+		if reset {
+			logf("Client connected, resetting board")
+			time.Sleep(bootDelay)
+			unix.IoctlSetInt(fd, unix.TCFLSH, unix.TCIFLUSH)
+		} else {
+			logf("Client connected")
+		}
+
+		in := make(chan byte, 4096)
+		go func() {
+			defer close(in)
+			buf := make([]byte, 1024)
+			for {
+				n, err := p.master.Read(buf)
+				for _, b := range buf[:n] {
+					in <- b
+				}
+				if err != nil {
+					return
+				}
+			}
+		}()
+
+		run := sim.Run
+		if !reset {
+			run = sim.Resume
+		}
+		if err := run(in, p.master); err != nil {
+			logf("Session ended: %v", err)
+		}
+		// Drain until the reader sees the hangup
+		for range in {
+		}
+		reset = p.hupcl(fd)
+		logf("Client disconnected")
+	}
+}
+
+// lineRate returns the rate a client set on the slave, or 0 if unknown.
+// The master's termios calls act on the slave.
+func (p *PTY) lineRate() int {
+	t, err := unix.IoctlGetTermios(p.fd, unix.TCGETS2)
+	if err != nil {
+		return 0
+	}
+	return int(t.Ospeed)
+}
+
+// hupcl reports whether HUPCL is set on the slave. The master's termios
+// calls act on the slave.
+func (p *PTY) hupcl(fd int) bool {
+	t, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	return err != nil || t.Cflag&unix.HUPCL != 0
+}
+
+// waitOpen blocks until a client has the slave open, or fails once the
+// PTY is closed
+func (p *PTY) waitOpen(fd int) error {
+	for {
+		fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+		if _, err := unix.Poll(fds, 100); err != nil && err != unix.EINTR {
+			return fmt.Errorf("poll failed: %w", err)
+		}
+		if fds[0].Revents&unix.POLLNVAL != 0 {
+			return fmt.Errorf("pty closed")
+		}
+		if fds[0].Revents&unix.POLLHUP == 0 {
+			return nil
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// makeRaw puts the slave into raw 8N1 mode
+func (p *PTY) makeRaw() error {
+	slave, err := os.OpenFile(p.slave, os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open pty slave: %w", err)
+	}
+	defer slave.Close()
+
+	sfd := int(slave.Fd())
+	t, err := unix.IoctlGetTermios(sfd, unix.TCGETS)
+	if err != nil {
+		return fmt.Errorf("failed to get termios: %w", err)
+	}
+	t.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	t.Oflag &^= unix.OPOST
+	t.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	t.Cflag &^= unix.CSIZE | unix.PARENB
+	t.Cflag |= unix.CS8 | unix.HUPCL // Serial ports hang up on close by default
+	t.Cc[unix.VMIN] = 1
+	t.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(sfd, unix.TCSETS, t); err != nil {
+		return fmt.Errorf("failed to set termios: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+//go:build !linux
+
+package bridgesim
+
+import (
+	"fmt"
+	"time"
+)
+
+// PTY is only available on Linux
+type PTY struct{}
+
+// OpenPTY is only available on Linux
+func OpenPTY() (*PTY, error) {
+	return nil, fmt.Errorf("bridge simulator PTY is only supported on Linux")
+}
+
+// SlavePath returns an empty path
+func (p *PTY) SlavePath() string {
+	return ""
+}
+
+// Close does nothing
+func (p *PTY) Close() error {
+	return nil
+}
+
+// Serve is only available on Linux
+func (p *PTY) Serve(sim *Simulator, bootDelay time.Duration, logf func(format string, args ...any)) error {
+	return fmt.Errorf("bridge simulator PTY is only supported on Linux")
+}
@@ -0,0 +1,423 @@
+package conformance
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/murdinc/pmp300/pkg/arduino"
+	"github.com/murdinc/pmp300/pkg/pmp300"
+)
+
+// Case checks one section of PROTOCOL.md
+type Case struct {
+	Section string // Heading in PROTOCOL.md
+	Feature uint16 // CAP_* bits the command needs, 0 if every bridge has it
+	Run     func(l *Link) error
+}
+
+// Cases covers every command in PROTOCOL.md, in the order of its sections
+var Cases = []Case{
+	{"0x01 - Write Data Register", 0, func(l *Link) error {
+		return l.exchange([]byte{arduino.CMD_WRITE_DATA, 0xA8}, arduino.RESP_OK)
+	}},
+	{"0x02 - Write Control Register", 0, func(l *Link) error {
+		return l.exchange([]byte{arduino.CMD_WRITE_CTRL, 0x04}, arduino.RESP_OK)
+	}},
+	{"0x03 - Read Status Register", 0, func(l *Link) error {
+		return readStatus(l)
+	}},
+	{"0x04 - Delay Microseconds", arduino.CAP_DELAY_US, func(l *Link) error {
+		if err := l.exchange([]byte{arduino.CMD_DELAY_US, 0x00, 0x0A}, arduino.RESP_OK); err != nil {
+			return err
+		}
+		return timed(10*time.Millisecond, func() error {
+			return l.exchange([]byte{arduino.CMD_DELAY_US, 0x27, 0x10}, arduino.RESP_OK)
+		})
+	}},
+	{"0x05 - Delay Milliseconds", 0, func(l *Link) error {
+		return timed(20*time.Millisecond, func() error {
+			return l.exchange([]byte{arduino.CMD_DELAY_MS, 0x00, 0x14}, arduino.RESP_OK)
+		})
+	}},
+	{"0x06 - Ping", 0, func(l *Link) error {
+		return l.exchange([]byte{arduino.CMD_PING}, arduino.RESP_PONG)
+	}},
+	{"0x07 - Get Version", 0, func(l *Link) error {
+		if err := l.exchange([]byte{arduino.CMD_VERSION}, arduino.RESP_VERSION); err != nil {
+			return err
+		}
+		v, err := l.read(3)
+		if err != nil {
+			return err
+		}
+		if v[0] == 0 {
+			return fmt.Errorf("version %d.%d.%d has no major version", v[0], v[1], v[2])
+		}
+		return nil
+	}},
+	{"0x08 - Set Data Direction", arduino.CAP_DATA_DIR, func(l *Link) error {
+		if err := l.exchange([]byte{arduino.CMD_SET_DATA_DIR, arduino.DATA_INPUT}, arduino.RESP_OK); err != nil {
+			return fmt.Errorf("input: %w", err)
+		}
+		if err := l.exchange([]byte{arduino.CMD_SET_DATA_DIR, arduino.DATA_OUTPUT}, arduino.RESP_OK); err != nil {
+			return fmt.Errorf("output: %w", err)
+		}
+		if err := l.exchange([]byte{arduino.CMD_SET_DATA_DIR, 'X'}, arduino.RESP_ERROR, arduino.ERR_PARAM); err != nil {
+			return fmt.Errorf("invalid direction: %w", err)
+		}
+		return nil
+	}},
+	{"0x09 - Query Capabilities", 0, func(l *Link) error {
+		if err := l.send(arduino.CMD_CAPABILITIES); err != nil {
+			return err
+		}
+		resp, err := l.read(2)
+		if err != nil {
+			return err
+		}
+		if resp[0] == arduino.RESP_ERROR {
+			// Firmware before 3.3
+			if resp[1] != arduino.ERR_UNKNOWN_CMD {
+				return fmt.Errorf("got error 0x%02X, want 0x%02X", resp[1], arduino.ERR_UNKNOWN_CMD)
+			}
+			return nil
+		}
+		if resp[0] != arduino.RESP_CAPABILITIES {
+			return fmt.Errorf("got response 0x%02X, want 0x%02X", resp[0], arduino.RESP_CAPABILITIES)
+		}
+		rest, err := l.read(5)
+		if err != nil {
+			return err
+		}
+		features := uint16(resp[1])<<8 | uint16(rest[0])
+		maxNibble := int(rest[1])<<8 | int(rest[2])
+		buffer := int(rest[3])<<8 | int(rest[4])
+		if features&arduino.REQUIRED_CAPS != arduino.REQUIRED_CAPS {
+			return fmt.Errorf("features 0x%04X lack the 2.0 commands", features)
+		}
+		if maxNibble == 0 || maxNibble == 0xFFFF || buffer == 0 {
+			return fmt.Errorf("limits out of range: max nibble %d, rx buffer %d", maxNibble, buffer)
+		}
+		return nil
+	}},
+	{"0x0A - Set Baud Rate", arduino.CAP_BAUD, func(l *Link) error {
+		if err := l.exchange([]byte{arduino.CMD_SET_BAUD, 0x00, 0x00, 0x12, 0x34}, arduino.RESP_ERROR, arduino.ERR_BAUD); err != nil {
+			return fmt.Errorf("unsupported rate: %w", err)
+		}
+		// Switch to the rate in use, which needs no change of the line
+		rate := arduino.DEFAULT_BAUD
+		if err := l.exchange([]byte{arduino.CMD_SET_BAUD, byte(rate >> 24), byte(rate >> 16), byte(rate >> 8), byte(rate)}, arduino.RESP_OK); err != nil {
+			return err
+		}
+		if err := l.exchange([]byte{arduino.CMD_PING}, arduino.RESP_PONG); err != nil {
+			return fmt.Errorf("confirmation ping: %w", err)
+		}
+		return nil
+	}},
+	{"0x0B - Checked Nibble Read", arduino.CAP_NIBBLE_CHECK, func(l *Link) error {
+		const skip, count = 16, 1000
+		if err := l.exchange([]byte{arduino.CMD_READ_NIBBLE_CHK, 0x00, skip, count >> 8, count & 0xFF}, arduino.RESP_OK); err != nil {
+			return err
+		}
+		for start := 0; start < count; start += arduino.NIBBLE_CHECK_SPAN {
+			n := min(arduino.NIBBLE_CHECK_SPAN, count-start)
+			span, err := l.read(n + 2)
+			if err != nil {
+				return fmt.Errorf("span at byte %d: %w", start, err)
+			}
+			check := uint16(span[n])<<8 | uint16(span[n+1])
+			if crc := arduino.UpdateCRC16(arduino.CRC16_INIT, span[:n]...); crc != check {
+				return fmt.Errorf("span at byte %d: check 0x%04X, want 0x%04X", start, check, crc)
+			}
+		}
+		return nil
+	}},
+	{"0x0C - Wait for Status", arduino.CAP_WAIT_STATUS, func(l *Link) error {
+		// Matches at once
+		if err := l.exchange([]byte{arduino.CMD_WAIT_STATUS, 0x00, 0x00, 0x00, 0x0F, 0x42, 0x40}, arduino.RESP_VALUE); err != nil {
+			return err
+		}
+		if _, err := l.read(1); err != nil {
+			return err
+		}
+		// Bits 0-2 of the status are always 0, so this runs into the 2ms timeout
+		return timed(2*time.Millisecond, func() error {
+			if err := l.exchange([]byte{arduino.CMD_WAIT_STATUS, 0x07, 0x07, 0x00, 0x00, 0x07, 0xD0}, arduino.RESP_VALUE); err != nil {
+				return err
+			}
+			status, err := l.read(1)
+			if err != nil {
+				return err
+			}
+			if status[0]&0x07 != 0 {
+				return fmt.Errorf("status 0x%02X has bits 0-2 set", status[0])
+			}
+			return nil
+		})
+	}},
+	{"0x0D - Select Framing", arduino.CAP_FRAMING, func(l *Link) (err error) {
+		if err := l.exchange([]byte{arduino.CMD_FRAMING, 0x02}, arduino.RESP_ERROR, arduino.ERR_FRAME); err != nil {
+			return fmt.Errorf("unknown mode: %w", err)
+		}
+		if err := l.exchange([]byte{arduino.CMD_FRAMING, arduino.FRAMING_CRC16}, arduino.RESP_OK); err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				l.unframe()
+			}
+		}()
+		// The first frame may carry any sequence number
+		if err := l.exchangeFrame(0x42, []byte{arduino.CMD_PING}, arduino.RESP_PONG); err != nil {
+			return fmt.Errorf("framed ping: %w", err)
+		}
+		if err := l.exchangeFrame(0x43, []byte{arduino.CMD_WRITE_DATA, 0xA8}, arduino.RESP_OK); err != nil {
+			return fmt.Errorf("framed write: %w", err)
+		}
+		if err := l.exchangeFrame(0x44, []byte{arduino.CMD_FRAMING, arduino.FRAMING_RAW}, arduino.RESP_OK); err != nil {
+			return fmt.Errorf("back to unframed: %w", err)
+		}
+		if err := l.exchange([]byte{arduino.CMD_PING}, arduino.RESP_PONG); err != nil {
+			return fmt.Errorf("unframed ping: %w", err)
+		}
+		return nil
+	}},
+	{"0x0E - Read Block", arduino.CAP_BLOCK, func(l *Link) error {
+		if err := l.exchange([]byte{arduino.CMD_READ_BLOCK, 0x00, 0x00, 0x40}, arduino.RESP_OK); err != nil {
+			return err
+		}
+		if _, err := l.read(pmp300.BLOCK_SIZE); err != nil {
+			return err
+		}
+		return l.exchange([]byte{arduino.CMD_PING}, arduino.RESP_PONG)
+	}},
+	{"0x0F - Write Block", arduino.CAP_BLOCK | arduino.CAP_BLOCK_READY, func(l *Link) error {
+		chunks := blockChunks(2)
+		if err := writeBlock(l, 0x80, chunks, -1); err != nil {
+			return err
+		}
+		if err := l.expect(arduino.RESP_OK); err != nil {
+			return err
+		}
+
+		// The pages come back without their end blocks
+		if err := l.exchange([]byte{arduino.CMD_READ_BLOCK, 0x00, 0x00, 0x80}, arduino.RESP_OK); err != nil {
+			return fmt.Errorf("read back: %w", err)
+		}
+		block, err := l.read(pmp300.BLOCK_SIZE)
+		if err != nil {
+			return fmt.Errorf("read back: %w", err)
+		}
+		for i := 0; i < arduino.BLOCK_CHUNKS; i++ {
+			page := chunks[i*arduino.CHUNK_SIZE : i*arduino.CHUNK_SIZE+pmp300.PAGE_SIZE]
+			if !bytes.Equal(block[i*pmp300.PAGE_SIZE:(i+1)*pmp300.PAGE_SIZE], page) {
+				return fmt.Errorf("page %d reads back differently", i)
+			}
+		}
+
+		// A corrupted chunk is answered in place of the next ready byte
+		if err := writeBlock(l, 0xC0, blockChunks(3), 2); err != nil {
+			return fmt.Errorf("corrupted chunk: %w", err)
+		}
+		if err := l.expect(arduino.RESP_ERROR, arduino.ERR_CRC); err != nil {
+			return fmt.Errorf("corrupted chunk: %w", err)
+		}
+		return nil
+	}},
+	{"0x10 - Abort", arduino.CAP_ABORT, func(l *Link) error {
+		// Nothing running: the byte is consumed without a response
+		if err := l.send(arduino.CMD_ABORT); err != nil {
+			return err
+		}
+		if err := l.exchange([]byte{arduino.CMD_PING}, arduino.RESP_PONG); err != nil {
+			return fmt.Errorf("idle abort: %w", err)
+		}
+
+		// A stream stops short
+		const count = 0xFFFE
+		if err := l.exchange([]byte{arduino.CMD_READ_NIBBLE_BLK, count >> 8, count & 0xFF}, arduino.RESP_OK); err != nil {
+			return err
+		}
+		if _, err := l.read(100); err != nil {
+			return err
+		}
+		if err := l.send(arduino.CMD_ABORT); err != nil {
+			return err
+		}
+		if n := 100 + l.drain(); n >= count {
+			return fmt.Errorf("stream of %d bytes not stopped", n)
+		}
+		if err := l.exchange([]byte{arduino.CMD_PING}, arduino.RESP_PONG); err != nil {
+			return fmt.Errorf("after the stream: %w", err)
+		}
+
+		// A delay ends at once
+		start := time.Now()
+		if err := l.exchange([]byte{arduino.CMD_DELAY_MS, 0x13, 0x88, arduino.CMD_ABORT}, arduino.RESP_OK); err != nil {
+			return fmt.Errorf("5s delay: %w", err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			return fmt.Errorf("5s delay answered after %v", elapsed)
+		}
+		return nil
+	}},
+	{"0x11 - Command Out", arduino.CAP_COMMANDOUT, func(l *Link) error {
+		return l.exchange([]byte{arduino.CMD_COMMANDOUT, 0xA8, 0x0C, 0x04}, arduino.RESP_OK)
+	}},
+	{"0x12 - Nibble Block Read", arduino.CAP_NIBBLE_BLOCK, func(l *Link) error {
+		if err := l.exchange([]byte{arduino.CMD_READ_NIBBLE_BLK, 0x00, 0x10}, arduino.RESP_OK); err != nil {
+			return err
+		}
+		if _, err := l.read(16); err != nil {
+			return err
+		}
+		// Nothing beyond count
+		return l.exchange([]byte{arduino.CMD_PING}, arduino.RESP_PONG)
+	}},
+	{"0x13 - Write PMP Chunk", arduino.CAP_PMP_CHUNK, func(l *Link) error {
+		cmd := make([]byte, 1+arduino.CHUNK_SIZE)
+		cmd[0] = arduino.CMD_WRITE_PMP_CHUNK
+		if err := l.exchange(cmd, arduino.RESP_OK); err != nil {
+			return err
+		}
+		return l.exchange([]byte{arduino.CMD_PING}, arduino.RESP_PONG)
+	}},
+	{"Errors and Retransmission", arduino.CAP_FRAMING, func(l *Link) (err error) {
+		if err := l.exchange([]byte{arduino.CMD_FRAMING, arduino.FRAMING_CRC16}, arduino.RESP_OK); err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				l.unframe()
+			}
+		}()
+		if err := l.exchangeFrame(7, []byte{arduino.CMD_PING}, arduino.RESP_PONG); err != nil {
+			return err
+		}
+
+		// A corrupted frame is rejected, and so is every frame after it
+		// until 'F' 0x01, which may carry any sequence number
+		frame := arduino.AppendFrame(nil, 8, []byte{arduino.CMD_COMMANDOUT, 0xA8, 0x0C, 0x04})
+		frame[len(frame)-1] ^= 0xFF
+		if err := l.send(frame...); err != nil {
+			return err
+		}
+		if err := l.expectFrame(8, arduino.RESP_ERROR, arduino.ERR_CRC); err != nil {
+			return fmt.Errorf("CRC mismatch: %w", err)
+		}
+		if err := l.exchangeFrame(9, []byte{arduino.CMD_PING}, arduino.RESP_ERROR, arduino.ERR_DROPPED); err != nil {
+			return fmt.Errorf("frame after an error: %w", err)
+		}
+		if err := l.exchangeFrame(0x30, []byte{arduino.CMD_FRAMING, arduino.FRAMING_CRC16}, arduino.RESP_OK); err != nil {
+			return fmt.Errorf("resync: %w", err)
+		}
+
+		// Out of order
+		if err := l.exchangeFrame(0x32, []byte{arduino.CMD_PING}, arduino.RESP_ERROR, arduino.ERR_DROPPED); err != nil {
+			return fmt.Errorf("skipped sequence number: %w", err)
+		}
+		if err := l.exchangeFrame(0x33, []byte{arduino.CMD_FRAMING, arduino.FRAMING_CRC16}, arduino.RESP_OK); err != nil {
+			return fmt.Errorf("resync: %w", err)
+		}
+
+		// Wrong parameter count
+		if err := l.exchangeFrame(0x34, []byte{arduino.CMD_WRITE_DATA}, arduino.RESP_ERROR, arduino.ERR_FRAME); err != nil {
+			return fmt.Errorf("missing parameter: %w", err)
+		}
+		if err := l.exchangeFrame(0x35, []byte{arduino.CMD_FRAMING, arduino.FRAMING_CRC16}, arduino.RESP_OK); err != nil {
+			return fmt.Errorf("resync: %w", err)
+		}
+		if err := l.exchangeFrame(0x36, []byte{arduino.CMD_PING}, arduino.RESP_PONG); err != nil {
+			return fmt.Errorf("after resync: %w", err)
+		}
+		if err := l.exchangeFrame(0x37, []byte{arduino.CMD_FRAMING, arduino.FRAMING_RAW}, arduino.RESP_OK); err != nil {
+			return fmt.Errorf("back to unframed: %w", err)
+		}
+		return nil
+	}},
+	{"Error Responses", 0, func(l *Link) error {
+		if err := l.exchange([]byte{'Z'}, arduino.RESP_ERROR, arduino.ERR_UNKNOWN_CMD); err != nil {
+			return fmt.Errorf("unknown command: %w", err)
+		}
+		// The parameter never comes
+		if err := l.exchange([]byte{arduino.CMD_WRITE_DATA}, arduino.RESP_ERROR, arduino.ERR_TIMEOUT); err != nil {
+			return fmt.Errorf("parameter timeout: %w", err)
+		}
+		l.drain()
+		return nil
+	}},
+}
+
+// readStatus reads the status register, whose bits 0-2 are always 0
+func readStatus(l *Link) error {
+	if err := l.exchange([]byte{arduino.CMD_READ_STATUS}, arduino.RESP_VALUE); err != nil {
+		return err
+	}
+	status, err := l.read(1)
+	if err != nil {
+		return err
+	}
+	if status[0]&0x07 != 0 {
+		return fmt.Errorf("status 0x%02X has bits 0-2 set", status[0])
+	}
+	return nil
+}
+
+// blockChunks returns the 64 chunks of test data for block pos, each page
+// followed by the end block the PMP300 checks
+func blockChunks(pos int) []byte {
+	chunks := make([]byte, 0, arduino.BLOCK_CHUNKS*arduino.CHUNK_SIZE)
+	for i := 0; i < arduino.BLOCK_CHUNKS; i++ {
+		page := make([]byte, pmp300.PAGE_SIZE)
+		for j := range page {
+			page[j] = byte(pos + i*7 + j)
+		}
+		end := make([]byte, arduino.CHUNK_SIZE-pmp300.PAGE_SIZE)
+		binary.LittleEndian.PutUint16(end[0:], uint16(pos))
+		end[2] = byte(i)
+		binary.LittleEndian.PutUint16(end[6:], pmp300.FAT_END)
+		binary.LittleEndian.PutUint16(end[8:], pmp300.PageChecksum(page))
+		chunks = append(append(chunks, page...), end...)
+	}
+	return chunks
+}
+
+// writeBlock sends 'b' for the block at page address addr and its chunks,
+// each after its ready byte, and leaves the response to the caller. The
+// chunk numbered bad gets a wrong CRC and is the last one sent.
+func writeBlock(l *Link, addr byte, chunks []byte, bad int) error {
+	if err := l.send(arduino.CMD_WRITE_BLOCK, 0x00, 0x00, addr); err != nil {
+		return err
+	}
+	for i := 0; i < arduino.BLOCK_CHUNKS; i++ {
+		if err := l.expect(arduino.RESP_READY); err != nil {
+			return fmt.Errorf("ready for chunk %d: %w", i, err)
+		}
+		chunk := chunks[i*arduino.CHUNK_SIZE : (i+1)*arduino.CHUNK_SIZE]
+		crc := arduino.UpdateCRC16(arduino.CRC16_INIT, chunk...)
+		if i == bad {
+			crc ^= 0xFFFF
+		}
+		if err := l.send(append(chunk[:len(chunk):len(chunk)], byte(crc>>8), byte(crc))...); err != nil {
+			return err
+		}
+		if i == bad {
+			return nil
+		}
+	}
+	return nil
+}
+
+// timed runs f and fails if it returns sooner than least
+func timed(least time.Duration, f func() error) error {
+	start := time.Now()
+	if err := f(); err != nil {
+		return err
+	}
+	if elapsed := time.Since(start); elapsed < least {
+		return fmt.Errorf("answered after %v, want at least %v", elapsed, least)
+	}
+	return nil
+}
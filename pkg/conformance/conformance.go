@@ -0,0 +1,247 @@
+// Package conformance checks a bridge against the serial protocol in
+// arduino/pmp300_usb_parallel_bridge/PROTOCOL.md. Every documented command
+// has a case that sends it and compares the bridge's answer with the spec,
+// so the firmware, the simulator and the document stay in step:
+//
+//	link := conformance.Simulate(bridgesim.New(emulator.New(flash)))
+//	defer link.Close()
+//	failed, err := conformance.Run(link, report)
+package conformance
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/murdinc/pmp300/pkg/arduino"
+	"github.com/murdinc/pmp300/pkg/bridgesim"
+)
+
+// Response timing
+const (
+	RESPONSE_TIMEOUT = 2 * time.Second        // Longest wait for a response byte
+	QUIET            = 200 * time.Millisecond // Silence that ends a drain
+)
+
+// Link is the serial line to the bridge under test
+type Link struct {
+	w     io.Writer
+	in    chan byte // Bytes from the bridge, closed when the line ends
+	close func() error
+}
+
+// NewLink reads the bridge's bytes from r and writes commands to w
+func NewLink(r io.Reader, w io.Writer) *Link {
+	l := &Link{w: w, in: make(chan byte, 4096)}
+	go func() {
+		defer close(l.in)
+		buf := make([]byte, 1024)
+		for {
+			n, err := r.Read(buf)
+			for _, b := range buf[:n] {
+				l.in <- b
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return l
+}
+
+// Simulate runs sim in-process, as if its board had just been reset
+func Simulate(sim *bridgesim.Simulator) *Link {
+	cmds := make(chan byte, 4096)
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(sim.Run(cmds, pw))
+	}()
+	l := NewLink(pr, chanWriter(cmds))
+	l.close = func() error {
+		close(cmds)
+		return pr.Close()
+	}
+	return l
+}
+
+// Close ends a simulated link
+func (l *Link) Close() error {
+	if l.close == nil {
+		return nil
+	}
+	return l.close()
+}
+
+// send writes a command and its parameters
+func (l *Link) send(data ...byte) error {
+	_, err := l.w.Write(data)
+	return err
+}
+
+// read returns the next n bytes from the bridge
+func (l *Link) read(n int) ([]byte, error) {
+	buf := make([]byte, 0, n)
+	timer := time.NewTimer(RESPONSE_TIMEOUT)
+	defer timer.Stop()
+	for len(buf) < n {
+		select {
+		case b, ok := <-l.in:
+			if !ok {
+				return buf, fmt.Errorf("line closed after %d of %d bytes", len(buf), n)
+			}
+			buf = append(buf, b)
+		case <-timer.C:
+			return buf, fmt.Errorf("no response after %d of %d bytes (got % X)", len(buf), n, buf)
+		}
+	}
+	return buf, nil
+}
+
+// expect reads len(want) bytes and compares them with want
+func (l *Link) expect(want ...byte) error {
+	got, err := l.read(len(want))
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("got % X, want % X", got, want)
+	}
+	return nil
+}
+
+// exchange sends a command and expects its response
+func (l *Link) exchange(cmd []byte, want ...byte) error {
+	if err := l.send(cmd...); err != nil {
+		return err
+	}
+	return l.expect(want...)
+}
+
+// drain discards bytes until the bridge is QUIET and returns their number
+func (l *Link) drain() int {
+	n := 0
+	for {
+		select {
+		case _, ok := <-l.in:
+			if !ok {
+				return n
+			}
+			n++
+		case <-time.After(QUIET):
+			return n
+		}
+	}
+}
+
+// exchangeFrame sends a command in a frame and expects its response in a
+// frame with the same sequence number
+func (l *Link) exchangeFrame(seq byte, cmd []byte, want ...byte) error {
+	if err := l.send(arduino.AppendFrame(nil, seq, cmd)...); err != nil {
+		return err
+	}
+	return l.expectFrame(seq, want...)
+}
+
+// expectFrame reads a response frame and compares its sequence number and
+// payload with seq and want
+func (l *Link) expectFrame(seq byte, want ...byte) error {
+	header, err := l.read(4)
+	if err != nil {
+		return err
+	}
+	if header[0] != arduino.FRAME_SYNC {
+		return fmt.Errorf("got 0x%02X, want frame sync 0x%02X", header[0], arduino.FRAME_SYNC)
+	}
+	n := int(header[1])<<8 | int(header[2])
+	if n > len(want) {
+		return fmt.Errorf("frame of %d bytes, want % X", n, want)
+	}
+	rest, err := l.read(n + 2)
+	if err != nil {
+		return err
+	}
+	payload := rest[:n]
+	check := uint16(rest[n])<<8 | uint16(rest[n+1])
+	if crc := arduino.UpdateCRC16(arduino.CRC16_INIT, header[1:]...); arduino.UpdateCRC16(crc, payload...) != check {
+		return fmt.Errorf("frame % X failed its CRC", payload)
+	}
+	if header[3] != seq {
+		return fmt.Errorf("frame % X has sequence number %d, want %d", payload, header[3], seq)
+	}
+	if !bytes.Equal(payload, want) {
+		return fmt.Errorf("got frame % X, want % X", payload, want)
+	}
+	return nil
+}
+
+// unframe returns a bridge left in framed mode by a failed case to the
+// unframed protocol. 'F' 0x01 is accepted with any sequence number and
+// ends the dropping of frames after an error.
+func (l *Link) unframe() {
+	l.drain()
+	l.send(arduino.AppendFrame(nil, 0, []byte{arduino.CMD_FRAMING, arduino.FRAMING_CRC16})...)
+	l.send(arduino.AppendFrame(nil, 1, []byte{arduino.CMD_FRAMING, arduino.FRAMING_RAW})...)
+	l.drain()
+}
+
+// chanWriter feeds a simulator's input
+type chanWriter chan<- byte
+
+func (c chanWriter) Write(p []byte) (int, error) {
+	for _, b := range p {
+		c <- b
+	}
+	return len(p), nil
+}
+
+// Result is the outcome of one case
+type Result struct {
+	Section string
+	Skipped bool  // The bridge does not report the case's feature
+	Err     error // nil if the bridge conforms
+}
+
+// Run drains the ready banner, queries the bridge's features and runs every
+// case in Cases, calling report with each result. It returns the number of
+// failed cases; the error is set if the bridge could not be queried.
+func Run(l *Link, report func(Result)) (int, error) {
+	l.drain()
+	features, err := queryFeatures(l)
+	if err != nil {
+		return 0, err
+	}
+
+	failed := 0
+	for _, c := range Cases {
+		r := Result{Section: c.Section}
+		if features&c.Feature != c.Feature {
+			r.Skipped = true
+		} else if r.Err = c.Run(l); r.Err != nil {
+			failed++
+			l.drain()
+		}
+		report(r)
+	}
+	return failed, nil
+}
+
+// queryFeatures returns the feature bits of the capability query, or just
+// the required ones if the bridge predates it
+func queryFeatures(l *Link) (uint16, error) {
+	if err := l.send(arduino.CMD_CAPABILITIES); err != nil {
+		return 0, err
+	}
+	resp, err := l.read(2)
+	if err != nil {
+		return 0, fmt.Errorf("capability query: %w", err)
+	}
+	if resp[0] == arduino.RESP_ERROR {
+		return arduino.REQUIRED_CAPS, nil
+	}
+	rest, err := l.read(5)
+	if err != nil {
+		return 0, fmt.Errorf("capability query: %w", err)
+	}
+	return uint16(resp[1])<<8 | uint16(rest[0]), nil
+}
@@ -0,0 +1,231 @@
+package conformance_test
+
+import (
+	"bufio"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/murdinc/pmp300/pkg/bridgesim"
+	"github.com/murdinc/pmp300/pkg/conformance"
+	"github.com/murdinc/pmp300/pkg/emulator"
+	"github.com/murdinc/pmp300/pkg/pmp300"
+)
+
+// Where the three definitions of the protocol live
+const (
+	SPEC   = "../../arduino/pmp300_usb_parallel_bridge/PROTOCOL.md"
+	SKETCH = "../../arduino/pmp300_usb_parallel_bridge/pmp300_usb_parallel_bridge.ino"
+	HOST   = "../arduino"
+)
+
+var (
+	headingRe = regexp.MustCompile(`^#{2,3} (.+?)(?: \(firmware [^)]*\))?$`)
+	sectionRe = regexp.MustCompile(`^### (0x[0-9A-F]{2} - .+?)(?: \(firmware [^)]*\))?$`)
+	commandRe = regexp.MustCompile("^\\*\\*Command\\*\\*: (?:`'.'` \\()?(0x[0-9A-F]{2})")
+	defineRe  = regexp.MustCompile(`^#define (CMD_\w+)\s+('.'|0x[0-9A-Fa-f]+)`)
+)
+
+// specCommands returns the command byte of every section of the Command
+// Reference in PROTOCOL.md, by section, and all its headings
+func specCommands(t *testing.T) (map[string]byte, map[string]bool) {
+	t.Helper()
+	f, err := os.Open(SPEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	commands := map[string]byte{}
+	headings := map[string]bool{}
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := headingRe.FindStringSubmatch(line); m != nil {
+			headings[m[1]] = true
+			section = ""
+		}
+		if m := sectionRe.FindStringSubmatch(line); m != nil {
+			section = m[1]
+			continue
+		}
+		if m := commandRe.FindStringSubmatch(line); m != nil && section != "" {
+			value, _ := strconv.ParseUint(m[1], 0, 8)
+			commands[section] = byte(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(commands) == 0 {
+		t.Fatalf("no commands found in %s", SPEC)
+	}
+	return commands, headings
+}
+
+// sketchCommands returns the CMD_ defines of the firmware sketch
+func sketchCommands(t *testing.T) map[string]byte {
+	t.Helper()
+	f, err := os.Open(SKETCH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	commands := map[string]byte{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if m := defineRe.FindStringSubmatch(scanner.Text()); m != nil {
+			commands[m[1]] = literal(t, m[2])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return commands
+}
+
+// hostCommands returns the CMD_ constants of the arduino package
+func hostCommands(t *testing.T) map[string]byte {
+	t.Helper()
+	pkgs, err := parser.ParseDir(token.NewFileSet(), HOST, func(fi os.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go")
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commands := map[string]byte{}
+	for _, pkg := range pkgs {
+		ast.Inspect(pkg, func(n ast.Node) bool {
+			spec, ok := n.(*ast.ValueSpec)
+			if !ok {
+				return true
+			}
+			for i, name := range spec.Names {
+				if !strings.HasPrefix(name.Name, "CMD_") || i >= len(spec.Values) {
+					continue
+				}
+				if lit, ok := spec.Values[i].(*ast.BasicLit); ok {
+					commands[name.Name] = literal(t, lit.Value)
+				}
+			}
+			return true
+		})
+	}
+	return commands
+}
+
+// literal parses a character or integer literal, as C and Go write them
+func literal(t *testing.T, s string) byte {
+	t.Helper()
+	if strings.HasPrefix(s, "'") {
+		value, _, _, err := strconv.UnquoteChar(s[1:len(s)-1], '\'')
+		if err != nil {
+			t.Fatalf("literal %s: %v", s, err)
+		}
+		return byte(value)
+	}
+	value, err := strconv.ParseUint(s, 0, 8)
+	if err != nil {
+		t.Fatalf("literal %s: %v", s, err)
+	}
+	return byte(value)
+}
+
+// TestCommandTables checks that the spec, the sketch and the host package
+// define the same commands with the same bytes
+func TestCommandTables(t *testing.T) {
+	spec, _ := specCommands(t)
+	sketch := sketchCommands(t)
+	host := hostCommands(t)
+
+	documented := map[byte]string{}
+	for section, cmd := range spec {
+		if other, ok := documented[cmd]; ok {
+			t.Errorf("0x%02X documented by both %q and %q", cmd, other, section)
+		}
+		documented[cmd] = section
+	}
+	defined := map[byte]string{}
+	for name, cmd := range sketch {
+		defined[cmd] = name
+		if _, ok := documented[cmd]; !ok {
+			t.Errorf("sketch command %s (0x%02X) has no section in PROTOCOL.md", name, cmd)
+		}
+		if value, ok := host[name]; !ok {
+			t.Errorf("sketch command %s has no constant in pkg/arduino", name)
+		} else if value != cmd {
+			t.Errorf("%s is 0x%02X in the sketch and 0x%02X in pkg/arduino", name, cmd, value)
+		}
+	}
+	for cmd, section := range documented {
+		if _, ok := defined[cmd]; !ok {
+			t.Errorf("%q documents 0x%02X, which the sketch does not define", section, cmd)
+		}
+	}
+	for name, cmd := range host {
+		if _, ok := sketch[name]; !ok {
+			t.Errorf("pkg/arduino defines %s (0x%02X), which the sketch does not", name, cmd)
+		}
+	}
+}
+
+// TestCasesCoverSpec checks that every documented command has a case and
+// every case checks a section that exists
+func TestCasesCoverSpec(t *testing.T) {
+	spec, headings := specCommands(t)
+	cases := map[string]bool{}
+	for _, c := range conformance.Cases {
+		if cases[c.Section] {
+			t.Errorf("two cases for %q", c.Section)
+		}
+		cases[c.Section] = true
+		if !headings[c.Section] {
+			t.Errorf("case %q has no section in PROTOCOL.md", c.Section)
+		}
+	}
+	for section, cmd := range spec {
+		if !cases[section] {
+			t.Errorf("command 0x%02X (%q) has no case", cmd, section)
+		}
+	}
+}
+
+// TestSimulator runs every case against the simulated 3.x firmware, which
+// must have all of them, and the 2.x one, which skips the 3.x commands
+func TestSimulator(t *testing.T) {
+	for _, legacy := range []bool{false, true} {
+		rio := emulator.New(emulator.NewFlash(pmp300.BLOCKS_INTERNAL))
+		sim := bridgesim.New(rio)
+		sim.Legacy = legacy
+		link := conformance.Simulate(sim)
+
+		skipped := 0
+		failed, err := conformance.Run(link, func(r conformance.Result) {
+			switch {
+			case r.Skipped:
+				skipped++
+			case r.Err != nil:
+				t.Errorf("%s: %v", r.Section, r.Err)
+			}
+		})
+		link.Close()
+		rio.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !legacy && skipped > 0 {
+			t.Errorf("simulator skipped %d cases", skipped)
+		}
+		if failed > 0 {
+			t.Errorf("%s: %d cases failed", sim.Banner(), failed)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package emulator_test
+
+import (
+	"bytes"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/murdinc/pmp300/pkg/emulator"
+	"github.com/murdinc/pmp300/pkg/pmp300"
+)
+
+// newPlayer returns an initialized device on an emulated player with an
+// erased internal flash
+func newPlayer(t *testing.T) (*emulator.Rio, *pmp300.Device) {
+	t.Helper()
+	rio := emulator.New(emulator.NewFlash(pmp300.BLOCKS_INTERNAL))
+	pmp := pmp300.New(emulator.NewPort(rio))
+	if err := pmp.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	return rio, pmp
+}
+
+// flashDirectory decodes block 0 straight from the flash and checks it
+func flashDirectory(t *testing.T, f *emulator.Flash) *pmp300.Directory {
+	t.Helper()
+	block, err := f.ReadBlock(pmp300.DIRECTORY_BLOCK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := pmp300.CheckDirectory(block, f.Blocks())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Clean() {
+		t.Fatalf("directory on flash has problems: %v", res.Problems)
+	}
+	return res.Directory
+}
+
+// song returns size bytes of test data
+func song(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func upload(t *testing.T, pmp *pmp300.Device, name string, data []byte) {
+	t.Helper()
+	if err := pmp.UploadFile(name, data, nil); err != nil {
+		t.Fatalf("upload %s: %v", name, err)
+	}
+}
+
+// listNames returns the names of the files in playback order
+func listNames(t *testing.T, pmp *pmp300.Device) []string {
+	t.Helper()
+	files, err := pmp.ListFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name)
+	}
+	return names
+}
+
+func TestFormat(t *testing.T) {
+	rio, pmp := newPlayer(t)
+	if err := pmp.FormatDevice(false); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := flashDirectory(t, rio.Internal())
+	h := dir.Header
+	if h.EntryCount != 0 || h.BlocksAvailable != pmp300.BLOCKS_INTERNAL-1 || h.BlocksUsed != 0 ||
+		h.BlocksRemaining != pmp300.BLOCKS_INTERNAL-1 || h.BlocksBad != 0 || h.Version != pmp300.DIRECTORY_VERSION {
+		t.Errorf("formatted header %+v", h)
+	}
+	if dir.BlockUsage[pmp300.DIRECTORY_BLOCK] != pmp300.BLOCK_USED || dir.BlockUsage[1] != pmp300.BLOCK_FREE {
+		t.Errorf("block usage starts %v", dir.BlockUsage[:2])
+	}
+	if names := listNames(t, pmp); len(names) != 0 {
+		t.Errorf("formatted flash lists %v", names)
+	}
+}
+
+func TestFormatBadBlocks(t *testing.T) {
+	rio, pmp := newPlayer(t)
+	card := emulator.NewFlash(pmp300.BLOCKS_EXTERNAL_MIN)
+	card.MarkBad(5)
+	rio.InsertCard(card)
+	if err := pmp.SwitchStorage(pmp300.StorageExternal); err != nil {
+		t.Fatal(err)
+	}
+	if err := pmp.FormatDevice(true); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := flashDirectory(t, card)
+	if dir.Header.BlocksAvailable != pmp300.BLOCKS_EXTERNAL_MIN-1 || dir.Header.BlocksBad != 1 || dir.BlockUsage[5] != pmp300.BLOCK_BAD {
+		t.Errorf("header %+v, block 5 usage 0x%02X", dir.Header, dir.BlockUsage[5])
+	}
+
+	// A quick format keeps the bad block
+	if err := pmp.FormatDevice(false); err != nil {
+		t.Fatal(err)
+	}
+	if dir := flashDirectory(t, card); dir.BlockUsage[5] != pmp300.BLOCK_BAD {
+		t.Errorf("quick format lost bad block 5")
+	}
+}
+
+func TestUploadListDownload(t *testing.T) {
+	rio, pmp := newPlayer(t)
+	if err := pmp.FormatDevice(false); err != nil {
+		t.Fatal(err)
+	}
+	a := song(1, 40000)
+	b := song(2, 100000)
+	upload(t, pmp, "a.mp3", a)
+	upload(t, pmp, "b.mp3", b)
+
+	files, err := pmp.ListFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 ||
+		files[0].Name != "a.mp3" || files[0].Size != 40000 || files[0].BlockPosition != 1 || files[0].BlockCount != 2 ||
+		files[1].Name != "b.mp3" || files[1].Size != 100000 || files[1].BlockPosition != 3 || files[1].BlockCount != 4 {
+		t.Fatalf("listed %+v", files)
+	}
+
+	// Directory and blocks as stored on the flash
+	dir := flashDirectory(t, rio.Internal())
+	if dir.Header.EntryCount != 2 || dir.Header.BlocksUsed != 6 {
+		t.Errorf("header %+v", dir.Header)
+	}
+	if dir.FAT[1] != 2 || dir.FAT[2] != pmp300.FAT_END || dir.FAT[6] != pmp300.FAT_END {
+		t.Errorf("FAT starts %v", dir.FAT[:8])
+	}
+	block1, _ := rio.Internal().ReadBlock(1)
+	block2, _ := rio.Internal().ReadBlock(2)
+	if !bytes.Equal(block1, a[:pmp300.BLOCK_SIZE]) {
+		t.Errorf("block 1 does not hold the start of a.mp3")
+	}
+	tail := len(a) - pmp300.BLOCK_SIZE
+	if !bytes.Equal(block2[:tail], a[pmp300.BLOCK_SIZE:]) || !bytes.Equal(block2[tail:], make([]byte, pmp300.BLOCK_SIZE-tail)) {
+		t.Errorf("block 2 does not hold the zero padded end of a.mp3")
+	}
+	for pos, want := range map[int][2]uint16{1: {0, 2}, 2: {1, pmp300.FAT_END}, 3: {0, 4}, 6: {5, pmp300.FAT_END}} {
+		prev, next, ok := rio.Internal().Links(pos)
+		if !ok || prev != want[0] || next != want[1] {
+			t.Errorf("block %d links to %d/%d, want %d/%d", pos, prev, next, want[0], want[1])
+		}
+	}
+
+	for name, want := range map[string][]byte{"a.mp3": a, "b.mp3": b} {
+		got, err := pmp.DownloadFile(name, nil)
+		if err != nil {
+			t.Fatalf("download %s: %v", name, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: downloaded contents differ", name)
+		}
+	}
+
+	// A fresh device reads the same directory back from the flash
+	again := pmp300.New(emulator.NewPort(rio))
+	if err := again.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	if names := listNames(t, again); len(names) != 2 || names[0] != "a.mp3" || names[1] != "b.mp3" {
+		t.Errorf("fresh device lists %v", names)
+	}
+}
+
+func TestMove(t *testing.T) {
+	rio, pmp := newPlayer(t)
+	if err := pmp.FormatDevice(false); err != nil {
+		t.Fatal(err)
+	}
+	data := map[string][]byte{"a.mp3": song(1, 1000), "b.mp3": song(2, 50000), "c.mp3": song(3, 70000)}
+	for _, name := range []string{"a.mp3", "b.mp3", "c.mp3"} {
+		upload(t, pmp, name, data[name])
+	}
+	before := flashDirectory(t, rio.Internal())
+
+	if err := pmp.MoveFile(2, 0); err != nil {
+		t.Fatal(err)
+	}
+	if names := listNames(t, pmp); len(names) != 3 || names[0] != "c.mp3" || names[1] != "a.mp3" || names[2] != "b.mp3" {
+		t.Fatalf("after move lists %v", names)
+	}
+
+	// Only the entries are reordered; blocks and FAT stay where they were
+	after := flashDirectory(t, rio.Internal())
+	if after.Entries[0] != before.Entries[2] || after.Entries[1] != before.Entries[0] || after.Entries[2] != before.Entries[1] {
+		t.Errorf("entries on flash not reordered")
+	}
+	if after.FAT != before.FAT || after.BlockUsage != before.BlockUsage {
+		t.Errorf("move changed the FAT or block usage")
+	}
+	for name, want := range data {
+		got, err := pmp.DownloadFile(name, nil)
+		if err != nil {
+			t.Fatalf("download %s: %v", name, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: contents differ after move", name)
+		}
+	}
+
+	if err := pmp.MoveFile(0, 3); err == nil {
+		t.Errorf("move to position 4 of 3 succeeded")
+	}
+}
+
+func TestExternalCard(t *testing.T) {
+	rio, pmp := newPlayer(t)
+	if err := pmp.FormatDevice(false); err != nil {
+		t.Fatal(err)
+	}
+	upload(t, pmp, "internal.mp3", song(1, 5000))
+	internal, _ := rio.Internal().ReadBlock(pmp300.DIRECTORY_BLOCK)
+
+	if present, err := pmp.DetectExternalStorage(); present || err != nil {
+		t.Fatalf("card detected without one: %v %v", present, err)
+	}
+	card := emulator.NewFlash(128)
+	rio.InsertCard(card)
+	if err := pmp.SwitchStorage(pmp300.StorageExternal); err != nil {
+		t.Fatal(err)
+	}
+	present, total, err := pmp.CheckPresent()
+	if err != nil || !present || total != 128 {
+		t.Fatalf("card present %v with %d blocks: %v", present, total, err)
+	}
+	if err := pmp.FormatDevice(false); err != nil {
+		t.Fatal(err)
+	}
+	card1 := song(2, 60000)
+	upload(t, pmp, "card.mp3", card1)
+
+	if names := listNames(t, pmp); len(names) != 1 || names[0] != "card.mp3" {
+		t.Errorf("card lists %v", names)
+	}
+	if dir := flashDirectory(t, card); dir.Header.BlocksAvailable != 127 || dir.Header.BlocksUsed != 2 {
+		t.Errorf("card header %+v", dir.Header)
+	}
+	if got, _ := rio.Internal().ReadBlock(pmp300.DIRECTORY_BLOCK); !bytes.Equal(got, internal) {
+		t.Errorf("card operations changed the internal directory")
+	}
+
+	if err := pmp.SwitchStorage(pmp300.StorageInternal); err != nil {
+		t.Fatal(err)
+	}
+	if names := listNames(t, pmp); len(names) != 1 || names[0] != "internal.mp3" {
+		t.Errorf("internal lists %v", names)
+	}
+}
+
+// TestFlashImage checks that a file-backed flash is an image the device
+// opens offline, and the reverse
+func TestFlashImage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rio.img")
+	flash, err := emulator.OpenFlash(path, pmp300.BLOCKS_INTERNAL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rio := emulator.New(flash)
+	pmp := pmp300.New(emulator.NewPort(rio))
+	if err := pmp.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	if err := pmp.FormatDevice(false); err != nil {
+		t.Fatal(err)
+	}
+	data := song(1, 50000)
+	upload(t, pmp, "song.mp3", data)
+	rio.Close()
+
+	img, err := pmp300.OpenImage(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	images := &pmp300.Images{Internal: img}
+	offline := pmp300.NewFromBlockDevice(images)
+	if got, err := offline.DownloadFile("song.mp3", nil); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("offline download differs: %v", err)
+	}
+	upload(t, offline, "offline.mp3", song(2, 1000))
+	images.Close()
+
+	flash, err = emulator.OpenFlash(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer flash.Close()
+	if flash.Blocks() != pmp300.BLOCKS_INTERNAL {
+		t.Errorf("reopened flash has %d blocks", flash.Blocks())
+	}
+	if dir := flashDirectory(t, flash); dir.Header.EntryCount != 2 {
+		t.Errorf("reopened flash holds %d files, want 2", dir.Header.EntryCount)
+	}
+}
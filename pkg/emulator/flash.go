@@ -0,0 +1,108 @@
+package emulator
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/murdinc/pmp300/pkg/pmp300"
+)
+
+// Image is the backing store of a flash, holding its blocks
+type Image interface {
+	ReadBlock(pos int) ([]byte, error)
+	WriteBlock(pos int, block []byte) error
+}
+
+// Flash is one storage of the emulated player (internal flash or SmartMedia)
+type Flash struct {
+	img    Image
+	blocks int
+	bad    map[int]bool
+	links  map[int][2]uint16
+	file   *pmp300.Image
+}
+
+// NewFlash returns an erased in-memory flash of the given size in blocks
+func NewFlash(blocks int) *Flash {
+	img := &memImage{data: bytes.Repeat([]byte{0xFF}, blocks*pmp300.BLOCK_SIZE)}
+	return &Flash{img: img, blocks: blocks, bad: map[int]bool{}, links: map[int][2]uint16{}}
+}
+
+// OpenFlash opens a flash backed by an image file, in the layout of
+// pmp300.OpenImage, which it uses. A missing file is created erased with the
+// given number of blocks; for an existing file blocks may be 0 to use the
+// file's size.
+func OpenFlash(path string, blocks int) (*Flash, error) {
+	img, err := pmp300.OpenImage(path, blocks)
+	if err != nil {
+		return nil, err
+	}
+	return &Flash{img: img, blocks: img.Blocks(), bad: map[int]bool{}, links: map[int][2]uint16{}, file: img}, nil
+}
+
+// Blocks returns the flash size in 32KB blocks
+func (f *Flash) Blocks() int {
+	return f.blocks
+}
+
+// MarkBad makes a block lose data on every write, like a worn out block
+func (f *Flash) MarkBad(pos int) {
+	f.bad[pos] = true
+}
+
+// Links returns the previous and next block of the file chain that the
+// last write of a block stored in its end blocks. They are kept in memory
+// only; ok is false for a block not written since the flash was opened.
+func (f *Flash) Links(pos int) (prev, next uint16, ok bool) {
+	l, ok := f.links[pos]
+	return l[0], l[1], ok
+}
+
+// ReadBlock returns a copy of a block
+func (f *Flash) ReadBlock(pos int) ([]byte, error) {
+	if pos < 0 || pos >= f.blocks {
+		return nil, fmt.Errorf("block %d out of range", pos)
+	}
+	return f.img.ReadBlock(pos)
+}
+
+// WriteBlock programs a block. Bad blocks keep their low data bit stuck at 0.
+func (f *Flash) WriteBlock(pos int, data []byte) error {
+	if pos < 0 || pos >= f.blocks {
+		return fmt.Errorf("block %d out of range", pos)
+	}
+	if len(data) != pmp300.BLOCK_SIZE {
+		return fmt.Errorf("block must be %d bytes, got %d", pmp300.BLOCK_SIZE, len(data))
+	}
+	if f.bad[pos] {
+		stuck := make([]byte, len(data))
+		for i, b := range data {
+			stuck[i] = b &^ 0x01
+		}
+		data = stuck
+	}
+	return f.img.WriteBlock(pos, data)
+}
+
+// Close closes a file-backed flash
+func (f *Flash) Close() error {
+	if f.file != nil {
+		return f.file.Close()
+	}
+	return nil
+}
+
+// memImage is an in-memory Image
+type memImage struct {
+	data []byte
+}
+
+func (m *memImage) ReadBlock(pos int) ([]byte, error) {
+	off := pos * pmp300.BLOCK_SIZE
+	return append([]byte(nil), m.data[off:off+pmp300.BLOCK_SIZE]...), nil
+}
+
+func (m *memImage) WriteBlock(pos int, block []byte) error {
+	copy(m.data[pos*pmp300.BLOCK_SIZE:], block)
+	return nil
+}
@@ -0,0 +1,98 @@
+package emulator
+
+import (
+	"fmt"
+	"math/bits"
+
+	"github.com/murdinc/pmp300/pkg/pmp300"
+)
+
+// Port drives a Rio the way the bridge firmware drives the real pins. It
+// implements pmp300.Transport.
+type Port struct {
+	rio *Rio
+}
+
+// NewPort returns a transport connected to rio
+func NewPort(rio *Rio) *Port {
+	return &Port{rio: rio}
+}
+
+// Rio returns the emulated player
+func (p *Port) Rio() *Rio {
+	return p.rio
+}
+
+// Device returns a description of the emulated device
+func (p *Port) Device() string {
+	return "emulator"
+}
+
+// Close closes the player's storage
+func (p *Port) Close() error {
+	return p.rio.Close()
+}
+
+// OutByte writes a byte to data (offset=0) or control (offset=2) register
+func (p *Port) OutByte(offset uint16, value byte) error {
+	switch offset {
+	case pmp300.OFFSET_DATA:
+		p.rio.WriteData(value)
+	case pmp300.OFFSET_CONTROL:
+		p.rio.WriteControl(value)
+	default:
+		return fmt.Errorf("invalid offset: %d", offset)
+	}
+	return nil
+}
+
+// InByte reads status register (offset must be 1)
+func (p *Port) InByte(offset uint16) (byte, error) {
+	if offset != pmp300.OFFSET_STATUS {
+		return 0, fmt.Errorf("invalid offset: %d", offset)
+	}
+	return p.rio.ReadStatus(), nil
+}
+
+// CommandOut writes data, ctrl1 and ctrl2 like the firmware's 'c' command
+func (p *Port) CommandOut(data, ctrl1, ctrl2 byte) error {
+	p.rio.WriteData(data)
+	p.rio.WriteControl(ctrl1)
+	p.rio.WriteControl(ctrl2)
+	return nil
+}
+
+// ReadNibbleBlock reads bytes like the firmware's 'n' command
+func (p *Port) ReadNibbleBlock(count uint16) ([]byte, error) {
+	p.rio.WriteControl(0x04)
+	data := make([]byte, count)
+	for i := range data {
+		p.rio.WriteControl(0x00)
+		result := (p.rio.ReadStatus() & 0xF0) >> 4
+		p.rio.WriteControl(0x04)
+		result |= p.rio.ReadStatus() & 0xF0
+		data[i] = bits.Reverse8(result)
+	}
+	return data, nil
+}
+
+// WritePMPChunk writes 528 bytes like the firmware's 'w' command
+func (p *Port) WritePMPChunk(data []byte) error {
+	if len(data) != pmp300.CHUNK_SIZE {
+		return fmt.Errorf("chunk must be exactly %d bytes, got %d", pmp300.CHUNK_SIZE, len(data))
+	}
+	for i, b := range data {
+		p.rio.WriteData(b)
+		if i&1 == 0 {
+			p.rio.WriteControl(0x00)
+		} else {
+			p.rio.WriteControl(0x04)
+		}
+	}
+	return nil
+}
+
+// DelayMilliseconds returns immediately; the emulator has no timing
+func (p *Port) DelayMilliseconds(ms uint16) error {
+	return nil
+}
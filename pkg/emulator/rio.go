@@ -0,0 +1,303 @@
+// Package emulator models a Diamond Rio PMP300 at the parallel port
+// register level, so the device layer can run without hardware:
+//
+//	rio := emulator.New(emulator.NewFlash(pmp300.BLOCKS_INTERNAL))
+//	rio.InsertCard(emulator.NewFlash(512)) // optional 16MB SmartMedia
+//	pmp := pmp300.New(emulator.NewPort(rio))
+package emulator
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"sync"
+
+	"github.com/murdinc/pmp300/pkg/pmp300"
+)
+
+// Raw status line levels. The device layer inverts Busy (bit 7) to get the
+// PC parallel port view, so every handshake value is stored inverted here.
+const (
+	statusIdle = 0x00 ^ pmp300.STATUS_BUSY
+	statusAckA = pmp300.STATUS_ACK_A ^ pmp300.STATUS_BUSY
+	statusAckB = pmp300.STATUS_ACK_B ^ pmp300.STATUS_BUSY
+	statusNak  = pmp300.STATUS_NAK ^ pmp300.STATUS_BUSY
+)
+
+// Unlock key expected after select, one parameter byte at a time
+var introKey = []byte{0xAD, 0x55, 0xAE, 0xAA}
+
+type state int
+
+const (
+	stateLocked      state = iota // Waiting for the intro key
+	stateKeyed                    // Key accepted, waiting for select
+	stateReady                    // Waiting for a block command
+	stateReadAddr                 // Collecting the 3 address bytes of a read
+	stateWriteAddr                // Collecting the 3 address bytes of a write
+	stateReadStream               // Serving nibbles
+	stateWriteStream              // Receiving 528-byte chunks
+	stateDone                     // Command finished, waiting for select
+)
+
+// Rio is an emulated PMP300. It is driven through WriteData, WriteControl
+// and ReadStatus exactly like the player's parallel port pins.
+type Rio struct {
+	mu sync.Mutex
+
+	internal *Flash
+	external *Flash
+
+	data    byte
+	control byte
+	status  byte
+
+	state    state
+	keyIndex int
+	acks     int
+
+	// Current block command
+	addr      uint32
+	addrBytes int
+	flash     *Flash
+	block     int
+	buf       []byte
+	offset    int
+	chunk     []byte
+}
+
+// New returns a player with the given internal flash and no SmartMedia card
+func New(internal *Flash) *Rio {
+	return &Rio{
+		internal: internal,
+		control:  0x04,
+		status:   statusIdle,
+		state:    stateLocked,
+	}
+}
+
+// InsertCard inserts a SmartMedia card
+func (r *Rio) InsertCard(card *Flash) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.external = card
+}
+
+// RemoveCard removes the SmartMedia card
+func (r *Rio) RemoveCard() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.external = nil
+}
+
+// Internal returns the internal flash
+func (r *Rio) Internal() *Flash {
+	return r.internal
+}
+
+// External returns the SmartMedia card, nil when none is inserted
+func (r *Rio) External() *Flash {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.external
+}
+
+// Close closes file-backed storage
+func (r *Rio) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.internal.Close()
+	if r.external != nil {
+		if cerr := r.external.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// WriteData sets the data pins
+func (r *Rio) WriteData(value byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.data = value
+}
+
+// ReadStatus returns the status pins (raw line levels)
+func (r *Rio) ReadStatus() byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.status
+}
+
+// WriteControl sets the control pins. Control 0x0C latches a command byte,
+// a 0x00 -> 0x04 transition latches a parameter byte, and during streams
+// every edge moves one byte.
+func (r *Rio) WriteControl(value byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	prev := r.control
+	r.control = value
+
+	if value == 0x0C {
+		r.command(r.data)
+		return
+	}
+
+	switch r.state {
+	case stateReadStream:
+		r.readEdge(prev, value)
+	case stateWriteStream:
+		r.writeEdge()
+	default:
+		if prev == 0x00 && value == 0x04 {
+			r.param(r.data)
+		}
+	}
+}
+
+// command handles a byte latched with control 0x0C
+func (r *Rio) command(cmd byte) {
+	switch cmd {
+	case pmp300.PMP_CMD_SELECT:
+		if r.state == stateKeyed {
+			r.state = stateReady
+		} else {
+			r.state = stateLocked
+			r.keyIndex = 0
+		}
+		r.buf = nil
+		r.chunk = nil
+	case pmp300.PMP_CMD_READ, pmp300.PMP_CMD_WRITE:
+		if r.state != stateReady {
+			return
+		}
+		r.state = stateReadAddr
+		if cmd == pmp300.PMP_CMD_WRITE {
+			r.state = stateWriteAddr
+		}
+		r.acks = 0
+		r.addr = 0
+		r.addrBytes = 0
+	}
+}
+
+// param handles a byte latched by a 0x00 -> 0x04 control transition
+func (r *Rio) param(b byte) {
+	switch r.state {
+	case stateLocked:
+		if b == introKey[r.keyIndex] {
+			r.ack(r.keyIndex)
+			r.keyIndex++
+		} else if b == introKey[0] {
+			r.ack(0)
+			r.keyIndex = 1
+		} else {
+			r.keyIndex = 0
+		}
+		if r.keyIndex == len(introKey) {
+			r.state = stateKeyed
+			r.keyIndex = 0
+		}
+
+	case stateReadAddr, stateWriteAddr:
+		r.addr |= uint32(b) << (8 * r.addrBytes)
+		r.addrBytes++
+		if r.addrBytes < 3 {
+			r.ack(r.acks)
+			r.acks++
+			return
+		}
+		if !r.selectBlock() {
+			r.status = statusNak
+			r.state = stateDone
+			return
+		}
+		r.ack(r.acks)
+		r.acks++
+		if r.state == stateReadAddr {
+			r.buf, _ = r.flash.ReadBlock(r.block)
+			r.offset = 0
+			r.state = stateReadStream
+		} else {
+			r.buf = make([]byte, 0, pmp300.BLOCK_SIZE)
+			r.chunk = make([]byte, 0, pmp300.CHUNK_SIZE)
+			r.state = stateWriteStream
+		}
+	}
+}
+
+// selectBlock resolves the collected address to a flash and block
+func (r *Rio) selectBlock() bool {
+	r.flash = r.internal
+	if r.addr&pmp300.ADDRESS_EXTERNAL != 0 {
+		r.flash = r.external
+	}
+	if r.flash == nil {
+		return false
+	}
+	page := r.addr &^ pmp300.ADDRESS_EXTERNAL
+	if page%pmp300.PAGES_PER_BLOCK != 0 {
+		return false
+	}
+	r.block = int(page / pmp300.PAGES_PER_BLOCK)
+	return r.block < r.flash.Blocks()
+}
+
+// readEdge serves one nibble per control edge. The bridge reads the first
+// nibble after 0x00 and the second after 0x04, then bit-reverses the byte.
+func (r *Rio) readEdge(prev, value byte) {
+	if r.offset >= len(r.buf) {
+		r.state = stateDone
+		return
+	}
+	encoded := bits.Reverse8(r.buf[r.offset])
+	switch {
+	case value == 0x00:
+		r.status = (encoded & 0x0F) << 4
+	case value == 0x04 && prev == 0x00:
+		r.status = encoded & 0xF0
+		r.offset++
+	}
+}
+
+// writeEdge latches one byte of a write chunk per control edge
+func (r *Rio) writeEdge() {
+	r.chunk = append(r.chunk, r.data)
+	if len(r.chunk) < pmp300.CHUNK_SIZE {
+		return
+	}
+
+	page := r.chunk[:pmp300.PAGE_SIZE]
+	end := r.chunk[pmp300.PAGE_SIZE:]
+	index := len(r.buf) / pmp300.PAGE_SIZE
+	if binary.LittleEndian.Uint16(end[0:]) != uint16(r.block) ||
+		int(end[2]) != index ||
+		binary.LittleEndian.Uint16(end[8:]) != pmp300.PageChecksum(page) {
+		r.status = statusNak
+		r.state = stateDone
+		return
+	}
+
+	r.buf = append(r.buf, page...)
+	r.chunk = r.chunk[:0]
+	if len(r.buf) == pmp300.BLOCK_SIZE {
+		if err := r.flash.WriteBlock(r.block, r.buf); err != nil {
+			r.status = statusNak
+			r.state = stateDone
+			return
+		}
+		r.flash.links[r.block] = [2]uint16{binary.LittleEndian.Uint16(end[4:]), binary.LittleEndian.Uint16(end[6:])}
+		r.state = stateDone
+	}
+	r.ack(r.acks)
+	r.acks++
+}
+
+// ack shows the n-th handshake of the current command on the status lines
+func (r *Rio) ack(n int) {
+	if n%2 == 0 {
+		r.status = statusAckA
+	} else {
+		r.status = statusAckB
+	}
+}
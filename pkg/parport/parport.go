@@ -0,0 +1,178 @@
+// Package parport drives a native parallel port through the Linux ppdev
+// interface (/dev/parportN). Port offers the same primitives as the Arduino
+// bridge and implements pmp300.Transport.
+package parport
+
+import (
+	"fmt"
+	"time"
+)
+
+// ppdev ioctl requests (linux/ppdev.h)
+const (
+	PPRSTATUS  = 0x80017081 // _IOR('p', 0x81, unsigned char)
+	PPWCONTROL = 0x40017084 // _IOW('p', 0x84, unsigned char)
+	PPWDATA    = 0x40017086 // _IOW('p', 0x86, unsigned char)
+	PPCLAIM    = 0x0000708B // _IO('p', 0x8b)
+	PPRELEASE  = 0x0000708C // _IO('p', 0x8c)
+)
+
+// STATUS_BUSY is the status bit the PC parallel port hardware inverts
+const STATUS_BUSY = 0x80
+
+// Ioctler is the ioctl layer under Port. The real implementation calls
+// ioctl(2) on /dev/parportN; tests can substitute a fake.
+type Ioctler interface {
+	// Ioctl issues request with arg pointing at a one-byte argument
+	// (nil for requests without one)
+	Ioctl(request uint, arg *byte) error
+	Close() error
+}
+
+// Port is a claimed native parallel port
+type Port struct {
+	dev    Ioctler
+	device string
+
+	// IODelay is the settle time between a control write and the status
+	// read of a nibble
+	IODelay time.Duration
+}
+
+// New claims the port behind dev
+func New(dev Ioctler, device string) (*Port, error) {
+	if err := dev.Ioctl(PPCLAIM, nil); err != nil {
+		return nil, fmt.Errorf("failed to claim %s: %w", device, err)
+	}
+	return &Port{dev: dev, device: device, IODelay: 2 * time.Microsecond}, nil
+}
+
+// Close releases and closes the port
+func (p *Port) Close() error {
+	p.dev.Ioctl(PPRELEASE, nil)
+	return p.dev.Close()
+}
+
+// Device returns the parport device path
+func (p *Port) Device() string {
+	return p.device
+}
+
+// OutByte writes a byte to data (offset=0) or control (offset=2) register
+func (p *Port) OutByte(offset uint16, value byte) error {
+	switch offset {
+	case 0:
+		return p.dev.Ioctl(PPWDATA, &value)
+	case 2:
+		return p.dev.Ioctl(PPWCONTROL, &value)
+	default:
+		return fmt.Errorf("invalid offset: %d", offset)
+	}
+}
+
+// InByte reads status register (offset must be 1). The PC hardware inverts
+// Busy; it is inverted back so callers see raw line levels like the bridge.
+func (p *Port) InByte(offset uint16) (byte, error) {
+	if offset != 1 {
+		return 0, fmt.Errorf("invalid offset: %d", offset)
+	}
+	status, err := p.readStatus()
+	if err != nil {
+		return 0, err
+	}
+	return status ^ STATUS_BUSY, nil
+}
+
+// DelayMilliseconds delays for specified milliseconds
+func (p *Port) DelayMilliseconds(ms uint16) error {
+	time.Sleep(time.Duration(ms) * time.Millisecond)
+	return nil
+}
+
+// CommandOut executes COMMANDOUT(data, ctrl1, ctrl2)
+func (p *Port) CommandOut(data, ctrl1, ctrl2 byte) error {
+	if err := p.dev.Ioctl(PPWDATA, &data); err != nil {
+		return err
+	}
+	if err := p.dev.Ioctl(PPWCONTROL, &ctrl1); err != nil {
+		return err
+	}
+	return p.dev.Ioctl(PPWCONTROL, &ctrl2)
+}
+
+// ReadNibbleBlock reads multiple bytes using PMP300 nibble protocol. Like the
+// original C++ code, Busy is XORed back before the bits are reversed.
+func (p *Port) ReadNibbleBlock(count uint16) ([]byte, error) {
+	if err := p.writeControl(0x04); err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, count)
+	for i := range data {
+		if err := p.writeControl(0x00); err != nil {
+			return nil, err
+		}
+		p.delay()
+		status, err := p.readStatus()
+		if err != nil {
+			return nil, err
+		}
+		result := ((status & 0xF0) ^ STATUS_BUSY) >> 4
+
+		if err := p.writeControl(0x04); err != nil {
+			return nil, err
+		}
+		p.delay()
+		if status, err = p.readStatus(); err != nil {
+			return nil, err
+		}
+		result |= (status & 0xF0) ^ STATUS_BUSY
+
+		result = (result&0xF0)>>4 | (result&0x0F)<<4
+		result = (result&0xCC)>>2 | (result&0x33)<<2
+		result = (result&0xAA)>>1 | (result&0x55)<<1
+		data[i] = result
+	}
+	return data, nil
+}
+
+// WritePMPChunk writes 528 bytes (512 data + 16 end block) with PMP300 control toggling
+func (p *Port) WritePMPChunk(data []byte) error {
+	if len(data) != 528 {
+		return fmt.Errorf("chunk must be exactly 528 bytes, got %d", len(data))
+	}
+	for i := range data {
+		if err := p.dev.Ioctl(PPWDATA, &data[i]); err != nil {
+			return err
+		}
+		ctrl := byte(0x04)
+		if i&1 == 0 {
+			ctrl = 0x00
+		}
+		if err := p.writeControl(ctrl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Helper: write control register
+func (p *Port) writeControl(value byte) error {
+	return p.dev.Ioctl(PPWCONTROL, &value)
+}
+
+// Helper: read status register as the PC hardware reports it
+func (p *Port) readStatus() (byte, error) {
+	var status byte
+	if err := p.dev.Ioctl(PPRSTATUS, &status); err != nil {
+		return 0, err
+	}
+	return status, nil
+}
+
+// Helper: settle delay between nibble strobes
+func (p *Port) delay() {
+	if p.IODelay > 0 {
+		time.Sleep(p.IODelay)
+	}
+}
@@ -0,0 +1,251 @@
+package parport
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/murdinc/pmp300/pkg/emulator"
+	"github.com/murdinc/pmp300/pkg/pmp300"
+)
+
+// call is one ioctl seen by fakeIoctler, with the argument it carried in
+type call struct {
+	request uint
+	arg     byte
+}
+
+// fakeIoctler records ioctls and answers PPRSTATUS with status. Requests in
+// fail return their error once failFrom calls have been made.
+type fakeIoctler struct {
+	calls    []call
+	status   byte
+	fail     map[uint]error
+	failFrom int
+	closed   bool
+}
+
+func (f *fakeIoctler) Ioctl(request uint, arg *byte) error {
+	c := call{request: request}
+	if arg != nil {
+		c.arg = *arg
+	}
+	n := len(f.calls)
+	f.calls = append(f.calls, c)
+	if err, ok := f.fail[request]; ok && n >= f.failFrom {
+		return err
+	}
+	if request == PPRSTATUS {
+		*arg = f.status
+	}
+	return nil
+}
+
+func (f *fakeIoctler) Close() error {
+	f.closed = true
+	return nil
+}
+
+// rioIoctler wires the ppdev registers to an emulated player, inverting
+// Busy like the PC parallel port hardware
+type rioIoctler struct {
+	rio *emulator.Rio
+}
+
+func (r *rioIoctler) Ioctl(request uint, arg *byte) error {
+	switch request {
+	case PPWDATA:
+		r.rio.WriteData(*arg)
+	case PPWCONTROL:
+		r.rio.WriteControl(*arg)
+	case PPRSTATUS:
+		*arg = r.rio.ReadStatus() ^ STATUS_BUSY
+	}
+	return nil
+}
+
+func (r *rioIoctler) Close() error {
+	return nil
+}
+
+var errIoctl = errors.New("ioctl failed")
+
+func TestClaimRelease(t *testing.T) {
+	dev := &fakeIoctler{}
+	port, err := New(dev, "/dev/parport0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dev.calls) != 1 || dev.calls[0].request != PPCLAIM {
+		t.Fatalf("New made %v, want one PPCLAIM", dev.calls)
+	}
+	if port.Device() != "/dev/parport0" {
+		t.Errorf("Device() = %q", port.Device())
+	}
+
+	if err := port.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(dev.calls) != 2 || dev.calls[1].request != PPRELEASE || !dev.closed {
+		t.Errorf("Close made %v, closed %v; want PPRELEASE then close", dev.calls[1:], dev.closed)
+	}
+}
+
+func TestClaimFails(t *testing.T) {
+	dev := &fakeIoctler{fail: map[uint]error{PPCLAIM: errIoctl}}
+	if _, err := New(dev, "/dev/parport0"); !errors.Is(err, errIoctl) {
+		t.Fatalf("New returned %v, want the PPCLAIM error", err)
+	}
+	if len(dev.calls) != 1 || dev.closed {
+		t.Errorf("after a failed claim: calls %v, closed %v", dev.calls, dev.closed)
+	}
+}
+
+func TestRegisters(t *testing.T) {
+	dev := &fakeIoctler{}
+	port, err := New(dev, "/dev/parport0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev.calls = nil
+
+	if err := port.OutByte(0, 0x5A); err != nil {
+		t.Fatal(err)
+	}
+	if err := port.OutByte(2, 0x0C); err != nil {
+		t.Fatal(err)
+	}
+	if err := port.CommandOut(0xA5, 0x00, 0x04); err != nil {
+		t.Fatal(err)
+	}
+	want := []call{{PPWDATA, 0x5A}, {PPWCONTROL, 0x0C}, {PPWDATA, 0xA5}, {PPWCONTROL, 0x00}, {PPWCONTROL, 0x04}}
+	if len(dev.calls) != len(want) {
+		t.Fatalf("writes made %v, want %v", dev.calls, want)
+	}
+	for i := range want {
+		if dev.calls[i] != want[i] {
+			t.Errorf("write %d: %+v, want %+v", i, dev.calls[i], want[i])
+		}
+	}
+
+	// Status comes back with Busy inverted to the raw line level
+	for _, status := range []byte{0x00, 0x78, 0x80, 0xE8} {
+		dev.status = status
+		got, err := port.InByte(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != status^STATUS_BUSY {
+			t.Errorf("hardware status 0x%02X read as 0x%02X, want 0x%02X", status, got, status^STATUS_BUSY)
+		}
+	}
+
+	dev.calls = nil
+	if err := port.OutByte(1, 0); err == nil {
+		t.Errorf("OutByte to the status register succeeded")
+	}
+	if _, err := port.InByte(0); err == nil {
+		t.Errorf("InByte from the data register succeeded")
+	}
+	if len(dev.calls) != 0 {
+		t.Errorf("invalid offsets made %v", dev.calls)
+	}
+}
+
+// TestIoctlErrors fails one request, from the start or mid-stream, and
+// checks that the operation returns the error and stops at the failed call
+func TestIoctlErrors(t *testing.T) {
+	ops := []struct {
+		name     string
+		request  uint
+		failFrom int // Calls before the failure, counting the claim
+		op       func(p *Port) error
+	}{
+		{"OutByte data", PPWDATA, 1, func(p *Port) error { return p.OutByte(0, 1) }},
+		{"OutByte control", PPWCONTROL, 1, func(p *Port) error { return p.OutByte(2, 1) }},
+		{"InByte", PPRSTATUS, 1, func(p *Port) error { _, err := p.InByte(1); return err }},
+		{"CommandOut data", PPWDATA, 1, func(p *Port) error { return p.CommandOut(1, 2, 3) }},
+		{"CommandOut ctrl2", PPWCONTROL, 3, func(p *Port) error { return p.CommandOut(1, 2, 3) }},
+		{"ReadNibbleBlock control", PPWCONTROL, 1, func(p *Port) error { _, err := p.ReadNibbleBlock(4); return err }},
+		{"ReadNibbleBlock status", PPRSTATUS, 6, func(p *Port) error { _, err := p.ReadNibbleBlock(4); return err }},
+		{"WritePMPChunk data", PPWDATA, 100, func(p *Port) error { return p.WritePMPChunk(make([]byte, 528)) }},
+		{"WritePMPChunk control", PPWCONTROL, 100, func(p *Port) error { return p.WritePMPChunk(make([]byte, 528)) }},
+	}
+	for _, tt := range ops {
+		dev := &fakeIoctler{}
+		port, err := New(dev, "/dev/parport0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port.IODelay = 0
+		dev.fail = map[uint]error{tt.request: errIoctl}
+		dev.failFrom = tt.failFrom
+
+		err = tt.op(port)
+		if !errors.Is(err, errIoctl) {
+			t.Errorf("%s: returned %v, want the ioctl error", tt.name, err)
+			continue
+		}
+		last := dev.calls[len(dev.calls)-1]
+		if last.request != tt.request || len(dev.calls) <= tt.failFrom {
+			t.Errorf("%s: %d calls ending with 0x%X, want to stop at the first failing 0x%X", tt.name, len(dev.calls), last.request, tt.request)
+		}
+	}
+}
+
+func TestWritePMPChunkSize(t *testing.T) {
+	dev := &fakeIoctler{}
+	port, err := New(dev, "/dev/parport0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev.calls = nil
+	if err := port.WritePMPChunk(make([]byte, 512)); err == nil {
+		t.Errorf("512-byte chunk accepted")
+	}
+	if len(dev.calls) != 0 {
+		t.Errorf("short chunk made %d ioctls", len(dev.calls))
+	}
+}
+
+// TestPlayerRoundTrip runs the device layer over the port against an
+// emulated player: the control strobes, nibble reads and chunk writes must
+// all line up for files to come back intact.
+func TestPlayerRoundTrip(t *testing.T) {
+	rio := emulator.New(emulator.NewFlash(pmp300.BLOCKS_INTERNAL))
+	port, err := New(&rioIoctler{rio: rio}, "/dev/parport0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port.IODelay = 0
+	defer port.Close()
+
+	pmp := pmp300.New(port)
+	if err := pmp.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	if err := pmp.FormatDevice(false); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 70000)
+	rand.New(rand.NewSource(1)).Read(data)
+	if err := pmp.UploadFile("song.mp3", data, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	block, err := rio.Internal().ReadBlock(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(block, data[:pmp300.BLOCK_SIZE]) {
+		t.Errorf("flash block 1 does not hold the start of the file")
+	}
+	got, err := pmp.DownloadFile("song.mp3", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("downloaded file differs")
+	}
+}
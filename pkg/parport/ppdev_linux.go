@@ -0,0 +1,42 @@
+//go:build linux
+
+package parport
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// ppdev is the ioctl(2) implementation of Ioctler
+type ppdev struct {
+	f *os.File
+}
+
+// Open opens and claims a ppdev device such as /dev/parport0
+func Open(device string) (*Port, error) {
+	f, err := os.OpenFile(device, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", device, err)
+	}
+	port, err := New(&ppdev{f: f}, device)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return port, nil
+}
+
+func (d *ppdev) Ioctl(request uint, arg *byte) error {
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, d.f.Fd(), uintptr(request), uintptr(unsafe.Pointer(arg)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (d *ppdev) Close() error {
+	return d.f.Close()
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package parport
+
+import "fmt"
+
+// Open is only available on Linux
+func Open(device string) (*Port, error) {
+	return nil, fmt.Errorf("native parallel ports (ppdev) are only supported on Linux")
+}
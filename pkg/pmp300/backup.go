@@ -0,0 +1,278 @@
+package pmp300
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// MANIFEST_SAVE_INTERVAL is how many blocks a dump reads between saves of
+// its manifest, and so how many are read again when it is resumed
+const MANIFEST_SAVE_INTERVAL = 32
+
+// Manifest is the JSON sidecar of an image dump, stored as ManifestPath of
+// the image. It records what the raw blocks do not: where they came from,
+// the directory header as read, and a SHA-256 of every block.
+type Manifest struct {
+	Storage        string           `json:"storage"` // Storage.String() of the dumped storage
+	Blocks         int              `json:"blocks"`
+	BlockSize      int              `json:"block_size"`
+	Dumped         time.Time        `json:"dumped"`
+	Complete       bool             `json:"complete"`
+	Header         *DirectoryHeader `json:"directory_header,omitempty"`
+	DirectoryError string           `json:"directory_error,omitempty"`
+	BlockSHA256    []string         `json:"block_sha256"` // Hex digests, "" until a block is dumped
+}
+
+// RestoreStats counts the blocks of a restore
+type RestoreStats struct {
+	Written int // Blocks whose data or chain links differed, written
+	Skipped int // Blocks that already matched the image
+}
+
+// ManifestPath returns the manifest file of an image
+func ManifestPath(image string) string {
+	return image + ".json"
+}
+
+// ReadManifest reads the manifest of an image
+func ReadManifest(image string) (*Manifest, error) {
+	data, err := os.ReadFile(ManifestPath(image))
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %w", ManifestPath(image), err)
+	}
+	if m.BlockSize != BLOCK_SIZE || len(m.BlockSHA256) != m.Blocks {
+		return nil, fmt.Errorf("invalid manifest %s: %d digests for %d blocks of %d bytes", ManifestPath(image), len(m.BlockSHA256), m.Blocks, m.BlockSize)
+	}
+	return m, nil
+}
+
+// write saves the manifest of an image
+func (m *Manifest) write(image string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(ManifestPath(image), append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return nil
+}
+
+// blockDigest returns the hex SHA-256 of a block
+func blockDigest(block []byte) string {
+	sum := sha256.Sum256(block)
+	return hex.EncodeToString(sum[:])
+}
+
+// DumpImage reads every block of the current storage into an image file and
+// writes its manifest next to it
+func (d *Device) DumpImage(path string, progress ProgressFunc) (*Manifest, error) {
+	return d.DumpImageContext(context.Background(), path, progress)
+}
+
+// DumpImageContext is DumpImage with a context. A dump that was interrupted
+// resumes from its last saved manifest, unless the directory block no longer
+// matches, which means the storage has changed and the dump starts over.
+func (d *Device) DumpImageContext(ctx context.Context, path string, progress ProgressFunc) (*Manifest, error) {
+	present, total, err := d.CheckPresentContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !present {
+		return nil, fmt.Errorf("%s not present", d.storage)
+	}
+
+	_, statErr := os.Stat(path)
+	m, err := ReadManifest(path)
+	if statErr != nil || err != nil || m.Complete || m.Storage != d.storage.String() || m.Blocks != total {
+		m = &Manifest{Storage: d.storage.String(), Blocks: total, BlockSize: BLOCK_SIZE, BlockSHA256: make([]string, total)}
+	}
+
+	img, err := OpenImage(path, total)
+	if err != nil {
+		return nil, err
+	}
+	defer img.Close()
+	if img.Blocks() != total {
+		return nil, fmt.Errorf("image %s has %d blocks, %s has %d", path, img.Blocks(), d.storage, total)
+	}
+
+	dirBlock, err := d.readBlock(ctx, DIRECTORY_BLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory: %w", err)
+	}
+	if digest := blockDigest(dirBlock); digest != m.BlockSHA256[DIRECTORY_BLOCK] {
+		m.BlockSHA256 = make([]string, total)
+		m.BlockSHA256[DIRECTORY_BLOCK] = digest
+	}
+	m.Dumped = time.Now()
+	m.Header, m.DirectoryError = nil, ""
+	if dir, err := parseDirectory(dirBlock); dir != nil {
+		m.Header = &dir.Header
+		if err != nil {
+			m.DirectoryError = err.Error()
+		}
+	} else {
+		m.DirectoryError = err.Error()
+	}
+	if err := img.WriteBlock(DIRECTORY_BLOCK, dirBlock); err != nil {
+		return nil, err
+	}
+
+	for pos := 1; pos < total; pos++ {
+		if m.BlockSHA256[pos] == "" {
+			block, err := d.readBlock(ctx, pos)
+			if err != nil {
+				return nil, errors.Join(err, m.write(path))
+			}
+			if err := img.WriteBlock(pos, block); err != nil {
+				return nil, errors.Join(err, m.write(path))
+			}
+			m.BlockSHA256[pos] = blockDigest(block)
+			if pos%MANIFEST_SAVE_INTERVAL == 0 {
+				if err := m.write(path); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if progress != nil {
+			progress((pos+1)*BLOCK_SIZE, total*BLOCK_SIZE)
+		}
+	}
+
+	m.Complete = true
+	return m, m.write(path)
+}
+
+// RestoreImage writes an image made by DumpImage back to the current
+// storage. Blocks that already match the image, data and chain links, are
+// skipped, so a restore that was interrupted resumes by running it again.
+func (d *Device) RestoreImage(path string, progress ProgressFunc) (RestoreStats, error) {
+	return d.RestoreImageContext(context.Background(), path, progress)
+}
+
+// RestoreImageContext is RestoreImage with a context. The image is checked
+// against its manifest before anything is written, and the directory block
+// is written last.
+func (d *Device) RestoreImageContext(ctx context.Context, path string, progress ProgressFunc) (RestoreStats, error) {
+	var stats RestoreStats
+	m, err := ReadManifest(path)
+	if err != nil {
+		return stats, err
+	}
+	if !m.Complete {
+		return stats, fmt.Errorf("image %s is an unfinished dump; run the dump again to complete it", path)
+	}
+	if m.Storage != d.storage.String() {
+		return stats, fmt.Errorf("image %s is of %s, not %s", path, m.Storage, d.storage)
+	}
+
+	img, err := OpenImage(path, 0)
+	if err != nil {
+		return stats, err
+	}
+	defer img.Close()
+	if img.Blocks() != m.Blocks {
+		return stats, fmt.Errorf("image %s has %d blocks, its manifest %d", path, img.Blocks(), m.Blocks)
+	}
+	for pos := 0; pos < m.Blocks; pos++ {
+		block, err := img.ReadBlock(pos)
+		if err != nil {
+			return stats, err
+		}
+		if blockDigest(block) != m.BlockSHA256[pos] {
+			return stats, fmt.Errorf("image %s block %d does not match its manifest", path, pos)
+		}
+	}
+
+	present, total, err := d.CheckPresentContext(ctx)
+	if err != nil {
+		return stats, err
+	}
+	if !present {
+		return stats, fmt.Errorf("%s not present", d.storage)
+	}
+	if total != m.Blocks {
+		return stats, fmt.Errorf("image %s has %d blocks, %s has %d", path, m.Blocks, d.storage, total)
+	}
+
+	dirBlock, err := img.ReadBlock(DIRECTORY_BLOCK)
+	if err != nil {
+		return stats, err
+	}
+	prev, next := chainLinks(dirBlock)
+
+	// The links a block holds cannot be read back; they are taken to be the
+	// ones of the directory on the storage, which wrote them
+	currentDir, err := d.readBlock(ctx, DIRECTORY_BLOCK)
+	if err != nil {
+		return stats, err
+	}
+	currentPrev, currentNext := chainLinks(currentDir)
+
+	d.dir = nil
+	for i := 1; i <= total; i++ {
+		pos := i % total // The directory block goes last
+		current, err := d.readBlock(ctx, pos)
+		if err != nil {
+			return stats, err
+		}
+		linked := prev[pos] == currentPrev[pos] && next[pos] == currentNext[pos]
+		if linked && blockDigest(current) == m.BlockSHA256[pos] {
+			stats.Skipped++
+		} else {
+			block, err := img.ReadBlock(pos)
+			if err != nil {
+				return stats, err
+			}
+			if err := d.writeBlock(ctx, pos, block, prev[pos], next[pos]); err != nil {
+				return stats, err
+			}
+			stats.Written++
+		}
+		if progress != nil {
+			progress(i*BLOCK_SIZE, total*BLOCK_SIZE)
+		}
+	}
+	return stats, nil
+}
+
+// chainLinks returns the neighbours an upload stores with each block: the
+// previous and next block of its file, or 0 and FAT_END for blocks outside
+// any file. The directory block links to 0 and 0.
+func chainLinks(dirBlock []byte) (prev, next [MAX_BLOCKS]uint16) {
+	for pos := range next {
+		next[pos] = FAT_END
+	}
+	next[DIRECTORY_BLOCK] = 0
+
+	dir, err := parseDirectory(dirBlock)
+	if err != nil {
+		return prev, next
+	}
+	for i := 0; i < int(dir.Header.EntryCount); i++ {
+		blocks, err := dir.chain(&dir.Entries[i])
+		if err != nil {
+			continue
+		}
+		for j, pos := range blocks {
+			if j > 0 {
+				prev[pos] = uint16(blocks[j-1])
+			}
+			if j < len(blocks)-1 {
+				next[pos] = uint16(blocks[j+1])
+			}
+		}
+	}
+	return prev, next
+}
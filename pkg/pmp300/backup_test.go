@@ -0,0 +1,345 @@
+package pmp300_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/murdinc/pmp300/pkg/emulator"
+	"github.com/murdinc/pmp300/pkg/pmp300"
+)
+
+// CARD_BLOCKS is the size of the SmartMedia cards the backup tests dump,
+// small to keep them quick
+const CARD_BLOCKS = 64
+
+// cardPlayer returns an emulated player with a formatted card selected,
+// holding files of the given sizes in blocks, named with prefix
+func cardPlayer(t *testing.T, prefix string, seed int64, sizes ...int) (*pmp300.Device, *emulator.Flash, map[string][]byte) {
+	t.Helper()
+	rio := emulator.New(emulator.NewFlash(pmp300.BLOCKS_INTERNAL))
+	card := emulator.NewFlash(CARD_BLOCKS)
+	rio.InsertCard(card)
+	pmp := pmp300.New(emulator.NewPort(rio))
+	if err := pmp.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	if err := pmp.SwitchStorage(pmp300.StorageExternal); err != nil {
+		t.Fatal(err)
+	}
+	if err := pmp.FormatDevice(false); err != nil {
+		t.Fatal(err)
+	}
+
+	rng := rand.New(rand.NewSource(seed))
+	files := map[string][]byte{}
+	for i, blocks := range sizes {
+		name := fmt.Sprintf("%s%02d.mp3", prefix, i+1)
+		data := make([]byte, blocks*pmp300.BLOCK_SIZE-100)
+		rng.Read(data)
+		if err := pmp.UploadFile(name, data, nil); err != nil {
+			t.Fatalf("upload %s: %v", name, err)
+		}
+		files[name] = data
+	}
+	return pmp, card, files
+}
+
+// fileNames returns the names of the files on the player, sorted
+func fileNames(t *testing.T, pmp *pmp300.Device) []string {
+	t.Helper()
+	files, err := pmp.ListFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// imageBlock reads a block of an image file
+func imageBlock(t *testing.T, path string, pos int) []byte {
+	t.Helper()
+	img, err := pmp300.OpenImage(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	block, err := img.ReadBlock(pos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+// flashBlock reads a block of a flash
+func flashBlock(t *testing.T, flash *emulator.Flash, pos int) []byte {
+	t.Helper()
+	block, err := flash.ReadBlock(pos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+// fill returns a block of b
+func fill(b byte) []byte {
+	return bytes.Repeat([]byte{b}, pmp300.BLOCK_SIZE)
+}
+
+// interruptAt returns a context cancelled by its progress function once
+// blocks blocks are done
+func interruptAt(blocks int) (context.Context, pmp300.ProgressFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	return ctx, func(current, total int) {
+		if current >= blocks*pmp300.BLOCK_SIZE {
+			cancel()
+		}
+	}
+}
+
+// TestDumpRestore dumps a card and restores it onto a card holding other
+// files, then again onto the restored card
+func TestDumpRestore(t *testing.T) {
+	src, srcCard, files := cardPlayer(t, "song", 1, 3, 5, 2)
+	path := filepath.Join(t.TempDir(), "card.img")
+	m, err := src.DumpImage(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.Complete || m.Blocks != CARD_BLOCKS || m.Storage != pmp300.StorageExternal.String() {
+		t.Errorf("manifest: complete %v, %d blocks of %s", m.Complete, m.Blocks, m.Storage)
+	}
+	if m.Header == nil || m.Header.EntryCount != 3 || m.DirectoryError != "" {
+		t.Errorf("manifest directory: %+v, %q", m.Header, m.DirectoryError)
+	}
+	saved, err := pmp300.ReadManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for pos := 0; pos < CARD_BLOCKS; pos++ {
+		if !bytes.Equal(imageBlock(t, path, pos), flashBlock(t, srcCard, pos)) {
+			t.Fatalf("image block %d differs from the card", pos)
+		}
+		if saved.BlockSHA256[pos] != m.BlockSHA256[pos] || saved.BlockSHA256[pos] == "" {
+			t.Fatalf("manifest digest of block %d: %q", pos, saved.BlockSHA256[pos])
+		}
+	}
+
+	dst, dstCard, _ := cardPlayer(t, "other", 2, 4, 4)
+	stats, err := dst.RestoreImage(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Written+stats.Skipped != CARD_BLOCKS || stats.Written == 0 {
+		t.Errorf("restore wrote %d and skipped %d blocks", stats.Written, stats.Skipped)
+	}
+	checkFiles(t, dst, dstCard, files)
+	if names := fileNames(t, dst); len(names) != 3 || names[0] != "song01.mp3" {
+		t.Errorf("restored card holds %v", names)
+	}
+
+	stats, err = dst.RestoreImage(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Written != 0 || stats.Skipped != CARD_BLOCKS {
+		t.Errorf("restore onto the restored card wrote %d and skipped %d blocks", stats.Written, stats.Skipped)
+	}
+}
+
+// TestDumpResume interrupts a dump and runs it again. The blocks saved in
+// the manifest are not read again; the others are.
+func TestDumpResume(t *testing.T) {
+	src, srcCard, _ := cardPlayer(t, "song", 1, 3, 5, 2)
+	path := filepath.Join(t.TempDir(), "card.img")
+	ctx, progress := interruptAt(40)
+	if _, err := src.DumpImageContext(ctx, path, progress); !errors.Is(err, context.Canceled) {
+		t.Fatalf("interrupted dump: %v", err)
+	}
+	m, err := pmp300.ReadManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Complete || m.BlockSHA256[pmp300.MANIFEST_SAVE_INTERVAL] == "" || m.BlockSHA256[CARD_BLOCKS-1] != "" {
+		t.Fatalf("manifest of the interrupted dump: complete %v, digests %q", m.Complete, m.BlockSHA256)
+	}
+
+	// Free blocks change behind the dump's back, the directory does not
+	old := flashBlock(t, srcCard, 20)
+	srcCard.WriteBlock(20, fill(0x20))
+	srcCard.WriteBlock(50, fill(0x50))
+
+	m, err = src.DumpImage(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.Complete {
+		t.Error("resumed dump is not complete")
+	}
+	if !bytes.Equal(imageBlock(t, path, 20), old) {
+		t.Error("a block saved before the interruption was read again")
+	}
+	if !bytes.Equal(imageBlock(t, path, 50), fill(0x50)) {
+		t.Error("a block after the interruption was not read")
+	}
+}
+
+// TestDumpResumeChanged interrupts a dump, changes the directory and runs
+// it again. The dump starts over.
+func TestDumpResumeChanged(t *testing.T) {
+	src, srcCard, _ := cardPlayer(t, "song", 1, 3, 5, 2)
+	path := filepath.Join(t.TempDir(), "card.img")
+	ctx, progress := interruptAt(40)
+	if _, err := src.DumpImageContext(ctx, path, progress); !errors.Is(err, context.Canceled) {
+		t.Fatalf("interrupted dump: %v", err)
+	}
+
+	srcCard.WriteBlock(20, fill(0x20))
+	if err := src.UploadFile("new.mp3", fill(0x33), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := src.DumpImage(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Header == nil || m.Header.EntryCount != 4 {
+		t.Errorf("manifest directory %+v, want 4 entries", m.Header)
+	}
+	for pos := 0; pos < CARD_BLOCKS; pos++ {
+		if !bytes.Equal(imageBlock(t, path, pos), flashBlock(t, srcCard, pos)) {
+			t.Errorf("image block %d differs from the card", pos)
+		}
+	}
+}
+
+// TestRestoreSkips restores an image onto the card it was dumped from after
+// a block and the directory changed. Only they, and the blocks whose chain
+// links changed with the directory, are written.
+func TestRestoreSkips(t *testing.T) {
+	pmp, card, files := cardPlayer(t, "song", 1, 3, 5, 2)
+	path := filepath.Join(t.TempDir(), "card.img")
+	if _, err := pmp.DumpImage(path, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	card.WriteBlock(2, fill(0x02))
+	if err := pmp.DeleteFile("song03.mp3"); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := pmp.RestoreImage(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Block 2, the directory and the two blocks of song03.mp3
+	if stats.Written != 4 || stats.Skipped != CARD_BLOCKS-4 {
+		t.Errorf("restore wrote %d and skipped %d blocks, want 4 and %d", stats.Written, stats.Skipped, CARD_BLOCKS-4)
+	}
+	checkFiles(t, pmp, card, files)
+}
+
+// TestRestoreDirectoryLast interrupts a restore: the card keeps its own
+// directory until every other block is written
+func TestRestoreDirectoryLast(t *testing.T) {
+	src, _, files := cardPlayer(t, "song", 1, 3, 5, 2)
+	path := filepath.Join(t.TempDir(), "card.img")
+	if _, err := src.DumpImage(path, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	dst, dstCard, _ := cardPlayer(t, "other", 2, 4, 4)
+	dirBlock := flashBlock(t, dstCard, pmp300.DIRECTORY_BLOCK)
+	ctx, progress := interruptAt(CARD_BLOCKS - 1)
+	if _, err := dst.RestoreImageContext(ctx, path, progress); !errors.Is(err, context.Canceled) {
+		t.Fatalf("interrupted restore: %v", err)
+	}
+	if !bytes.Equal(flashBlock(t, dstCard, pmp300.DIRECTORY_BLOCK), dirBlock) {
+		t.Fatal("the directory was written before the other blocks")
+	}
+	if !bytes.Equal(flashBlock(t, dstCard, CARD_BLOCKS-1), imageBlock(t, path, CARD_BLOCKS-1)) {
+		t.Fatal("the last data block was not written")
+	}
+
+	if _, err := dst.RestoreImage(path, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, dst, dstCard, files)
+}
+
+// TestRestoreLinks restores a file onto blocks that hold its data already,
+// as two files. The blocks are written again for their chain links.
+func TestRestoreLinks(t *testing.T) {
+	data := make([]byte, 2*pmp300.BLOCK_SIZE)
+	rand.New(rand.NewSource(1)).Read(data)
+	src, _, _ := cardPlayer(t, "song", 1)
+	if err := src.UploadFile("whole.mp3", data, nil); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "card.img")
+	if _, err := src.DumpImage(path, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	dst, dstCard, _ := cardPlayer(t, "song", 1)
+	for i, name := range []string{"first.mp3", "second.mp3"} {
+		if err := dst.UploadFile(name, data[i*pmp300.BLOCK_SIZE:(i+1)*pmp300.BLOCK_SIZE], nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for pos := 1; pos <= 2; pos++ {
+		if !bytes.Equal(flashBlock(t, dstCard, pos), imageBlock(t, path, pos)) {
+			t.Fatalf("block %d does not hold the data of the image", pos)
+		}
+	}
+
+	stats, err := dst.RestoreImage(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Written != 3 {
+		t.Errorf("restore wrote %d blocks, want the directory and both data blocks", stats.Written)
+	}
+	checkFiles(t, dst, dstCard, map[string][]byte{"whole.mp3": data})
+}
+
+// TestRestoreCorruptImage checks that an image that does not match its
+// manifest is refused before anything is written
+func TestRestoreCorruptImage(t *testing.T) {
+	src, _, _ := cardPlayer(t, "song", 1, 3, 5, 2)
+	path := filepath.Join(t.TempDir(), "card.img")
+	if _, err := src.DumpImage(path, nil); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte{0x00}, 40*pmp300.BLOCK_SIZE+7)
+	f.Close()
+
+	dst, dstCard, _ := cardPlayer(t, "other", 2, 4, 4)
+	before := make([][]byte, CARD_BLOCKS)
+	for pos := range before {
+		before[pos] = flashBlock(t, dstCard, pos)
+	}
+	_, err = dst.RestoreImage(path, nil)
+	if err == nil || !strings.Contains(err.Error(), "block 40 does not match its manifest") {
+		t.Fatalf("restore of a corrupted image: %v", err)
+	}
+	for pos := range before {
+		if !bytes.Equal(flashBlock(t, dstCard, pos), before[pos]) {
+			t.Errorf("block %d was written", pos)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package pmp300
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// DefragMove relocates the blocks of one file
+type DefragMove struct {
+	Entry int    // Index in the playback order
+	Name  string // Name of the entry, checked before the move
+	From  []int  // Blocks to relocate, in chain order
+	To    []int  // Their new blocks
+}
+
+// DefragPlan is the relocations that make the free space of a storage
+// contiguous, as made by PlanDefrag
+type DefragPlan struct {
+	Moves      []DefragMove
+	Blocks     int           // Blocks to relocate
+	FreeBlocks int           // Free blocks, which form one run afterwards
+	LargestRun int           // Largest run of free blocks before
+	BlockTime  time.Duration // Measured time of one block read
+}
+
+// Estimate returns how long the plan should take: a read and a write for
+// every relocated block, and a directory write for every file
+func (p *DefragPlan) Estimate() time.Duration {
+	return p.BlockTime * time.Duration(2*p.Blocks+len(p.Moves))
+}
+
+// PlanDefrag plans the fewest block relocations that leave the free blocks
+// of the current storage in one run. Bad blocks stay where they are and do
+// not break a run. The directory must pass CheckDirectory.
+func (d *Device) PlanDefrag() (*DefragPlan, error) {
+	return d.PlanDefragContext(context.Background())
+}
+
+// PlanDefragContext is PlanDefrag with a context
+func (d *Device) PlanDefragContext(ctx context.Context) (*DefragPlan, error) {
+	present, total, err := d.CheckPresentContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !present {
+		return nil, fmt.Errorf("%s not present", d.storage)
+	}
+	start := time.Now()
+	block, err := d.readBlock(ctx, DIRECTORY_BLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory: %w", err)
+	}
+	blockTime := time.Since(start)
+
+	res, err := CheckDirectory(block, total)
+	if err != nil {
+		return nil, err
+	}
+	if !res.Clean() {
+		d.dir = nil
+		return nil, fmt.Errorf("directory has %d problems; run 'pmp300 fsck' first", len(res.Problems))
+	}
+	dir := res.Directory
+	d.dir = dir
+
+	plan := planDefrag(dir)
+	plan.BlockTime = blockTime
+	return plan, nil
+}
+
+// planDefrag picks the window of FreeBlocks usable blocks holding the most
+// free blocks, preferring the last, and moves the used blocks inside it to
+// the free blocks outside it. Each file's blocks go to consecutive free
+// blocks where possible.
+func planDefrag(dir *Directory) *DefragPlan {
+	plan := &DefragPlan{}
+
+	// Usable blocks, i.e. all but the directory and bad blocks
+	var usable []int
+	run := 0
+	for pos := 1; pos < dir.TotalBlocks() && pos < MAX_BLOCKS; pos++ {
+		switch dir.BlockUsage[pos] {
+		case BLOCK_BAD:
+			continue
+		case BLOCK_FREE:
+			plan.FreeBlocks++
+			run++
+			plan.LargestRun = max(plan.LargestRun, run)
+		default:
+			run = 0
+		}
+		usable = append(usable, pos)
+	}
+	free := func(i int) int {
+		if dir.BlockUsage[usable[i]] == BLOCK_FREE {
+			return 1
+		}
+		return 0
+	}
+
+	n := plan.FreeBlocks
+	if n == 0 || plan.LargestRun == n {
+		return plan
+	}
+	count := 0
+	for i := 0; i < n; i++ {
+		count += free(i)
+	}
+	best, bestCount := 0, count
+	for i := n; i < len(usable); i++ {
+		count += free(i) - free(i-n)
+		if count >= bestCount {
+			best, bestCount = i-n+1, count
+		}
+	}
+	window := map[int]bool{}
+	for _, pos := range usable[best : best+n] {
+		window[pos] = true
+	}
+
+	var targets []int
+	for _, pos := range usable {
+		if !window[pos] && dir.BlockUsage[pos] == BLOCK_FREE {
+			targets = append(targets, pos)
+		}
+	}
+
+	for i := 0; i < int(dir.Header.EntryCount); i++ {
+		e := &dir.Entries[i]
+		blocks, err := dir.chain(e)
+		if err != nil {
+			continue
+		}
+		m := DefragMove{Entry: i, Name: e.EntryName()}
+		for _, pos := range blocks {
+			if window[pos] {
+				m.From = append(m.From, pos)
+				m.To = append(m.To, targets[0])
+				targets = targets[1:]
+			}
+		}
+		if len(m.From) > 0 {
+			plan.Moves = append(plan.Moves, m)
+			plan.Blocks += len(m.From)
+		}
+	}
+	return plan
+}
+
+// Defrag runs a plan from PlanDefrag, one file at a time. Each file's blocks
+// are copied to free blocks and then the directory is rewritten to use them.
+// Nothing in use is written before the directory, so an interrupted defrag
+// loses nothing and resumes when planned and run again. progress counts
+// relocated blocks in bytes.
+func (d *Device) Defrag(plan *DefragPlan, progress ProgressFunc) error {
+	return d.DefragContext(context.Background(), plan, progress)
+}
+
+// DefragContext is Defrag with a context. Cancelling while a file's blocks
+// are copied stops after the block being copied, and the file stays where
+// it was; once they are copied, the file's move is finished.
+func (d *Device) DefragContext(ctx context.Context, plan *DefragPlan, progress ProgressFunc) error {
+	done := 0
+	for _, m := range plan.Moves {
+		if err := d.relocate(ctx, m, func(n int) {
+			if progress != nil {
+				progress((done+n)*BLOCK_SIZE, plan.Blocks*BLOCK_SIZE)
+			}
+		}); err != nil {
+			return fmt.Errorf("%s: %w", m.Name, err)
+		}
+		done += len(m.From)
+	}
+	return nil
+}
+
+// relocate copies the blocks of one move to free blocks and rewrites the
+// directory to use them. Every page's end block holds the previous and next
+// block of the chain. The copies get the links of the new chain, but their
+// unmoved neighbours keep links to the old places: rewriting a block in use
+// in place loses it if interrupted, and reads follow the FAT. It checks
+// first that the directory still matches the plan.
+func (d *Device) relocate(ctx context.Context, m DefragMove, copied func(n int)) error {
+	dir, err := d.directory(ctx)
+	if err != nil {
+		return err
+	}
+	if m.Entry >= int(dir.Header.EntryCount) || dir.Entries[m.Entry].EntryName() != m.Name {
+		return fmt.Errorf("directory changed since the plan")
+	}
+	e := &dir.Entries[m.Entry]
+	blocks, err := dir.chain(e)
+	if err != nil {
+		return err
+	}
+
+	// The new chain, with each moved block replaced
+	chain := append([]int(nil), blocks...)
+	for k, from := range m.From {
+		j := indexOf(blocks, from)
+		if j < 0 || dir.BlockUsage[m.To[k]] != BLOCK_FREE {
+			return fmt.Errorf("directory changed since the plan")
+		}
+		chain[j] = m.To[k]
+	}
+
+	// Only free blocks are written until the directory, which is written
+	// even if ctx is cancelled once the copies are done
+	n := 0
+	for j := range chain {
+		if chain[j] == blocks[j] {
+			continue
+		}
+		prev, next := uint16(0), uint16(FAT_END)
+		if j > 0 {
+			prev = uint16(chain[j-1])
+		}
+		if j < len(chain)-1 {
+			next = uint16(chain[j+1])
+		}
+		data, err := d.readBlock(ctx, blocks[j])
+		if err != nil {
+			return err
+		}
+		if err := d.writeBlock(ctx, chain[j], data, prev, next); err != nil {
+			return err
+		}
+		n++
+		copied(n)
+	}
+
+	e.BlockPosition = uint16(chain[0])
+	for j, pos := range chain {
+		dir.BlockUsage[pos] = BLOCK_USED
+		if j < len(chain)-1 {
+			dir.FAT[pos] = uint16(chain[j+1])
+		} else {
+			dir.FAT[pos] = FAT_END
+		}
+	}
+	for _, from := range m.From {
+		dir.BlockUsage[from] = BLOCK_FREE
+		dir.FAT[from] = 0
+	}
+	return d.writeDirectory(ctx, dir)
+}
+
+// indexOf returns the index of pos in blocks, or -1
+func indexOf(blocks []int, pos int) int {
+	for i, b := range blocks {
+		if b == pos {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,292 @@
+package pmp300_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/murdinc/pmp300/pkg/emulator"
+	"github.com/murdinc/pmp300/pkg/pmp300"
+)
+
+// fragmented returns a formatted emulated player holding files of the given
+// sizes in blocks, with the files at the indexes in deleted removed again
+func fragmented(t *testing.T, sizes []int, deleted ...int) (*pmp300.Device, *emulator.Rio, map[string][]byte) {
+	t.Helper()
+	rio := emulator.New(emulator.NewFlash(pmp300.BLOCKS_INTERNAL))
+	pmp := pmp300.New(emulator.NewPort(rio))
+	if err := pmp.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	if err := pmp.FormatDevice(false); err != nil {
+		t.Fatal(err)
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	files := map[string][]byte{}
+	for i, blocks := range sizes {
+		name := fmt.Sprintf("song%02d.mp3", i+1)
+		data := make([]byte, blocks*pmp300.BLOCK_SIZE-100)
+		rng.Read(data)
+		if err := pmp.UploadFile(name, data, nil); err != nil {
+			t.Fatalf("upload %s: %v", name, err)
+		}
+		files[name] = data
+	}
+	for _, i := range deleted {
+		name := fmt.Sprintf("song%02d.mp3", i+1)
+		if err := pmp.DeleteFile(name); err != nil {
+			t.Fatalf("delete %s: %v", name, err)
+		}
+		delete(files, name)
+	}
+	return pmp, rio, files
+}
+
+// checkFiles checks the directory, the file contents, and that every block's
+// end blocks on flash link to its neighbours in the FAT chain
+func checkFiles(t *testing.T, pmp *pmp300.Device, flash *emulator.Flash, files map[string][]byte) {
+	t.Helper()
+	checkLinks(t, flash, checkContents(t, pmp, files), nil)
+}
+
+// checkContents checks the directory and the file contents, and returns the
+// directory
+func checkContents(t *testing.T, pmp *pmp300.Device, files map[string][]byte) *pmp300.Directory {
+	t.Helper()
+	res, err := pmp.CheckDirectory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Clean() {
+		t.Fatalf("directory problems: %v", res.Problems)
+	}
+	for name, want := range files {
+		got, err := pmp.DownloadFile(name, nil)
+		if err != nil {
+			t.Fatalf("download %s: %v", name, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: contents differ", name)
+		}
+	}
+
+	return res.Directory
+}
+
+// checkLinks checks that the end blocks on flash of the blocks in only, or
+// of every block given nil, link to their neighbours in the FAT chain
+func checkLinks(t *testing.T, flash *emulator.Flash, dir *pmp300.Directory, only map[int]bool) {
+	t.Helper()
+	for i := 0; i < int(dir.Header.EntryCount); i++ {
+		e := &dir.Entries[i]
+		pos := int(e.BlockPosition)
+		prev := 0
+		for j := 0; j < int(e.BlockCount); j++ {
+			next := int(dir.FAT[pos])
+			gotPrev, gotNext, ok := flash.Links(pos)
+			if only != nil && !only[pos] {
+				prev, pos = pos, next
+				continue
+			}
+			if !ok || int(gotPrev) != prev || int(gotNext) != next {
+				t.Errorf("%s block %d links to %d/%d, FAT chain %d/%d", e.EntryName(), pos, gotPrev, gotNext, prev, next)
+			}
+			prev, pos = pos, next
+		}
+	}
+}
+
+// movedBlocks returns the blocks a plan copies to
+func movedBlocks(plan *pmp300.DefragPlan) map[int]bool {
+	moved := map[int]bool{}
+	for _, m := range plan.Moves {
+		for _, pos := range m.To {
+			moved[pos] = true
+		}
+	}
+	return moved
+}
+
+func TestDefrag(t *testing.T) {
+	pmp, rio, files := fragmented(t, []int{10, 6, 20, 8, 30, 5}, 1, 3)
+
+	plan, err := pmp.PlanDefrag()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Blocks != 14 {
+		t.Fatalf("plan moves %d blocks, want 14", plan.Blocks)
+	}
+	if plan.LargestRun == plan.FreeBlocks {
+		t.Fatalf("free space already contiguous")
+	}
+	flash := rio.Internal()
+	before := make([][]byte, flash.Blocks())
+	for pos := range before {
+		before[pos] = flashBlock(t, flash, pos)
+	}
+	if err := pmp.Defrag(plan, nil); err != nil {
+		t.Fatal(err)
+	}
+	moved := movedBlocks(plan)
+	checkLinks(t, flash, checkContents(t, pmp, files), moved)
+
+	// Only the copies and the directory were written
+	for pos := 1; pos < len(before); pos++ {
+		if !moved[pos] && !bytes.Equal(flashBlock(t, flash, pos), before[pos]) {
+			t.Errorf("block %d was rewritten", pos)
+		}
+	}
+
+	after, err := pmp.PlanDefrag()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after.Moves) != 0 || after.LargestRun != plan.FreeBlocks {
+		t.Errorf("after defrag: %d moves, largest run %d of %d free", len(after.Moves), after.LargestRun, plan.FreeBlocks)
+	}
+}
+
+func TestDefragResume(t *testing.T) {
+	pmp, rio, files := fragmented(t, []int{10, 6, 20, 8, 30, 5}, 1, 3)
+
+	plan, err := pmp.PlanDefrag()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	err = pmp.DefragContext(ctx, plan, func(current, total int) {
+		if current >= 3*pmp300.BLOCK_SIZE {
+			cancel()
+		}
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("interrupted defrag returned %v", err)
+	}
+	moved := movedBlocks(plan)
+	checkLinks(t, rio.Internal(), checkContents(t, pmp, files), moved)
+
+	plan, err = pmp.PlanDefrag()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pmp.Defrag(plan, nil); err != nil {
+		t.Fatal(err)
+	}
+	for pos := range movedBlocks(plan) {
+		moved[pos] = true
+	}
+	checkLinks(t, rio.Internal(), checkContents(t, pmp, files), moved)
+	if plan.LargestRun == plan.FreeBlocks {
+		t.Fatalf("resumed plan has nothing to do")
+	}
+}
+
+var errCrash = errors.New("player unplugged")
+
+// crashing is a block device that fails every write after the first writes.
+// The write that fails leaves its block erased, as a write cut short between
+// the erase and the programming would; the directory is left alone, as its
+// loss is not something a defrag can avoid.
+type crashing struct {
+	pmp300.BlockDevice
+	writes int
+}
+
+func (c *crashing) WriteBlockContext(ctx context.Context, s pmp300.Storage, pos int, block []byte, prev, next uint16) error {
+	if c.writes == 0 {
+		if pos != pmp300.DIRECTORY_BLOCK {
+			c.BlockDevice.WriteBlockContext(ctx, s, pos, bytes.Repeat([]byte{0xFF}, pmp300.BLOCK_SIZE), 0, 0)
+		}
+		return errCrash
+	}
+	c.writes--
+	return c.BlockDevice.WriteBlockContext(ctx, s, pos, block, prev, next)
+}
+
+// TestDefragInterrupted stops a defrag at each of its writes, as if the
+// player were unplugged, and checks that the directory on the player still
+// reads every file and that the defrag finishes when run again
+func TestDefragInterrupted(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "fragmented.img")
+	img, err := pmp300.OpenImage(path, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pmp := pmp300.NewFromBlockDevice(&pmp300.Images{Internal: img})
+	if err := pmp.FormatDevice(false); err != nil {
+		t.Fatal(err)
+	}
+	rng := rand.New(rand.NewSource(1))
+	files := map[string][]byte{}
+	for i, blocks := range []int{10, 6, 20, 8, 30, 5} {
+		name := fmt.Sprintf("song%02d.mp3", i+1)
+		data := make([]byte, blocks*pmp300.BLOCK_SIZE-100)
+		rng.Read(data)
+		if err := pmp.UploadFile(name, data, nil); err != nil {
+			t.Fatal(err)
+		}
+		files[name] = data
+	}
+	for _, name := range []string{"song02.mp3", "song04.mp3"} {
+		if err := pmp.DeleteFile(name); err != nil {
+			t.Fatal(err)
+		}
+		delete(files, name)
+	}
+	plan, err := pmp.PlanDefrag()
+	if err != nil {
+		t.Fatal(err)
+	}
+	img.Close()
+	fragmented, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A write for every relocated block and for the directory after each file
+	writes := plan.Blocks + len(plan.Moves)
+	for step := 0; step < writes; step++ {
+		path := filepath.Join(dir, fmt.Sprintf("step%02d.img", step))
+		if err := os.WriteFile(path, fragmented, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		img, err := pmp300.OpenImage(path, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		images := &pmp300.Images{Internal: img}
+
+		pmp := pmp300.NewFromBlockDevice(&crashing{images, step})
+		plan, err := pmp.PlanDefrag()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := pmp.Defrag(plan, nil); !errors.Is(err, errCrash) {
+			t.Fatalf("step %d: defrag returned %v", step, err)
+		}
+
+		// The player read afresh, as after plugging it back in
+		pmp = pmp300.NewFromBlockDevice(images)
+		checkContents(t, pmp, files)
+		plan, err = pmp.PlanDefrag()
+		if err != nil {
+			t.Fatalf("step %d: %v", step, err)
+		}
+		if err := pmp.Defrag(plan, nil); err != nil {
+			t.Fatalf("step %d: resumed defrag: %v", step, err)
+		}
+		checkContents(t, pmp, files)
+		if after, err := pmp.PlanDefrag(); err != nil || len(after.Moves) != 0 {
+			t.Errorf("step %d: %v after the resumed defrag", step, err)
+		}
+		img.Close()
+	}
+}
@@ -0,0 +1,78 @@
+package pmp300
+
+import (
+	"context"
+	"fmt"
+)
+
+// DeleteFile removes a file from the current storage and frees its blocks
+func (d *Device) DeleteFile(name string) error {
+	return d.DeleteFileContext(context.Background(), name)
+}
+
+// DeleteFileContext is DeleteFile with a context
+func (d *Device) DeleteFileContext(ctx context.Context, name string) error {
+	dir, err := d.directory(ctx)
+	if err != nil {
+		return err
+	}
+	index := dir.findEntry(name)
+	if index < 0 {
+		return fmt.Errorf("file not found: %s", name)
+	}
+
+	blocks, err := dir.chain(&dir.Entries[index])
+	if err != nil {
+		return err
+	}
+	dir.freeBlocks(blocks)
+
+	count := int(dir.Header.EntryCount)
+	copy(dir.Entries[index:count-1], dir.Entries[index+1:count])
+	dir.Entries[count-1] = DirectoryEntry{}
+	dir.Header.EntryCount--
+
+	return d.writeDirectory(ctx, dir)
+}
+
+// DeleteAllFiles removes every file from the current storage. Bad block
+// marks are kept.
+func (d *Device) DeleteAllFiles() error {
+	return d.DeleteAllFilesContext(context.Background())
+}
+
+// DeleteAllFilesContext is DeleteAllFiles with a context
+func (d *Device) DeleteAllFilesContext(ctx context.Context) error {
+	dir, err := d.directory(ctx)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < int(dir.Header.EntryCount); i++ {
+		if blocks, err := dir.chain(&dir.Entries[i]); err == nil {
+			dir.freeBlocks(blocks)
+		}
+		dir.Entries[i] = DirectoryEntry{}
+	}
+	dir.Header.EntryCount = 0
+
+	// Anything still marked used without an owner is freed as well
+	for pos := 1; pos < dir.TotalBlocks() && pos < MAX_BLOCKS; pos++ {
+		if dir.BlockUsage[pos] == BLOCK_USED {
+			dir.BlockUsage[pos] = BLOCK_FREE
+			dir.FAT[pos] = 0
+		}
+	}
+
+	return d.writeDirectory(ctx, dir)
+}
+
+// freeBlocks marks blocks free and clears their FAT links
+func (dir *Directory) freeBlocks(blocks []int) {
+	for _, pos := range blocks {
+		if dir.BlockUsage[pos] == BLOCK_USED {
+			dir.BlockUsage[pos] = BLOCK_FREE
+		}
+		dir.FAT[pos] = 0
+	}
+}
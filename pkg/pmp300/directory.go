@@ -0,0 +1,339 @@
+package pmp300
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Directory layout constants
+const (
+	MAX_ENTRIES       = 60
+	MAX_FILENAME      = 99 // 100-byte name field, NUL terminated
+	DIRECTORY_BLOCK   = 0
+	DIRECTORY_VERSION = 107 // 0x6B, matches Rio utility v1.07
+	HEADER_SIZE       = 512
+	ENTRY_SIZE        = 128
+)
+
+// BlockUsage values
+const (
+	BLOCK_USED = 0x00
+	BLOCK_BAD  = 0x0F
+	BLOCK_FREE = 0xFF
+)
+
+// FAT_END marks the last block of a file chain. Free and bad blocks hold 0.
+const FAT_END = 0xFFFF
+
+// DirectoryHeader is the first 512 bytes of block 0
+type DirectoryHeader struct {
+	EntryCount      uint16                 `json:"entry_count"`
+	BlocksAvailable uint16                 `json:"blocks_available"` // Data blocks (total minus the directory block)
+	BlocksUsed      uint16                 `json:"blocks_used"`
+	BlocksRemaining uint16                 `json:"blocks_remaining"`
+	BlocksBad       uint16                 `json:"blocks_bad"`
+	TimeLastUpdate  uint32                 `json:"time_last_update"` // Unix time
+	Checksum1       uint16                 `json:"checksum1"`        // Header words sum to zero
+	Checksum2       uint16                 `json:"checksum2"`        // Negated sum of the words after the header
+	NotUsed2        [2]byte                `json:"-"`
+	Version         uint16                 `json:"version"`
+	NotUsed3        [HEADER_SIZE - 22]byte `json:"-"`
+}
+
+// DirectoryEntry is one 128-byte file entry as stored on the device
+type DirectoryEntry struct {
+	BlockPosition uint16 // First block of the file
+	BlockCount    uint16
+	SizeMod32K    uint16 // Size % BLOCK_SIZE
+	Size          uint32
+	NotUsed       [5]byte
+	TimeUpload    uint32  // Unix time
+	Properties    [4]byte // First MP3 frame header
+	NotUsed2      [5]byte
+	Name          [MAX_FILENAME + 1]byte
+}
+
+// Directory is the full contents of block 0
+type Directory struct {
+	Header     DirectoryHeader
+	Entries    [MAX_ENTRIES]DirectoryEntry
+	BlockUsage [MAX_BLOCKS]byte
+	FAT        [MAX_BLOCKS]uint16
+}
+
+// FileEntry is a file on the device in a friendlier form
+type FileEntry struct {
+	Name          string
+	Size          uint32
+	BlockPosition uint16
+	BlockCount    uint16
+	Timestamp     time.Time
+	Bitrate       uint16 // kbps, 0 if unknown
+
+	// Filled in by ReadFileID3Tags
+	Artist string
+	Title  string
+	Album  string
+}
+
+// DeviceInfo summarizes the directory header
+type DeviceInfo struct {
+	EntryCount      int
+	BlocksAvailable int
+	BlocksUsed      int
+	BlocksRemaining int
+	BlocksBad       int
+	LastUpdate      time.Time
+	Version         int
+}
+
+// EntryName returns the entry's filename without NUL padding
+func (e *DirectoryEntry) EntryName() string {
+	return string(bytes.TrimRight(e.Name[:], "\x00"))
+}
+
+// TotalBlocks returns the storage size in blocks, including the directory
+func (dir *Directory) TotalBlocks() int {
+	return int(dir.Header.BlocksAvailable) + 1
+}
+
+// parseDirectory decodes a raw directory block and validates its checksums.
+// The decoded directory is returned even when the checksums do not match.
+func parseDirectory(block []byte) (*Directory, error) {
+	if len(block) != BLOCK_SIZE {
+		return nil, fmt.Errorf("directory block must be %d bytes, got %d", BLOCK_SIZE, len(block))
+	}
+
+	dir := &Directory{}
+	if err := binary.Read(bytes.NewReader(block), binary.LittleEndian, dir); err != nil {
+		return nil, fmt.Errorf("failed to parse directory: %w", err)
+	}
+
+	c1, c2 := directoryChecksums(block)
+	if c1 != dir.Header.Checksum1 || c2 != dir.Header.Checksum2 {
+		return dir, fmt.Errorf("directory checksum mismatch (header 0x%04X/0x%04X, computed 0x%04X/0x%04X)",
+			dir.Header.Checksum1, dir.Header.Checksum2, c1, c2)
+	}
+	if dir.Header.EntryCount > MAX_ENTRIES {
+		return dir, fmt.Errorf("directory entry count %d exceeds maximum %d", dir.Header.EntryCount, MAX_ENTRIES)
+	}
+	if dir.TotalBlocks() > MAX_BLOCKS {
+		return dir, fmt.Errorf("directory block count %d exceeds maximum %d", dir.TotalBlocks(), MAX_BLOCKS)
+	}
+	return dir, nil
+}
+
+// Bytes encodes the directory into a 32KB block, updating its checksums
+func (dir *Directory) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	buf.Grow(BLOCK_SIZE)
+	dir.Header.Checksum1 = 0
+	dir.Header.Checksum2 = 0
+	binary.Write(buf, binary.LittleEndian, dir)
+
+	block := buf.Bytes()
+	c1, c2 := directoryChecksums(block)
+	dir.Header.Checksum1 = c1
+	dir.Header.Checksum2 = c2
+	putUint16(block[14:], c1)
+	putUint16(block[16:], c2)
+	return block
+}
+
+// directoryChecksums computes Checksum1 and Checksum2 for a raw directory
+// block. Checksum2 is the negated word sum of everything after the header;
+// Checksum1 makes the header words (with Checksum2 filled in) sum to zero.
+func directoryChecksums(block []byte) (uint16, uint16) {
+	var c2 uint16
+	for i := HEADER_SIZE; i+1 < len(block); i += 2 {
+		c2 -= binary.LittleEndian.Uint16(block[i:])
+	}
+
+	var c1 uint16
+	for i := 0; i < HEADER_SIZE; i += 2 {
+		switch i {
+		case 14:
+			// Checksum1 itself
+		case 16:
+			c1 -= c2
+		default:
+			c1 -= binary.LittleEndian.Uint16(block[i:])
+		}
+	}
+	return c1, c2
+}
+
+// newDirectory returns an empty directory for a storage of total blocks.
+// Blocks listed in bad are marked unusable.
+func newDirectory(total int, bad []int) *Directory {
+	dir := &Directory{}
+	for i := range dir.BlockUsage {
+		dir.BlockUsage[i] = BLOCK_FREE
+	}
+	dir.BlockUsage[DIRECTORY_BLOCK] = BLOCK_USED
+
+	for _, pos := range bad {
+		if pos > DIRECTORY_BLOCK && pos < total {
+			dir.BlockUsage[pos] = BLOCK_BAD
+		}
+	}
+
+	dir.Header.BlocksAvailable = uint16(total - 1)
+	dir.Header.Version = DIRECTORY_VERSION
+	dir.recount()
+	return dir
+}
+
+// recount recomputes the header block counters from BlockUsage
+func (dir *Directory) recount() {
+	var used, free, bad uint16
+	for pos := 1; pos < dir.TotalBlocks() && pos < MAX_BLOCKS; pos++ {
+		switch dir.BlockUsage[pos] {
+		case BLOCK_USED:
+			used++
+		case BLOCK_BAD:
+			bad++
+		default:
+			free++
+		}
+	}
+	dir.Header.BlocksUsed = used
+	dir.Header.BlocksRemaining = free
+	dir.Header.BlocksBad = bad
+	dir.Header.TimeLastUpdate = uint32(time.Now().Unix())
+}
+
+// badBlocks lists blocks marked bad in the directory
+func (dir *Directory) badBlocks() []int {
+	var bad []int
+	for pos := 1; pos < dir.TotalBlocks() && pos < MAX_BLOCKS; pos++ {
+		if dir.BlockUsage[pos] == BLOCK_BAD {
+			bad = append(bad, pos)
+		}
+	}
+	return bad
+}
+
+// chain returns the blocks of an entry by following the FAT
+func (dir *Directory) chain(e *DirectoryEntry) ([]int, error) {
+	blocks := make([]int, 0, e.BlockCount)
+	pos := int(e.BlockPosition)
+	for i := 0; i < int(e.BlockCount); i++ {
+		if pos <= DIRECTORY_BLOCK || pos >= dir.TotalBlocks() || pos >= MAX_BLOCKS {
+			return nil, fmt.Errorf("%s: block %d out of range", e.EntryName(), pos)
+		}
+		blocks = append(blocks, pos)
+		pos = int(dir.FAT[pos])
+	}
+	return blocks, nil
+}
+
+// findEntry returns the index of the entry with the given name, or -1
+func (dir *Directory) findEntry(name string) int {
+	for i := 0; i < int(dir.Header.EntryCount); i++ {
+		if dir.Entries[i].EntryName() == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// toFileEntry converts a raw entry
+func (e *DirectoryEntry) toFileEntry() FileEntry {
+	return FileEntry{
+		Name:          e.EntryName(),
+		Size:          e.Size,
+		BlockPosition: e.BlockPosition,
+		BlockCount:    e.BlockCount,
+		Timestamp:     time.Unix(int64(e.TimeUpload), 0),
+		Bitrate:       frameBitrate(e.Properties),
+	}
+}
+
+// ReadDirectory reads and parses the directory of the current storage. On a
+// checksum error the parsed directory is still returned.
+func (d *Device) ReadDirectory() (*Directory, error) {
+	return d.ReadDirectoryContext(context.Background())
+}
+
+// ReadDirectoryContext is ReadDirectory with a context
+func (d *Device) ReadDirectoryContext(ctx context.Context) (*Directory, error) {
+	block, err := d.readBlock(ctx, DIRECTORY_BLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory: %w", err)
+	}
+	dir, err := parseDirectory(block)
+	if err != nil {
+		d.dir = nil
+		return dir, err
+	}
+	d.dir = dir
+	return dir, nil
+}
+
+// directory returns the cached directory, reading it when needed
+func (d *Device) directory(ctx context.Context) (*Directory, error) {
+	if d.dir != nil {
+		return d.dir, nil
+	}
+	return d.ReadDirectoryContext(ctx)
+}
+
+// writeDirectory stores the directory in block 0 and caches it. It is the
+// last step of every change and ignores cancellation, so that blocks that
+// were written are never lost.
+func (d *Device) writeDirectory(ctx context.Context, dir *Directory) error {
+	dir.recount()
+	if err := d.writeBlock(context.WithoutCancel(ctx), DIRECTORY_BLOCK, dir.Bytes(), 0, 0); err != nil {
+		d.dir = nil
+		return fmt.Errorf("failed to write directory: %w", err)
+	}
+	d.dir = dir
+	return nil
+}
+
+// ListFiles returns the files on the current storage in playback order
+func (d *Device) ListFiles() ([]FileEntry, error) {
+	return d.ListFilesContext(context.Background())
+}
+
+// ListFilesContext is ListFiles with a context
+func (d *Device) ListFilesContext(ctx context.Context) ([]FileEntry, error) {
+	dir, err := d.directory(ctx)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]FileEntry, 0, dir.Header.EntryCount)
+	for i := 0; i < int(dir.Header.EntryCount); i++ {
+		files = append(files, dir.Entries[i].toFileEntry())
+	}
+	return files, nil
+}
+
+// GetDeviceInfo returns the directory header summary of the current storage.
+// If the directory fails validation the info is still returned with the error.
+func (d *Device) GetDeviceInfo() (*DeviceInfo, error) {
+	return d.GetDeviceInfoContext(context.Background())
+}
+
+// GetDeviceInfoContext is GetDeviceInfo with a context
+func (d *Device) GetDeviceInfoContext(ctx context.Context) (*DeviceInfo, error) {
+	dir, err := d.directory(ctx)
+	if dir == nil {
+		return nil, err
+	}
+	h := dir.Header
+	info := &DeviceInfo{
+		EntryCount:      int(h.EntryCount),
+		BlocksAvailable: int(h.BlocksAvailable),
+		BlocksUsed:      int(h.BlocksUsed),
+		BlocksRemaining: int(h.BlocksRemaining),
+		BlocksBad:       int(h.BlocksBad),
+		LastUpdate:      time.Unix(int64(h.TimeLastUpdate), 0),
+		Version:         int(h.Version),
+	}
+	return info, err
+}
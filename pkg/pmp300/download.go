@@ -0,0 +1,110 @@
+package pmp300
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+)
+
+// DownloadFile reads a file from the current storage
+func (d *Device) DownloadFile(name string, progress ProgressFunc) ([]byte, error) {
+	return d.DownloadFileContext(context.Background(), name, progress)
+}
+
+// DownloadFileContext is DownloadFile with a context
+func (d *Device) DownloadFileContext(ctx context.Context, name string, progress ProgressFunc) ([]byte, error) {
+	dir, err := d.directory(ctx)
+	if err != nil {
+		return nil, err
+	}
+	index := dir.findEntry(name)
+	if index < 0 {
+		return nil, fmt.Errorf("file not found: %s", name)
+	}
+	entry := &dir.Entries[index]
+
+	blocks, err := dir.chain(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	size := int(entry.Size)
+	data := make([]byte, 0, len(blocks)*BLOCK_SIZE)
+	for _, pos := range blocks {
+		block, err := d.readBlock(ctx, pos)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, block...)
+		if progress != nil {
+			progress(min(len(data), size), size)
+		}
+	}
+
+	if len(data) < size {
+		return nil, fmt.Errorf("%s: read %d bytes, expected %d", name, len(data), size)
+	}
+	return data[:size], nil
+}
+
+// ReadFileID3Tags fills in Artist, Title and Album from the file's ID3v1 tag.
+// Only the block holding the last 128 bytes of the file is read.
+func (d *Device) ReadFileID3Tags(file *FileEntry) error {
+	return d.ReadFileID3TagsContext(context.Background(), file)
+}
+
+// ReadFileID3TagsContext is ReadFileID3Tags with a context
+func (d *Device) ReadFileID3TagsContext(ctx context.Context, file *FileEntry) error {
+	dir, err := d.directory(ctx)
+	if err != nil {
+		return err
+	}
+	index := dir.findEntry(file.Name)
+	if index < 0 {
+		return fmt.Errorf("file not found: %s", file.Name)
+	}
+	entry := &dir.Entries[index]
+	blocks, err := dir.chain(entry)
+	if err != nil {
+		return err
+	}
+
+	// The size comes from the directory, file may be stale
+	size := int(entry.Size)
+	if size < 128 {
+		return fmt.Errorf("file too small for ID3v1 tag")
+	}
+	tagStart := size - 128
+	first := tagStart / BLOCK_SIZE
+	last := (size - 1) / BLOCK_SIZE
+	if last >= len(blocks) {
+		return fmt.Errorf("%s is %d bytes but has only %d blocks; run 'pmp300 fsck'", file.Name, size, len(blocks))
+	}
+
+	var tail []byte
+	for i := first; i <= last; i++ {
+		block, err := d.readBlock(ctx, blocks[i])
+		if err != nil {
+			return err
+		}
+		tail = append(tail, block...)
+	}
+	offset := tagStart - first*BLOCK_SIZE
+	tag := tail[offset : offset+128]
+
+	if string(tag[:3]) != "TAG" {
+		return fmt.Errorf("no ID3v1 tag")
+	}
+	file.Title = id3String(tag[3:33])
+	file.Artist = id3String(tag[33:63])
+	file.Album = id3String(tag[63:93])
+	return nil
+}
+
+func id3String(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return strings.TrimSpace(string(b))
+}
@@ -0,0 +1,43 @@
+package pmp300_test
+
+import (
+	"testing"
+
+	"github.com/murdinc/pmp300/pkg/emulator"
+	"github.com/murdinc/pmp300/pkg/pmp300"
+)
+
+// TestReadFileID3TagsStaleEntry reads a tag through an entry whose size no
+// longer matches the directory
+func TestReadFileID3TagsStaleEntry(t *testing.T) {
+	rio := emulator.New(emulator.NewFlash(pmp300.BLOCKS_INTERNAL))
+	pmp := pmp300.New(emulator.NewPort(rio))
+	if err := pmp.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	if err := pmp.FormatDevice(false); err != nil {
+		t.Fatal(err)
+	}
+
+	// The tag straddles the end of the first block
+	data := make([]byte, pmp300.BLOCK_SIZE+60)
+	tag := data[len(data)-128:]
+	copy(tag, "TAG")
+	copy(tag[3:], "Title")
+	copy(tag[33:], "Artist")
+	copy(tag[63:], "Album")
+	if err := pmp.UploadFile("song.mp3", data, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []uint32{uint32(len(data)), 100, 10 * pmp300.BLOCK_SIZE} {
+		file := pmp300.FileEntry{Name: "song.mp3", Size: size}
+		if err := pmp.ReadFileID3Tags(&file); err != nil {
+			t.Errorf("entry of %d bytes: %v", size, err)
+			continue
+		}
+		if file.Title != "Title" || file.Artist != "Artist" || file.Album != "Album" {
+			t.Errorf("entry of %d bytes: tag %q/%q/%q", size, file.Title, file.Artist, file.Album)
+		}
+	}
+}
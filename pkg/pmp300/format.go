@@ -0,0 +1,69 @@
+package pmp300
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+)
+
+// Patterns written to every block during a bad block check
+var badBlockPatterns = []byte{0xAA, 0x55}
+
+// FormatDevice writes an empty directory to the current storage. With
+// checkBadBlocks every data block is written and verified first; otherwise
+// bad blocks recorded in the existing directory are carried over.
+func (d *Device) FormatDevice(checkBadBlocks bool) error {
+	return d.FormatDeviceContext(context.Background(), checkBadBlocks)
+}
+
+// FormatDeviceContext is FormatDevice with a context. Cancelling during the
+// bad block check leaves the existing directory in place.
+func (d *Device) FormatDeviceContext(ctx context.Context, checkBadBlocks bool) error {
+	present, total, err := d.CheckPresentContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !present {
+		return fmt.Errorf("%s not present", d.storage)
+	}
+
+	var bad []int
+	if checkBadBlocks {
+		for pos := 1; pos < total; pos++ {
+			ok, err := d.testBlock(ctx, pos)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				bad = append(bad, pos)
+			}
+		}
+	} else if old, err := d.ReadDirectoryContext(ctx); err == nil && old.TotalBlocks() == total {
+		bad = old.badBlocks()
+	} else if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return d.writeDirectory(ctx, newDirectory(total, bad))
+}
+
+// testBlock writes each pattern to a block and reads it back
+func (d *Device) testBlock(ctx context.Context, pos int) (bool, error) {
+	for _, pattern := range badBlockPatterns {
+		data := bytes.Repeat([]byte{pattern}, BLOCK_SIZE)
+		if err := d.writeBlock(ctx, pos, data, 0, FAT_END); err != nil {
+			if ctx.Err() != nil {
+				return false, err
+			}
+			return false, nil
+		}
+		got, err := d.readBlock(ctx, pos)
+		if err != nil {
+			return false, err
+		}
+		if !bytes.Equal(got, data) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,410 @@
+package pmp300
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Problem is one inconsistency found by CheckDirectory
+type Problem struct {
+	Message string
+	Fixed   bool // Corrected in the repaired directory
+}
+
+// CheckResult is the outcome of CheckDirectory
+type CheckResult struct {
+	Directory *Directory // As read
+	Repaired  *Directory // Corrected copy, nil if nothing could be fixed
+	Problems  []Problem
+}
+
+// Clean reports whether no problems were found
+func (r *CheckResult) Clean() bool {
+	return len(r.Problems) == 0
+}
+
+// Unfixed returns the number of problems the repaired directory does not
+// correct
+func (r *CheckResult) Unfixed() int {
+	n := 0
+	for _, p := range r.Problems {
+		if !p.Fixed {
+			n++
+		}
+	}
+	return n
+}
+
+// checker collects problems while it builds the repaired directory
+type checker struct {
+	res   *CheckResult
+	fixed bool // Something in the repaired directory changed
+}
+
+func (c *checker) problem(fixed bool, format string, args ...any) {
+	c.res.Problems = append(c.res.Problems, Problem{Message: fmt.Sprintf(format, args...), Fixed: fixed})
+	c.fixed = c.fixed || fixed
+}
+
+// CheckOptions changes what the repair of CheckDirectory does
+type CheckOptions struct {
+	// AdoptStale keeps entries past EntryCount as files, if their chains
+	// hold up. They are left over from a directory that was not fully
+	// rewritten, so by default the repair clears them.
+	AdoptStale bool
+}
+
+// CheckDirectory reads the directory of the current storage and checks it
+// for consistency without changing anything
+func (d *Device) CheckDirectory() (*CheckResult, error) {
+	return d.CheckDirectoryContext(context.Background())
+}
+
+// CheckDirectoryContext is CheckDirectory with a context
+func (d *Device) CheckDirectoryContext(ctx context.Context) (*CheckResult, error) {
+	return d.CheckDirectoryWithOptionsContext(ctx, CheckOptions{})
+}
+
+// CheckDirectoryWithOptionsContext is CheckDirectoryContext with options
+// for the repair
+func (d *Device) CheckDirectoryWithOptionsContext(ctx context.Context, opts CheckOptions) (*CheckResult, error) {
+	present, total, err := d.CheckPresentContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !present {
+		return nil, fmt.Errorf("%s not present", d.storage)
+	}
+	block, err := d.readBlock(ctx, DIRECTORY_BLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory: %w", err)
+	}
+	return CheckDirectoryWithOptions(block, total, opts)
+}
+
+// RepairDirectory writes the repaired directory of a check. The directory
+// on the storage must not have changed since the check.
+func (d *Device) RepairDirectory(r *CheckResult) error {
+	return d.RepairDirectoryContext(context.Background(), r)
+}
+
+// RepairDirectoryContext is RepairDirectory with a context
+func (d *Device) RepairDirectoryContext(ctx context.Context, r *CheckResult) error {
+	if r.Repaired == nil {
+		return fmt.Errorf("nothing to repair")
+	}
+	return d.writeDirectory(ctx, r.Repaired)
+}
+
+// CheckDirectory checks a raw directory block of a storage of total blocks:
+// the header checksums and counters, the entry count, every file's chain,
+// and the block usage against the chains. Files are checked in playback
+// order; a file sharing blocks with an earlier one is cross-linked and
+// dropped by the repair.
+func CheckDirectory(block []byte, total int) (*CheckResult, error) {
+	return CheckDirectoryWithOptions(block, total, CheckOptions{})
+}
+
+// CheckDirectoryWithOptions is CheckDirectory with options for the repair
+func CheckDirectoryWithOptions(block []byte, total int, opts CheckOptions) (*CheckResult, error) {
+	dir, err := parseDirectory(block)
+	if dir == nil {
+		return nil, err
+	}
+	res := &CheckResult{Directory: dir}
+	c := &checker{res: res}
+	fixed := *dir
+	h := &dir.Header
+
+	c1, c2 := directoryChecksums(block)
+	if c1 != h.Checksum1 || c2 != h.Checksum2 {
+		c.problem(true, "header checksums are 0x%04X/0x%04X, should be 0x%04X/0x%04X", h.Checksum1, h.Checksum2, c1, c2)
+	}
+	if dir.TotalBlocks() != total {
+		c.problem(false, "directory describes %d blocks, the storage has %d", dir.TotalBlocks(), total)
+	}
+	end := min(dir.TotalBlocks(), total, MAX_BLOCKS)
+
+	// Entries: holes are dropped, and entries past EntryCount are stale
+	// unless adopted
+	count := int(h.EntryCount)
+	if count > MAX_ENTRIES {
+		c.problem(true, "EntryCount %d exceeds maximum %d", count, MAX_ENTRIES)
+		count = MAX_ENTRIES
+	}
+	entries := make([]DirectoryEntry, 0, MAX_ENTRIES)
+	for i := range dir.Entries {
+		e := dir.Entries[i]
+		empty := e == DirectoryEntry{}
+		switch {
+		case i < count && empty:
+			c.problem(true, "entry %d is empty but counted in EntryCount", i+1)
+		case i >= count && !empty && opts.AdoptStale:
+			c.problem(true, "entry %d (%s) is past EntryCount %d; adopting it", i+1, e.EntryName(), h.EntryCount)
+			entries = append(entries, e)
+		case i >= count && !empty:
+			c.problem(true, "entry %d (%s) is past EntryCount %d, a stale entry; clearing it", i+1, e.EntryName(), h.EntryCount)
+		case !empty:
+			entries = append(entries, e)
+		}
+	}
+
+	// Chains, in playback order
+	owner := make([]string, end) // File owning each block
+	kept := entries[:0]
+	for i, e := range entries {
+		name := e.EntryName()
+		if name == "" {
+			name = fmt.Sprintf("RECOVERED%02d.MP3", i+1)
+			c.problem(true, "entry at block %d has no name, naming it %s", e.BlockPosition, name)
+			e.Name = [MAX_FILENAME + 1]byte{}
+			copy(e.Name[:], name)
+		}
+		blocks, msg := fileChain(&fixed, &e, end, owner)
+		if msg != "" {
+			c.problem(true, "%s %s; dropping the entry", name, msg)
+			continue
+		}
+		for _, pos := range blocks {
+			owner[pos] = name
+			if dir.BlockUsage[pos] == BLOCK_BAD {
+				c.problem(false, "%s uses block %d, which is marked bad", name, pos)
+			}
+		}
+		if last := blocks[len(blocks)-1]; fixed.FAT[last] != FAT_END {
+			c.problem(true, "%s does not end its chain at block %d (FAT 0x%04X)", name, last, fixed.FAT[last])
+			fixed.FAT[last] = FAT_END
+		}
+
+		capacity := uint32(e.BlockCount) * BLOCK_SIZE
+		if e.Size > capacity {
+			c.problem(true, "%s is %d bytes but has only %d blocks; truncating it to %d bytes", name, e.Size, e.BlockCount, capacity)
+			e.Size = capacity
+		} else if e.Size <= capacity-BLOCK_SIZE {
+			c.problem(false, "%s is %d bytes but has %d blocks", name, e.Size, e.BlockCount)
+		}
+		if mod := uint16(e.Size % BLOCK_SIZE); e.SizeMod32K != mod {
+			c.problem(true, "%s has SizeMod32K %d, should be %d", name, e.SizeMod32K, mod)
+			e.SizeMod32K = mod
+		}
+		kept = append(kept, e)
+	}
+
+	seen := map[string]bool{}
+	for _, e := range kept {
+		if name := e.EntryName(); seen[name] {
+			c.problem(false, "%s appears more than once", name)
+		} else {
+			seen[name] = true
+		}
+	}
+
+	fixed.Entries = [MAX_ENTRIES]DirectoryEntry{}
+	copy(fixed.Entries[:], kept)
+	fixed.Header.EntryCount = uint16(len(kept))
+
+	// Block usage against the chains
+	if dir.BlockUsage[DIRECTORY_BLOCK] != BLOCK_USED {
+		c.problem(true, "directory block is not marked used")
+		fixed.BlockUsage[DIRECTORY_BLOCK] = BLOCK_USED
+	}
+	var orphans []int
+	for pos := 1; pos < end; pos++ {
+		switch usage := dir.BlockUsage[pos]; {
+		case owner[pos] != "" && usage != BLOCK_USED && usage != BLOCK_BAD:
+			c.problem(true, "block %d of %s is marked %s", pos, owner[pos], usageName(usage))
+			fixed.BlockUsage[pos] = BLOCK_USED
+		case owner[pos] != "":
+		case usage == BLOCK_USED:
+			orphans = append(orphans, pos)
+			fixed.BlockUsage[pos] = BLOCK_FREE
+			fixed.FAT[pos] = 0
+		case usage != BLOCK_FREE && usage != BLOCK_BAD:
+			c.problem(true, "block %d has unknown usage 0x%02X", pos, usage)
+			fixed.BlockUsage[pos] = BLOCK_FREE
+			fixed.FAT[pos] = 0
+		case dir.FAT[pos] != 0:
+			c.problem(true, "free block %d has FAT link 0x%04X", pos, dir.FAT[pos])
+			fixed.FAT[pos] = 0
+		}
+	}
+	if len(orphans) == 1 {
+		c.problem(true, "block %d is marked used but belongs to no file", orphans[0])
+	} else if len(orphans) > 1 {
+		c.problem(true, "blocks %s are marked used but belong to no file", BlockRanges(orphans))
+	}
+
+	// Header counters
+	if h.EntryCount != fixed.Header.EntryCount {
+		c.problem(true, "EntryCount is %d, should be %d", h.EntryCount, fixed.Header.EntryCount)
+	}
+	if sum := int(h.BlocksUsed) + int(h.BlocksRemaining) + int(h.BlocksBad); sum != int(h.BlocksAvailable) {
+		c.problem(true, "BlocksUsed + BlocksRemaining + BlocksBad is %d, BlocksAvailable %d", sum, h.BlocksAvailable)
+	}
+	counted := fixed
+	counted.recount()
+	for _, f := range []struct {
+		name       string
+		have, want uint16
+	}{
+		{"BlocksUsed", h.BlocksUsed, counted.Header.BlocksUsed},
+		{"BlocksRemaining", h.BlocksRemaining, counted.Header.BlocksRemaining},
+		{"BlocksBad", h.BlocksBad, counted.Header.BlocksBad},
+	} {
+		if f.have != f.want {
+			c.problem(true, "%s is %d, should be %d", f.name, f.have, f.want)
+		}
+	}
+
+	if c.fixed {
+		fixed.recount()
+		fixed.Bytes()
+		res.Repaired = &fixed
+	}
+	return res, nil
+}
+
+// fileChain follows an entry's chain through the FAT, checking that it stays
+// inside the storage, does not loop and does not use blocks of the files in
+// owner. It returns the blocks, or why the entry cannot be kept.
+func fileChain(dir *Directory, e *DirectoryEntry, end int, owner []string) ([]int, string) {
+	if e.BlockCount == 0 {
+		return nil, "has no blocks"
+	}
+	blocks := make([]int, 0, e.BlockCount)
+	mine := map[int]bool{}
+	pos := int(e.BlockPosition)
+	for i := 0; i < int(e.BlockCount); i++ {
+		switch {
+		case pos <= DIRECTORY_BLOCK || pos >= end:
+			return nil, fmt.Sprintf("points past the end of storage (block %d of %d is %d)", i+1, e.BlockCount, pos)
+		case mine[pos]:
+			return nil, fmt.Sprintf("has a chain that loops at block %d", pos)
+		case owner[pos] != "":
+			return nil, fmt.Sprintf("is cross-linked with %s at block %d", owner[pos], pos)
+		}
+		mine[pos] = true
+		blocks = append(blocks, pos)
+		pos = int(dir.FAT[pos])
+	}
+	return blocks, ""
+}
+
+// DiffDirectories describes the changes from one directory to another, one
+// line per header field, entry or run of blocks
+func DiffDirectories(from, to *Directory) []string {
+	var lines []string
+	fields := []struct {
+		name, format string
+		from, to     uint16
+	}{
+		{"EntryCount", "%d", from.Header.EntryCount, to.Header.EntryCount},
+		{"BlocksAvailable", "%d", from.Header.BlocksAvailable, to.Header.BlocksAvailable},
+		{"BlocksUsed", "%d", from.Header.BlocksUsed, to.Header.BlocksUsed},
+		{"BlocksRemaining", "%d", from.Header.BlocksRemaining, to.Header.BlocksRemaining},
+		{"BlocksBad", "%d", from.Header.BlocksBad, to.Header.BlocksBad},
+		{"Checksum1", "0x%04X", from.Header.Checksum1, to.Header.Checksum1},
+		{"Checksum2", "0x%04X", from.Header.Checksum2, to.Header.Checksum2},
+	}
+	for _, f := range fields {
+		if f.from != f.to {
+			lines = append(lines, fmt.Sprintf("header %s: "+f.format+" -> "+f.format, f.name, f.from, f.to))
+		}
+	}
+
+	for i := range from.Entries {
+		a, b := &from.Entries[i], &to.Entries[i]
+		if *a == *b {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("entry %d: %s -> %s", i+1, describeEntry(a), describeEntry(b)))
+	}
+
+	lines = append(lines, diffRuns("block", from.TotalBlocks(), func(pos int) string {
+		if from.BlockUsage[pos] == to.BlockUsage[pos] {
+			return ""
+		}
+		return usageName(from.BlockUsage[pos]) + " -> " + usageName(to.BlockUsage[pos])
+	})...)
+	lines = append(lines, diffRuns("FAT", from.TotalBlocks(), func(pos int) string {
+		switch {
+		case from.FAT[pos] == to.FAT[pos]:
+			return ""
+		case to.FAT[pos] == 0:
+			return "cleared"
+		}
+		return fmt.Sprintf("0x%04X -> 0x%04X", from.FAT[pos], to.FAT[pos])
+	})...)
+	return lines
+}
+
+// diffRuns describes the changes of blocks 0 to total, merging runs of
+// consecutive blocks with the same change. change returns "" for a block
+// that is unchanged.
+func diffRuns(what string, total int, change func(pos int) string) []string {
+	var lines []string
+	start, run := -1, ""
+	flush := func(end int) {
+		if start < 0 {
+			return
+		}
+		if end-start == 1 {
+			lines = append(lines, fmt.Sprintf("%s %d: %s", what, start, run))
+		} else {
+			lines = append(lines, fmt.Sprintf("%s %d-%d: %s", what, start, end-1, run))
+		}
+		start = -1
+	}
+	for pos := 0; pos < total && pos < MAX_BLOCKS; pos++ {
+		c := change(pos)
+		if c != run || start < 0 {
+			flush(pos)
+			if c != "" {
+				start, run = pos, c
+			}
+		}
+	}
+	flush(min(total, MAX_BLOCKS))
+	return lines
+}
+
+// BlockRanges formats sorted block numbers as ranges, e.g. "3-7, 12"
+func BlockRanges(blocks []int) string {
+	var parts []string
+	for i := 0; i < len(blocks); {
+		j := i
+		for j+1 < len(blocks) && blocks[j+1] == blocks[j]+1 {
+			j++
+		}
+		if i == j {
+			parts = append(parts, fmt.Sprint(blocks[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", blocks[i], blocks[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ", ")
+}
+
+// describeEntry summarizes an entry for DiffDirectories
+func describeEntry(e *DirectoryEntry) string {
+	if *e == (DirectoryEntry{}) {
+		return "(empty)"
+	}
+	return fmt.Sprintf("%q %d bytes, %d blocks at %d", e.EntryName(), e.Size, e.BlockCount, e.BlockPosition)
+}
+
+// usageName names a BlockUsage value
+func usageName(usage byte) string {
+	switch usage {
+	case BLOCK_USED:
+		return "used"
+	case BLOCK_FREE:
+		return "free"
+	case BLOCK_BAD:
+		return "bad"
+	default:
+		return fmt.Sprintf("0x%02X", usage)
+	}
+}
@@ -0,0 +1,276 @@
+package pmp300_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/murdinc/pmp300/pkg/pmp300"
+)
+
+// checkedCard returns the directory block of a card holding three files,
+// in blocks 1-3, 4-8 and 9-10, and the directory decoded from it
+func checkedCard(t *testing.T) ([]byte, *pmp300.Directory) {
+	t.Helper()
+	_, card, _ := cardPlayer(t, "song", 1, 3, 5, 2)
+	block := flashBlock(t, card, pmp300.DIRECTORY_BLOCK)
+	res, err := pmp300.CheckDirectory(block, CARD_BLOCKS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Clean() {
+		t.Fatalf("problems on a fresh card: %v", res.Problems)
+	}
+	return block, res.Directory
+}
+
+// entryNames returns the names of the counted entries of a directory
+func entryNames(dir *pmp300.Directory) string {
+	var names []string
+	for i := 0; i < int(dir.Header.EntryCount); i++ {
+		names = append(names, dir.Entries[i].EntryName())
+	}
+	return strings.Join(names, " ")
+}
+
+// TestCheckDirectory breaks a directory in the ways CheckDirectory finds
+// and checks the problems reported and the repaired directory
+func TestCheckDirectory(t *testing.T) {
+	clean, base := checkedCard(t)
+
+	for _, tc := range []struct {
+		name     string
+		opts     pmp300.CheckOptions
+		change   func(dir *pmp300.Directory)
+		raw      func(block []byte) // Changes the encoded block
+		problems []string           // Parts of the problems, in order
+		unfixed  int
+		entries  string // Entries of the repair
+		repaired func(t *testing.T, dir *pmp300.Directory)
+	}{
+		{
+			name:     "bad Checksum1",
+			raw:      func(block []byte) { block[14] ^= 0x01 },
+			problems: []string{"header checksums"},
+			entries:  "song01.mp3 song02.mp3 song03.mp3",
+		},
+		{
+			name:     "bad Checksum2",
+			raw:      func(block []byte) { block[16] ^= 0x80 },
+			problems: []string{"header checksums"},
+			entries:  "song01.mp3 song02.mp3 song03.mp3",
+		},
+		{
+			name:   "cross-linked chain",
+			change: func(dir *pmp300.Directory) { dir.FAT[2] = 5 },
+			problems: []string{
+				"song01.mp3 does not end its chain at block 5",
+				"song02.mp3 is cross-linked with song01.mp3 at block 5; dropping the entry",
+				"blocks 3-4, 6-8 are marked used but belong to no file",
+				"EntryCount is 3, should be 2",
+				"BlocksUsed is 10, should be 5",
+				"BlocksRemaining is 53, should be 58",
+			},
+			entries: "song01.mp3 song03.mp3",
+			repaired: func(t *testing.T, dir *pmp300.Directory) {
+				if dir.FAT[5] != pmp300.FAT_END || dir.BlockUsage[3] != pmp300.BLOCK_FREE || dir.FAT[3] != 0 {
+					t.Errorf("FAT 5 0x%04X, block 3 %d with FAT 0x%04X", dir.FAT[5], dir.BlockUsage[3], dir.FAT[3])
+				}
+			},
+		},
+		{
+			name: "orphan used block",
+			change: func(dir *pmp300.Directory) {
+				dir.BlockUsage[30] = pmp300.BLOCK_USED
+				dir.Header.BlocksUsed++
+				dir.Header.BlocksRemaining--
+			},
+			problems: []string{
+				"block 30 is marked used but belongs to no file",
+				"BlocksUsed is 11, should be 10",
+				"BlocksRemaining is 52, should be 53",
+			},
+			entries: "song01.mp3 song02.mp3 song03.mp3",
+			repaired: func(t *testing.T, dir *pmp300.Directory) {
+				if dir.BlockUsage[30] != pmp300.BLOCK_FREE {
+					t.Errorf("block 30 is %d", dir.BlockUsage[30])
+				}
+			},
+		},
+		{
+			name:   "FAT entry out of range",
+			change: func(dir *pmp300.Directory) { dir.FAT[9] = 200 },
+			problems: []string{
+				"song03.mp3 points past the end of storage (block 2 of 2 is 200); dropping the entry",
+				"blocks 9-10 are marked used but belong to no file",
+				"EntryCount is 3, should be 2",
+				"BlocksUsed is 10, should be 8",
+				"BlocksRemaining is 53, should be 55",
+			},
+			entries: "song01.mp3 song02.mp3",
+		},
+		{
+			name:     "EntryCount too high",
+			change:   func(dir *pmp300.Directory) { dir.Header.EntryCount = 4 },
+			problems: []string{"entry 4 is empty but counted in EntryCount", "EntryCount is 4, should be 3"},
+			entries:  "song01.mp3 song02.mp3 song03.mp3",
+		},
+		{
+			name:   "block counters",
+			change: func(dir *pmp300.Directory) { dir.Header.BlocksUsed = 20 },
+			problems: []string{
+				"BlocksUsed + BlocksRemaining + BlocksBad is 73, BlocksAvailable 63",
+				"BlocksUsed is 20, should be 10",
+			},
+			entries: "song01.mp3 song02.mp3 song03.mp3",
+		},
+		{
+			name:   "stale entry",
+			change: func(dir *pmp300.Directory) { dir.Header.EntryCount = 2 },
+			problems: []string{
+				"entry 3 (song03.mp3) is past EntryCount 2, a stale entry; clearing it",
+				"blocks 9-10 are marked used but belong to no file",
+				"BlocksUsed is 10, should be 8",
+				"BlocksRemaining is 53, should be 55",
+			},
+			entries: "song01.mp3 song02.mp3",
+			repaired: func(t *testing.T, dir *pmp300.Directory) {
+				if dir.Entries[2] != (pmp300.DirectoryEntry{}) {
+					t.Errorf("stale entry kept: %q", dir.Entries[2].EntryName())
+				}
+			},
+		},
+		{
+			name:     "stale entry adopted",
+			opts:     pmp300.CheckOptions{AdoptStale: true},
+			change:   func(dir *pmp300.Directory) { dir.Header.EntryCount = 2 },
+			problems: []string{"entry 3 (song03.mp3) is past EntryCount 2; adopting it", "EntryCount is 2, should be 3"},
+			entries:  "song01.mp3 song02.mp3 song03.mp3",
+		},
+		{
+			name:   "stale entry adopted into a taken chain",
+			opts:   pmp300.CheckOptions{AdoptStale: true},
+			change: func(dir *pmp300.Directory) { dir.Header.EntryCount = 2; dir.Entries[2].BlockPosition = 4 },
+			problems: []string{
+				"past EntryCount 2; adopting it",
+				"song03.mp3 is cross-linked with song02.mp3 at block 4",
+				"blocks 9-10",
+				"BlocksUsed is 10, should be 8",
+				"BlocksRemaining is 53, should be 55",
+			},
+			entries: "song01.mp3 song02.mp3",
+		},
+		{
+			name:     "size past the blocks",
+			change:   func(dir *pmp300.Directory) { dir.Entries[2].Size = 3 * pmp300.BLOCK_SIZE },
+			problems: []string{"song03.mp3 is 98304 bytes but has only 2 blocks; truncating it to 65536 bytes", "SizeMod32K"},
+			entries:  "song01.mp3 song02.mp3 song03.mp3",
+		},
+		{
+			name:     "file on a bad block",
+			change:   func(dir *pmp300.Directory) { dir.BlockUsage[5] = pmp300.BLOCK_BAD },
+			problems: []string{"song02.mp3 uses block 5, which is marked bad", "BlocksUsed is 10, should be 9", "BlocksBad is 0, should be 1"},
+			unfixed:  1,
+			entries:  "song01.mp3 song02.mp3 song03.mp3",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := *base
+			if tc.change != nil {
+				tc.change(&dir)
+			}
+			block := dir.Bytes()
+			if tc.raw != nil {
+				tc.raw(block)
+			}
+			res, err := pmp300.CheckDirectoryWithOptions(block, CARD_BLOCKS, tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, p := range res.Problems {
+				got = append(got, p.Message)
+			}
+			if len(got) != len(tc.problems) {
+				t.Fatalf("problems:\n  %s\nwant %d", strings.Join(got, "\n  "), len(tc.problems))
+			}
+			for i, want := range tc.problems {
+				if !strings.Contains(got[i], want) {
+					t.Errorf("problem %d is %q, want %q", i+1, got[i], want)
+				}
+			}
+			if res.Unfixed() != tc.unfixed {
+				t.Errorf("%d problems not fixed, want %d", res.Unfixed(), tc.unfixed)
+			}
+
+			if res.Repaired == nil {
+				t.Fatal("nothing repaired")
+			}
+			if names := entryNames(res.Repaired); names != tc.entries {
+				t.Errorf("repaired entries %q, want %q", names, tc.entries)
+			}
+			if tc.repaired != nil {
+				tc.repaired(t, res.Repaired)
+			}
+			again, err := pmp300.CheckDirectory(res.Repaired.Bytes(), CARD_BLOCKS)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again.Unfixed() != len(again.Problems) {
+				t.Errorf("the repaired directory has problems: %v", again.Problems)
+			}
+			if tc.name == "bad Checksum1" || tc.name == "bad Checksum2" {
+				if !bytes.Equal(res.Repaired.Bytes(), clean) {
+					t.Error("the repair of the checksums changed more")
+				}
+			}
+		})
+	}
+}
+
+// TestRepairDirectory repairs the directory of a card whose entries were
+// left inconsistent
+func TestRepairDirectory(t *testing.T) {
+	pmp, card, files := cardPlayer(t, "song", 1, 3, 5, 2)
+	_, base := checkedCard(t)
+	dir := *base
+	dir.Header.EntryCount = 2
+	dir.Entries[0].Size = 4 * pmp300.BLOCK_SIZE
+	card.WriteBlock(pmp300.DIRECTORY_BLOCK, dir.Bytes())
+	// Drop the cached directory
+	pmp.SwitchStorage(pmp300.StorageInternal)
+	pmp.SwitchStorage(pmp300.StorageExternal)
+
+	file := pmp300.FileEntry{Name: "song01.mp3"}
+	if err := pmp.ReadFileID3Tags(&file); err == nil || !strings.Contains(err.Error(), "run 'pmp300 fsck'") {
+		t.Errorf("tag of an entry larger than its blocks: %v", err)
+	}
+
+	ctx := context.Background()
+	res, err := pmp.CheckDirectoryWithOptionsContext(ctx, pmp300.CheckOptions{AdoptStale: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Clean() || res.Unfixed() != 0 {
+		t.Fatalf("problems %v", res.Problems)
+	}
+	if err := pmp.RepairDirectoryContext(ctx, res); err != nil {
+		t.Fatal(err)
+	}
+
+	// song01.mp3 is cut to its three blocks; the stale song03.mp3 is kept
+	got, err := pmp.DownloadFile("song01.mp3", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3*pmp300.BLOCK_SIZE || !bytes.HasPrefix(got, files["song01.mp3"]) {
+		t.Errorf("song01.mp3 is %d bytes after the repair", len(got))
+	}
+	delete(files, "song01.mp3")
+	checkFiles(t, pmp, card, files)
+	if err := pmp.RepairDirectory(&pmp300.CheckResult{}); err == nil {
+		t.Error("repair with nothing to repair succeeded")
+	}
+}
@@ -0,0 +1,176 @@
+package pmp300
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+)
+
+// Image is a file of raw 32KB blocks back to back, holding one storage of a
+// PMP300. The layout is the one emulate-bridge uses for its flash images, so
+// images move freely between the two.
+type Image struct {
+	file   *os.File
+	blocks int
+}
+
+// OpenImage opens an image file. A missing file is created erased (0xFF)
+// with the given number of blocks; for an existing file blocks may be 0 to
+// use the file's size.
+func OpenImage(path string, blocks int) (*Image, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open image: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	size := info.Size()
+	if size%BLOCK_SIZE != 0 {
+		f.Close()
+		return nil, fmt.Errorf("image size %d is not a multiple of %d", size, BLOCK_SIZE)
+	}
+	if blocks == 0 {
+		blocks = int(size / BLOCK_SIZE)
+	}
+	switch {
+	case blocks <= 0:
+		f.Close()
+		return nil, fmt.Errorf("image %s is empty and no block count was given", path)
+	case blocks < 2 || blocks > MAX_BLOCKS:
+		f.Close()
+		return nil, fmt.Errorf("image must have 2 to %d blocks, got %d", MAX_BLOCKS, blocks)
+	case int64(blocks)*BLOCK_SIZE < size:
+		f.Close()
+		return nil, fmt.Errorf("image %s has %d blocks, not %d", path, size/BLOCK_SIZE, blocks)
+	}
+
+	// Extend with erased blocks
+	erased := bytes.Repeat([]byte{0xFF}, BLOCK_SIZE)
+	for off := size; off < int64(blocks)*BLOCK_SIZE; off += BLOCK_SIZE {
+		if _, err := f.WriteAt(erased, off); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to extend image: %w", err)
+		}
+	}
+
+	return &Image{file: f, blocks: blocks}, nil
+}
+
+// Blocks returns the image size in 32KB blocks
+func (img *Image) Blocks() int {
+	return img.blocks
+}
+
+// Path returns the image's file name
+func (img *Image) Path() string {
+	return img.file.Name()
+}
+
+// ReadBlock reads the block at pos
+func (img *Image) ReadBlock(pos int) ([]byte, error) {
+	if pos < 0 || pos >= img.blocks {
+		return nil, fmt.Errorf("block %d out of range (image has %d blocks)", pos, img.blocks)
+	}
+	block := make([]byte, BLOCK_SIZE)
+	if _, err := img.file.ReadAt(block, int64(pos)*BLOCK_SIZE); err != nil {
+		return nil, fmt.Errorf("block %d: %w", pos, err)
+	}
+	return block, nil
+}
+
+// WriteBlock writes BLOCK_SIZE bytes to the block at pos
+func (img *Image) WriteBlock(pos int, block []byte) error {
+	if pos < 0 || pos >= img.blocks {
+		return fmt.Errorf("block %d out of range (image has %d blocks)", pos, img.blocks)
+	}
+	if len(block) != BLOCK_SIZE {
+		return fmt.Errorf("block must be %d bytes, got %d", BLOCK_SIZE, len(block))
+	}
+	if _, err := img.file.WriteAt(block, int64(pos)*BLOCK_SIZE); err != nil {
+		return fmt.Errorf("block %d: %w", pos, err)
+	}
+	return nil
+}
+
+// Close closes the image file
+func (img *Image) Close() error {
+	return img.file.Close()
+}
+
+// Images is a BlockDevice made of image files: a PMP300 whose internal
+// flash and SmartMedia card are stored offline. A nil image is a storage
+// that is not present. The chain neighbours of written blocks are not kept.
+type Images struct {
+	Internal *Image
+	External *Image
+}
+
+// image returns the image of a storage, or nil
+func (m *Images) image(s Storage) *Image {
+	if s == StorageExternal {
+		return m.External
+	}
+	return m.Internal
+}
+
+// CheckPresentContext reports whether a storage has an image and its size
+func (m *Images) CheckPresentContext(ctx context.Context, s Storage) (bool, int, error) {
+	if err := ctx.Err(); err != nil {
+		return false, 0, err
+	}
+	img := m.image(s)
+	if img == nil {
+		return false, 0, nil
+	}
+	return true, img.Blocks(), nil
+}
+
+// ReadBlockContext reads a block from the image of a storage
+func (m *Images) ReadBlockContext(ctx context.Context, s Storage, pos int) ([]byte, error) {
+	img, err := m.checkImage(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	return img.ReadBlock(pos)
+}
+
+// WriteBlockContext writes a block to the image of a storage. prev and next
+// are dropped.
+func (m *Images) WriteBlockContext(ctx context.Context, s Storage, pos int, block []byte, prev, next uint16) error {
+	img, err := m.checkImage(ctx, s)
+	if err != nil {
+		return err
+	}
+	return img.WriteBlock(pos, block)
+}
+
+// checkImage returns the image of a storage, failing if there is none or
+// ctx is done
+func (m *Images) checkImage(ctx context.Context, s Storage) (*Image, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	img := m.image(s)
+	if img == nil {
+		return nil, fmt.Errorf("no image of %s", s)
+	}
+	return img, nil
+}
+
+// Close closes the image files
+func (m *Images) Close() error {
+	var err error
+	for _, img := range []*Image{m.Internal, m.External} {
+		if img != nil {
+			if cerr := img.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+	}
+	return err
+}
@@ -0,0 +1,190 @@
+package pmp300_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/murdinc/pmp300/pkg/pmp300"
+)
+
+// TestOpenImage checks the creation and sizes of image files
+func TestOpenImage(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "rio.img")
+
+	img, err := pmp300.OpenImage(path, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := img.ReadBlock(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(block, bytes.Repeat([]byte{0xFF}, pmp300.BLOCK_SIZE)) {
+		t.Error("a new image is not erased")
+	}
+	if _, err := img.ReadBlock(4); err == nil {
+		t.Error("read past the end of the image")
+	}
+	img.Close()
+
+	// An existing image keeps its size, or grows erased
+	for _, tc := range []struct {
+		blocks int
+		want   int
+	}{
+		{0, 4},
+		{4, 4},
+		{6, 6},
+	} {
+		img, err := pmp300.OpenImage(path, tc.blocks)
+		if err != nil {
+			t.Fatalf("reopen with %d blocks: %v", tc.blocks, err)
+		}
+		if img.Blocks() != tc.want {
+			t.Errorf("reopen with %d blocks: %d blocks, want %d", tc.blocks, img.Blocks(), tc.want)
+		}
+		img.Close()
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() != 6*pmp300.BLOCK_SIZE {
+		t.Errorf("grown image: %v, %v", info, err)
+	}
+
+	odd := filepath.Join(dir, "odd.img")
+	os.WriteFile(odd, make([]byte, 100), 0o644)
+	for _, tc := range []struct {
+		name   string
+		path   string
+		blocks int
+	}{
+		{"shrunk", path, 2},
+		{"size not a multiple of a block", odd, 0},
+		{"empty without a block count", filepath.Join(dir, "new.img"), 0},
+		{"too small", filepath.Join(dir, "small.img"), 1},
+		{"too large", filepath.Join(dir, "large.img"), pmp300.MAX_BLOCKS + 1},
+	} {
+		if img, err := pmp300.OpenImage(tc.path, tc.blocks); err == nil {
+			img.Close()
+			t.Errorf("%s: opened", tc.name)
+		}
+	}
+}
+
+// TestImages runs the device on images of both storages
+func TestImages(t *testing.T) {
+	dir := t.TempDir()
+	internal, err := pmp300.OpenImage(filepath.Join(dir, "rio.img"), pmp300.BLOCKS_INTERNAL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	card, err := pmp300.OpenImage(filepath.Join(dir, "card.img"), 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	images := &pmp300.Images{Internal: internal, External: card}
+	defer images.Close()
+	pmp := pmp300.NewFromBlockDevice(images)
+
+	for _, tc := range []struct {
+		s      pmp300.Storage
+		blocks int
+	}{
+		{pmp300.StorageInternal, pmp300.BLOCKS_INTERNAL},
+		{pmp300.StorageExternal, 512},
+	} {
+		s := tc.s
+		pmp.SwitchStorage(s)
+		present, blocks, err := pmp.CheckPresent()
+		if err != nil || !present || blocks != tc.blocks {
+			t.Fatalf("%s: present %v, %d blocks, %v; want %d blocks", s, present, blocks, err, tc.blocks)
+		}
+		if err := pmp.FormatDevice(false); err != nil {
+			t.Fatal(err)
+		}
+		if err := pmp.UploadFile(s.String()+".mp3", bytes.Repeat([]byte{byte(s) + 1}, pmp300.BLOCK_SIZE+10), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each storage holds its own file, in its own image
+	for _, s := range []pmp300.Storage{pmp300.StorageInternal, pmp300.StorageExternal} {
+		pmp.SwitchStorage(s)
+		files, err := pmp.ListFiles()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 1 || files[0].Name != s.String()+".mp3" {
+			t.Errorf("%s holds %v", s, files)
+		}
+		data, err := pmp.DownloadFile(s.String()+".mp3", nil)
+		if err != nil || !bytes.Equal(data, bytes.Repeat([]byte{byte(s) + 1}, pmp300.BLOCK_SIZE+10)) {
+			t.Errorf("%s: download differs: %v", s, err)
+		}
+	}
+}
+
+// TestImagesMissingCard checks that a storage without an image is not
+// present and cannot be read or written
+func TestImagesMissingCard(t *testing.T) {
+	internal, err := pmp300.OpenImage(filepath.Join(t.TempDir(), "rio.img"), pmp300.BLOCKS_INTERNAL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	images := &pmp300.Images{Internal: internal}
+	defer images.Close()
+	ctx := context.Background()
+
+	present, _, err := images.CheckPresentContext(ctx, pmp300.StorageExternal)
+	if err != nil || present {
+		t.Errorf("missing card: present %v, %v", present, err)
+	}
+	if _, err := images.ReadBlockContext(ctx, pmp300.StorageExternal, 0); err == nil || !strings.Contains(err.Error(), "no image") {
+		t.Errorf("read from a missing card: %v", err)
+	}
+	if err := images.WriteBlockContext(ctx, pmp300.StorageExternal, 0, make([]byte, pmp300.BLOCK_SIZE), 0, 0); err == nil {
+		t.Error("write to a missing card succeeded")
+	}
+
+	pmp := pmp300.NewFromBlockDevice(images)
+	if present, err := pmp.DetectExternalStorage(); present || err != nil {
+		t.Errorf("detect a missing card: %v, %v", present, err)
+	}
+	if pmp.GetCurrentStorage() != pmp300.StorageInternal {
+		t.Error("detection left the card selected")
+	}
+}
+
+// TestImagesWriteBlock checks that an image stores the data of a block
+// only: the chain neighbours are not kept
+func TestImagesWriteBlock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rio.img")
+	internal, err := pmp300.OpenImage(path, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	images := &pmp300.Images{Internal: internal}
+	defer images.Close()
+	ctx := context.Background()
+
+	block := bytes.Repeat([]byte{0x5A}, pmp300.BLOCK_SIZE)
+	if err := images.WriteBlockContext(ctx, pmp300.StorageInternal, 2, block, 1, 3); err != nil {
+		t.Fatal(err)
+	}
+	got, err := images.ReadBlockContext(ctx, pmp300.StorageInternal, 2)
+	if err != nil || !bytes.Equal(got, block) {
+		t.Errorf("read back: %v", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() != 4*pmp300.BLOCK_SIZE {
+		t.Errorf("image grew to %v bytes: %v", info.Size(), err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := images.WriteBlockContext(cancelled, pmp300.StorageInternal, 2, block, 0, 0); err != context.Canceled {
+		t.Errorf("cancelled write: %v", err)
+	}
+}
@@ -0,0 +1,672 @@
+package pmp300
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Port register offsets (PC parallel port layout)
+const (
+	OFFSET_DATA    = 0
+	OFFSET_STATUS  = 1
+	OFFSET_CONTROL = 2
+)
+
+// Geometry
+const (
+	BLOCK_SIZE          = 32768 // One flash block
+	PAGE_SIZE           = 512   // Data bytes per write chunk
+	SPARE_SIZE          = 16    // "End block" bytes sent after each page
+	CHUNK_SIZE          = PAGE_SIZE + SPARE_SIZE
+	PAGES_PER_BLOCK     = BLOCK_SIZE / PAGE_SIZE
+	BLOCKS_INTERNAL     = 1024 // 32MB PMP300
+	BLOCKS_INTERNAL_SE  = 2048 // 64MB PMP300 SE
+	BLOCKS_EXTERNAL_MIN = 64   // 2MB SmartMedia
+	BLOCKS_EXTERNAL_MAX = 4096 // 128MB SmartMedia
+	MAX_BLOCKS          = 8192 // Size of the directory block tables
+)
+
+// PMP300 command bytes (latched with control 0x0C)
+const (
+	PMP_CMD_SELECT = 0xA8 // Reset / select, also sent as the io outro
+	PMP_CMD_READ   = 0xA0 // Read 32KB block, followed by 3 address bytes
+	PMP_CMD_WRITE  = 0xAB // Write 32KB block, followed by 3 address bytes
+)
+
+// Unlock key sent after PMP_CMD_SELECT (latched with control 0x00/0x04)
+var introKey = []byte{0xAD, 0x55, 0xAE, 0xAA}
+
+// Handshake status values as seen through a PC parallel port (Busy inverted).
+// The device alternates between the two acks for every byte it accepts.
+const (
+	STATUS_MASK  = 0xF8
+	STATUS_BUSY  = 0x80
+	STATUS_ACK_A = 0x68
+	STATUS_ACK_B = 0xC8
+	STATUS_NAK   = 0x28
+)
+
+// External storage is selected by the top bit of the 24-bit page address
+const ADDRESS_EXTERNAL = 0x800000
+
+// Handshake polling limits
+const (
+	WAIT_RETRIES  = 1000
+	PROBE_RETRIES = 50
+)
+
+// RETRY_WAIT is how long a status wait on the bridge runs per polling
+// retry, about the round trip of one poll from the host
+const RETRY_WAIT = time.Millisecond
+
+// BLOCK_RETRIES is how often a failed block read or write is retried after
+// resynchronizing the transport
+const BLOCK_RETRIES = 2
+
+// REREAD_ATTEMPTS is how often the corrupted spans of a checked block read
+// are re-read before the whole block is retried
+const REREAD_ATTEMPTS = 3
+
+// Storage selects internal flash or the SmartMedia card
+type Storage int
+
+const (
+	StorageInternal Storage = iota
+	StorageExternal
+)
+
+func (s Storage) String() string {
+	switch s {
+	case StorageInternal:
+		return "internal flash"
+	case StorageExternal:
+		return "external SmartMedia"
+	default:
+		return fmt.Sprintf("storage(%d)", int(s))
+	}
+}
+
+// Device manages the files on a PMP300, one storage at a time, through a
+// BlockDevice: the player itself (New) or image files of its storages
+// (NewFromBlockDevice with *Images)
+type Device struct {
+	dev     BlockDevice
+	storage Storage
+
+	// Cached directory for the current storage, nil when unknown
+	dir *Directory
+}
+
+// portDevice is the PMP300 itself, behind a Transport
+type portDevice struct {
+	port     Transport
+	pipe     Pipeliner      // port, or a synchronous stand-in
+	blocks   BlockTransport // port if it runs whole block commands, or nil
+	checked  NibbleChecker  // port if its nibble reads are checked, or nil
+	waiter   StatusWaiter   // port if it waits for handshakes itself, or nil
+	readSize int            // Bytes per nibble block read
+	stats    TransferStats
+
+	specialEdition     bool
+	externalBlockCount int
+}
+
+// TransferStats counts how often block transfers had to recover
+type TransferStats struct {
+	BlockRetries int // Block reads and writes repeated after an error
+	CorruptSpans int // Spans of checked reads that failed their check
+	Rereads      int // Passes re-reading corrupted spans of a block
+}
+
+// New creates a device on top of an opened transport such as *arduino.Port.
+// It uses the fastest path the transport supports: whole block commands,
+// then pipelined nibble reads as large as the transport takes, then one
+// command at a time. Checked nibble reads are preferred over block reads,
+// which have no integrity check.
+func New(port Transport) *Device {
+	return NewFromBlockDevice(&portDevice{
+		port:     port,
+		pipe:     pipeline(port),
+		blocks:   blockTransport(port),
+		checked:  nibbleChecker(port),
+		waiter:   statusWaiter(port),
+		readSize: nibbleReadSize(port),
+	})
+}
+
+// NewFromBlockDevice creates a device on top of any BlockDevice, such as
+// *Images
+func NewFromBlockDevice(dev BlockDevice) *Device {
+	return &Device{dev: dev, storage: StorageInternal}
+}
+
+// TransferStats returns the recovery counts since the device was created.
+// They stay zero unless the device is reached through a Transport.
+func (d *Device) TransferStats() TransferStats {
+	if p, ok := d.dev.(*portDevice); ok {
+		return p.stats
+	}
+	return TransferStats{}
+}
+
+// Initialize runs the PMP300 io intro (select + unlock key). Other block
+// devices need no initialization.
+func (d *Device) Initialize() error {
+	return d.InitializeContext(context.Background())
+}
+
+// InitializeContext is Initialize with a context
+func (d *Device) InitializeContext(ctx context.Context) error {
+	if p, ok := d.dev.(*portDevice); ok {
+		return p.ioIntro(ctx)
+	}
+	return ctx.Err()
+}
+
+// SwitchStorage selects which storage subsequent operations use
+func (d *Device) SwitchStorage(s Storage) error {
+	if s != StorageInternal && s != StorageExternal {
+		return fmt.Errorf("invalid storage: %d", int(s))
+	}
+	if s != d.storage {
+		d.dir = nil
+	}
+	d.storage = s
+	return nil
+}
+
+// GetCurrentStorage returns the active storage
+func (d *Device) GetCurrentStorage() Storage {
+	return d.storage
+}
+
+// CheckPresent verifies the player answers on the current storage and probes
+// its size. Returns whether storage is present and its size in 32KB blocks.
+func (d *Device) CheckPresent() (bool, int, error) {
+	return d.CheckPresentContext(context.Background())
+}
+
+// CheckPresentContext is CheckPresent with a context
+func (d *Device) CheckPresentContext(ctx context.Context) (bool, int, error) {
+	return d.dev.CheckPresentContext(ctx, d.storage)
+}
+
+// DetectExternalStorage checks for a SmartMedia card regardless of the active
+// storage. A card that is present but has no valid directory returns true
+// together with the directory error.
+func (d *Device) DetectExternalStorage() (bool, error) {
+	return d.DetectExternalStorageContext(context.Background())
+}
+
+// DetectExternalStorageContext is DetectExternalStorage with a context
+func (d *Device) DetectExternalStorageContext(ctx context.Context) (bool, error) {
+	prev := d.storage
+	prevDir := d.dir
+	defer func() {
+		d.storage = prev
+		if prev != StorageExternal {
+			d.dir = prevDir
+		}
+	}()
+
+	d.SwitchStorage(StorageExternal)
+	present, _, err := d.CheckPresentContext(ctx)
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	if err != nil || !present {
+		return false, nil
+	}
+	if _, err := d.ReadDirectoryContext(ctx); err != nil {
+		return true, err
+	}
+	return true, nil
+}
+
+// Resync recovers from a failed command: the transport's link is
+// resynchronized if it supports it, then the io intro selects the device
+// again, which also ends any block command it was in. Other block devices
+// have nothing to recover.
+func (d *Device) Resync(ctx context.Context) error {
+	if p, ok := d.dev.(*portDevice); ok {
+		return p.Resync(ctx)
+	}
+	return nil
+}
+
+// readBlock reads one 32KB block of the current storage
+func (d *Device) readBlock(ctx context.Context, pos int) ([]byte, error) {
+	return d.dev.ReadBlockContext(ctx, d.storage, pos)
+}
+
+// writeBlock writes up to 32KB to a block of the current storage, padding
+// it with zeros. prev and next are the neighbouring blocks of the file
+// chain.
+func (d *Device) writeBlock(ctx context.Context, pos int, data []byte, prev, next uint16) error {
+	if len(data) > BLOCK_SIZE {
+		return fmt.Errorf("block data too large: %d bytes", len(data))
+	}
+	block := make([]byte, BLOCK_SIZE)
+	copy(block, data)
+	return d.dev.WriteBlockContext(ctx, d.storage, pos, block, prev, next)
+}
+
+// ============================================================================
+// BLOCK DEVICE
+// ============================================================================
+
+// CheckPresentContext runs the io intro and probes the size of a storage
+func (d *portDevice) CheckPresentContext(ctx context.Context, s Storage) (bool, int, error) {
+	if err := d.ioIntro(ctx); err != nil {
+		return false, 0, fmt.Errorf("device not responding: %w", err)
+	}
+
+	if s == StorageInternal {
+		d.specialEdition = d.probeBlock(ctx, s, BLOCKS_INTERNAL)
+		return true, d.totalBlocks(s), ctx.Err()
+	}
+
+	if !d.probeBlock(ctx, s, 0) {
+		if err := ctx.Err(); err != nil {
+			return false, 0, err
+		}
+		d.externalBlockCount = 0
+		return false, 0, nil
+	}
+	count := BLOCKS_EXTERNAL_MIN
+	for count < BLOCKS_EXTERNAL_MAX && d.probeBlock(ctx, s, count) {
+		count *= 2
+	}
+	if err := ctx.Err(); err != nil {
+		return false, 0, err
+	}
+	d.externalBlockCount = count
+	return true, count, nil
+}
+
+// Resync resynchronizes the transport's link if it supports it and runs
+// the io intro
+func (d *portDevice) Resync(ctx context.Context) error {
+	if r, ok := d.port.(Resyncer); ok {
+		if err := r.Resync(ctx); err != nil {
+			return err
+		}
+	}
+	return d.ioIntro(ctx)
+}
+
+// retryBlock runs a block operation, resynchronizing and retrying it up to
+// BLOCK_RETRIES times. Cancellation is never retried.
+func (d *portDevice) retryBlock(ctx context.Context, op func() error) error {
+	err := op()
+	for attempt := 0; err != nil && attempt < BLOCK_RETRIES && ctx.Err() == nil; attempt++ {
+		if rerr := d.Resync(ctx); rerr != nil {
+			return fmt.Errorf("%w (resync failed: %v)", err, rerr)
+		}
+		d.stats.BlockRetries++
+		err = op()
+	}
+	return err
+}
+
+// totalBlocks returns the block count of a storage found by the last probe
+func (d *portDevice) totalBlocks(s Storage) int {
+	if s == StorageExternal {
+		return d.externalBlockCount
+	}
+	if d.specialEdition {
+		return BLOCKS_INTERNAL_SE
+	}
+	return BLOCKS_INTERNAL
+}
+
+// ============================================================================
+// LOW-LEVEL PROTOCOL
+// ============================================================================
+
+// ioIntro selects the device and sends the unlock key
+func (d *portDevice) ioIntro(ctx context.Context) error {
+	waits := []func() error{
+		d.pipe.SubmitOutByteContext(ctx, OFFSET_CONTROL, 0x04),
+		d.pipe.SubmitCommandOutContext(ctx, PMP_CMD_SELECT, 0x0C, 0x04),
+		d.pipe.SubmitOutByteContext(ctx, OFFSET_CONTROL, 0x00),
+		d.pipe.SubmitDelayMillisecondsContext(ctx, 20),
+		d.pipe.SubmitOutByteContext(ctx, OFFSET_CONTROL, 0x04),
+		d.pipe.SubmitDelayMillisecondsContext(ctx, 20),
+	}
+	for _, wait := range waits {
+		if err := wait(); err != nil {
+			return err
+		}
+	}
+
+	for i, key := range introKey {
+		if err := d.latchAndAck(ctx, key, i, WAIT_RETRIES); err != nil {
+			return fmt.Errorf("intro key 0x%02X: %w", key, err)
+		}
+	}
+
+	return d.commandOut(ctx, PMP_CMD_SELECT, 0x0C, 0x04)
+}
+
+// ioOutro deselects the device after a block operation. It also runs after
+// ctx is done, so that a cancelled transfer leaves the device idle.
+func (d *portDevice) ioOutro(ctx context.Context) error {
+	return d.commandOut(context.WithoutCancel(ctx), PMP_CMD_SELECT, 0x0C, 0x04)
+}
+
+// commandOut writes data, then ctrl1, then ctrl2
+func (d *portDevice) commandOut(ctx context.Context, data, ctrl1, ctrl2 byte) error {
+	return d.pipe.SubmitCommandOutContext(ctx, data, ctrl1, ctrl2)()
+}
+
+// readStatus reads the status register as a PC parallel port would see it.
+// The bridge reports raw line levels, so Busy is inverted here to match the
+// handshake constants from the original parallel port code.
+func (d *portDevice) readStatus(ctx context.Context) (byte, error) {
+	status, err := d.pipe.SubmitInByteContext(ctx, OFFSET_STATUS)()
+	if err != nil {
+		return 0, err
+	}
+	return (status ^ STATUS_BUSY) & STATUS_MASK, nil
+}
+
+// waitAck polls the status register for the n-th handshake of a command.
+// A bridge that waits for the status itself does it in one round trip.
+func (d *portDevice) waitAck(ctx context.Context, n int, retries int) error {
+	expected := byte(STATUS_ACK_A)
+	if n%2 == 1 {
+		expected = STATUS_ACK_B
+	}
+
+	if d.waiter != nil {
+		wait := d.waiter.SubmitWaitStatusContext(ctx, STATUS_MASK, expected^STATUS_BUSY, time.Duration(retries)*RETRY_WAIT)
+		raw, err := wait()
+		if err != nil && (raw^STATUS_BUSY)&STATUS_MASK == STATUS_NAK {
+			return fmt.Errorf("device rejected handshake %d", n)
+		}
+		return err
+	}
+
+	var status byte
+	var err error
+	for i := 0; i < retries; i++ {
+		status, err = d.readStatus(ctx)
+		if err != nil {
+			return err
+		}
+		if status == expected {
+			return nil
+		}
+		if status == STATUS_NAK {
+			return fmt.Errorf("device rejected handshake %d", n)
+		}
+	}
+	return fmt.Errorf("timeout waiting for status 0x%02X (last 0x%02X)", expected, status)
+}
+
+// latchAndAck latches a parameter byte and waits for the n-th handshake.
+// The first status poll goes out with the byte, saving a round trip.
+func (d *portDevice) latchAndAck(ctx context.Context, value byte, n int, retries int) error {
+	sent := d.pipe.SubmitCommandOutContext(ctx, value, 0x00, 0x04)
+	ackErr := d.waitAck(ctx, n, retries)
+	if err := sent(); err != nil {
+		return err
+	}
+	return ackErr
+}
+
+// blockAddress returns the 24-bit page address of a block on a storage
+func blockAddress(s Storage, pos int) uint32 {
+	addr := uint32(pos) * PAGES_PER_BLOCK
+	if s == StorageExternal {
+		addr |= ADDRESS_EXTERNAL
+	}
+	return addr
+}
+
+// sendCommand latches a block command and its address, waiting for each ack.
+// Returns the number of handshakes used so far.
+func (d *portDevice) sendCommand(ctx context.Context, cmd byte, s Storage, pos int, retries int) (int, error) {
+	if err := d.commandOut(ctx, cmd, 0x0C, 0x04); err != nil {
+		return 0, err
+	}
+
+	addr := blockAddress(s, pos)
+	for i := 0; i < 3; i++ {
+		if err := d.latchAndAck(ctx, byte(addr>>(8*i)), i, retries); err != nil {
+			return i, fmt.Errorf("block %d address: %w", pos, err)
+		}
+	}
+	return 3, nil
+}
+
+// probeBlock reports whether the device accepts the address of a block
+func (d *portDevice) probeBlock(ctx context.Context, s Storage, pos int) bool {
+	if err := d.ioIntro(ctx); err != nil {
+		return false
+	}
+	_, err := d.sendCommand(ctx, PMP_CMD_READ, s, pos, PROBE_RETRIES)
+	d.ioOutro(ctx)
+	return err == nil
+}
+
+// ReadBlockContext reads one 32KB block, retrying after transfer errors.
+// Cancelling ctx stops the stream of the page being read and deselects the
+// device.
+func (d *portDevice) ReadBlockContext(ctx context.Context, s Storage, pos int) ([]byte, error) {
+	var block []byte
+	err := d.retryBlock(ctx, func() error {
+		var err error
+		block, err = d.readBlockOnce(ctx, s, pos)
+		return err
+	})
+	return block, err
+}
+
+// readBlockOnce reads one 32KB block. Checked nibble reads are preferred
+// over the bridge's block read: 'B' streams the block unchecked, so a
+// glitch on the status lines corrupts it silently, while a checked read
+// catches it and only the spans that failed are re-read. 'B' is used with
+// firmware 3.1 to 3.4, which has no checked reads.
+func (d *portDevice) readBlockOnce(ctx context.Context, s Storage, pos int) ([]byte, error) {
+	if d.blocks != nil && d.checked == nil {
+		block, err := d.blocks.ReadBlockContext(ctx, blockAddress(s, pos))
+		if err != nil {
+			return nil, fmt.Errorf("block %d: %w", pos, err)
+		}
+		return block, nil
+	}
+
+	if err := d.ioIntro(ctx); err != nil {
+		return nil, err
+	}
+	if _, err := d.sendCommand(ctx, PMP_CMD_READ, s, pos, WAIT_RETRIES); err != nil {
+		return nil, err
+	}
+
+	// Queue every read so the bridge streams the block without pauses
+	reads := make([]func() ([]byte, error), BLOCK_SIZE/d.readSize)
+	for i := range reads {
+		reads[i] = d.pipe.SubmitReadNibbleBlockContext(ctx, uint16(d.readSize))
+	}
+
+	block := make([]byte, 0, BLOCK_SIZE)
+	var bad [][2]int
+	for i, read := range reads {
+		data, err := read()
+		var cerr corruptRanges
+		if errors.As(err, &cerr) {
+			for _, r := range cerr.CorruptRanges() {
+				bad = append(bad, [2]int{len(block) + r[0], len(block) + r[1]})
+			}
+			err = nil
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				d.ioOutro(ctx)
+			}
+			return nil, fmt.Errorf("block %d page %d: %w", pos, i*d.readSize/PAGE_SIZE, err)
+		}
+		block = append(block, data...)
+	}
+
+	if err := d.ioOutro(ctx); err != nil {
+		return nil, err
+	}
+	if len(bad) > 0 {
+		if err := d.rereadRanges(ctx, s, pos, block, bad); err != nil {
+			return nil, err
+		}
+	}
+	return block, nil
+}
+
+// rereadRanges re-reads corrupted byte ranges of a checked block read. The
+// block is read from its start again, but the bridge drops the bytes
+// before and between the ranges instead of sending them, and the read
+// stops after the last range. Ranges that read clean replace the corrupted
+// bytes in block.
+func (d *portDevice) rereadRanges(ctx context.Context, s Storage, pos int, block []byte, bad [][2]int) error {
+	d.stats.CorruptSpans += len(bad)
+	var lastErr error
+	for attempt := 0; attempt < REREAD_ATTEMPTS; attempt++ {
+		d.stats.Rereads++
+		if err := d.ioIntro(ctx); err != nil {
+			return err
+		}
+		if _, err := d.sendCommand(ctx, PMP_CMD_READ, s, pos, WAIT_RETRIES); err != nil {
+			return err
+		}
+
+		reads := make([]func() ([]byte, error), len(bad))
+		next := 0
+		for i, r := range bad {
+			reads[i] = d.checked.SubmitReadNibbleRangeContext(ctx, uint16(r[0]-next), uint16(r[1]-r[0]))
+			next = r[1]
+		}
+		var still [][2]int
+		for i, read := range reads {
+			data, err := read()
+			if errors.As(err, new(corruptRanges)) {
+				still = append(still, bad[i])
+				lastErr = err
+				continue
+			}
+			if err != nil {
+				if ctx.Err() != nil {
+					d.ioOutro(ctx)
+				}
+				return fmt.Errorf("block %d re-read: %w", pos, err)
+			}
+			copy(block[bad[i][0]:bad[i][1]], data)
+		}
+
+		if err := d.ioOutro(ctx); err != nil {
+			return err
+		}
+		if len(still) == 0 {
+			return nil
+		}
+		d.stats.CorruptSpans += len(still)
+		bad = still
+	}
+	return fmt.Errorf("block %d: %d spans still corrupted after %d re-reads: %w", pos, len(bad), REREAD_ATTEMPTS, lastErr)
+}
+
+// WriteBlockContext writes one 32KB block, retrying after transfer errors.
+// prev and next are stored in every page's end block. ctx is only checked
+// before each attempt: a block that was started is always finished, so a
+// cancelled transfer never leaves the device mid-command.
+func (d *portDevice) WriteBlockContext(ctx context.Context, s Storage, pos int, block []byte, prev, next uint16) error {
+	if len(block) != BLOCK_SIZE {
+		return fmt.Errorf("block must be %d bytes, got %d", BLOCK_SIZE, len(block))
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return d.retryBlock(ctx, func() error {
+		return d.writeBlockOnce(context.WithoutCancel(ctx), s, pos, block, prev, next)
+	})
+}
+
+// writeBlockOnce writes one 32KB block of exactly BLOCK_SIZE bytes
+func (d *portDevice) writeBlockOnce(ctx context.Context, s Storage, pos int, block []byte, prev, next uint16) error {
+	if d.blocks != nil {
+		chunks := make([]byte, 0, PAGES_PER_BLOCK*CHUNK_SIZE)
+		for page := 0; page < PAGES_PER_BLOCK; page++ {
+			chunks = append(chunks, makeChunk(block[page*PAGE_SIZE:(page+1)*PAGE_SIZE], uint16(pos), byte(page), prev, next)...)
+		}
+		if err := d.blocks.WriteBlockContext(ctx, blockAddress(s, pos), chunks); err != nil {
+			return fmt.Errorf("block %d: %w", pos, err)
+		}
+		return nil
+	}
+
+	if err := d.ioIntro(ctx); err != nil {
+		return err
+	}
+	acks, err := d.sendCommand(ctx, PMP_CMD_WRITE, s, pos, WAIT_RETRIES)
+	if err != nil {
+		return err
+	}
+
+	for page := 0; page < PAGES_PER_BLOCK; page++ {
+		chunk := makeChunk(block[page*PAGE_SIZE:(page+1)*PAGE_SIZE], uint16(pos), byte(page), prev, next)
+		sent := d.pipe.SubmitWritePMPChunkContext(ctx, chunk)
+		ackErr := d.waitAck(ctx, acks, WAIT_RETRIES)
+		if err := sent(); err != nil {
+			return fmt.Errorf("block %d page %d: %w", pos, page, err)
+		}
+		if ackErr != nil {
+			return fmt.Errorf("block %d page %d not acknowledged: %w", pos, page, ackErr)
+		}
+		acks++
+	}
+
+	return d.ioOutro(ctx)
+}
+
+// makeChunk builds a 528-byte write chunk: 512 data bytes followed by the
+// 16-byte end block
+//
+//	[0:2]   block position
+//	[2]     page within block
+//	[3]     reserved (0x00)
+//	[4:6]   previous block in chain
+//	[6:8]   next block in chain
+//	[8:10]  16-bit sum of the 512 data bytes
+//	[10:16] 0xFF
+func makeChunk(page []byte, pos uint16, index byte, prev, next uint16) []byte {
+	chunk := make([]byte, CHUNK_SIZE)
+	copy(chunk, page)
+
+	end := chunk[PAGE_SIZE:]
+	putUint16(end[0:], pos)
+	end[2] = index
+	end[3] = 0x00
+	putUint16(end[4:], prev)
+	putUint16(end[6:], next)
+	putUint16(end[8:], PageChecksum(page))
+	for i := 10; i < SPARE_SIZE; i++ {
+		end[i] = 0xFF
+	}
+	return chunk
+}
+
+// PageChecksum returns the 16-bit sum of a page, as stored in its end block
+func PageChecksum(page []byte) uint16 {
+	var sum uint16
+	for _, b := range page {
+		sum += uint16(b)
+	}
+	return sum
+}
+
+func putUint16(b []byte, v uint16) {
+	b[0] = byte(v)
+	b[1] = byte(v >> 8)
+}
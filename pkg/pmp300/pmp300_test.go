@@ -0,0 +1,145 @@
+package pmp300_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/murdinc/pmp300/pkg/emulator"
+	"github.com/murdinc/pmp300/pkg/pmp300"
+)
+
+// CHECK_SPAN is the span of a glitchy transport's checks, like the bridge's
+const CHECK_SPAN = 512
+
+// spanError is the error of a glitchy read, naming the corrupted ranges
+type spanError [][2]int
+
+func (e spanError) Error() string {
+	return fmt.Sprintf("%d spans failed the check", len(e))
+}
+
+func (e spanError) CorruptRanges() [][2]int {
+	return e
+}
+
+// glitchy is an emulated player whose nibble reads are checked and corrupt
+// chosen spans, like firmware 3.5 over unsettled status lines. Spans are
+// chosen by their first bytes, so the plan follows them into re-reads.
+type glitchy struct {
+	*emulator.Port
+	plan       map[string]int // Corruptions left, by the first bytes of a span
+	rangeBytes int            // Bytes asked for by range reads
+}
+
+func (g *glitchy) HasNibbleCheck() bool {
+	return true
+}
+
+func (g *glitchy) ReadNibbleBlock(count uint16) ([]byte, error) {
+	return g.read(count)
+}
+
+func (g *glitchy) SubmitReadNibbleRangeContext(ctx context.Context, skip, count uint16) func() ([]byte, error) {
+	if skip > 0 {
+		g.Port.ReadNibbleBlock(skip)
+	}
+	g.rangeBytes += int(count)
+	data, err := g.read(count)
+	return func() ([]byte, error) { return data, err }
+}
+
+// read reads count bytes, corrupting the spans the plan names
+func (g *glitchy) read(count uint16) ([]byte, error) {
+	data, err := g.Port.ReadNibbleBlock(count)
+	if err != nil {
+		return nil, err
+	}
+	var bad spanError
+	for start := 0; start < len(data); start += CHECK_SPAN {
+		key := string(data[start : start+8])
+		if g.plan[key] > 0 {
+			g.plan[key]--
+			data[start] ^= 0xFF
+			bad = append(bad, [2]int{start, min(start+CHECK_SPAN, len(data))})
+		}
+	}
+	if len(bad) > 0 {
+		return data, bad
+	}
+	return data, nil
+}
+
+// glitchyPlayer returns a player holding one block of random data, read
+// back through a glitchy transport
+func glitchyPlayer(t *testing.T) (*pmp300.Device, *glitchy, []byte) {
+	t.Helper()
+	rio := emulator.New(emulator.NewFlash(pmp300.BLOCKS_INTERNAL))
+	pmp := pmp300.New(emulator.NewPort(rio))
+	if err := pmp.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	if err := pmp.FormatDevice(false); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, pmp300.BLOCK_SIZE)
+	rand.New(rand.NewSource(1)).Read(data)
+	if err := pmp.UploadFile("song.mp3", data, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	g := &glitchy{Port: emulator.NewPort(rio), plan: map[string]int{}}
+	pmp = pmp300.New(g)
+	if err := pmp.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	return pmp, g, data
+}
+
+// TestCorruptSpansReread checks that only the spans failing their check
+// are re-read, until they read clean
+func TestCorruptSpansReread(t *testing.T) {
+	pmp, g, data := glitchyPlayer(t)
+	span := func(i int) string { return string(data[i*CHECK_SPAN : i*CHECK_SPAN+8]) }
+	g.plan[span(3)] = 1
+	g.plan[span(40)] = 2
+	g.plan[span(63)] = 1
+
+	got, err := pmp.DownloadFile("song.mp3", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("download differs from the upload")
+	}
+	// Three spans fail the read, one the first re-read
+	s := pmp.TransferStats()
+	if s.CorruptSpans != 4 || s.Rereads != 2 || s.BlockRetries != 0 {
+		t.Errorf("%d corrupted spans, %d re-reads, %d block retries; want 4, 2, 0", s.CorruptSpans, s.Rereads, s.BlockRetries)
+	}
+	if want := 4 * CHECK_SPAN; g.rangeBytes != want {
+		t.Errorf("re-reads read %d bytes, want %d", g.rangeBytes, want)
+	}
+}
+
+// TestCorruptSpansPersist checks that a span that never reads clean fails
+// the block after the re-reads and block retries
+func TestCorruptSpansPersist(t *testing.T) {
+	pmp, g, data := glitchyPlayer(t)
+	g.plan[string(data[CHECK_SPAN:CHECK_SPAN+8])] = 1000
+
+	_, err := pmp.DownloadFile("song.mp3", nil)
+	if err == nil || !strings.Contains(err.Error(), "still corrupted") {
+		t.Fatalf("download of a span that never reads clean: %v", err)
+	}
+	s := pmp.TransferStats()
+	if s.BlockRetries != pmp300.BLOCK_RETRIES {
+		t.Errorf("%d block retries, want %d", s.BlockRetries, pmp300.BLOCK_RETRIES)
+	}
+	if want := (pmp300.BLOCK_RETRIES + 1) * pmp300.REREAD_ATTEMPTS; s.Rereads != want {
+		t.Errorf("%d re-reads, want %d", s.Rereads, want)
+	}
+}
@@ -0,0 +1,40 @@
+package pmp300
+
+import (
+	"context"
+	"fmt"
+)
+
+// MoveFile moves the entry at position from to position to (0-based),
+// shifting the entries in between. Only the directory is rewritten.
+func (d *Device) MoveFile(from, to int) error {
+	return d.MoveFileContext(context.Background(), from, to)
+}
+
+// MoveFileContext is MoveFile with a context
+func (d *Device) MoveFileContext(ctx context.Context, from, to int) error {
+	dir, err := d.directory(ctx)
+	if err != nil {
+		return err
+	}
+	count := int(dir.Header.EntryCount)
+	if from < 0 || from >= count {
+		return fmt.Errorf("from position %d out of range (have %d files)", from+1, count)
+	}
+	if to < 0 || to >= count {
+		return fmt.Errorf("to position %d out of range (have %d files)", to+1, count)
+	}
+	if from == to {
+		return nil
+	}
+
+	entry := dir.Entries[from]
+	if from < to {
+		copy(dir.Entries[from:to], dir.Entries[from+1:to+1])
+	} else {
+		copy(dir.Entries[to+1:from+1], dir.Entries[to:from])
+	}
+	dir.Entries[to] = entry
+
+	return d.writeDirectory(ctx, dir)
+}
@@ -0,0 +1,224 @@
+package pmp300
+
+import (
+	"context"
+	"time"
+)
+
+// Transport is the parallel port access the device layer needs. The Arduino
+// bridge (arduino.Port) is one implementation; emulators, recorders and other
+// backends only have to provide these primitives.
+type Transport interface {
+	// OutByte writes the data (offset 0) or control (offset 2) register
+	OutByte(offset uint16, value byte) error
+
+	// InByte reads the status register (offset 1) as raw line levels,
+	// i.e. without the PC parallel port's Busy inversion
+	InByte(offset uint16) (byte, error)
+
+	// CommandOut writes data, then ctrl1, then ctrl2
+	CommandOut(data, ctrl1, ctrl2 byte) error
+
+	// ReadNibbleBlock reads count bytes using the PMP300 nibble protocol
+	ReadNibbleBlock(count uint16) ([]byte, error)
+
+	// WritePMPChunk writes 528 bytes, toggling control 0x00/0x04 per byte
+	WritePMPChunk(data []byte) error
+
+	// DelayMilliseconds waits on the bridge side
+	DelayMilliseconds(ms uint16) error
+}
+
+// BlockDevice is the block storage the directory and file operations run
+// on. The PMP300 behind a Transport is one (New); Images of its storages are
+// another. Blocks are addressed per storage, and a storage that is not
+// present reports false from CheckPresentContext.
+type BlockDevice interface {
+	// CheckPresentContext reports whether a storage is present and its
+	// size in 32KB blocks
+	CheckPresentContext(ctx context.Context, s Storage) (bool, int, error)
+
+	// ReadBlockContext reads the 32KB block at pos
+	ReadBlockContext(ctx context.Context, s Storage, pos int) ([]byte, error)
+
+	// WriteBlockContext writes BLOCK_SIZE bytes to the block at pos. prev
+	// and next are the neighbouring blocks of the file chain, which the
+	// PMP300 keeps next to the data.
+	WriteBlockContext(ctx context.Context, s Storage, pos int, block []byte, prev, next uint16) error
+}
+
+// Pipeliner is implemented by transports that can keep several commands in
+// flight (arduino.Port). Each Submit method sends its command without
+// waiting and returns a function that waits for the result. Commands
+// complete in submission order, and an error is returned by the wait
+// function of the command that caused it. A done context fails the
+// command, and the transport brings the link back to idle.
+type Pipeliner interface {
+	Transport
+
+	SubmitOutByteContext(ctx context.Context, offset uint16, value byte) func() error
+	SubmitInByteContext(ctx context.Context, offset uint16) func() (byte, error)
+	SubmitCommandOutContext(ctx context.Context, data, ctrl1, ctrl2 byte) func() error
+	SubmitReadNibbleBlockContext(ctx context.Context, count uint16) func() ([]byte, error)
+	SubmitWritePMPChunkContext(ctx context.Context, data []byte) func() error
+	SubmitDelayMillisecondsContext(ctx context.Context, ms uint16) func() error
+}
+
+// BlockTransport is implemented by transports that can run a whole block
+// read or write in one call (arduino.Port with firmware 3.1). The transport
+// runs the io intro, the block command, every handshake and the outro.
+type BlockTransport interface {
+	Transport
+
+	// HasBlockCommands reports whether ReadBlockContext and
+	// WriteBlockContext work
+	HasBlockCommands() bool
+
+	// ReadBlockContext reads the 32KB block at a 24-bit page address
+	ReadBlockContext(ctx context.Context, addr uint32) ([]byte, error)
+
+	// WriteBlockContext writes PAGES_PER_BLOCK chunks of CHUNK_SIZE bytes
+	// to the block at a 24-bit page address
+	WriteBlockContext(ctx context.Context, addr uint32, chunks []byte) error
+}
+
+// NibbleLimiter is implemented by transports that bound the count of a
+// ReadNibbleBlock call (arduino.Port). Transports without it are read a page
+// at a time.
+type NibbleLimiter interface {
+	MaxNibbleBlock() int
+}
+
+// NibbleChecker is implemented by transports whose nibble reads carry
+// integrity checks (arduino.Port with firmware 3.5). A read with corrupted
+// spans returns its data together with an error that has a
+// CorruptRanges() [][2]int method listing the bad [start, end) ranges.
+// SubmitReadNibbleRangeContext drops skip bytes before reading count.
+type NibbleChecker interface {
+	HasNibbleCheck() bool
+	SubmitReadNibbleRangeContext(ctx context.Context, skip, count uint16) func() ([]byte, error)
+}
+
+// corruptRanges is the error of a checked read that names its bad ranges
+type corruptRanges interface {
+	error
+	CorruptRanges() [][2]int
+}
+
+// StatusWaiter is implemented by transports that wait for a status on the
+// bridge side (arduino.Port with firmware 3.6). Statuses are raw line levels
+// as returned by InByte. The wait returns the last status read, and an
+// error if (status & mask) did not reach value within timeout.
+type StatusWaiter interface {
+	HasWaitStatus() bool
+	SubmitWaitStatusContext(ctx context.Context, mask, value byte, timeout time.Duration) func() (byte, error)
+}
+
+// Resyncer is implemented by transports whose link can get out of step and
+// be recovered (arduino.Port). Resync drains the link and checks that the
+// bridge answers cleanly again.
+type Resyncer interface {
+	Resync(ctx context.Context) error
+}
+
+// blockTransport returns port as a BlockTransport if it has block commands
+func blockTransport(port Transport) BlockTransport {
+	if b, ok := port.(BlockTransport); ok && b.HasBlockCommands() {
+		return b
+	}
+	return nil
+}
+
+// nibbleChecker returns port as a NibbleChecker if its reads are checked
+func nibbleChecker(port Transport) NibbleChecker {
+	if c, ok := port.(NibbleChecker); ok && c.HasNibbleCheck() {
+		return c
+	}
+	return nil
+}
+
+// statusWaiter returns port as a StatusWaiter if it waits on the bridge
+func statusWaiter(port Transport) StatusWaiter {
+	if w, ok := port.(StatusWaiter); ok && w.HasWaitStatus() {
+		return w
+	}
+	return nil
+}
+
+// nibbleReadSize returns the bytes read per ReadNibbleBlock call: the
+// largest power-of-two number of pages, up to a block, that the transport
+// takes at once
+func nibbleReadSize(port Transport) int {
+	l, ok := port.(NibbleLimiter)
+	if !ok {
+		return PAGE_SIZE
+	}
+	size := BLOCK_SIZE
+	for size > PAGE_SIZE && size > l.MaxNibbleBlock() {
+		size /= 2
+	}
+	return size
+}
+
+// pipeline returns port as a Pipeliner, running commands synchronously if
+// the transport cannot pipeline
+func pipeline(port Transport) Pipeliner {
+	if p, ok := port.(Pipeliner); ok {
+		return p
+	}
+	return syncPipeline{port}
+}
+
+// syncPipeline runs each submitted command immediately. The context is
+// checked before each command; a running command is never interrupted.
+type syncPipeline struct {
+	Transport
+}
+
+func (s syncPipeline) SubmitOutByteContext(ctx context.Context, offset uint16, value byte) func() error {
+	err := ctx.Err()
+	if err == nil {
+		err = s.OutByte(offset, value)
+	}
+	return func() error { return err }
+}
+
+func (s syncPipeline) SubmitInByteContext(ctx context.Context, offset uint16) func() (byte, error) {
+	if err := ctx.Err(); err != nil {
+		return func() (byte, error) { return 0, err }
+	}
+	value, err := s.InByte(offset)
+	return func() (byte, error) { return value, err }
+}
+
+func (s syncPipeline) SubmitCommandOutContext(ctx context.Context, data, ctrl1, ctrl2 byte) func() error {
+	err := ctx.Err()
+	if err == nil {
+		err = s.CommandOut(data, ctrl1, ctrl2)
+	}
+	return func() error { return err }
+}
+
+func (s syncPipeline) SubmitReadNibbleBlockContext(ctx context.Context, count uint16) func() ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return func() ([]byte, error) { return nil, err }
+	}
+	data, err := s.ReadNibbleBlock(count)
+	return func() ([]byte, error) { return data, err }
+}
+
+func (s syncPipeline) SubmitWritePMPChunkContext(ctx context.Context, data []byte) func() error {
+	err := ctx.Err()
+	if err == nil {
+		err = s.WritePMPChunk(data)
+	}
+	return func() error { return err }
+}
+
+func (s syncPipeline) SubmitDelayMillisecondsContext(ctx context.Context, ms uint16) func() error {
+	err := ctx.Err()
+	if err == nil {
+		err = s.DelayMilliseconds(ms)
+	}
+	return func() error { return err }
+}
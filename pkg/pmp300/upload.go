@@ -0,0 +1,163 @@
+package pmp300
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ProgressFunc reports transfer progress in bytes
+type ProgressFunc func(current, total int)
+
+// UploadFile writes a file to the current storage and appends it to the
+// playback order. Files are stored in a contiguous run of free blocks,
+// stepping over bad blocks.
+func (d *Device) UploadFile(name string, data []byte, progress ProgressFunc) error {
+	return d.UploadFileContext(context.Background(), name, data, progress)
+}
+
+// UploadFileContext is UploadFile with a context. Cancelling stops after the
+// block being written; the directory is then left unchanged, so the
+// partial file takes no space.
+func (d *Device) UploadFileContext(ctx context.Context, name string, data []byte, progress ProgressFunc) error {
+	if name == "" {
+		return fmt.Errorf("filename is empty")
+	}
+	if len(name) > MAX_FILENAME {
+		return fmt.Errorf("filename too long: %d characters (max %d)", len(name), MAX_FILENAME)
+	}
+	if len(data) == 0 {
+		return fmt.Errorf("file is empty")
+	}
+
+	dir, err := d.directory(ctx)
+	if err != nil {
+		return err
+	}
+	if int(dir.Header.EntryCount) >= MAX_ENTRIES {
+		return fmt.Errorf("directory full (%d files)", MAX_ENTRIES)
+	}
+	if dir.findEntry(name) >= 0 {
+		return fmt.Errorf("file already exists: %s", name)
+	}
+
+	count := (len(data) + BLOCK_SIZE - 1) / BLOCK_SIZE
+	if count > int(dir.Header.BlocksRemaining) {
+		return fmt.Errorf("not enough free space: need %d blocks, %d remaining", count, dir.Header.BlocksRemaining)
+	}
+	blocks := dir.findFreeRun(count)
+	if blocks == nil {
+		return fmt.Errorf("not enough contiguous free space: need %d blocks, %d remaining but fragmented (see 'pmp300 defrag')", count, dir.Header.BlocksRemaining)
+	}
+
+	for i, pos := range blocks {
+		prev, next := uint16(0), uint16(FAT_END)
+		if i > 0 {
+			prev = uint16(blocks[i-1])
+		}
+		if i < count-1 {
+			next = uint16(blocks[i+1])
+		}
+
+		end := (i + 1) * BLOCK_SIZE
+		if end > len(data) {
+			end = len(data)
+		}
+		if err := d.writeBlock(ctx, pos, data[i*BLOCK_SIZE:end], prev, next); err != nil {
+			return err
+		}
+		if progress != nil {
+			progress(end, len(data))
+		}
+	}
+
+	for i, pos := range blocks {
+		dir.BlockUsage[pos] = BLOCK_USED
+		if i < count-1 {
+			dir.FAT[pos] = uint16(blocks[i+1])
+		} else {
+			dir.FAT[pos] = FAT_END
+		}
+	}
+
+	entry := &dir.Entries[dir.Header.EntryCount]
+	*entry = DirectoryEntry{
+		BlockPosition: uint16(blocks[0]),
+		BlockCount:    uint16(count),
+		SizeMod32K:    uint16(len(data) % BLOCK_SIZE),
+		Size:          uint32(len(data)),
+		TimeUpload:    uint32(time.Now().Unix()),
+		Properties:    findFrameHeader(data),
+	}
+	copy(entry.Name[:], name)
+	dir.Header.EntryCount++
+
+	return d.writeDirectory(ctx, dir)
+}
+
+// findFreeRun returns the first run of count free blocks, or nil. Bad
+// blocks inside a run are skipped.
+func (dir *Directory) findFreeRun(count int) []int {
+	run := make([]int, 0, count)
+	for pos := 1; pos < dir.TotalBlocks() && pos < MAX_BLOCKS; pos++ {
+		switch dir.BlockUsage[pos] {
+		case BLOCK_BAD:
+			continue
+		case BLOCK_FREE:
+			run = append(run, pos)
+		default:
+			run = run[:0]
+			continue
+		}
+		if len(run) == count {
+			return run
+		}
+	}
+	return nil
+}
+
+// MPEG audio bitrates in kbps, indexed by the frame header bitrate field
+var (
+	bitratesMPEG1 = [16]uint16{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0}
+	bitratesMPEG2 = [16]uint16{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0}
+)
+
+// findFrameHeader returns the first MPEG layer III frame header in data,
+// skipping a leading ID3v2 tag
+func findFrameHeader(data []byte) [4]byte {
+	var header [4]byte
+
+	start := 0
+	if len(data) >= 10 && string(data[:3]) == "ID3" {
+		size := int(data[6]&0x7F)<<21 | int(data[7]&0x7F)<<14 | int(data[8]&0x7F)<<7 | int(data[9]&0x7F)
+		start = 10 + size
+	}
+
+	for i := start; i+4 <= len(data) && i < start+BLOCK_SIZE; i++ {
+		if data[i] != 0xFF || data[i+1]&0xE0 != 0xE0 {
+			continue
+		}
+		copy(header[:], data[i:i+4])
+		if frameBitrate(header) != 0 {
+			return header
+		}
+	}
+	return [4]byte{}
+}
+
+// frameBitrate decodes the bitrate of a layer III frame header, 0 if invalid
+func frameBitrate(h [4]byte) uint16 {
+	if h[0] != 0xFF || h[1]&0xE0 != 0xE0 {
+		return 0
+	}
+	version := (h[1] >> 3) & 0x03 // 3 = MPEG1, 2 = MPEG2, 0 = MPEG2.5
+	layer := (h[1] >> 1) & 0x03   // 1 = layer III
+	if version == 1 || layer != 1 {
+		return 0
+	}
+	index := h[2] >> 4
+	if version == 3 {
+		return bitratesMPEG1[index]
+	}
+	return bitratesMPEG2[index]
+}
@@ -2,6 +2,7 @@
 # find-device.sh - Helps find Arduino serial device
 
 echo "Searching for Arduino serial devices..."
+echo "(\`pmp300 devices\` also probes each port for the bridge firmware)"
 echo
 
 # macOS